@@ -0,0 +1,428 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	AuditFormatJson  = "json"
+	AuditFormatSarif = "sarif"
+)
+
+var AuditFormats = []string{AuditFormatJson, AuditFormatSarif}
+
+const (
+	SeverityLow      = "low"
+	SeverityMedium   = "medium"
+	SeverityHigh     = "high"
+	SeverityCritical = "critical"
+)
+
+var severityColors = map[string]string{
+	SeverityLow:      "#b58900",
+	SeverityMedium:   "#cb4b16",
+	SeverityHigh:     "#dc322f",
+	SeverityCritical: "#d33682",
+}
+
+var severityOrder = map[string]int{SeverityLow: 1, SeverityMedium: 2, SeverityHigh: 3, SeverityCritical: 4}
+
+var sarifLevels = map[string]string{
+	SeverityLow:      "note",
+	SeverityMedium:   "warning",
+	SeverityHigh:     "error",
+	SeverityCritical: "error",
+}
+
+// Variables available in the conditions of audit rules.
+var auditVariables = []string{"name", "assetType", "parent", "ancestors", "ancestorNames", "data", "uses"}
+
+// AuditRule is a check over the graph. Assets violate a rule if its CEL condition evaluates
+// to true for them, or if its Gizmo query emits them.
+type AuditRule struct {
+	Name        string   `yaml:"name" json:"name"`
+	Description string   `yaml:"description" json:"description,omitempty"`
+	Severity    string   `yaml:"severity" json:"severity"`
+	AssetTypes  []string `yaml:"asset_types" json:"assetTypes,omitempty"`
+	Condition   string   `yaml:"condition" json:"condition,omitempty"`
+	Query       string   `yaml:"query" json:"query,omitempty"`
+
+	condition *CelProgram
+}
+
+type AuditViolation struct {
+	Rule        string `json:"rule"`
+	Severity    string `json:"severity"`
+	Description string `json:"description,omitempty"`
+	Resource    string `json:"resource"`
+	AssetType   string `json:"assetType"`
+}
+
+type AuditSummary struct {
+	Rules      int            `json:"rules"`
+	Violations int            `json:"violations"`
+	Severities map[string]int `json:"severities"`
+}
+
+type AuditReport struct {
+	Summary    AuditSummary      `json:"summary"`
+	Violations []*AuditViolation `json:"violations"`
+
+	rules []*AuditRule
+}
+
+type auditAsset struct {
+	Name      string   `json:"name"`
+	AssetType string   `json:"asset_type"`
+	Ancestors []string `json:"ancestors"`
+	Resource  struct {
+		Data   interface{} `json:"data"`
+		Parent string      `json:"parent"`
+	} `json:"resource"`
+}
+
+// LoadAuditRules reads and validates the rules file, compiling the rule conditions.
+func LoadAuditRules(fileName string) ([]*AuditRule, error) {
+	yamlFile, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var rulesFile struct {
+		Rules []*AuditRule `yaml:"rules"`
+	}
+	err = yaml.Unmarshal(yamlFile, &rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing rules file %s: %v", fileName, err)
+	}
+
+	names := make(map[string]bool, len(rulesFile.Rules))
+	for i, rule := range rulesFile.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule #%d has no name", i+1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule %s", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if rule.Severity == "" {
+			rule.Severity = SeverityMedium
+		}
+		if _, found := severityOrder[rule.Severity]; !found {
+			return nil, fmt.Errorf("rule %s: invalid severity %s (use low, medium, high or critical)", rule.Name, rule.Severity)
+		}
+		if (rule.Condition == "") == (rule.Query == "") {
+			return nil, fmt.Errorf("rule %s: specify either a condition or a query", rule.Name)
+		}
+		if rule.Condition != "" {
+			rule.condition, err = CompileCel(rule.Condition, auditVariables...)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: invalid condition: %v", rule.Name, err)
+			}
+		}
+	}
+	return rulesFile.Rules, nil
+}
+
+func (r *AuditRule) appliesTo(assetType string) bool {
+	if len(r.AssetTypes) == 0 {
+		return true
+	}
+	for _, t := range r.AssetTypes {
+		if t == assetType {
+			return true
+		}
+	}
+	return false
+}
+
+// ancestorAssetName converts an ancestor (ie. folders/123) into an asset name.
+func ancestorAssetName(ancestor string) string {
+	return "//cloudresourcemanager.googleapis.com/" + ancestor
+}
+
+// ancestorNames returns the display names of the ancestors of an asset.
+func ancestorNames(tx *bolt.Tx, cache map[string]string, ancestors []string) []interface{} {
+	names := make([]interface{}, 0, len(ancestors))
+	for _, ancestor := range ancestors {
+		name, found := cache[ancestor]
+		if !found {
+			name = ancestor
+			var asset auditAsset
+			if bv := tx.Bucket([]byte("Assets")).Get([]byte(ancestorAssetName(ancestor))); bv != nil && json.Unmarshal(bv, &asset) == nil {
+				if data, ok := asset.Resource.Data.(map[string]interface{}); ok {
+					if displayName, ok := data["displayName"].(string); ok && displayName != "" {
+						name = displayName
+					} else if n, ok := data["name"].(string); ok && n != "" {
+						name = n
+					}
+				}
+			}
+			cache[ancestor] = name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// Audit runs the rules over the graph and returns the violations.
+func (v *GcpViz) Audit(ctx context.Context, rules []*AuditRule) (*AuditReport, error) {
+	report := &AuditReport{
+		Summary:    AuditSummary{Rules: len(rules), Severities: make(map[string]int, 0)},
+		Violations: make([]*AuditViolation, 0),
+		rules:      rules,
+	}
+	addViolation := func(rule *AuditRule, name string, assetType string) {
+		report.Violations = append(report.Violations, &AuditViolation{
+			Rule:        rule.Name,
+			Severity:    rule.Severity,
+			Description: rule.Description,
+			Resource:    name,
+			AssetType:   assetType,
+		})
+	}
+
+	edges, err := v.usesEdges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	uses := make(map[string][]interface{}, 0)
+	for edge := range edges {
+		uses[edge[0]] = append(uses[edge[0]], edge[1])
+	}
+
+	fmt.Fprintf(os.Stderr, "Evaluating %d rules...\n", len(rules))
+	failures := make(map[string]int, 0)
+	err = v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		names := make(map[string]string, 0)
+		return tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+			var asset auditAsset
+			if err := json.Unmarshal(bv, &asset); err != nil {
+				return fmt.Errorf("error parsing asset %s: %v", string(k), err)
+			}
+			var variables map[string]interface{}
+			for _, rule := range rules {
+				if rule.condition == nil || !rule.appliesTo(asset.AssetType) {
+					continue
+				}
+				if variables == nil {
+					ancestors := make([]interface{}, 0, len(asset.Ancestors))
+					for _, a := range asset.Ancestors {
+						ancestors = append(ancestors, a)
+					}
+					assetUses := uses[string(k)]
+					if assetUses == nil {
+						assetUses = make([]interface{}, 0)
+					}
+					variables = map[string]interface{}{
+						"name":          string(k),
+						"assetType":     asset.AssetType,
+						"parent":        asset.Resource.Parent,
+						"ancestors":     ancestors,
+						"ancestorNames": ancestorNames(tx, names, asset.Ancestors),
+						"data":          asset.Resource.Data,
+						"uses":          assetUses,
+					}
+				}
+				violates, err := rule.condition.EvalBool(variables)
+				if err != nil {
+					if failures[rule.Name] == 0 {
+						fmt.Fprintf(os.Stderr, "Warning: rule %s could not be evaluated for %s: %v\n", rule.Name, string(k), err)
+					}
+					failures[rule.Name]++
+					continue
+				}
+				if violates {
+					addViolation(rule, string(k), asset.AssetType)
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, count := range failures {
+		if count > 1 {
+			fmt.Fprintf(os.Stderr, "Warning: rule %s could not be evaluated for %d assets, use has() to check for optional fields.\n", name, count)
+		}
+	}
+
+	for _, rule := range rules {
+		if rule.Query == "" {
+			continue
+		}
+		results, err := v.RunQuery(ctx, rule.Query, make(map[string]interface{}, 0), -1)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: error running query: %v", rule.Name, err)
+		}
+		seen := make(map[string]bool, len(results))
+		err = v.AssetDatabase.View(func(tx *bolt.Tx) error {
+			for _, result := range results {
+				name := queryResultName(result)
+				if name == "" || seen[name] {
+					continue
+				}
+				seen[name] = true
+				var asset auditAsset
+				bv := tx.Bucket([]byte("Assets")).Get([]byte(name))
+				if bv == nil || json.Unmarshal(bv, &asset) != nil {
+					continue
+				}
+				if rule.appliesTo(asset.AssetType) {
+					addViolation(rule, name, asset.AssetType)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(report.Violations, func(i, j int) bool {
+		a, b := report.Violations[i], report.Violations[j]
+		if severityOrder[a.Severity] != severityOrder[b.Severity] {
+			return severityOrder[a.Severity] > severityOrder[b.Severity]
+		}
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		return a.Resource < b.Resource
+	})
+	report.Summary.Violations = len(report.Violations)
+	for _, violation := range report.Violations {
+		report.Summary.Severities[violation.Severity]++
+	}
+	fmt.Fprintf(os.Stderr, "Found %d violations.\n", len(report.Violations))
+	return report, nil
+}
+
+// queryResultName returns the vertex of a Gizmo query result.
+func queryResultName(result interface{}) string {
+	switch r := result.(type) {
+	case string:
+		return r
+	case map[string]interface{}:
+		if id, ok := r["id"]; ok {
+			return fmt.Sprint(id)
+		}
+	}
+	return ""
+}
+
+func (r *AuditReport) Write(format string, out io.Writer) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	switch format {
+	case AuditFormatJson:
+		return enc.Encode(r)
+	case AuditFormatSarif:
+		return enc.Encode(r.sarif())
+	}
+	return fmt.Errorf("unsupported audit format %s (supported: %s)", format, strings.Join(AuditFormats, ", "))
+}
+
+// sarif returns the report as a SARIF 2.1.0 log, with the assets as logical locations.
+func (r *AuditReport) sarif() map[string]interface{} {
+	rules := make([]interface{}, 0, len(r.rules))
+	ruleIndex := make(map[string]int, len(r.rules))
+	for i, rule := range r.rules {
+		description := rule.Description
+		if description == "" {
+			description = rule.Name
+		}
+		rules = append(rules, map[string]interface{}{
+			"id":                   rule.Name,
+			"shortDescription":     map[string]string{"text": description},
+			"defaultConfiguration": map[string]string{"level": sarifLevels[rule.Severity]},
+			"properties":           map[string]string{"severity": rule.Severity},
+		})
+		ruleIndex[rule.Name] = i
+	}
+
+	results := make([]interface{}, 0, len(r.Violations))
+	for _, violation := range r.Violations {
+		message := violation.Description
+		if message == "" {
+			message = fmt.Sprintf("Rule %s violated", violation.Rule)
+		}
+		results = append(results, map[string]interface{}{
+			"ruleId":    violation.Rule,
+			"ruleIndex": ruleIndex[violation.Rule],
+			"level":     sarifLevels[violation.Severity],
+			"message":   map[string]string{"text": fmt.Sprintf("%s: %s", violation.Resource, message)},
+			"locations": []interface{}{
+				map[string]interface{}{
+					"logicalLocations": []interface{}{
+						map[string]string{
+							"fullyQualifiedName": violation.Resource,
+							"kind":               "resource",
+						},
+					},
+				},
+			},
+			"properties": map[string]string{"assetType": violation.AssetType},
+		})
+	}
+
+	return map[string]interface{}{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []interface{}{
+			map[string]interface{}{
+				"tool": map[string]interface{}{
+					"driver": map[string]interface{}{
+						"name":           "gcpviz",
+						"informationUri": "https://github.com/GoogleCloudPlatform/professional-services/tree/main/tools/gcpviz",
+						"rules":          rules,
+					},
+				},
+				"results": results,
+			},
+		},
+	}
+}
+
+// HighlightViolations marks the violating assets in rendered graphs, colored by the
+// highest severity of their violations and with the violated rules as tooltip.
+func (v *GcpViz) HighlightViolations(report *AuditReport) {
+	severities := make(map[string]string, 0)
+	rules := make(map[string][]string, 0)
+	for _, violation := range report.Violations {
+		if severityOrder[violation.Severity] > severityOrder[severities[violation.Resource]] {
+			severities[violation.Resource] = violation.Severity
+		}
+		rules[violation.Resource] = append(rules[violation.Resource], violation.Rule)
+	}
+	v.highlights = make(map[string]string, len(severities))
+	for name, severity := range severities {
+		v.highlights[name] = fmt.Sprintf(`%s,tooltip=%s`, highlightAttributes(severityColors[severity]), v.EscapeLabel("Violates: "+strings.Join(rules[name], ", ")))
+	}
+}
@@ -0,0 +1,1234 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+// A subset of the Common Expression Language (https://github.com/google/cel-spec) for
+// expressions over asset data. Values are the JSON types (nil, bool, int64, float64, string,
+// []interface{} and map[string]interface{}). Supported are literals, lists and maps, field
+// selection and indexing, the arithmetic, comparison, logical, `in` and conditional
+// operators, the has(), all(), exists(), exists_one(), filter() and map() macros, type()
+// and the functions listed in celFunctions. As in CEL, selecting a missing field is an error,
+// which && and || and the all() and exists() macros ignore if other operands decide the
+// result. As JSON numbers are doubles, % also accepts doubles with an integral value.
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type CelProgram struct {
+	Source string
+	root   celNode
+}
+
+type celNode interface {
+	eval(s *celScope) (interface{}, error)
+}
+
+type celScope struct {
+	vars   map[string]interface{}
+	parent *celScope
+}
+
+func (s *celScope) lookup(name string) (interface{}, bool) {
+	for ; s != nil; s = s.parent {
+		if value, found := s.vars[name]; found {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// CompileCel parses an expression, all identifiers used in it have to be in variables.
+func CompileCel(source string, variables ...string) (*CelProgram, error) {
+	tokens, err := celLex(source)
+	if err != nil {
+		return nil, err
+	}
+	declared := make(map[string]bool, len(variables))
+	for _, name := range variables {
+		declared[name] = true
+	}
+	p := &celParser{tokens: tokens, declared: []map[string]bool{declared}}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != celEOF {
+		return nil, p.errorf(tok, "unexpected %q", tok.text)
+	}
+	return &CelProgram{Source: source, root: root}, nil
+}
+
+// Eval evaluates the expression with the values of the variables.
+func (p *CelProgram) Eval(variables map[string]interface{}) (interface{}, error) {
+	return p.root.eval(&celScope{vars: variables})
+}
+
+// EvalBool evaluates an expression that has to result in a boolean.
+func (p *CelProgram) EvalBool(variables map[string]interface{}) (bool, error) {
+	result, err := p.Eval(variables)
+	if err != nil {
+		return false, err
+	}
+	b, ok := result.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q returned %s, expected bool", p.Source, celTypeName(result))
+	}
+	return b, nil
+}
+
+// Lexer
+
+type celTokenKind int
+
+const (
+	celEOF celTokenKind = iota
+	celIdent
+	celInt
+	celFloat
+	celString
+	celOperator
+)
+
+type celToken struct {
+	kind  celTokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+var celOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "(", ")", "[", "]", "{", "}", ".", ",", "?", ":", "!", "-", "+", "*", "/", "%", "<", ">"}
+
+func celLex(source string) ([]celToken, error) {
+	tokens := make([]celToken, 0)
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z'):
+			start := i
+			for i < len(source) && (source[i] == '_' || (source[i] >= 'a' && source[i] <= 'z') || (source[i] >= 'A' && source[i] <= 'Z') || (source[i] >= '0' && source[i] <= '9')) {
+				i++
+			}
+			tokens = append(tokens, celToken{kind: celIdent, text: source[start:i], pos: start})
+		case c >= '0' && c <= '9':
+			start := i
+			isFloat := false
+			hex := strings.HasPrefix(source[i:], "0x") || strings.HasPrefix(source[i:], "0X")
+			if hex {
+				i += 2
+			}
+			for i < len(source) {
+				d := source[i]
+				if (d >= '0' && d <= '9') || (hex && ((d >= 'a' && d <= 'f') || (d >= 'A' && d <= 'F'))) {
+					i++
+				} else if !hex && d == '.' && i+1 < len(source) && source[i+1] >= '0' && source[i+1] <= '9' {
+					isFloat = true
+					i++
+				} else if !hex && (d == 'e' || d == 'E') {
+					isFloat = true
+					i++
+					if i < len(source) && (source[i] == '+' || source[i] == '-') {
+						i++
+					}
+				} else {
+					break
+				}
+			}
+			text := source[start:i]
+			if i < len(source) && (source[i] == 'u' || source[i] == 'U') {
+				i++
+			}
+			if isFloat {
+				f, err := strconv.ParseFloat(text, 64)
+				if err != nil {
+					return nil, fmt.Errorf("column %d: invalid number %s", start+1, text)
+				}
+				tokens = append(tokens, celToken{kind: celFloat, text: text, value: f, pos: start})
+			} else {
+				n, err := strconv.ParseInt(text, 0, 64)
+				if err != nil {
+					return nil, fmt.Errorf("column %d: invalid number %s", start+1, text)
+				}
+				tokens = append(tokens, celToken{kind: celInt, text: text, value: n, pos: start})
+			}
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for {
+				if i >= len(source) || source[i] == '\n' {
+					return nil, fmt.Errorf("column %d: unterminated string", start+1)
+				}
+				if source[i] == c {
+					i++
+					break
+				}
+				if source[i] == '\\' && i+1 < len(source) {
+					switch source[i+1] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					case 'r':
+						sb.WriteByte('\r')
+					default:
+						sb.WriteByte(source[i+1])
+					}
+					i += 2
+					continue
+				}
+				sb.WriteByte(source[i])
+				i++
+			}
+			tokens = append(tokens, celToken{kind: celString, text: source[start:i], value: sb.String(), pos: start})
+		default:
+			matched := false
+			for _, op := range celOperators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, celToken{kind: celOperator, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("column %d: unexpected character %q", i+1, c)
+			}
+		}
+	}
+	return append(tokens, celToken{kind: celEOF, pos: len(source)}), nil
+}
+
+// Parser
+
+type celParser struct {
+	tokens   []celToken
+	pos      int
+	declared []map[string]bool
+}
+
+func (p *celParser) peek() celToken {
+	return p.tokens[p.pos]
+}
+
+func (p *celParser) next() celToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != celEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *celParser) isOperator(ops ...string) bool {
+	tok := p.peek()
+	if tok.kind == celIdent && tok.text == "in" {
+		for _, op := range ops {
+			if op == "in" {
+				return true
+			}
+		}
+	}
+	if tok.kind != celOperator {
+		return false
+	}
+	for _, op := range ops {
+		if tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *celParser) expect(op string) error {
+	tok := p.next()
+	if tok.kind != celOperator || tok.text != op {
+		if tok.kind == celEOF {
+			return p.errorf(tok, "expected %q, got end of expression", op)
+		}
+		return p.errorf(tok, "expected %q, got %q", op, tok.text)
+	}
+	return nil
+}
+
+func (p *celParser) errorf(tok celToken, format string, args ...interface{}) error {
+	return fmt.Errorf("column %d: %s", tok.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *celParser) isDeclared(name string) bool {
+	for _, scope := range p.declared {
+		if scope[name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *celParser) parseExpr() (celNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOperator("?") {
+		return cond, nil
+	}
+	p.next()
+	then, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &celConditional{cond, then, otherwise}, nil
+}
+
+var celPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">=", "in"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *celParser) parseBinary(level int) (celNode, error) {
+	if level == len(celPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator(celPrecedence[level]...) {
+		op := p.next()
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &celBinary{op: op.text, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *celParser) parseUnary() (celNode, error) {
+	if p.isOperator("!", "-") {
+		op := p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &celUnary{op: op.text, operand: operand}, nil
+	}
+	return p.parseMember()
+}
+
+func (p *celParser) parseArgs() ([]celNode, error) {
+	args := make([]celNode, 0)
+	if p.isOperator(")") {
+		p.next()
+		return args, nil
+	}
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.isOperator(")") {
+			p.next()
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+var celMacros = map[string]bool{"all": true, "exists": true, "exists_one": true, "filter": true, "map": true}
+
+func (p *celParser) parseMember() (celNode, error) {
+	operand, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOperator("."):
+			p.next()
+			tok := p.next()
+			if tok.kind != celIdent {
+				return nil, p.errorf(tok, "expected field or function name after '.'")
+			}
+			if !p.isOperator("(") {
+				operand = &celSelect{operand: operand, field: tok.text}
+				continue
+			}
+			p.next()
+			if celMacros[tok.text] {
+				operand, err = p.parseComprehension(tok, operand)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if _, found := celFunctions[tok.text]; !found {
+				return nil, p.errorf(tok, "undeclared function '%s'", tok.text)
+			}
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			operand = &celCall{function: tok.text, args: append([]celNode{operand}, args...)}
+		case p.isOperator("["):
+			p.next()
+			index, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			operand = &celIndex{operand: operand, index: index}
+		default:
+			return operand, nil
+		}
+	}
+}
+
+func (p *celParser) parseComprehension(macro celToken, target celNode) (celNode, error) {
+	tok := p.next()
+	if tok.kind != celIdent {
+		return nil, p.errorf(tok, "%s() expects a variable name as first argument", macro.text)
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	p.declared = append(p.declared, map[string]bool{tok.text: true})
+	defer func() { p.declared = p.declared[:len(p.declared)-1] }()
+	args, err := p.parseArgs()
+	if err != nil {
+		return nil, err
+	}
+	c := &celComprehension{macro: macro.text, target: target, variable: tok.text}
+	switch {
+	case len(args) == 1:
+		c.predicate = args[0]
+	case len(args) == 2 && macro.text == "map":
+		c.filter, c.predicate = args[0], args[1]
+	default:
+		return nil, p.errorf(macro, "wrong number of arguments to %s()", macro.text)
+	}
+	return c, nil
+}
+
+func (p *celParser) parsePrimary() (celNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case celInt, celFloat, celString:
+		return &celLiteral{tok.value}, nil
+	case celIdent:
+		switch tok.text {
+		case "true":
+			return &celLiteral{true}, nil
+		case "false":
+			return &celLiteral{false}, nil
+		case "null":
+			return &celLiteral{nil}, nil
+		}
+		if p.isOperator("(") {
+			p.next()
+			if tok.text == "has" {
+				args, err := p.parseArgs()
+				if err != nil {
+					return nil, err
+				}
+				if len(args) == 1 {
+					if sel, ok := args[0].(*celSelect); ok {
+						return &celHas{sel}, nil
+					}
+				}
+				return nil, p.errorf(tok, "has() expects a field selection, ie. has(data.field)")
+			}
+			if _, found := celFunctions[tok.text]; !found {
+				return nil, p.errorf(tok, "undeclared function '%s'", tok.text)
+			}
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			return &celCall{function: tok.text, args: args}, nil
+		}
+		if !p.isDeclared(tok.text) {
+			if celTypeNames[tok.text] {
+				return &celLiteral{celType(tok.text)}, nil
+			}
+			return nil, p.errorf(tok, "undeclared reference to '%s'", tok.text)
+		}
+		return &celIdentifier{tok.text}, nil
+	case celOperator:
+		switch tok.text {
+		case "(":
+			expr, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return expr, p.expect(")")
+		case "[":
+			list := &celList{}
+			for !p.isOperator("]") {
+				elem, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				list.elements = append(list.elements, elem)
+				if !p.isOperator("]") {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			p.next()
+			return list, nil
+		case "{":
+			m := &celMap{}
+			for !p.isOperator("}") {
+				key, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				value, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				m.keys = append(m.keys, key)
+				m.values = append(m.values, value)
+				if !p.isOperator("}") {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			p.next()
+			return m, nil
+		}
+	case celEOF:
+		return nil, p.errorf(tok, "unexpected end of expression")
+	}
+	return nil, p.errorf(tok, "unexpected %q", tok.text)
+}
+
+// Evaluation
+
+type celLiteral struct{ value interface{} }
+
+func (n *celLiteral) eval(s *celScope) (interface{}, error) {
+	return n.value, nil
+}
+
+type celIdentifier struct{ name string }
+
+func (n *celIdentifier) eval(s *celScope) (interface{}, error) {
+	value, found := s.lookup(n.name)
+	if !found {
+		return nil, fmt.Errorf("no such attribute: %s", n.name)
+	}
+	return celNormalize(value), nil
+}
+
+type celSelect struct {
+	operand celNode
+	field   string
+}
+
+func (n *celSelect) eval(s *celScope) (interface{}, error) {
+	operand, err := n.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := operand.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot select field '%s' from %s", n.field, celTypeName(operand))
+	}
+	value, found := m[n.field]
+	if !found {
+		return nil, fmt.Errorf("no such key: %s", n.field)
+	}
+	return celNormalize(value), nil
+}
+
+type celHas struct{ sel *celSelect }
+
+func (n *celHas) eval(s *celScope) (interface{}, error) {
+	operand, err := n.sel.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := operand.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot test field '%s' on %s", n.sel.field, celTypeName(operand))
+	}
+	_, found := m[n.sel.field]
+	return found, nil
+}
+
+type celIndex struct {
+	operand celNode
+	index   celNode
+}
+
+func (n *celIndex) eval(s *celScope) (interface{}, error) {
+	operand, err := n.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch o := operand.(type) {
+	case []interface{}:
+		i, ok := celInteger(index)
+		if !ok {
+			return nil, fmt.Errorf("invalid list index %v", index)
+		}
+		if i < 0 || i >= int64(len(o)) {
+			return nil, fmt.Errorf("index out of range: %d", i)
+		}
+		return celNormalize(o[i]), nil
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid map key %v", index)
+		}
+		value, found := o[key]
+		if !found {
+			return nil, fmt.Errorf("no such key: %s", key)
+		}
+		return celNormalize(value), nil
+	}
+	return nil, fmt.Errorf("cannot index %s", celTypeName(operand))
+}
+
+type celList struct{ elements []celNode }
+
+func (n *celList) eval(s *celScope) (interface{}, error) {
+	list := make([]interface{}, 0, len(n.elements))
+	for _, elem := range n.elements {
+		value, err := elem.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+type celMap struct {
+	keys   []celNode
+	values []celNode
+}
+
+func (n *celMap) eval(s *celScope) (interface{}, error) {
+	m := make(map[string]interface{}, len(n.keys))
+	for i := range n.keys {
+		key, err := n.keys[i].eval(s)
+		if err != nil {
+			return nil, err
+		}
+		k, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("map keys must be strings, got %s", celTypeName(key))
+		}
+		value, err := n.values[i].eval(s)
+		if err != nil {
+			return nil, err
+		}
+		m[k] = value
+	}
+	return m, nil
+}
+
+type celConditional struct {
+	cond      celNode
+	then      celNode
+	otherwise celNode
+}
+
+func (n *celConditional) eval(s *celScope) (interface{}, error) {
+	cond, err := n.cond.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := cond.(bool)
+	if !ok {
+		return nil, fmt.Errorf("condition is %s, expected bool", celTypeName(cond))
+	}
+	if b {
+		return n.then.eval(s)
+	}
+	return n.otherwise.eval(s)
+}
+
+type celUnary struct {
+	op      string
+	operand celNode
+}
+
+func (n *celUnary) eval(s *celScope) (interface{}, error) {
+	operand, err := n.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch o := operand.(type) {
+	case bool:
+		if n.op == "!" {
+			return !o, nil
+		}
+	case int64:
+		if n.op == "-" {
+			return -o, nil
+		}
+	case float64:
+		if n.op == "-" {
+			return -o, nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s%s", n.op, celTypeName(operand))
+}
+
+type celBinary struct {
+	op    string
+	left  celNode
+	right celNode
+}
+
+func (n *celBinary) eval(s *celScope) (interface{}, error) {
+	if n.op == "&&" || n.op == "||" {
+		return n.evalLogical(s)
+	}
+	left, err := n.left.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return celEqual(left, right), nil
+	case "!=":
+		return !celEqual(left, right), nil
+	case "in":
+		switch r := right.(type) {
+		case []interface{}:
+			for _, elem := range r {
+				if celEqual(left, celNormalize(elem)) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			if key, ok := left.(string); ok {
+				_, found := r[key]
+				return found, nil
+			}
+			return false, nil
+		}
+	case "<", "<=", ">", ">=":
+		cmp, ok := celCompare(left, right)
+		if ok {
+			switch n.op {
+			case "<":
+				return cmp < 0, nil
+			case "<=":
+				return cmp <= 0, nil
+			case ">":
+				return cmp > 0, nil
+			default:
+				return cmp >= 0, nil
+			}
+		}
+	case "+":
+		switch l := left.(type) {
+		case string:
+			if r, ok := right.(string); ok {
+				return l + r, nil
+			}
+		case []interface{}:
+			if r, ok := right.([]interface{}); ok {
+				return append(append(make([]interface{}, 0, len(l)+len(r)), l...), r...), nil
+			}
+		}
+		return celArithmetic(n.op, left, right)
+	case "-", "*", "/", "%":
+		return celArithmetic(n.op, left, right)
+	}
+	return nil, fmt.Errorf("no such overload: %s %s %s", celTypeName(left), n.op, celTypeName(right))
+}
+
+// evalLogical short-circuits like CEL: an error on one side is ignored if the other side
+// decides the result.
+func (n *celBinary) evalLogical(s *celScope) (interface{}, error) {
+	decisive := n.op == "||"
+	left, leftErr := n.left.eval(s)
+	if b, ok := left.(bool); leftErr == nil && ok && b == decisive {
+		return decisive, nil
+	}
+	right, rightErr := n.right.eval(s)
+	if b, ok := right.(bool); rightErr == nil && ok && b == decisive {
+		return decisive, nil
+	}
+	if leftErr != nil {
+		return nil, leftErr
+	}
+	if rightErr != nil {
+		return nil, rightErr
+	}
+	_, leftOk := left.(bool)
+	_, rightOk := right.(bool)
+	if !leftOk || !rightOk {
+		return nil, fmt.Errorf("no such overload: %s %s %s", celTypeName(left), n.op, celTypeName(right))
+	}
+	return !decisive, nil
+}
+
+type celComprehension struct {
+	macro     string
+	target    celNode
+	variable  string
+	filter    celNode
+	predicate celNode
+}
+
+func (n *celComprehension) eval(s *celScope) (interface{}, error) {
+	target, err := n.target.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	var elements []interface{}
+	switch t := target.(type) {
+	case []interface{}:
+		elements = t
+	case map[string]interface{}:
+		for k := range t {
+			elements = append(elements, k)
+		}
+	default:
+		return nil, fmt.Errorf("%s() is not supported on %s", n.macro, celTypeName(target))
+	}
+
+	results := make([]interface{}, 0)
+	matches := 0
+	// all() and exists() ignore errors of elements if another element decides the result
+	var predicateErr error
+	for _, elem := range elements {
+		scope := &celScope{vars: map[string]interface{}{n.variable: celNormalize(elem)}, parent: s}
+		if n.filter != nil {
+			include, err := celEvalBool(n.filter, scope)
+			if err != nil {
+				return nil, err
+			}
+			if !include {
+				continue
+			}
+		}
+		if n.macro == "map" {
+			value, err := n.predicate.eval(scope)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, value)
+			continue
+		}
+		match, err := celEvalBool(n.predicate, scope)
+		if err != nil {
+			if n.macro != "all" && n.macro != "exists" {
+				return nil, err
+			}
+			if predicateErr == nil {
+				predicateErr = err
+			}
+			continue
+		}
+		switch {
+		case n.macro == "all" && !match:
+			return false, nil
+		case n.macro == "exists" && match:
+			return true, nil
+		case n.macro == "filter" && match:
+			results = append(results, elem)
+		}
+		if match {
+			matches++
+		}
+	}
+	if predicateErr != nil {
+		return nil, predicateErr
+	}
+	switch n.macro {
+	case "all":
+		return true, nil
+	case "exists":
+		return false, nil
+	case "exists_one":
+		return matches == 1, nil
+	}
+	return results, nil
+}
+
+func celEvalBool(n celNode, s *celScope) (bool, error) {
+	value, err := n.eval(s)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("predicate returned %s, expected bool", celTypeName(value))
+	}
+	return b, nil
+}
+
+type celCall struct {
+	function string
+	args     []celNode
+}
+
+type celFunction func(args []interface{}) (interface{}, error)
+
+var celFunctions map[string]celFunction
+
+func init() {
+	celFunctions = map[string]celFunction{
+		"size": func(args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("size() takes one argument")
+			}
+			switch a := args[0].(type) {
+			case string:
+				return int64(utf8.RuneCountInString(a)), nil
+			case []interface{}:
+				return int64(len(a)), nil
+			case map[string]interface{}:
+				return int64(len(a)), nil
+			}
+			return nil, fmt.Errorf("no such overload: size(%s)", celTypeName(args[0]))
+		},
+		"type": func(args []interface{}) (interface{}, error) {
+			if len(args) != 1 {
+				return nil, fmt.Errorf("type() takes one argument")
+			}
+			return celType(celTypeName(args[0])), nil
+		},
+		"contains":   celStringFunction("contains", strings.Contains),
+		"startsWith": celStringFunction("startsWith", strings.HasPrefix),
+		"endsWith":   celStringFunction("endsWith", strings.HasSuffix),
+		"matches": celStringFunction("matches", func(s string, pattern string) bool {
+			re, err := regexp.Compile(pattern)
+			return err == nil && re.MatchString(s)
+		}),
+		"lowerAscii": func(args []interface{}) (interface{}, error) {
+			if s, ok := args[0].(string); ok && len(args) == 1 {
+				return strings.ToLower(s), nil
+			}
+			return nil, fmt.Errorf("no such overload: lowerAscii()")
+		},
+		"upperAscii": func(args []interface{}) (interface{}, error) {
+			if s, ok := args[0].(string); ok && len(args) == 1 {
+				return strings.ToUpper(s), nil
+			}
+			return nil, fmt.Errorf("no such overload: upperAscii()")
+		},
+		"split": func(args []interface{}) (interface{}, error) {
+			if len(args) == 2 {
+				s, ok1 := args[0].(string)
+				sep, ok2 := args[1].(string)
+				if ok1 && ok2 {
+					parts := make([]interface{}, 0)
+					for _, part := range strings.Split(s, sep) {
+						parts = append(parts, part)
+					}
+					return parts, nil
+				}
+			}
+			return nil, fmt.Errorf("no such overload: split()")
+		},
+		"int": func(args []interface{}) (interface{}, error) {
+			switch a := args[0].(type) {
+			case int64:
+				return a, nil
+			case float64:
+				return int64(a), nil
+			case string:
+				return strconv.ParseInt(a, 10, 64)
+			}
+			return nil, fmt.Errorf("no such overload: int(%s)", celTypeName(args[0]))
+		},
+		"double": func(args []interface{}) (interface{}, error) {
+			switch a := args[0].(type) {
+			case int64:
+				return float64(a), nil
+			case float64:
+				return a, nil
+			case string:
+				return strconv.ParseFloat(a, 64)
+			}
+			return nil, fmt.Errorf("no such overload: double(%s)", celTypeName(args[0]))
+		},
+		"string": func(args []interface{}) (interface{}, error) {
+			switch a := args[0].(type) {
+			case string:
+				return a, nil
+			case int64, bool:
+				return fmt.Sprint(a), nil
+			case float64:
+				return strconv.FormatFloat(a, 'g', -1, 64), nil
+			}
+			return nil, fmt.Errorf("no such overload: string(%s)", celTypeName(args[0]))
+		},
+	}
+}
+
+func celStringFunction(name string, f func(string, string) bool) celFunction {
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) == 2 {
+			s, ok1 := args[0].(string)
+			arg, ok2 := args[1].(string)
+			if ok1 && ok2 {
+				return f(s, arg), nil
+			}
+		}
+		types := make([]string, len(args))
+		for i, arg := range args {
+			types[i] = celTypeName(arg)
+		}
+		return nil, fmt.Errorf("no such overload: %s(%s)", name, strings.Join(types, ", "))
+	}
+}
+
+func (n *celCall) eval(s *celScope) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s() takes arguments", n.function)
+	}
+	return celFunctions[n.function](args)
+}
+
+// Values
+
+// celNormalize converts the numbers from JSON and Go values into int64 and float64.
+func celNormalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float32:
+		return float64(v)
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case []string:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			list[i] = v[i]
+		}
+		return list
+	}
+	return value
+}
+
+func celInteger(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return v, true
+	case float64:
+		if v == math.Trunc(v) {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+func celNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// celType is a type value, as returned by type() or referenced by name (ie. type(x) == int).
+type celType string
+
+var celTypeNames = map[string]bool{"null_type": true, "bool": true, "int": true, "double": true, "string": true, "list": true, "map": true, "type": true}
+
+func celTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null_type"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	case celType:
+		return "type"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// celEqual compares values, numbers are equal if they have the same value regardless of type.
+func celEqual(left interface{}, right interface{}) bool {
+	if l, ok := celNumber(left); ok {
+		r, ok := celNumber(right)
+		return ok && l == r
+	}
+	switch l := left.(type) {
+	case []interface{}:
+		r, ok := right.([]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for i := range l {
+			if !celEqual(celNormalize(l[i]), celNormalize(r[i])) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		r, ok := right.(map[string]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for k, lv := range l {
+			rv, found := r[k]
+			if !found || !celEqual(celNormalize(lv), celNormalize(rv)) {
+				return false
+			}
+		}
+		return true
+	}
+	return left == right
+}
+
+func celCompare(left interface{}, right interface{}) (int, bool) {
+	if l, ok := celNumber(left); ok {
+		if r, ok := celNumber(right); ok {
+			switch {
+			case l < r:
+				return -1, true
+			case l > r:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok {
+			return strings.Compare(l, r), true
+		}
+	}
+	if l, ok := left.(bool); ok {
+		if r, ok := right.(bool); ok {
+			switch {
+			case l == r:
+				return 0, true
+			case !l:
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+func celArithmetic(op string, left interface{}, right interface{}) (interface{}, error) {
+	l, lInt := left.(int64)
+	r, rInt := right.(int64)
+	if lInt && rInt {
+		switch op {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/", "%":
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if op == "/" {
+				return l / r, nil
+			}
+			return l % r, nil
+		}
+	}
+	if op == "%" {
+		l, lOk := celInteger(left)
+		r, rOk := celInteger(right)
+		if lOk && rOk {
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return l % r, nil
+		}
+	}
+	lf, lOk := celNumber(left)
+	rf, rOk := celNumber(right)
+	if lOk && rOk && op != "%" {
+		switch op {
+		case "+":
+			return lf + rf, nil
+		case "-":
+			return lf - rf, nil
+		case "*":
+			return lf * rf, nil
+		case "/":
+			return lf / rf, nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s %s %s", celTypeName(left), op, celTypeName(right))
+}
@@ -0,0 +1,237 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testCelData is asset data as decoded from JSON, so all numbers are doubles.
+const testCelData = `{
+	"name": "vpc",
+	"mtu": 1460,
+	"ratio": 0.5,
+	"autoCreateSubnetworks": false,
+	"labels": {"env": "prod", "team": "net"},
+	"peerings": [
+		{"name": "a", "state": "ACTIVE", "network": "projects/p/global/networks/a"},
+		{"name": "b", "state": "INACTIVE"}
+	],
+	"ranges": ["10.0.0.0/24", "10.0.1.0/24"]
+}`
+
+func TestCelEval(t *testing.T) {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(testCelData), &data); err != nil {
+		t.Fatal(err)
+	}
+	variables := map[string]interface{}{"data": data, "name": "//compute.googleapis.com/projects/p/global/networks/vpc"}
+
+	tests := []struct {
+		expression string
+		expected   interface{}
+	}{
+		// Literals
+		{`1`, int64(1)},
+		{`0x10`, int64(16)},
+		{`1.5e1`, 15.0},
+		{`'single' + "double"`, "singledouble"},
+		{`"esc\"aped\n"`, "esc\"aped\n"},
+		{`null`, nil},
+		{`[1, "a", true]`, []interface{}{int64(1), "a", true}},
+		{`{"a": 1}.a`, int64(1)},
+		// Arithmetic
+		{`1 + 2 * 3`, int64(7)},
+		{`(1 + 2) * 3`, int64(9)},
+		{`7 / 2`, int64(3)},
+		{`7 % 3`, int64(1)},
+		{`-7 % 3`, int64(-1)},
+		{`7.0 / 2`, 3.5},
+		{`data.mtu + 1`, 1461.0},
+		{`data.mtu % 100`, int64(60)},
+		{`data.mtu % 2 == 0`, true},
+		{`-data.ratio`, -0.5},
+		{`[1] + [2]`, []interface{}{int64(1), int64(2)}},
+		// Comparison
+		{`data.mtu == 1460`, true},
+		{`data.mtu != 1460.0`, false},
+		{`data.ratio < 1`, true},
+		{`"a" < "b"`, true},
+		{`false < true`, true},
+		{`data.labels == {"team": "net", "env": "prod"}`, true},
+		{`data.ranges == ["10.0.0.0/24", "10.0.1.0/24"]`, true},
+		{`null == null`, true},
+		// Logical and conditional
+		{`!data.autoCreateSubnetworks`, true},
+		{`true && false || true`, true},
+		{`data.mtu > 1000 ? "large" : "small"`, "large"},
+		// Errors are ignored if the other operand decides the result
+		{`data.missing == 1 || true`, true},
+		{`false && data.missing == 1`, false},
+		{`has(data.missing) && data.missing == 1`, false},
+		// Membership
+		{`"10.0.0.0/24" in data.ranges`, true},
+		{`"owner" in data.labels`, false},
+		{`1 in [1.0, 2.0]`, true},
+		// Field selection and indexing
+		{`data.labels.env`, "prod"},
+		{`data.labels["team"]`, "net"},
+		{`data.peerings[1].name`, "b"},
+		{`data.peerings[1.0].state`, "INACTIVE"},
+		{`has(data.labels.env)`, true},
+		{`has(data.peerings)`, true},
+		{`has(data.subnetworks)`, false},
+		// Macros
+		{`data.peerings.all(p, has(p.state))`, true},
+		{`data.peerings.exists(p, p.state == "INACTIVE")`, true},
+		{`data.peerings.exists_one(p, p.state == "ACTIVE")`, true},
+		{`data.peerings.filter(p, p.state == "ACTIVE").map(p, p.network)`, []interface{}{"projects/p/global/networks/a"}},
+		{`data.peerings.map(p, p.state == "ACTIVE", p.name)`, []interface{}{"a"}},
+		{`data.labels.all(k, k in ["env", "team"])`, true},
+		{`[1, 2, 3].filter(x, x > 1).map(x, x * 2)`, []interface{}{int64(4), int64(6)}},
+		{`[].all(x, x > 1)`, true},
+		{`[].exists(x, x > 1)`, false},
+		// Errors of elements are ignored if another element decides the result
+		{`data.peerings.exists(p, p.network.endsWith("/a"))`, true},
+		{`data.peerings.all(p, p.network.endsWith("/b"))`, false},
+		// Functions
+		{`size(data.ranges)`, int64(2)},
+		{`data.name.size()`, int64(3)},
+		{`size(data.labels)`, int64(2)},
+		{`name.contains("/networks/")`, true},
+		{`name.startsWith("//compute")`, true},
+		{`name.endsWith("/vpc")`, true},
+		{`data.name.matches("^v[a-z]+$")`, true},
+		{`"AbC".lowerAscii() + "AbC".upperAscii()`, "abcABC"},
+		{`"a,b".split(",")`, []interface{}{"a", "b"}},
+		{`int("42") + int(data.mtu)`, int64(1502)},
+		{`double(1) / 4`, 0.25},
+		{`string(data.mtu) + string(1) + string(true)`, "14601true"},
+		// Types
+		{`type(1) == int`, true},
+		{`type(data.mtu) == double`, true},
+		{`type(data.labels) == map && type(data.ranges) == list`, true},
+		{`type("a") == string && type(true) == bool && type(null) == null_type`, true},
+		{`type(int) == type`, true},
+		{`type(data.mtu) == int`, false},
+	}
+	for _, test := range tests {
+		program, err := CompileCel(test.expression, "data", "name")
+		if err != nil {
+			t.Errorf("%s: unexpected compile error %v", test.expression, err)
+			continue
+		}
+		result, err := program.Eval(variables)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.expression, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.expected, result) {
+			t.Errorf("%s: expected %#v, got %#v", test.expression, test.expected, result)
+		}
+	}
+}
+
+func TestCelCompileErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{`unknown == 1`, "undeclared reference to 'unknown'"},
+		{`data.name.unknown()`, "undeclared function 'unknown'"},
+		{`unknown(1)`, "undeclared function 'unknown'"},
+		{`data.name ==`, "unexpected end of expression"},
+		{`(1 + 2`, `expected ")"`},
+		{`1 2`, `unexpected "2"`},
+		{`"unterminated`, "unterminated string"},
+		{`data # 1`, "unexpected character"},
+		{`has(1)`, "has() expects a field selection"},
+		{`data.ranges.all(1, true)`, "expects a variable name"},
+		{`data.ranges.all(x)`, `expected ","`},
+		{`data.ranges.filter(x, x, x)`, "wrong number of arguments to filter()"},
+		// Variables of macros are only declared in the macro
+		{`data.ranges.all(x, true) && x`, "undeclared reference to 'x'"},
+	}
+	for _, test := range tests {
+		_, err := CompileCel(test.expression, "data")
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.expression, test.err, err)
+		}
+	}
+}
+
+func TestCelEvalErrors(t *testing.T) {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(testCelData), &data); err != nil {
+		t.Fatal(err)
+	}
+	variables := map[string]interface{}{"data": data}
+
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{`data.missing == 1`, "no such key: missing"},
+		{`data.labels["owner"]`, "no such key: owner"},
+		{`data.missing == 1 && true`, "no such key: missing"},
+		{`data.missing == 1 || false`, "no such key: missing"},
+		{`data.name.field`, "cannot select field 'field' from string"},
+		{`has(data.name.field)`, "cannot test field 'field' on string"},
+		{`data.ranges[2]`, "index out of range: 2"},
+		{`data.ranges[0.5]`, "invalid list index"},
+		{`data.mtu[0]`, "cannot index double"},
+		{`1 / 0`, "division by zero"},
+		{`data.mtu % 0`, "division by zero"},
+		{`data.ratio % 2`, "no such overload: double % int"},
+		{`"a" - "b"`, "no such overload: string - string"},
+		{`"a" < 1`, "no such overload: string < int"},
+		{`!1`, "no such overload: !int"},
+		{`1 && true`, "no such overload: int && bool"},
+		{`data.mtu ? 1 : 2`, "condition is double, expected bool"},
+		{`{1: 2}`, "map keys must be strings"},
+		{`data.peerings.all(p, p.network.endsWith("/a"))`, "no such key: network"},
+		{`data.peerings.exists(p, p.network.endsWith("/b"))`, "no such key: network"},
+		{`data.peerings.filter(p, p.network != "")`, "no such key: network"},
+		{`data.ranges.all(x, 1)`, "predicate returned int, expected bool"},
+		{`data.mtu.all(x, true)`, "all() is not supported on double"},
+		{`size(1)`, "no such overload: size(int)"},
+		{`data.mtu.startsWith("1")`, "no such overload: startsWith(double, string)"},
+		{`int("a")`, "invalid syntax"},
+	}
+	for _, test := range tests {
+		program, err := CompileCel(test.expression, "data")
+		if err != nil {
+			t.Errorf("%s: unexpected compile error %v", test.expression, err)
+			continue
+		}
+		_, err = program.Eval(variables)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.expression, test.err, err)
+		}
+	}
+
+	program, err := CompileCel(`data.name`, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := program.EvalBool(variables); err == nil || !strings.Contains(err.Error(), "returned string, expected bool") {
+		t.Errorf("expected a bool error, got %v", err)
+	}
+}
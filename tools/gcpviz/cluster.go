@@ -0,0 +1,340 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const (
+	ClusterByFolder  = "folder"
+	ClusterByProject = "project"
+	ClusterByNetwork = "network"
+	ClusterByRegion  = "region"
+	// Followed by the label key, ie. label:env
+	ClusterByLabel = "label:"
+)
+
+var ClusterBy = []string{ClusterByFolder, ClusterByProject, ClusterByNetwork, ClusterByRegion, ClusterByLabel + "<key>"}
+
+// ClusterStyle configures grouping the nodes of a graph into clusters, and collapsing
+// projects with many nodes into a single summary node.
+type ClusterStyle struct {
+	By                string `yaml:"by" json:"by"`
+	Style             string `yaml:"style" json:"style"`
+	CollapseThreshold int    `yaml:"collapse_threshold" json:"collapse_threshold"`
+	CollapseStyle     string `yaml:"collapse_style" json:"collapse_style"`
+}
+
+// ClusterTemplateData is passed to the cluster and collapsed project style templates.
+type ClusterTemplateData struct {
+	Name  string
+	Label string
+	Link  string
+	Count int
+}
+
+var ClusterTemplate *template.Template
+var CollapseTemplate *template.Template
+
+func (s *ClusterStyle) compile() error {
+	if s.By != "" {
+		valid := strings.HasPrefix(s.By, ClusterByLabel) && len(s.By) > len(ClusterByLabel)
+		for _, by := range ClusterBy {
+			if s.By == by {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid cluster grouping %s (supported: %s)", s.By, strings.Join(ClusterBy, ", "))
+		}
+	}
+	if s.CollapseThreshold < 0 {
+		return fmt.Errorf("invalid collapse threshold %d", s.CollapseThreshold)
+	}
+
+	var err error
+	ClusterTemplate, err = template.New("cluster").Funcs(templateFuncMap).Parse(s.Style)
+	if err != nil {
+		return fmt.Errorf("error parsing cluster style: %v", err)
+	}
+	CollapseTemplate, err = template.New("collapse").Funcs(templateFuncMap).Parse(s.CollapseStyle)
+	if err != nil {
+		return fmt.Errorf("error parsing collapsed project style: %v", err)
+	}
+	return nil
+}
+
+func executeClusterTemplate(t *template.Template, data *ClusterTemplateData) string {
+	var out bytes.Buffer
+	if t != nil {
+		t.Execute(&out, data)
+	}
+	return strings.Trim(out.String(), "\n")
+}
+
+// ancestorOfType returns the first ancestor of a node of a type (ie. folders/), the
+// ancestors start from the node itself.
+func ancestorOfType(node *GraphNode, prefix string) string {
+	if node.Resource == nil {
+		return ""
+	}
+	for _, ancestor := range node.Resource.Ancestors {
+		if strings.HasPrefix(ancestor, prefix) {
+			return ancestor
+		}
+	}
+	return ""
+}
+
+// ancestorLabel returns the display name of a folder or project.
+func (v *GcpViz) ancestorLabel(ancestor string) string {
+	asset, err := v.getRenderedAsset(ancestorAssetName(ancestor))
+	if err != nil {
+		return v.redactor.Redact(ancestor)
+	}
+	if data, ok := asset.Resource.Data.(map[string]interface{}); ok {
+		for _, field := range []string{"displayName", "projectId", "name"} {
+			if value, ok := data[field].(string); ok && value != "" {
+				return value
+			}
+		}
+	}
+	return ancestor
+}
+
+func nodeData(node *GraphNode) map[string]interface{} {
+	if node.Resource != nil {
+		if data, ok := node.Resource.Resource.Data.(map[string]interface{}); ok {
+			return data
+		}
+	}
+	return map[string]interface{}{}
+}
+
+// nodeNetwork returns the VPC network a node is attached to.
+func nodeNetwork(node *GraphNode) string {
+	if node.AssetType == "compute.googleapis.com/Network" {
+		return node.Name
+	}
+	data := nodeData(node)
+	if network, ok := data["network"].(string); ok && strings.Contains(network, "/networks/") {
+		return computeAssetName(network)
+	}
+	if nics, ok := data["networkInterfaces"].([]interface{}); ok && len(nics) > 0 {
+		if nic, ok := nics[0].(map[string]interface{}); ok {
+			if network, ok := nic["network"].(string); ok {
+				return computeAssetName(network)
+			}
+		}
+	}
+	return ""
+}
+
+// nodeRegion returns the region of a regional or zonal resource, or its location.
+func nodeRegion(node *GraphNode) string {
+	if region := GetRegion(node.Name); region != "" {
+		return region
+	}
+	parts := strings.Split(node.Name, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if parts[i] == "zones" {
+			if idx := strings.LastIndex(parts[i+1], "-"); idx > -1 {
+				return parts[i+1][:idx]
+			}
+		}
+	}
+	data := nodeData(node)
+	if region, ok := data["region"].(string); ok && region != "" {
+		return GetLastPart(region)
+	}
+	if location, ok := data["location"].(string); ok && location != "" {
+		return strings.ToLower(location)
+	}
+	return ""
+}
+
+// clusterKey returns the cluster of a node and its label.
+func (v *GcpViz) clusterKey(node *GraphNode, by string, labels map[string]string) (string, string) {
+	var key string
+	switch by {
+	case ClusterByFolder:
+		key = ancestorOfType(node, "folders/")
+	case ClusterByProject:
+		key = ancestorOfType(node, "projects/")
+	case ClusterByNetwork:
+		key = nodeNetwork(node)
+	case ClusterByRegion:
+		key = nodeRegion(node)
+	default:
+		if strings.HasPrefix(by, ClusterByLabel) {
+			labelKey := strings.TrimPrefix(by, ClusterByLabel)
+			if resourceLabels, ok := nodeData(node)["labels"].(map[string]interface{}); ok {
+				if value, ok := resourceLabels[labelKey].(string); ok {
+					key = labelKey + "=" + value
+				}
+			}
+		}
+	}
+	if key == "" {
+		return "", ""
+	}
+	if _, found := labels[key]; !found {
+		switch by {
+		case ClusterByFolder, ClusterByProject:
+			labels[key] = v.ancestorLabel(key)
+		case ClusterByNetwork:
+			labels[key] = GetLastPart(key)
+		default:
+			labels[key] = key
+		}
+	}
+	return key, labels[key]
+}
+
+// collapseProjects replaces the nodes of projects with more nodes than the threshold with a
+// summary node, the edges of the replaced nodes are moved to the summary node.
+func (v *GcpViz) collapseProjects(g *Graph, threshold int) {
+	projects := make(map[string][]*GraphNode, 0)
+	var maxId int64
+	for _, node := range g.Nodes {
+		if node.Id > maxId {
+			maxId = node.Id
+		}
+		if project := ancestorOfType(node, "projects/"); project != "" {
+			projects[project] = append(projects[project], node)
+		}
+	}
+	collapsed := make([]string, 0)
+	for project, nodes := range projects {
+		if len(nodes) > threshold {
+			collapsed = append(collapsed, project)
+		}
+	}
+	if len(collapsed) == 0 {
+		return
+	}
+	sort.Strings(collapsed)
+
+	replacedBy := make(map[int64]int64, 0)
+	summaries := make([]*GraphNode, 0, len(collapsed))
+	for _, project := range collapsed {
+		maxId++
+		name := ancestorAssetName(project)
+		label := fmt.Sprintf("%s\n%d resources", v.ancestorLabel(project), len(projects[project]))
+		summary := &GraphNode{
+			Id:        maxId,
+			Name:      name,
+			AssetType: "cloudresourcemanager.googleapis.com/Project",
+			Label:     label,
+		}
+		if asset, err := v.getAsset(name); err == nil {
+			summary.Resource = asset
+		} else {
+			summary.Resource = &TemplateResource{Name: name, AssetType: summary.AssetType, Ancestors: []string{project}}
+		}
+		var link string
+		if t, found := Links[summary.AssetType]; found && summary.Resource != nil {
+			var linkBuf bytes.Buffer
+			t.Execute(&linkBuf, v.redactor.RedactResource(summary.Resource))
+			link = strings.Trim(linkBuf.String(), "\n")
+		}
+		summary.Link = link
+		summary.Attributes = executeClusterTemplate(CollapseTemplate, &ClusterTemplateData{
+			Name:  name,
+			Label: v.EscapeLabel(label),
+			Link:  v.EscapeLabel(link),
+			Count: len(projects[project]),
+		})
+		for _, node := range projects[project] {
+			replacedBy[node.Id] = summary.Id
+		}
+		summaries = append(summaries, summary)
+	}
+	fmt.Fprintf(os.Stderr, "Collapsed %d projects with more than %d nodes.\n", len(collapsed), threshold)
+
+	nodes := make([]*GraphNode, 0, len(g.Nodes))
+	for _, node := range g.Nodes {
+		if _, found := replacedBy[node.Id]; !found {
+			nodes = append(nodes, node)
+		}
+	}
+	g.Nodes = append(nodes, summaries...)
+
+	edges := make([]*GraphEdge, 0, len(g.Edges))
+	seen := make(map[[2]int64]bool, len(g.Edges))
+	for _, edge := range g.Edges {
+		from, to := edge.From, edge.To
+		if id, found := replacedBy[from]; found {
+			from = id
+		}
+		if id, found := replacedBy[to]; found {
+			to = id
+		}
+		if from == to || seen[[2]int64{from, to}] {
+			continue
+		}
+		seen[[2]int64{from, to}] = true
+		edges = append(edges, &GraphEdge{From: from, To: to, Attributes: edge.Attributes})
+	}
+	g.Edges = edges
+}
+
+// clusterGraph collapses large projects and groups the nodes into clusters as configured
+// in the clusters section of the style.
+func (v *GcpViz) clusterGraph(g *Graph) {
+	if Style.Clusters.CollapseThreshold > 0 {
+		v.collapseProjects(g, Style.Clusters.CollapseThreshold)
+	}
+	if Style.Clusters.By == "" {
+		return
+	}
+
+	clusters := make(map[string]*GraphCluster, 0)
+	keys := make([]string, 0)
+	labels := make(map[string]string, 0)
+	for _, node := range g.Nodes {
+		key, label := v.clusterKey(node, Style.Clusters.By, labels)
+		if key == "" {
+			continue
+		}
+		cluster, found := clusters[key]
+		if !found {
+			cluster = &GraphCluster{Name: key, Label: v.redactor.Redact(label)}
+			clusters[key] = cluster
+			keys = append(keys, key)
+		}
+		cluster.Nodes = append(cluster.Nodes, node.Id)
+	}
+	sort.Strings(keys)
+	g.Clusters = make([]*GraphCluster, 0, len(keys))
+	for i, key := range keys {
+		cluster := clusters[key]
+		cluster.Id = int64(i + 1)
+		cluster.Attributes = executeClusterTemplate(ClusterTemplate, &ClusterTemplateData{
+			Name:  key,
+			Label: v.EscapeLabel(cluster.Label),
+			Count: len(cluster.Nodes),
+		})
+		g.Clusters = append(g.Clusters, cluster)
+	}
+}
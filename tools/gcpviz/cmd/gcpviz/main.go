@@ -21,13 +21,13 @@ import (
 	"bytes"
 	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"runtime"
 	"runtime/pprof"
 	"strings"
-	"sync"
 
 	"github.com/GoogleCloudPlatform/professional-services/tools/gcpviz"
 	"github.com/dimiro1/banner"
@@ -35,6 +35,8 @@ import (
 
 var modePtr string
 
+var modes = []string{"generate", "update", "visualize", "diff", "serve", "export", "path", "audit", "list-queries"}
+
 type arrayFlags []string
 
 func (i *arrayFlags) String() string {
@@ -46,16 +48,64 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
+func highlightViolations(viz *gcpviz.GcpViz, rulesFile string) {
+	rules, err := gcpviz.LoadAuditRules(rulesFile)
+	if err != nil {
+		log.Fatalf("Failed to load rules file: %v", err)
+	}
+	report, err := viz.Audit(context.Background(), rules)
+	if err != nil {
+		log.Fatalf("Failed to audit graph: %v", err)
+	}
+	viz.HighlightViolations(report)
+}
+
+func enableRedaction(viz *gcpviz.GcpViz, redactionFile string, salt string) {
+	if redactionFile == "" {
+		return
+	}
+	config, err := gcpviz.LoadRedactionConfig(redactionFile)
+	if err != nil {
+		log.Fatalf("Failed to load redaction file: %v", err)
+	}
+	err = viz.EnableRedaction(config, salt)
+	if err != nil {
+		log.Fatalf("Failed to enable redaction: %v", err)
+	}
+}
+
 func main() {
-	modePtr := flag.String("mode", "", "mode of operation (generate, visualize)")
+	modePtr := flag.String("mode", "", "mode of operation (generate, update, visualize, diff, serve, export, path, audit, list-queries)")
 	relationsFilePtr := flag.String("relations-file", "relations.yaml", "location of relations file")
 	styleFilePtr := flag.String("style-file", "style.yaml", "location of graph style file")
 	labelsFilePtr := flag.String("labels-file", "labels.yaml", "location of node/edge labels file")
 	queryFilePtr := flag.String("query-file", "query.js", "location of Gizmo query file")
+	listenAddressPtr := flag.String("listen-address", "127.0.0.1:8080", "address to listen on for HTTP requests (serve mode)")
+	queryTimeoutPtr := flag.Duration("query-timeout", gcpviz.DefaultQueryTimeout, "maximum time a query can run (serve mode)")
+	queriesDirPtr := flag.String("queries-dir", "queries", "directory of Gizmo query files (serve and list-queries modes)")
 	graphFilePtr := flag.String("graph-file", "graph.db", "location of Graph & Asset database file")
-	resourceInventoryFilePtr := flag.String("resource-inventory-file", "resource_inventory.json", "location of resource inventory file from Cloud Asset Inventory")
+	previousGraphFilePtr := flag.String("previous-graph-file", "", "location of the previous Graph & Asset database file to compare against (diff mode)")
+	diffReportFilePtr := flag.String("diff-report-file", "", "write JSON report of changes to file (diff mode)")
+	sourcePtr := flag.String("source", "", "asset name, alias or IP address of the source resource (path mode)")
+	destinationPtr := flag.String("destination", "", "asset name, alias or IP address of the destination resource (path mode)")
+	maxPathLengthPtr := flag.Int("max-path-length", 6, "maximum number of edges in a path (path mode)")
+	evaluateFirewallPtr := flag.Bool("evaluate-firewall", false, "evaluate routes and VPC firewall rules between source and destination (path mode)")
+	portPtr := flag.String("port", "", "protocol and port to evaluate firewall rules for, ie. tcp:443 (path mode, default any)")
+	pathReportFilePtr := flag.String("path-report-file", "", "write JSON report of paths and firewall verdict to file (path mode)")
+	rulesFilePtr := flag.String("rules-file", "rules.yaml", "location of audit rules file (audit mode)")
+	auditFormatPtr := flag.String("audit-format", "json", "format of the audit report (json, sarif) (audit mode)")
+	redactionFilePtr := flag.String("redaction-file", "", "location of redaction file, redacts project IDs, names, IP addresses and labels in graphs and exports (generate, visualize, diff, path, export and serve modes)")
+	redactionSaltPtr := flag.String("redaction-salt", os.Getenv("GCPVIZ_REDACTION_SALT"), "salt for hashing redacted values (default $GCPVIZ_REDACTION_SALT)")
+	highlightViolationsPtr := flag.Bool("highlight-violations", false, "highlight assets violating the rules in -rules-file (visualize and serve modes)")
+	var resourceInventoryFiles arrayFlags
+	flag.Var(&resourceInventoryFiles, "resource-inventory-file", "location of resource inventory file or directory from Cloud Asset Inventory, can be repeated and gzipped (default \"resource_inventory.json\")")
+	feedFilePtr := flag.String("feed-file", "-", "location of Cloud Asset Inventory feed messages, one per line (update mode, - for stdin)")
+	iamPolicyFilePtr := flag.String("iam-policy-file", "", "location of IAM policy export file from Cloud Asset Inventory (generate mode)")
+	billingExportFilePtr := flag.String("billing-export-file", "", "location of Cloud Billing export file, CSV or JSON (generate mode)")
 	resourceDataPtr := flag.Bool("resource-data", false, "adds resource data to graph under `data` predicate")
 	graphTitlePtr := flag.String("graph-title", "", "Title for the graph")
+	formatPtr := flag.String("format", "dot", "output format of the graph (dot, svg, json, html)")
+	exportFormatPtr := flag.String("export-format", "graphml", "format of the exported graph (graphml, cypher, nquads, jsonld) (export mode)")
 	noColorPtr := flag.Bool("no-color", false, "disables color in output")
 	noBannerPtr := flag.Bool("no-banner", false, "disables banner")
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to `file`")
@@ -105,6 +155,15 @@ func main() {
 		}
 	}
 
+	if *modePtr == "list-queries" {
+		queries, err := gcpviz.ListQueries(*queriesDirPtr)
+		if err != nil {
+			log.Fatalf("Failed to list queries: %v", err)
+		}
+		gcpviz.WriteQueryList(queries, os.Stdout)
+		return
+	}
+
 	var overrideParams map[string]string = nil
 	if len(graphParameters) > 0 {
 		overrideParams = make(map[string]string, len(graphParameters))
@@ -118,6 +177,7 @@ func main() {
 		log.Fatalf("Failed to initialize graph engine: %v", err)
 	}
 	if *modePtr == "generate" {
+		enableRedaction(viz, *redactionFilePtr, *redactionSaltPtr)
 		err = viz.Create(*graphFilePtr)
 		if err != nil {
 			log.Fatalf("Failed to create graph file: %v", err)
@@ -126,16 +186,57 @@ func main() {
 		if *resourceDataPtr {
 			log.Print("Including resource data in graph - this increases memory consumption for the graph.")
 		}
-		err = viz.ReadAssetsFromFile(*resourceInventoryFilePtr, *resourceDataPtr)
+		if len(resourceInventoryFiles) == 0 {
+			resourceInventoryFiles = append(resourceInventoryFiles, "resource_inventory.json")
+		}
+		err = viz.ReadAssetsFromFiles(resourceInventoryFiles, *resourceDataPtr)
 		if err != nil {
 			log.Fatalf("Failed read assets from resource inventory: %v", err)
 		}
 
+		if *iamPolicyFilePtr != "" {
+			err = viz.ReadAssetsFromFile(*iamPolicyFilePtr, false)
+			if err != nil {
+				log.Fatalf("Failed read IAM policies from inventory: %v", err)
+			}
+		}
+
 		err = viz.EnrichAssets()
 		if err != nil {
 			log.Fatalf("Failed create references and enrich assets in resource inventory: %v", err)
 		}
 
+		if *billingExportFilePtr != "" {
+			err = viz.ReadBillingExport(*billingExportFilePtr)
+			if err != nil {
+				log.Fatalf("Failed to read billing export: %v", err)
+			}
+		}
+
+		err = viz.Save()
+		if err != nil {
+			log.Fatalf("Failed to save graph file: %v", err)
+		}
+	}
+	if *modePtr == "update" {
+		err = viz.LoadForUpdate(*graphFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load graph file: %v", err)
+		}
+
+		feed := os.Stdin
+		if *feedFilePtr != "-" {
+			feed, err = os.Open(*feedFilePtr)
+			if err != nil {
+				log.Fatalf("Failed to open feed file: %v", err)
+			}
+			defer feed.Close()
+		}
+		err = viz.ApplyFeedMessages(feed, *resourceDataPtr)
+		if err != nil {
+			log.Fatalf("Failed to apply feed messages: %v", err)
+		}
+
 		err = viz.Save()
 		if err != nil {
 			log.Fatalf("Failed to save graph file: %v", err)
@@ -146,6 +247,10 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to load graph file: %v", err)
 		}
+		enableRedaction(viz, *redactionFilePtr, *redactionSaltPtr)
+		if *highlightViolationsPtr {
+			highlightViolations(viz, *rulesFilePtr)
+		}
 
 		gizmoQuery, err := ioutil.ReadFile(*queryFilePtr)
 		if err != nil {
@@ -170,17 +275,176 @@ func main() {
 		f := bufio.NewWriter(os.Stdout)
 		defer f.Flush()
 
-		waitGroup := sync.WaitGroup{}
+		ctx := context.Background()
+		graph, err := viz.GenerateGraph(ctx, string(gizmoQuery), parameters)
+		if err != nil {
+			log.Fatalf("Failed to create graph: %v", err)
+		}
+		err = gcpviz.RenderGraph(graph, *formatPtr, f)
+		if err != nil {
+			log.Fatalf("Failed to render graph: %v", err)
+		}
+	}
+	if *modePtr == "diff" {
+		if *previousGraphFilePtr == "" {
+			log.Fatal("Specify the graph file to compare against with -previous-graph-file")
+		}
+		previousViz, err := gcpviz.NewGcpViz(*relationsFilePtr, *labelsFilePtr, *styleFilePtr, overrideParams)
+		if err != nil {
+			log.Fatalf("Failed to initialize graph engine: %v", err)
+		}
+		err = previousViz.Load(*previousGraphFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load previous graph file: %v", err)
+		}
+		enableRedaction(previousViz, *redactionFilePtr, *redactionSaltPtr)
+		err = viz.Load(*graphFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load graph file: %v", err)
+		}
+		enableRedaction(viz, *redactionFilePtr, *redactionSaltPtr)
 
 		ctx := context.Background()
-		waitGroup.Add(1)
-		err = viz.GenerateNodes(&waitGroup, ctx, string(gizmoQuery), parameters, f)
+		diff, err := gcpviz.DiffGraphs(ctx, previousViz, viz)
+		if err != nil {
+			log.Fatalf("Failed to compare graphs: %v", err)
+		}
+
+		if *diffReportFilePtr != "" {
+			reportFile, err := os.Create(*diffReportFilePtr)
+			if err != nil {
+				log.Fatalf("Failed to create diff report file: %v", err)
+			}
+			defer reportFile.Close()
+			err = diff.WriteReport(reportFile)
+			if err != nil {
+				log.Fatalf("Failed to write diff report: %v", err)
+			}
+		}
+
+		title := *graphTitlePtr
+		if title == "" {
+			title = fmt.Sprintf("Changes: %d added, %d removed, %d modified", diff.Summary.AddedAssets, diff.Summary.RemovedAssets, diff.Summary.ModifiedAssets)
+		}
+		graph, err := diff.Graph(map[string]interface{}{"Title": viz.EscapeLabel(title)})
 		if err != nil {
 			log.Fatalf("Failed to create graph: %v", err)
 		}
-		waitGroup.Wait()
+		f := bufio.NewWriter(os.Stdout)
+		defer f.Flush()
+		err = gcpviz.RenderGraph(graph, *formatPtr, f)
+		if err != nil {
+			log.Fatalf("Failed to render graph: %v", err)
+		}
+	}
+	if *modePtr == "path" {
+		if *sourcePtr == "" || *destinationPtr == "" {
+			log.Fatal("Specify the resources to find paths between with -source and -destination")
+		}
+		err = viz.Load(*graphFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load graph file: %v", err)
+		}
+		enableRedaction(viz, *redactionFilePtr, *redactionSaltPtr)
+
+		ctx := context.Background()
+		analysis, err := viz.FindPaths(ctx, *sourcePtr, *destinationPtr, gcpviz.PathOptions{
+			MaxLength:        *maxPathLengthPtr,
+			EvaluateFirewall: *evaluateFirewallPtr,
+			Port:             *portPtr,
+		})
+		if err != nil {
+			log.Fatalf("Failed to find paths: %v", err)
+		}
+
+		if *pathReportFilePtr != "" {
+			reportFile, err := os.Create(*pathReportFilePtr)
+			if err != nil {
+				log.Fatalf("Failed to create path report file: %v", err)
+			}
+			defer reportFile.Close()
+			err = analysis.WriteReport(reportFile)
+			if err != nil {
+				log.Fatalf("Failed to write path report: %v", err)
+			}
+		}
+
+		title := *graphTitlePtr
+		if title == "" {
+			title = viz.Redact(fmt.Sprintf("Paths: %s to %s", *sourcePtr, *destinationPtr))
+			if analysis.Verdict != "" {
+				title = fmt.Sprintf("%s (%s)", title, analysis.Verdict)
+			}
+		}
+		graph, err := analysis.Graph(ctx, map[string]interface{}{"Title": viz.EscapeLabel(title)})
+		if err != nil {
+			log.Fatalf("Failed to create graph: %v", err)
+		}
+		f := bufio.NewWriter(os.Stdout)
+		defer f.Flush()
+		err = gcpviz.RenderGraph(graph, *formatPtr, f)
+		if err != nil {
+			log.Fatalf("Failed to render graph: %v", err)
+		}
+	}
+	if *modePtr == "export" {
+		err = viz.Load(*graphFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load graph file: %v", err)
+		}
+		enableRedaction(viz, *redactionFilePtr, *redactionSaltPtr)
+
+		ctx := context.Background()
+		err = viz.Export(ctx, *exportFormatPtr, os.Stdout)
+		if err != nil {
+			log.Fatalf("Failed to export graph: %v", err)
+		}
+	}
+	if *modePtr == "audit" {
+		rules, err := gcpviz.LoadAuditRules(*rulesFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load rules file: %v", err)
+		}
+		err = viz.Load(*graphFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load graph file: %v", err)
+		}
+
+		ctx := context.Background()
+		report, err := viz.Audit(ctx, rules)
+		if err != nil {
+			log.Fatalf("Failed to audit graph: %v", err)
+		}
+		err = report.Write(*auditFormatPtr, os.Stdout)
+		if err != nil {
+			log.Fatalf("Failed to write audit report: %v", err)
+		}
+	}
+	if *modePtr == "serve" {
+		err = viz.Load(*graphFilePtr)
+		if err != nil {
+			log.Fatalf("Failed to load graph file: %v", err)
+		}
+		enableRedaction(viz, *redactionFilePtr, *redactionSaltPtr)
+		if *highlightViolationsPtr {
+			highlightViolations(viz, *rulesFilePtr)
+		}
+
+		server := gcpviz.NewServer(viz, *queriesDirPtr)
+		server.QueryTimeout = *queryTimeoutPtr
+		log.Printf("Serving graph %s on %s", *graphFilePtr, *listenAddressPtr)
+		err = server.HttpServer(*listenAddressPtr).ListenAndServe()
+		if err != nil {
+			log.Fatalf("Failed to serve: %v", err)
+		}
+	}
+	validMode := false
+	for _, mode := range modes {
+		if *modePtr == mode {
+			validMode = true
+		}
 	}
-	if *modePtr != "visualize" && *modePtr != "generate" {
-		log.Fatal("invalid mode specified, specify either generate or visualize")
+	if !validMode {
+		log.Fatalf("invalid mode specified, specify one of: %s", strings.Join(modes, ", "))
 	}
 }
@@ -0,0 +1,293 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/boltdb/bolt"
+)
+
+// ResourceCost is the average monthly cost of an asset in a Cloud Billing export. Projects
+// contain the cost of all their resources, folders and organizations of their projects.
+type ResourceCost struct {
+	Monthly  float64 `json:"monthly"`
+	Currency string  `json:"currency"`
+}
+
+// CostStyle sizes or colours nodes by their monthly cost. Buckets are the upper bounds of
+// the cost buckets, Styles the node attributes for each bucket (one more than buckets).
+type CostStyle struct {
+	Buckets []float64 `yaml:"buckets" json:"buckets"`
+	Styles  []string  `yaml:"styles" json:"styles"`
+}
+
+var CostTemplates []*template.Template
+
+func (s *CostStyle) compile() error {
+	for i := 1; i < len(s.Buckets); i++ {
+		if s.Buckets[i] <= s.Buckets[i-1] {
+			return fmt.Errorf("cost buckets must be in ascending order: %v", s.Buckets)
+		}
+	}
+	if len(s.Styles) > 0 && len(s.Styles) != len(s.Buckets)+1 {
+		return fmt.Errorf("expected %d cost styles for %d cost buckets, got %d", len(s.Buckets)+1, len(s.Buckets), len(s.Styles))
+	}
+	CostTemplates = make([]*template.Template, len(s.Styles))
+	for i, style := range s.Styles {
+		t, err := template.New("cost").Funcs(templateFuncMap).Parse(style)
+		if err != nil {
+			return fmt.Errorf("error parsing cost style %d: %v", i, err)
+		}
+		CostTemplates[i] = t
+	}
+	return nil
+}
+
+// Cost formats the monthly cost of an asset, or returns an empty string if it has no cost.
+func Cost(cost *ResourceCost) string {
+	if cost == nil {
+		return ""
+	}
+	return strings.TrimSpace(fmt.Sprintf("%.2f %s", cost.Monthly, cost.Currency))
+}
+
+// CostBucket returns the cost bucket of an asset (0 for costs up to the first bucket in
+// the style), or -1 if it has no cost.
+func CostBucket(cost *ResourceCost) int {
+	if cost == nil {
+		return -1
+	}
+	for i, limit := range Style.Costs.Buckets {
+		if cost.Monthly <= limit {
+			return i
+		}
+	}
+	return len(Style.Costs.Buckets)
+}
+
+// costAttributes returns the node attributes of the cost bucket of an asset.
+func costAttributes(cost *ResourceCost) string {
+	bucket := CostBucket(cost)
+	if bucket < 0 || bucket >= len(CostTemplates) {
+		return ""
+	}
+	var out bytes.Buffer
+	CostTemplates[bucket].Execute(&out, cost)
+	if attributes := strings.Trim(out.String(), "\n"); attributes != "" {
+		return "," + attributes
+	}
+	return ""
+}
+
+// billingRow is a line of a billing export, with the column names flattened and
+// normalized (ie. project.id and project_id are both project_id).
+type billingRow map[string]string
+
+func normalizeBillingColumn(column string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(column), ".", "_", -1))
+}
+
+// flattenBillingRow flattens a row of a JSON billing export, credits are summed up.
+func flattenBillingRow(prefix string, value map[string]interface{}, row billingRow) {
+	for k, val := range value {
+		column := normalizeBillingColumn(prefix + k)
+		switch typed := val.(type) {
+		case map[string]interface{}:
+			flattenBillingRow(column+"_", typed, row)
+		case []interface{}:
+			if column == "credits" {
+				var credits float64
+				for _, credit := range typed {
+					if c, ok := credit.(map[string]interface{}); ok {
+						amount, _ := strconv.ParseFloat(fmt.Sprint(c["amount"]), 64)
+						credits += amount
+					}
+				}
+				row[column] = strconv.FormatFloat(credits, 'f', -1, 64)
+			}
+		case nil:
+		default:
+			row[column] = fmt.Sprint(typed)
+		}
+	}
+}
+
+// readBillingRows reads a billing export as CSV (with a header line) or JSON (one row per
+// line), optionally gzipped.
+func readBillingRows(input string) ([]billingRow, error) {
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := inventoryReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]billingRow, 0)
+	if strings.HasSuffix(strings.TrimSuffix(strings.ToLower(input), ".gz"), ".csv") {
+		r := csv.NewReader(reader)
+		header, err := r.Read()
+		if err != nil {
+			return nil, fmt.Errorf("error reading CSV header: %v", err)
+		}
+		for i := range header {
+			header[i] = normalizeBillingColumn(header[i])
+		}
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			row := make(billingRow, len(header))
+			for i, value := range record {
+				if i < len(header) && value != "" {
+					row[header[i]] = value
+				}
+			}
+			rows = append(rows, row)
+		}
+		return rows, nil
+	}
+
+	const bufferSize = 5 * 1024 * 1024 // Length of one line is maximum 5 MB
+	scanner := bufio.NewScanner(reader)
+	buf := make([]byte, bufferSize)
+	scanner.Buffer(buf, bufferSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var value map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &value); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		row := make(billingRow, 0)
+		flattenBillingRow("", value, row)
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// ReadBillingExport attaches the costs in a Cloud Billing export to the assets. Costs are
+// matched to projects by project number or ID, and to resources by resource.global_name
+// (available in detailed exports).
+func (v *GcpViz) ReadBillingExport(input string) error {
+	rows, err := readBillingRows(input)
+	if err != nil {
+		return err
+	}
+
+	return v.AssetDatabase.Update(func(tx *bolt.Tx) error {
+		assets := tx.Bucket([]byte("Assets"))
+		projects := make(map[string]*TemplateResource, 0)
+		err := assets.ForEach(func(k, bv []byte) error {
+			if !strings.HasPrefix(string(k), "//cloudresourcemanager.googleapis.com/projects/") {
+				return nil
+			}
+			var project TemplateResource
+			if err := json.Unmarshal(bv, &project); err != nil {
+				return err
+			}
+			projects[GetLastPart(project.Name)] = &project
+			if data, ok := project.Resource.Data.(map[string]interface{}); ok {
+				if projectId, ok := data["projectId"].(string); ok {
+					projects[projectId] = &project
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		costs := make(map[string]float64, 0)
+		months := make(map[string]bool, 0)
+		var currency string
+		var unmatched int
+		for i, row := range rows {
+			cost, err := strconv.ParseFloat(row["cost"], 64)
+			if err != nil {
+				return fmt.Errorf("row %d: invalid cost %q", i+1, row["cost"])
+			}
+			if credits, err := strconv.ParseFloat(row["credits"], 64); err == nil {
+				cost += credits
+			}
+			if row["currency"] != "" {
+				if currency != "" && currency != row["currency"] {
+					return fmt.Errorf("row %d: mixed currencies in billing export (%s, %s)", i+1, currency, row["currency"])
+				}
+				currency = row["currency"]
+			}
+			months[row["invoice_month"]] = true
+
+			project, found := projects[row["project_number"]]
+			if !found {
+				project, found = projects[row["project_id"]]
+			}
+			if !found {
+				unmatched++
+				continue
+			}
+			for _, ancestor := range project.Ancestors {
+				costs[ancestorAssetName(ancestor)] += cost
+			}
+			if resource := row["resource_global_name"]; resource != "" && assets.Get([]byte(resource)) != nil {
+				costs[resource] += cost
+			}
+		}
+
+		names := make([]string, 0, len(costs))
+		for name := range costs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			var asset map[string]interface{}
+			if err := json.Unmarshal(assets.Get([]byte(name)), &asset); err != nil {
+				continue
+			}
+			asset["cost"] = &ResourceCost{Monthly: costs[name] / float64(len(months)), Currency: currency}
+			jsn, err := json.Marshal(asset)
+			if err != nil {
+				return err
+			}
+			if err := assets.Put([]byte(name), jsn); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Attached costs of %d billing rows over %d months to %d assets (%d rows without a known project).\n", len(rows), len(months), len(names), unmatched)
+		return nil
+	})
+}
@@ -0,0 +1,298 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	cquad "github.com/cayleygraph/quad"
+)
+
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+var changeColors = map[string]string{
+	ChangeAdded:    "#859900",
+	ChangeRemoved:  "#dc322f",
+	ChangeModified: "#cb4b16",
+}
+
+const unchangedColor = "#586e75"
+
+type AssetChange struct {
+	Name          string   `json:"name"`
+	AssetType     string   `json:"assetType"`
+	Change        string   `json:"change"`
+	ChangedFields []string `json:"changedFields,omitempty"`
+}
+
+type EdgeChange struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Change string `json:"change"`
+}
+
+type DiffSummary struct {
+	AddedAssets    int `json:"addedAssets"`
+	RemovedAssets  int `json:"removedAssets"`
+	ModifiedAssets int `json:"modifiedAssets"`
+	AddedEdges     int `json:"addedEdges"`
+	RemovedEdges   int `json:"removedEdges"`
+}
+
+// GraphDiff contains the changes between two graph databases.
+type GraphDiff struct {
+	Summary DiffSummary   `json:"summary"`
+	Assets  []AssetChange `json:"assets"`
+	Edges   []EdgeChange  `json:"edges"`
+
+	previous       *GcpViz
+	current        *GcpViz
+	unchangedEdges [][2]string
+}
+
+type diffAsset struct {
+	AssetType string                 `json:"asset_type"`
+	Ancestors []string               `json:"ancestors"`
+	Resource  map[string]interface{} `json:"resource"`
+}
+
+func (v *GcpViz) readDiffAssets() (map[string]*diffAsset, error) {
+	assets := make(map[string]*diffAsset, 0)
+	err := v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+			var asset diffAsset
+			if err := json.Unmarshal(bv, &asset); err != nil {
+				return fmt.Errorf("error parsing asset %s: %v", string(k), err)
+			}
+			assets[string(k)] = &asset
+			return nil
+		})
+	})
+	return assets, err
+}
+
+func (v *GcpViz) usesEdges(ctx context.Context) (map[[2]string]bool, error) {
+	edges := make(map[[2]string]bool, 0)
+	it := v.QS.QuadsAllIterator()
+	defer it.Close()
+	for it.Next(ctx) {
+		q := v.QS.Quad(it.Result())
+		if fmt.Sprint(cquad.NativeOf(q.Predicate)) != "uses" {
+			continue
+		}
+		edges[[2]string{fmt.Sprint(cquad.NativeOf(q.Subject)), fmt.Sprint(cquad.NativeOf(q.Object))}] = true
+	}
+	return edges, it.Err()
+}
+
+// changedFields compares two versions of an asset, ignoring fields synthesized by the
+// enrichment configuration (those changes are reported on the enriching assets).
+func (v *GcpViz) changedFields(previous *diffAsset, current *diffAsset) []string {
+	changed := make([]string, 0)
+	if !reflect.DeepEqual(previous.Ancestors, current.Ancestors) {
+		changed = append(changed, "ancestors")
+	}
+	if !reflect.DeepEqual(previous.Resource["parent"], current.Resource["parent"]) {
+		changed = append(changed, "parent")
+	}
+	previousData, _ := previous.Resource["data"].(map[string]interface{})
+	currentData, _ := current.Resource["data"].(map[string]interface{})
+	keys := make(map[string]bool, len(previousData)+len(currentData))
+	for k := range previousData {
+		keys[k] = true
+	}
+	for k := range currentData {
+		keys[k] = true
+	}
+	enriched := v.Relations.Enrich[current.AssetType]
+	dataChanges := make([]string, 0)
+	for k := range keys {
+		if _, found := enriched[k]; found {
+			continue
+		}
+		if !reflect.DeepEqual(previousData[k], currentData[k]) {
+			dataChanges = append(dataChanges, fmt.Sprintf("data.%s", k))
+		}
+	}
+	sort.Strings(dataChanges)
+	return append(changed, dataChanges...)
+}
+
+// DiffGraphs computes the added, removed and modified assets and the added and removed
+// `uses` edges between two graph databases.
+func DiffGraphs(ctx context.Context, previous *GcpViz, current *GcpViz) (*GraphDiff, error) {
+	diff := &GraphDiff{previous: previous, current: current, Assets: make([]AssetChange, 0), Edges: make([]EdgeChange, 0)}
+
+	fmt.Fprintf(os.Stderr, "Comparing assets...\n")
+	previousAssets, err := previous.readDiffAssets()
+	if err != nil {
+		return nil, err
+	}
+	currentAssets, err := current.readDiffAssets()
+	if err != nil {
+		return nil, err
+	}
+	for name, asset := range currentAssets {
+		if previousAsset, found := previousAssets[name]; found {
+			if fields := current.changedFields(previousAsset, asset); len(fields) > 0 {
+				diff.Assets = append(diff.Assets, AssetChange{Name: name, AssetType: asset.AssetType, Change: ChangeModified, ChangedFields: fields})
+				diff.Summary.ModifiedAssets++
+			}
+		} else {
+			diff.Assets = append(diff.Assets, AssetChange{Name: name, AssetType: asset.AssetType, Change: ChangeAdded})
+			diff.Summary.AddedAssets++
+		}
+	}
+	for name, asset := range previousAssets {
+		if _, found := currentAssets[name]; !found {
+			diff.Assets = append(diff.Assets, AssetChange{Name: name, AssetType: asset.AssetType, Change: ChangeRemoved})
+			diff.Summary.RemovedAssets++
+		}
+	}
+	sort.Slice(diff.Assets, func(i, j int) bool { return diff.Assets[i].Name < diff.Assets[j].Name })
+
+	fmt.Fprintf(os.Stderr, "Comparing edges...\n")
+	previousEdges, err := previous.usesEdges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	currentEdges, err := current.usesEdges(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for edge := range currentEdges {
+		if _, found := previousEdges[edge]; !found {
+			diff.Edges = append(diff.Edges, EdgeChange{From: edge[0], To: edge[1], Change: ChangeAdded})
+			diff.Summary.AddedEdges++
+		} else {
+			diff.unchangedEdges = append(diff.unchangedEdges, edge)
+		}
+	}
+	for edge := range previousEdges {
+		if _, found := currentEdges[edge]; !found {
+			diff.Edges = append(diff.Edges, EdgeChange{From: edge[0], To: edge[1], Change: ChangeRemoved})
+			diff.Summary.RemovedEdges++
+		}
+	}
+	sort.Slice(diff.Edges, func(i, j int) bool {
+		if diff.Edges[i].From == diff.Edges[j].From {
+			return diff.Edges[i].To < diff.Edges[j].To
+		}
+		return diff.Edges[i].From < diff.Edges[j].From
+	})
+
+	fmt.Fprintf(os.Stderr, "Assets added: %d, removed: %d, modified: %d. Edges added: %d, removed: %d\n",
+		diff.Summary.AddedAssets, diff.Summary.RemovedAssets, diff.Summary.ModifiedAssets, diff.Summary.AddedEdges, diff.Summary.RemovedEdges)
+	return diff, nil
+}
+
+// WriteReport writes the changes as JSON, redacted if redaction is enabled for the graphs.
+// Removed assets are only in the previous graph, so both redactors are applied.
+func (d *GraphDiff) WriteReport(out io.Writer) error {
+	return writeRedactedReport(out, d, d.current.redactor, d.previous.redactor)
+}
+
+func highlightAttributes(color string) string {
+	if color == unchangedColor {
+		return fmt.Sprintf(`,style="filled",fillcolor="%s",color="%s",fontcolor="white"`, color, color)
+	}
+	return fmt.Sprintf(`,style="filled,bold",fillcolor="%s",color="%s",fontcolor="white",penwidth=3`, color, color)
+}
+
+// Graph builds a graph containing the changed assets and the endpoints of the changed
+// edges. Added and modified assets are rendered from the current graph, removed assets
+// from the previous one.
+func (d *GraphDiff) Graph(parameters map[string]interface{}) (*Graph, error) {
+	g, err := d.current.newGraph(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]int64, 0)
+	addNode := func(name string, viz *GcpViz, color string) {
+		if _, found := ids[name]; found {
+			return
+		}
+		id := int64(len(ids) + 1)
+		node, err := viz.renderNode(name, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to render node %s: %v\n", name, err)
+			return
+		}
+		if node == nil {
+			return
+		}
+		node.Attributes += highlightAttributes(color)
+		viz.redactNode(node)
+		ids[name] = id
+		g.Nodes = append(g.Nodes, node)
+	}
+	for _, change := range d.Assets {
+		if change.Change == ChangeRemoved {
+			addNode(change.Name, d.previous, changeColors[change.Change])
+		} else {
+			addNode(change.Name, d.current, changeColors[change.Change])
+		}
+	}
+	for _, change := range d.Edges {
+		viz := d.current
+		if change.Change == ChangeRemoved {
+			viz = d.previous
+		}
+		addNode(change.From, viz, unchangedColor)
+		addNode(change.To, viz, unchangedColor)
+	}
+
+	addEdge := func(from string, to string, viz *GcpViz, color string) {
+		fromId, fromFound := ids[from]
+		toId, toFound := ids[to]
+		if !fromFound || !toFound {
+			return
+		}
+		edge, err := viz.renderEdge(from, to, fromId, toId)
+		if err != nil || edge == nil {
+			edge = &GraphEdge{From: fromId, To: toId}
+		}
+		if edge.Attributes != "" {
+			edge.Attributes += ","
+		}
+		edge.Attributes += fmt.Sprintf(`color="%s",penwidth=2`, color)
+		g.Edges = append(g.Edges, edge)
+	}
+	for _, change := range d.Edges {
+		if change.Change == ChangeRemoved {
+			addEdge(change.From, change.To, d.previous, changeColors[change.Change])
+		} else {
+			addEdge(change.From, change.To, d.current, changeColors[change.Change])
+		}
+	}
+	for _, edge := range d.unchangedEdges {
+		addEdge(edge[0], edge[1], d.current, unchangedColor)
+	}
+	return g, nil
+}
@@ -0,0 +1,393 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	cquad "github.com/cayleygraph/quad"
+	"github.com/cayleygraph/quad/nquads"
+)
+
+// Supported formats for exporting the whole graph.
+const (
+	ExportGraphML = "graphml"
+	ExportCypher  = "cypher"
+	ExportNQuads  = "nquads"
+	ExportJsonLD  = "jsonld"
+)
+
+var ExportFormats = []string{ExportGraphML, ExportCypher, ExportNQuads, ExportJsonLD}
+
+// Edge types in exported graphs: assets use other assets and have a parent, principals
+// have roles on resources.
+const (
+	ExportEdgeUses    = "uses"
+	ExportEdgeParent  = "parent"
+	ExportEdgeHasRole = "hasRole"
+)
+
+// exportProperties are the node properties, in the order they are written.
+var exportProperties = []string{"assetType", "displayName", "location", "parent", "ancestors", "updateTime", "monthlyCost", "source", "aliases", "data"}
+
+type ExportNode struct {
+	Name       string
+	Properties map[string]string
+}
+
+type ExportEdge struct {
+	From string
+	To   string
+	Type string
+	Role string
+}
+
+type exportAsset struct {
+	AssetType  string        `json:"asset_type"`
+	Ancestors  []string      `json:"ancestors"`
+	UpdateTime string        `json:"update_time"`
+	Cost       *ResourceCost `json:"cost"`
+	Resource   struct {
+		Parent   string                 `json:"parent"`
+		Location string                 `json:"location"`
+		Data     map[string]interface{} `json:"data"`
+	} `json:"resource"`
+}
+
+// exportGraph collects all vertexes of the graph with their asset properties, and the
+// `uses` and parent edges between them. Resource data is only included if the graph was
+// generated with it.
+func (v *GcpViz) exportGraph(ctx context.Context) ([]*ExportNode, []*ExportEdge, error) {
+	nodes := make(map[string]*ExportNode, 0)
+	node := func(name string) *ExportNode {
+		if n, found := nodes[name]; found {
+			return n
+		}
+		n := &ExportNode{Name: name, Properties: make(map[string]string, 0)}
+		nodes[name] = n
+		return n
+	}
+	edges := make([]*ExportEdge, 0)
+
+	it := v.QS.QuadsAllIterator()
+	defer it.Close()
+	for it.Next(ctx) {
+		q := v.QS.Quad(it.Result())
+		subject := fmt.Sprint(cquad.NativeOf(q.Subject))
+		object := fmt.Sprint(cquad.NativeOf(q.Object))
+		switch fmt.Sprint(cquad.NativeOf(q.Predicate)) {
+		case "child":
+			node(object)
+			if subject != "" {
+				node(subject)
+				edges = append(edges, &ExportEdge{From: object, To: subject, Type: ExportEdgeParent})
+			}
+		case "uses":
+			node(subject)
+			node(object)
+			edges = append(edges, &ExportEdge{From: subject, To: object, Type: ExportEdgeUses})
+		case "data":
+			node(subject).Properties["data"] = object
+		case SourcePredicate:
+			node(subject).Properties["source"] = object
+		default:
+			if predicate := fmt.Sprint(cquad.NativeOf(q.Predicate)); IsRolePredicate(predicate) {
+				node(subject)
+				node(object)
+				edges = append(edges, &ExportEdge{From: subject, To: object, Type: ExportEdgeHasRole, Role: strings.TrimPrefix(predicate, RolePredicatePrefix)})
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	err := v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		assets := tx.Bucket([]byte("Assets"))
+		for name, n := range nodes {
+			bv := assets.Get([]byte(name))
+			if bv == nil {
+				continue
+			}
+			var asset exportAsset
+			if err := json.Unmarshal(bv, &asset); err != nil {
+				return fmt.Errorf("error parsing asset %s: %v", name, err)
+			}
+			n.Properties["assetType"] = asset.AssetType
+			n.Properties["parent"] = asset.Resource.Parent
+			n.Properties["location"] = asset.Resource.Location
+			n.Properties["ancestors"] = strings.Join(asset.Ancestors, ",")
+			n.Properties["updateTime"] = asset.UpdateTime
+			if asset.Cost != nil {
+				n.Properties["monthlyCost"] = Cost(asset.Cost)
+			}
+			for _, field := range []string{"displayName", "name"} {
+				if displayName, ok := asset.Resource.Data[field].(string); ok {
+					n.Properties["displayName"] = displayName
+					break
+				}
+			}
+		}
+
+		aliases := make(map[string][]string, 0)
+		err := tx.Bucket([]byte("Aliases")).ForEach(func(k, bv []byte) error {
+			aliases[string(bv)] = append(aliases[string(bv)], string(k))
+			return nil
+		})
+		for name, a := range aliases {
+			if n, found := nodes[name]; found {
+				sort.Strings(a)
+				n.Properties["aliases"] = strings.Join(a, ",")
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sortedNodes := make([]*ExportNode, 0, len(nodes))
+	for _, n := range nodes {
+		for k, val := range n.Properties {
+			if val == "" {
+				delete(n.Properties, k)
+			}
+		}
+		v.redactExportNode(n)
+		sortedNodes = append(sortedNodes, n)
+	}
+	for _, e := range edges {
+		e.From = v.redactor.Redact(e.From)
+		e.To = v.redactor.Redact(e.To)
+	}
+	sort.Slice(sortedNodes, func(i, j int) bool { return sortedNodes[i].Name < sortedNodes[j].Name })
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		if edges[i].To != edges[j].To {
+			return edges[i].To < edges[j].To
+		}
+		if edges[i].Type != edges[j].Type {
+			return edges[i].Type < edges[j].Type
+		}
+		return edges[i].Role < edges[j].Role
+	})
+	return sortedNodes, edges, nil
+}
+
+// Export writes the whole graph in one of the export formats.
+func (v *GcpViz) Export(ctx context.Context, format string, out io.Writer) error {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	if format == ExportNQuads {
+		return v.exportNQuads(ctx, w)
+	}
+
+	nodes, edges, err := v.exportGraph(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exporting %d vertexes and %d edges...\n", len(nodes), len(edges))
+	switch format {
+	case ExportGraphML:
+		return writeGraphML(w, nodes, edges)
+	case ExportCypher:
+		return writeCypher(w, nodes, edges)
+	case ExportJsonLD:
+		return writeJsonLD(w, nodes, edges)
+	}
+	return fmt.Errorf("unsupported export format %s (supported: %s)", format, strings.Join(ExportFormats, ", "))
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func writeGraphML(w io.Writer, nodes []*ExportNode, edges []*ExportEdge) error {
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(w, "<graphml xmlns=\"http://graphml.graphdrawing.org/xmlns\">\n")
+	for _, property := range exportProperties {
+		fmt.Fprintf(w, "  <key id=\"%s\" for=\"node\" attr.name=\"%s\" attr.type=\"string\"/>\n", property, property)
+	}
+	fmt.Fprintf(w, "  <key id=\"type\" for=\"edge\" attr.name=\"type\" attr.type=\"string\"/>\n")
+	fmt.Fprintf(w, "  <key id=\"role\" for=\"edge\" attr.name=\"role\" attr.type=\"string\"/>\n")
+	fmt.Fprintf(w, "  <graph id=\"gcp\" edgedefault=\"directed\">\n")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "    <node id=\"%s\">\n", xmlEscape(n.Name))
+		for _, property := range exportProperties {
+			if val, ok := n.Properties[property]; ok {
+				fmt.Fprintf(w, "      <data key=\"%s\">%s</data>\n", property, xmlEscape(val))
+			}
+		}
+		fmt.Fprintf(w, "    </node>\n")
+	}
+	for i, e := range edges {
+		fmt.Fprintf(w, "    <edge id=\"e%d\" source=\"%s\" target=\"%s\">\n", i, xmlEscape(e.From), xmlEscape(e.To))
+		fmt.Fprintf(w, "      <data key=\"type\">%s</data>\n", e.Type)
+		if e.Role != "" {
+			fmt.Fprintf(w, "      <data key=\"role\">%s</data>\n", xmlEscape(e.Role))
+		}
+		fmt.Fprintf(w, "    </edge>\n")
+	}
+	fmt.Fprintf(w, "  </graph>\n")
+	fmt.Fprintf(w, "</graphml>\n")
+	return nil
+}
+
+var cypherEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`)
+
+func cypherString(s string) string {
+	return "'" + cypherEscaper.Replace(s) + "'"
+}
+
+// writeCypher writes a Cypher script creating every vertex as an :Asset node (labeled
+// with its asset type) and the edges as :USES, :PARENT and :HAS_ROLE {role} relationships.
+func writeCypher(w io.Writer, nodes []*ExportNode, edges []*ExportEdge) error {
+	fmt.Fprintf(w, "CREATE INDEX asset_name IF NOT EXISTS FOR (n:Asset) ON (n.name);\n")
+	for _, n := range nodes {
+		labels := ":Asset"
+		if assetType, ok := n.Properties["assetType"]; ok {
+			labels += ":`" + strings.ReplaceAll(assetType, "`", "``") + "`"
+		}
+		properties := []string{"name: " + cypherString(n.Name)}
+		for _, property := range exportProperties {
+			if val, ok := n.Properties[property]; ok {
+				properties = append(properties, property+": "+cypherString(val))
+			}
+		}
+		fmt.Fprintf(w, "CREATE (%s {%s});\n", labels, strings.Join(properties, ", "))
+	}
+	for _, e := range edges {
+		relationship := strings.ToUpper(e.Type)
+		if e.Type == ExportEdgeHasRole {
+			relationship = fmt.Sprintf("HAS_ROLE {role: %s}", cypherString(e.Role))
+		}
+		fmt.Fprintf(w, "MATCH (a:Asset {name: %s}), (b:Asset {name: %s}) CREATE (a)-[:%s]->(b);\n",
+			cypherString(e.From), cypherString(e.To), relationship)
+	}
+	return nil
+}
+
+func writeJsonLD(w io.Writer, nodes []*ExportNode, edges []*ExportEdge) error {
+	objects := make(map[string]map[string]interface{}, len(nodes))
+	graph := make([]map[string]interface{}, 0, len(nodes))
+	for _, n := range nodes {
+		obj := map[string]interface{}{"@id": n.Name}
+		for k, val := range n.Properties {
+			switch k {
+			case "assetType":
+				obj["@type"] = val
+			case "aliases", "ancestors":
+				obj[k] = strings.Split(val, ",")
+			case "data":
+				var data interface{}
+				if err := json.Unmarshal([]byte(val), &data); err == nil {
+					obj[k] = data
+				}
+			default:
+				obj[k] = val
+			}
+		}
+		objects[n.Name] = obj
+		graph = append(graph, obj)
+	}
+	for _, e := range edges {
+		obj := objects[e.From]
+		if e.Type == ExportEdgeHasRole {
+			roles, _ := obj["roles"].([]map[string]interface{})
+			obj["roles"] = append(roles, map[string]interface{}{"role": e.Role, "resource": map[string]string{"@id": e.To}})
+			continue
+		}
+		refs, _ := obj[e.Type].([]map[string]string)
+		obj[e.Type] = append(refs, map[string]string{"@id": e.To})
+	}
+
+	vocab := "https://cloud.google.com/asset-inventory/"
+	context := map[string]interface{}{
+		"@vocab":         vocab,
+		ExportEdgeUses:   map[string]string{"@type": "@id"},
+		ExportEdgeParent: map[string]string{"@type": "@id"},
+		"aliases":        map[string]string{"@container": "@set"},
+		"resource":       map[string]string{"@type": "@id"},
+		"ancestors":      map[string]string{"@container": "@list"},
+		"data":           map[string]string{"@type": "@json"},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{"@context": context, "@graph": graph})
+}
+
+// exportNQuads writes the quads of the graph, with the asset names, predicates and
+// asset types as IRIs, and the aliases of the assets as `alias` quads.
+func (v *GcpViz) exportNQuads(ctx context.Context, w io.Writer) error {
+	qw := nquads.NewWriter(w)
+	defer qw.Close()
+
+	toIRI := func(val cquad.Value) cquad.Value {
+		if s := fmt.Sprint(cquad.NativeOf(val)); s != "" {
+			return cquad.IRI(v.redactor.Redact(s))
+		}
+		return nil
+	}
+	it := v.QS.QuadsAllIterator()
+	defer it.Close()
+	count := 0
+	for it.Next(ctx) {
+		q := v.QS.Quad(it.Result())
+		out := cquad.Quad{Subject: toIRI(q.Subject), Predicate: toIRI(q.Predicate), Label: toIRI(q.Label)}
+		switch fmt.Sprint(cquad.NativeOf(q.Predicate)) {
+		case "data":
+			out.Object = cquad.String(v.redactJson(fmt.Sprint(cquad.NativeOf(q.Object))))
+		case SourcePredicate:
+			out.Object = q.Object
+		default:
+			out.Object = toIRI(q.Object)
+		}
+		if out.Subject == nil || out.Object == nil {
+			continue
+		}
+		if err := qw.WriteQuad(out); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	err := v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Aliases")).ForEach(func(k, bv []byte) error {
+			count++
+			return qw.WriteQuad(cquad.Make(cquad.IRI(v.redactor.Redact(string(bv))), cquad.IRI("alias"), cquad.String(v.redactor.Redact(string(k))), nil))
+		})
+	})
+	fmt.Fprintf(os.Stderr, "Exported %d quads.\n", count)
+	return err
+}
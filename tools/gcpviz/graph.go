@@ -0,0 +1,391 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Supported output formats for a rendered graph.
+const (
+	FormatDot  = "dot"
+	FormatSvg  = "svg"
+	FormatJson = "json"
+	FormatHtml = "html"
+)
+
+var OutputFormats = []string{FormatDot, FormatSvg, FormatJson, FormatHtml}
+
+type GraphNode struct {
+	Id         int64
+	Name       string
+	AssetType  string
+	Label      string
+	Link       string
+	Attributes string
+	Resource   *TemplateResource
+}
+
+type GraphEdge struct {
+	From       int64
+	To         int64
+	Attributes string
+}
+
+// GraphCluster groups nodes, which are drawn inside a box (a Graphviz cluster subgraph).
+type GraphCluster struct {
+	Id         int64
+	Name       string
+	Label      string
+	Attributes string
+	Nodes      []int64
+}
+
+// Graph holds the styled result of a query, before it is serialized into
+// one of the output formats.
+type Graph struct {
+	Global   map[string]string
+	Options  map[string]string
+	Nodes    []*GraphNode
+	Edges    []*GraphEdge
+	Clusters []*GraphCluster
+}
+
+type jsonGraphNode struct {
+	Label    string                 `json:"label"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+type jsonGraphEdge struct {
+	Source   string                 `json:"source"`
+	Target   string                 `json:"target"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+type jsonGraph struct {
+	Directed bool                      `json:"directed"`
+	Label    string                    `json:"label,omitempty"`
+	Metadata map[string]interface{}    `json:"metadata,omitempty"`
+	Nodes    map[string]*jsonGraphNode `json:"nodes"`
+	Edges    []*jsonGraphEdge          `json:"edges"`
+}
+
+// RenderGraph serializes the graph in the requested output format.
+func RenderGraph(g *Graph, format string, out io.Writer) error {
+	switch format {
+	case FormatDot, "":
+		return g.WriteDot(out)
+	case FormatSvg:
+		return g.WriteSvg(out)
+	case FormatJson:
+		return g.WriteJson(out)
+	case FormatHtml:
+		return g.WriteHtml(out)
+	}
+	return fmt.Errorf("unsupported output format %s (supported: %s)", format, strings.Join(OutputFormats, ", "))
+}
+
+func nodeId(id int64) string {
+	return fmt.Sprintf("N_%d", id)
+}
+
+// WriteDot writes the graph in Graphviz DOT format.
+func (g *Graph) WriteDot(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "digraph GCP {\n")
+	for _, k := range sortedKeys(g.Global) {
+		fmt.Fprintf(w, "  %s [%s];\n", k, g.Global[k])
+	}
+	for _, k := range sortedKeys(g.Options) {
+		fmt.Fprintf(w, "  %s=%s;\n", k, g.Options[k])
+	}
+	clustered := make(map[int64]bool, 0)
+	for _, cluster := range g.Clusters {
+		for _, id := range cluster.Nodes {
+			clustered[id] = true
+		}
+	}
+	nodes := make(map[int64]*GraphNode, len(g.Nodes))
+	for _, node := range g.Nodes {
+		nodes[node.Id] = node
+		if !clustered[node.Id] {
+			fmt.Fprintf(w, "  %s [%s];\n", nodeId(node.Id), node.Attributes)
+		}
+	}
+	for _, cluster := range g.Clusters {
+		fmt.Fprintf(w, "  subgraph cluster_%d {\n", cluster.Id)
+		if cluster.Attributes != "" {
+			fmt.Fprintf(w, "    graph [%s];\n", cluster.Attributes)
+		}
+		for _, id := range cluster.Nodes {
+			if node, found := nodes[id]; found {
+				fmt.Fprintf(w, "    %s [%s];\n", nodeId(node.Id), node.Attributes)
+			}
+		}
+		fmt.Fprintf(w, "  }\n")
+	}
+	for _, edge := range g.Edges {
+		if edge.Attributes != "" {
+			fmt.Fprintf(w, "  %s -> %s [%s];\n", nodeId(edge.From), nodeId(edge.To), edge.Attributes)
+		} else {
+			fmt.Fprintf(w, "  %s -> %s;\n", nodeId(edge.From), nodeId(edge.To))
+		}
+	}
+	fmt.Fprintf(w, "}\n")
+	// The buffered writer keeps the first write error, Flush returns it
+	return w.Flush()
+}
+
+// sortedKeys returns the keys of a map in order, so the same graph is always written the same.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteJson writes the graph in JSON Graph Format (http://jsongraphformat.info/).
+func (g *Graph) WriteJson(out io.Writer) error {
+	jg := jsonGraph{
+		Directed: true,
+		Label:    g.Title(),
+		Nodes:    make(map[string]*jsonGraphNode, len(g.Nodes)),
+		Edges:    make([]*jsonGraphEdge, 0, len(g.Edges)),
+	}
+	clusters := make(map[int64]*GraphCluster, 0)
+	for _, cluster := range g.Clusters {
+		for _, id := range cluster.Nodes {
+			clusters[id] = cluster
+		}
+	}
+	for _, node := range g.Nodes {
+		metadata := map[string]interface{}{
+			"name":       node.Name,
+			"assetType":  node.AssetType,
+			"attributes": jsonAttributes(node.Attributes),
+		}
+		if node.Link != "" {
+			metadata["link"] = node.Link
+		}
+		if node.Resource != nil && len(node.Resource.Ancestors) > 0 {
+			metadata["ancestors"] = node.Resource.Ancestors
+		}
+		if node.Resource != nil && node.Resource.Cost != nil {
+			metadata["cost"] = node.Resource.Cost
+		}
+		if cluster, found := clusters[node.Id]; found {
+			metadata["cluster"] = map[string]string{"name": cluster.Name, "label": cluster.Label}
+		}
+		jg.Nodes[nodeId(node.Id)] = &jsonGraphNode{Label: node.DisplayLabel(), Metadata: metadata}
+	}
+	for _, edge := range g.Edges {
+		jEdge := &jsonGraphEdge{Source: nodeId(edge.From), Target: nodeId(edge.To)}
+		if edge.Attributes != "" {
+			jEdge.Metadata = map[string]interface{}{"attributes": jsonAttributes(edge.Attributes)}
+		}
+		jg.Edges = append(jg.Edges, jEdge)
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{"graph": jg})
+}
+
+func jsonAttributes(attributes string) map[string]string {
+	attrs := ParseDotAttributes(attributes)
+	for k, v := range attrs {
+		attrs[k] = DotString(v)
+	}
+	return attrs
+}
+
+// Title returns the plain text title of the graph, if one was set in the
+// global graph style.
+func (g *Graph) Title() string {
+	if graphStyle, ok := g.Global["graph"]; ok {
+		if label, ok := ParseDotAttributes(graphStyle)["label"]; ok {
+			return PlainLabel(label, false)
+		}
+	}
+	return ""
+}
+
+// DisplayLabel returns the node label as plain text.
+func (n *GraphNode) DisplayLabel() string {
+	attrs := ParseDotAttributes(n.Attributes)
+	if label, ok := attrs["label"]; ok {
+		return PlainLabel(label, attrs["shape"] == "record" || attrs["shape"] == "Mrecord")
+	}
+	return n.Label
+}
+
+// ParseDotAttributes parses a DOT attribute list (ie. `shape=box,label="foo"`). Later
+// attributes override earlier ones, as they do in Graphviz. HTML-like labels are
+// returned with their angle brackets, quoted strings are returned as-is between quotes
+// so PlainLabel can tell them apart.
+func ParseDotAttributes(attributes string) map[string]string {
+	ret := make(map[string]string, 0)
+	s := attributes
+	i := 0
+	skipSeparators := func() {
+		for i < len(s) && (s[i] == ',' || s[i] == ';' || s[i] == ' ' || s[i] == '\n' || s[i] == '\t' || s[i] == '\r') {
+			i++
+		}
+	}
+	readId := func() string {
+		start := i
+		for i < len(s) && s[i] != '=' && s[i] != ',' && s[i] != ';' && s[i] != ' ' && s[i] != '\n' && s[i] != '\t' {
+			i++
+		}
+		return s[start:i]
+	}
+	for {
+		skipSeparators()
+		if i >= len(s) {
+			break
+		}
+		key := readId()
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i >= len(s) || s[i] != '=' {
+			if key != "" {
+				ret[key] = "true"
+			} else {
+				i++
+			}
+			continue
+		}
+		i++ // skip =
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+		if i >= len(s) {
+			ret[key] = ""
+			break
+		}
+		start := i
+		switch s[i] {
+		case '"':
+			i++
+			for i < len(s) && s[i] != '"' {
+				if s[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+			if i > len(s) {
+				i = len(s)
+			}
+		case '<':
+			depth := 0
+			for i < len(s) {
+				if s[i] == '<' {
+					depth++
+				} else if s[i] == '>' {
+					depth--
+					if depth == 0 {
+						i++
+						break
+					}
+				}
+				i++
+			}
+		default:
+			readId()
+		}
+		ret[key] = s[start:i]
+	}
+	return ret
+}
+
+// DotString returns the value of a DOT attribute without quotes.
+func DotString(value string) string {
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return unescapeDotString(value[1 : len(value)-1])
+	}
+	return value
+}
+
+func unescapeDotString(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n', 'l', 'r':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+var htmlBreakRegexp = regexp.MustCompile(`(?i)<br\s*/?>`)
+var htmlTagRegexp = regexp.MustCompile(`<[^>]*>`)
+var blankLinesRegexp = regexp.MustCompile(`\n\s*\n+`)
+
+// PlainLabel converts a DOT label (quoted string, HTML-like or record label) into
+// plain text, with lines separated by newlines.
+func PlainLabel(label string, record bool) string {
+	var text string
+	if strings.HasPrefix(label, "<") && strings.HasSuffix(label, ">") {
+		text = label[1 : len(label)-1]
+		text = htmlBreakRegexp.ReplaceAllString(text, "\n")
+		text = htmlTagRegexp.ReplaceAllString(text, "")
+		text = html.UnescapeString(text)
+	} else {
+		text = DotString(label)
+	}
+	if record {
+		var b strings.Builder
+		for i := 0; i < len(text); i++ {
+			switch text[i] {
+			case '\\':
+				if i+1 < len(text) {
+					i++
+					b.WriteByte(text[i])
+				}
+			case '|':
+				b.WriteByte('\n')
+			case '{', '}':
+			default:
+				b.WriteByte(text[i])
+			}
+		}
+		text = b.String()
+	}
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return strings.Trim(blankLinesRegexp.ReplaceAllString(strings.Join(lines, "\n"), "\n"), "\n")
+}
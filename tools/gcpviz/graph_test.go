@@ -0,0 +1,59 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestWriteDot(t *testing.T) {
+	g := &Graph{
+		Global:  map[string]string{"node": "shape=box", "edge": "color=gray", "graph": "rankdir=LR"},
+		Options: map[string]string{"splines": "ortho", "concentrate": "true", "nodesep": "0.5"},
+		Nodes:   []*GraphNode{{Id: 1, Attributes: `label="a"`}, {Id: 2, Attributes: `label="b"`}},
+		Edges:   []*GraphEdge{{From: 1, To: 2}},
+	}
+	var first bytes.Buffer
+	if err := g.WriteDot(&first); err != nil {
+		t.Fatal(err)
+	}
+	expected := "digraph GCP {\n  edge [color=gray];\n  graph [rankdir=LR];\n  node [shape=box];\n  concentrate=true;\n  nodesep=0.5;\n  splines=ortho;\n"
+	if !bytes.HasPrefix(first.Bytes(), []byte(expected)) {
+		t.Errorf("unexpected DOT output:\n%s", first.String())
+	}
+	for i := 0; i < 10; i++ {
+		var out bytes.Buffer
+		if err := g.WriteDot(&out); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != first.String() {
+			t.Fatalf("DOT output differs between runs:\n%s\n%s", first.String(), out.String())
+		}
+	}
+
+	if err := g.WriteDot(failingWriter{}); err == nil {
+		t.Error("expected the write error to be returned")
+	}
+}
@@ -0,0 +1,159 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+const htmlViewerHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+  html, body { margin: 0; height: 100%%; overflow: hidden; font-family: sans-serif; background: %s; }
+  #toolbar { position: fixed; top: 8px; right: 8px; z-index: 10; background: rgba(255,255,255,0.9); padding: 6px; border-radius: 4px; box-shadow: 0 1px 4px rgba(0,0,0,0.4); }
+  #toolbar input { width: 240px; }
+  #toolbar span { font-size: 12px; margin: 0 6px; }
+  #viewer { width: 100%%; height: 100%%; cursor: grab; }
+  #viewer svg { width: 100%%; height: 100%%; }
+  #viewer.searching g.node { opacity: 0.25; }
+  #viewer.searching g.node.match { opacity: 1; }
+  g.node.match > * { stroke: #ff0000 !important; stroke-width: 3px; }
+</style>
+</head>
+<body>
+<div id="toolbar">
+  <input id="search" type="search" placeholder="Search nodes (Enter for next match)">
+  <span id="matches"></span>
+  <button id="reset">Reset</button>
+</div>
+<div id="viewer">
+`
+
+const htmlViewerFooter = `</div>
+<script>
+(function () {
+  var viewer = document.getElementById("viewer");
+  var svg = viewer.querySelector("svg");
+  svg.removeAttribute("width");
+  svg.removeAttribute("height");
+  var vb = svg.viewBox.baseVal;
+  var initial = { x: vb.x, y: vb.y, width: vb.width, height: vb.height };
+
+  var toSvg = function (evt) {
+    var pt = svg.createSVGPoint();
+    pt.x = evt.clientX;
+    pt.y = evt.clientY;
+    return pt.matrixTransform(svg.getScreenCTM().inverse());
+  };
+
+  svg.addEventListener("wheel", function (evt) {
+    evt.preventDefault();
+    var p = toSvg(evt);
+    var factor = evt.deltaY > 0 ? 1.15 : 1 / 1.15;
+    vb.x = p.x - (p.x - vb.x) * factor;
+    vb.y = p.y - (p.y - vb.y) * factor;
+    vb.width *= factor;
+    vb.height *= factor;
+  }, { passive: false });
+
+  var dragging = null;
+  svg.addEventListener("mousedown", function (evt) {
+    dragging = toSvg(evt);
+    viewer.style.cursor = "grabbing";
+  });
+  window.addEventListener("mousemove", function (evt) {
+    if (!dragging) {
+      return;
+    }
+    var p = toSvg(evt);
+    vb.x -= p.x - dragging.x;
+    vb.y -= p.y - dragging.y;
+  });
+  window.addEventListener("mouseup", function () {
+    dragging = null;
+    viewer.style.cursor = "grab";
+  });
+
+  var reset = function () {
+    vb.x = initial.x;
+    vb.y = initial.y;
+    vb.width = initial.width;
+    vb.height = initial.height;
+  };
+  document.getElementById("reset").addEventListener("click", reset);
+
+  var nodes = Array.prototype.slice.call(svg.querySelectorAll("g.node"));
+  var matches = [];
+  var current = -1;
+  var focus = function (node) {
+    var box = node.getBBox();
+    var width = Math.max(box.width * 4, initial.width / 10);
+    var height = width * (vb.height / vb.width);
+    vb.x = box.x + box.width / 2 - width / 2;
+    vb.y = box.y + box.height / 2 - height / 2;
+    vb.width = width;
+    vb.height = height;
+  };
+  var search = document.getElementById("search");
+  search.addEventListener("input", function () {
+    var term = search.value.trim().toLowerCase();
+    matches = [];
+    current = -1;
+    nodes.forEach(function (node) {
+      var text = (node.getAttribute("data-name") + " " + node.getAttribute("data-type") + " " + node.textContent).toLowerCase();
+      var match = term !== "" && text.indexOf(term) > -1;
+      node.classList.toggle("match", match);
+      if (match) {
+        matches.push(node);
+      }
+    });
+    viewer.classList.toggle("searching", term !== "");
+    document.getElementById("matches").textContent = term !== "" ? matches.length + " matches" : "";
+  });
+  search.addEventListener("keydown", function (evt) {
+    if (evt.key === "Enter" && matches.length > 0) {
+      current = (current + 1) % matches.length;
+      focus(matches[current]);
+    }
+  });
+})();
+</script>
+</body>
+</html>
+`
+
+// WriteHtml writes a self-contained HTML page that embeds the SVG rendering
+// of the graph, with pan, zoom and search support.
+func (g *Graph) WriteHtml(out io.Writer) error {
+	w := bufio.NewWriter(out)
+
+	title := g.Title()
+	if title == "" {
+		title = "gcpviz"
+	}
+	background := svgStyle{attrs: ParseDotAttributes(g.Global["graph"])}.get("bgcolor", "white")
+	fmt.Fprintf(w, htmlViewerHeader, svgEscape(title), svgEscape(background))
+	g.writeSvg(w, false)
+	fmt.Fprint(w, htmlViewerFooter)
+	// The buffered writer keeps the first write error, Flush returns it
+	return w.Flush()
+}
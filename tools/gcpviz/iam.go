@@ -0,0 +1,200 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/cayleygraph/cayley"
+	cquad "github.com/cayleygraph/quad"
+)
+
+// Asset types of the principals synthesized from IAM policy bindings. Service accounts
+// that are part of the inventory are linked directly, service accounts from outside the
+// inventory (ie. Google-managed service agents) are ExternalServiceAccount principals.
+const (
+	PrincipalUser                   = "iam.googleapis.com/User"
+	PrincipalGroup                  = "iam.googleapis.com/Group"
+	PrincipalDomain                 = "iam.googleapis.com/Domain"
+	PrincipalExternalServiceAccount = "iam.googleapis.com/ExternalServiceAccount"
+	PrincipalOther                  = "iam.googleapis.com/Principal"
+)
+
+const principalPrefix = "//iam.googleapis.com/principals/"
+
+// RolePredicatePrefix is the prefix of the predicates linking principals to the resources
+// they have a role on (ie. hasRole:roles/storage.admin).
+const RolePredicatePrefix = "hasRole:"
+
+type iamPolicyAsset struct {
+	Name      string `json:"name"`
+	AssetType string `json:"asset_type"`
+	IamPolicy struct {
+		Bindings []struct {
+			Role    string   `json:"role"`
+			Members []string `json:"members"`
+		} `json:"bindings"`
+	} `json:"iam_policy"`
+}
+
+func RolePredicate(role string) string {
+	return RolePredicatePrefix + role
+}
+
+func IsRolePredicate(predicate string) bool {
+	return strings.HasPrefix(predicate, RolePredicatePrefix)
+}
+
+// isIamPolicyAsset returns true for assets from IAM_POLICY content type exports.
+func isIamPolicyAsset(resource interface{}) bool {
+	asset, ok := resource.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, hasPolicy := asset["iam_policy"]
+	_, hasResource := asset["resource"]
+	return hasPolicy && !hasResource
+}
+
+func (v *GcpViz) addRolePredicate(predicate string) {
+	if v.rolePredicates == nil {
+		v.rolePredicates = make(map[string]bool, 0)
+	}
+	v.rolePredicates[predicate] = true
+}
+
+// RolePredicates returns the role predicates in the graph.
+func (v *GcpViz) RolePredicates() []string {
+	predicates := make([]string, 0, len(v.rolePredicates))
+	for p := range v.rolePredicates {
+		predicates = append(predicates, p)
+	}
+	sort.Strings(predicates)
+	return predicates
+}
+
+// AddIamPolicy stores an asset from an IAM policy export, the principals are linked once
+// all resources have been read (see linkIamPolicies).
+func (v *GcpViz) AddIamPolicy(tx *bolt.Tx, name string, resource interface{}) error {
+	jsn, err := json.Marshal(resource)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("IamPolicies")).Put([]byte(name), jsn)
+}
+
+// principal returns the vertex and asset type for an IAM policy member, and the asset
+// to create for it (nil if the member is an asset in the inventory).
+func (v *GcpViz) principal(tx *bolt.Tx, member string) (string, string, map[string]interface{}) {
+	memberType, id := member, ""
+	if idx := strings.Index(member, ":"); idx > -1 && !strings.HasPrefix(member, "principal") {
+		memberType, id = member[:idx], member[idx+1:]
+	}
+
+	var assetType string
+	switch memberType {
+	case "user":
+		assetType = PrincipalUser
+	case "group":
+		assetType = PrincipalGroup
+	case "domain":
+		assetType = PrincipalDomain
+	case "serviceAccount":
+		if target := tx.Bucket([]byte("Aliases")).Get([]byte(id)); target != nil {
+			return string(target), "iam.googleapis.com/ServiceAccount", nil
+		}
+		assetType = PrincipalExternalServiceAccount
+	default:
+		assetType = PrincipalOther
+		id = member
+	}
+
+	name := principalPrefix + member
+	asset := map[string]interface{}{
+		"name":       name,
+		"asset_type": assetType,
+		"ancestors":  []string{},
+		"resource": map[string]interface{}{
+			"data": map[string]interface{}{
+				"member": member,
+				"type":   memberType,
+				"id":     id,
+			},
+		},
+	}
+	return name, assetType, asset
+}
+
+// linkIamPolicies creates the principals of the stored IAM policies and links them to the
+// resources with hasRole:<role> edges.
+func (v *GcpViz) linkIamPolicies() error {
+	return v.AssetDatabase.Update(func(tx *bolt.Tx) error {
+		policies := tx.Bucket([]byte("IamPolicies"))
+		if policies == nil {
+			return nil
+		}
+		principals := make(map[string]bool, 0)
+		return policies.ForEach(func(k, bv []byte) error {
+			var policy iamPolicyAsset
+			if err := json.Unmarshal(bv, &policy); err != nil {
+				return fmt.Errorf("error parsing IAM policy of %s: %v", string(k), err)
+			}
+			if tx.Bucket([]byte("Assets")).Get(k) == nil {
+				fmt.Fprintf(os.Stderr, "Warning: IAM policy for resource %s that is not in the inventory.\n", string(k))
+			}
+			for _, binding := range policy.IamPolicy.Bindings {
+				predicate := RolePredicate(binding.Role)
+				for _, member := range binding.Members {
+					name, assetType, asset := v.principal(tx, member)
+					if asset != nil && !principals[name] {
+						jsn, err := json.Marshal(asset)
+						if err != nil {
+							return err
+						}
+						if err := tx.Bucket([]byte("Assets")).Put([]byte(name), jsn); err != nil {
+							return err
+						}
+						principals[name] = true
+						v.TotalVertexes++
+					}
+					v.QW.AddQuad(cayley.Quad(name, predicate, string(k), assetType))
+					v.addRolePredicate(predicate)
+					v.TotalEdges++
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// principalRoles returns the roles a principal has on a resource.
+func (v *GcpViz) principalRoles(principal string, resource string) []string {
+	roles := make([]string, 0)
+	for _, q := range v.quadsOf(cquad.Subject, principal, "") {
+		predicate := fmt.Sprint(cquad.NativeOf(q.Predicate))
+		if IsRolePredicate(predicate) && fmt.Sprint(cquad.NativeOf(q.Object)) == resource {
+			roles = append(roles, strings.TrimPrefix(predicate, RolePredicatePrefix))
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
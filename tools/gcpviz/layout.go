@@ -0,0 +1,411 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	layoutNodePadding   = 10.0
+	layoutNodeSpacing   = 30.0
+	layoutRankSpacing   = 70.0
+	layoutRowSpacing    = 30.0
+	layoutMargin        = 40.0
+	layoutMaxRowNodes   = 40
+	layoutOrderingSweep = 8
+	layoutClusterMargin = 15.0
+	layoutClusterLabel  = 18.0
+)
+
+type LayoutNode struct {
+	Node     *GraphNode
+	Lines    []string
+	FontSize float64
+	X        float64
+	Y        float64
+	Width    float64
+	Height   float64
+	rank     int
+	order    float64
+}
+
+type LayoutEdge struct {
+	Edge *GraphEdge
+	From *LayoutNode
+	To   *LayoutNode
+}
+
+// LayoutCluster is the box around the nodes of a cluster, X and Y are its top left corner.
+type LayoutCluster struct {
+	Cluster *GraphCluster
+	X       float64
+	Y       float64
+	Width   float64
+	Height  float64
+}
+
+// Layout is a positioned graph, where X and Y are the centers of the nodes.
+type Layout struct {
+	Nodes    []*LayoutNode
+	Edges    []*LayoutEdge
+	Clusters []*LayoutCluster
+	Width    float64
+	Height   float64
+	Top      float64
+}
+
+func layoutFontSize(attrs map[string]string, defaults map[string]string) float64 {
+	for _, a := range []map[string]string{attrs, defaults} {
+		if fs, ok := a["fontsize"]; ok {
+			if f, err := strconv.ParseFloat(DotString(fs), 64); err == nil && f > 0 {
+				return f
+			}
+		}
+	}
+	return 14.0
+}
+
+// LayoutGraph positions the nodes of the graph in layers (a simplified Sugiyama
+// layout): edges point from the resource using another resource to the used
+// resource, so the used resources (organizations, networks) end up on top.
+func LayoutGraph(g *Graph, topMargin float64) *Layout {
+	nodeDefaults := ParseDotAttributes(g.Global["node"])
+	layout := &Layout{Nodes: make([]*LayoutNode, 0, len(g.Nodes)), Top: topMargin}
+	byId := make(map[int64]*LayoutNode, len(g.Nodes))
+	for _, node := range g.Nodes {
+		if _, found := byId[node.Id]; found {
+			continue
+		}
+		attrs := ParseDotAttributes(node.Attributes)
+		ln := &LayoutNode{Node: node, FontSize: layoutFontSize(attrs, nodeDefaults)}
+		ln.Lines = strings.Split(node.DisplayLabel(), "\n")
+		maxLen := 0
+		for _, line := range ln.Lines {
+			if l := utf8.RuneCountInString(line); l > maxLen {
+				maxLen = l
+			}
+		}
+		ln.Width = float64(maxLen)*ln.FontSize*0.6 + 2*layoutNodePadding
+		ln.Height = float64(len(ln.Lines))*ln.FontSize*1.2 + 2*layoutNodePadding
+		if ln.Width < 3*ln.FontSize {
+			ln.Width = 3 * ln.FontSize
+		}
+		byId[node.Id] = ln
+		layout.Nodes = append(layout.Nodes, ln)
+	}
+
+	// Edges pointing to nodes that were not rendered are dropped, like Graphviz would
+	// create an empty node for them
+	outgoing := make(map[*LayoutNode][]*LayoutNode, len(layout.Nodes))
+	incoming := make(map[*LayoutNode][]*LayoutNode, len(layout.Nodes))
+	for _, edge := range g.Edges {
+		from, fromFound := byId[edge.From]
+		to, toFound := byId[edge.To]
+		if !fromFound || !toFound {
+			continue
+		}
+		layout.Edges = append(layout.Edges, &LayoutEdge{Edge: edge, From: from, To: to})
+		if from != to {
+			outgoing[from] = append(outgoing[from], to)
+			incoming[to] = append(incoming[to], from)
+		}
+	}
+
+	// Break cycles by ignoring back edges found during a depth-first search
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*LayoutNode]int, len(layout.Nodes))
+	acyclic := make(map[*LayoutNode][]*LayoutNode, len(layout.Nodes))
+	var visit func(n *LayoutNode)
+	visit = func(n *LayoutNode) {
+		state[n] = visiting
+		for _, t := range outgoing[n] {
+			if state[t] == visiting {
+				continue
+			}
+			acyclic[n] = append(acyclic[n], t)
+			if state[t] == unvisited {
+				visit(t)
+			}
+		}
+		state[n] = visited
+	}
+	for _, n := range layout.Nodes {
+		if state[n] == unvisited {
+			visit(n)
+		}
+	}
+
+	// Longest path layering, counted from the sinks of the graph
+	rankOf := make(map[*LayoutNode]int, len(layout.Nodes))
+	var rankNode func(n *LayoutNode) int
+	rankNode = func(n *LayoutNode) int {
+		if r, found := rankOf[n]; found {
+			return r
+		}
+		r := 0
+		for _, t := range acyclic[n] {
+			if tr := rankNode(t) + 1; tr > r {
+				r = tr
+			}
+		}
+		rankOf[n] = r
+		return r
+	}
+	maxRank := 0
+	for _, n := range layout.Nodes {
+		n.rank = rankNode(n)
+		if n.rank > maxRank {
+			maxRank = n.rank
+		}
+	}
+
+	ranks := make([][]*LayoutNode, maxRank+1)
+	for _, n := range layout.Nodes {
+		n.order = float64(len(ranks[n.rank]))
+		ranks[n.rank] = append(ranks[n.rank], n)
+	}
+
+	// Reduce crossings with the barycenter heuristic, sweeping down and up
+	barycenter := func(n *LayoutNode, neighbours []*LayoutNode) (float64, bool) {
+		if len(neighbours) == 0 {
+			return 0, false
+		}
+		sum := 0.0
+		for _, nb := range neighbours {
+			sum += nb.order
+		}
+		return sum / float64(len(neighbours)), true
+	}
+	reorder := func(rank []*LayoutNode, neighboursOf func(n *LayoutNode) []*LayoutNode) {
+		weights := make(map[*LayoutNode]float64, len(rank))
+		for _, n := range rank {
+			if b, ok := barycenter(n, neighboursOf(n)); ok {
+				weights[n] = b
+			} else {
+				weights[n] = n.order
+			}
+		}
+		sort.SliceStable(rank, func(i, j int) bool { return weights[rank[i]] < weights[rank[j]] })
+		for i, n := range rank {
+			n.order = float64(i)
+		}
+	}
+	for sweep := 0; sweep < layoutOrderingSweep; sweep++ {
+		if sweep%2 == 0 {
+			for r := 1; r <= maxRank; r++ {
+				reorder(ranks[r], func(n *LayoutNode) []*LayoutNode { return outgoing[n] })
+			}
+		} else {
+			for r := maxRank - 1; r >= 0; r-- {
+				reorder(ranks[r], func(n *LayoutNode) []*LayoutNode { return incoming[n] })
+			}
+		}
+	}
+
+	if len(g.Clusters) > 0 {
+		layout.positionClusters(g, ranks, byId)
+		return layout
+	}
+
+	// Assign coordinates, wrapping very wide ranks into multiple rows
+	rows := make([][]*LayoutNode, 0, len(ranks))
+	rowGaps := make([]float64, 0, len(ranks))
+	for r := 0; r <= maxRank; r++ {
+		for start := 0; start < len(ranks[r]); start += layoutMaxRowNodes {
+			end := start + layoutMaxRowNodes
+			if end > len(ranks[r]) {
+				end = len(ranks[r])
+			}
+			if start == 0 {
+				rowGaps = append(rowGaps, layoutRankSpacing)
+			} else {
+				rowGaps = append(rowGaps, layoutRowSpacing)
+			}
+			rows = append(rows, ranks[r][start:end])
+		}
+	}
+
+	rowWidths := make([]float64, len(rows))
+	maxWidth := 0.0
+	for i, row := range rows {
+		w := 0.0
+		for j, n := range row {
+			if j > 0 {
+				w += layoutNodeSpacing
+			}
+			w += n.Width
+		}
+		rowWidths[i] = w
+		if w > maxWidth {
+			maxWidth = w
+		}
+	}
+
+	y := topMargin + layoutMargin
+	for i, row := range rows {
+		if i > 0 {
+			y += rowGaps[i]
+		}
+		rowHeight := 0.0
+		for _, n := range row {
+			if n.Height > rowHeight {
+				rowHeight = n.Height
+			}
+		}
+		x := layoutMargin + (maxWidth-rowWidths[i])/2
+		for _, n := range row {
+			n.X = x + n.Width/2
+			n.Y = y + rowHeight/2
+			x += n.Width + layoutNodeSpacing
+		}
+		y += rowHeight
+	}
+
+	layout.Width = maxWidth + 2*layoutMargin
+	layout.Height = y + layoutMargin
+	return layout
+}
+
+// positionClusters assigns coordinates keeping the nodes of each cluster in a column of
+// their own, so the cluster boxes don't overlap. The columns are ordered by the position
+// of their nodes after the crossing reduction.
+func (layout *Layout) positionClusters(g *Graph, ranks [][]*LayoutNode, byId map[int64]*LayoutNode) {
+	unclustered := len(g.Clusters)
+	columnOf := make(map[*LayoutNode]int, len(layout.Nodes))
+	for _, n := range layout.Nodes {
+		columnOf[n] = unclustered
+	}
+	for i, cluster := range g.Clusters {
+		for _, id := range cluster.Nodes {
+			if n, found := byId[id]; found {
+				columnOf[n] = i
+			}
+		}
+	}
+
+	weights := make([]float64, unclustered+1)
+	counts := make([]int, unclustered+1)
+	for _, rank := range ranks {
+		for _, n := range rank {
+			weights[columnOf[n]] += (n.order + 0.5) / float64(len(rank))
+			counts[columnOf[n]]++
+		}
+	}
+	columns := make([]int, 0, len(weights))
+	for c := range weights {
+		if counts[c] > 0 {
+			weights[c] /= float64(counts[c])
+			columns = append(columns, c)
+		}
+	}
+	sort.SliceStable(columns, func(i, j int) bool { return weights[columns[i]] < weights[columns[j]] })
+	position := make(map[int]int, len(columns))
+	for i, c := range columns {
+		position[c] = i
+	}
+
+	// A column is as wide as its widest rank
+	columnWidths := make([]float64, unclustered+1)
+	rankWidths := make([]map[int]float64, len(ranks))
+	for r, rank := range ranks {
+		sort.SliceStable(rank, func(i, j int) bool {
+			if position[columnOf[rank[i]]] != position[columnOf[rank[j]]] {
+				return position[columnOf[rank[i]]] < position[columnOf[rank[j]]]
+			}
+			return rank[i].order < rank[j].order
+		})
+		rankWidths[r] = make(map[int]float64, 0)
+		for _, n := range rank {
+			c := columnOf[n]
+			if rankWidths[r][c] > 0 {
+				rankWidths[r][c] += layoutNodeSpacing
+			}
+			rankWidths[r][c] += n.Width
+			if rankWidths[r][c] > columnWidths[c] {
+				columnWidths[c] = rankWidths[r][c]
+			}
+		}
+	}
+	columnX := make([]float64, unclustered+1)
+	x := layoutMargin
+	for _, c := range columns {
+		if c != unclustered {
+			columnWidths[c] += 2 * layoutClusterMargin
+		}
+		columnX[c] = x
+		x += columnWidths[c] + layoutNodeSpacing
+	}
+	layout.Width = x - layoutNodeSpacing + layoutMargin
+
+	y := layout.Top + layoutMargin + layoutClusterMargin + layoutClusterLabel
+	for r, rank := range ranks {
+		if r > 0 {
+			y += layoutRankSpacing
+		}
+		rowHeight := 0.0
+		for _, n := range rank {
+			if n.Height > rowHeight {
+				rowHeight = n.Height
+			}
+		}
+		offsets := make(map[int]float64, 0)
+		for _, n := range rank {
+			c := columnOf[n]
+			if _, found := offsets[c]; !found {
+				offsets[c] = columnX[c] + (columnWidths[c]-rankWidths[r][c])/2
+			}
+			n.X = offsets[c] + n.Width/2
+			n.Y = y + rowHeight/2
+			offsets[c] += n.Width + layoutNodeSpacing
+		}
+		y += rowHeight
+	}
+	layout.Height = y + layoutClusterMargin + layoutMargin
+
+	for i, cluster := range g.Clusters {
+		if counts[i] == 0 {
+			continue
+		}
+		top, bottom := layout.Height, 0.0
+		for _, n := range layout.Nodes {
+			if columnOf[n] == i {
+				if n.Y-n.Height/2 < top {
+					top = n.Y - n.Height/2
+				}
+				if n.Y+n.Height/2 > bottom {
+					bottom = n.Y + n.Height/2
+				}
+			}
+		}
+		top -= layoutClusterMargin + layoutClusterLabel
+		layout.Clusters = append(layout.Clusters, &LayoutCluster{
+			Cluster: cluster,
+			X:       columnX[i],
+			Y:       top,
+			Width:   columnWidths[i],
+			Height:  bottom + layoutClusterMargin - top,
+		})
+	}
+}
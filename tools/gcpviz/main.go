@@ -26,7 +26,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"reflect"
@@ -46,7 +45,6 @@ import (
 	"github.com/forseti-security/config-validator/pkg/api/validator"
 	cvasset "github.com/forseti-security/config-validator/pkg/asset"
 	"github.com/golang/protobuf/jsonpb"
-	"github.com/yalp/jsonpath"
 	"gopkg.in/yaml.v3"
 
 	"text/template"
@@ -54,6 +52,7 @@ import (
 	"github.com/boltdb/bolt"
 	_ "github.com/cayleygraph/cayley/graph/kv/bolt"
 	"github.com/mitchellh/go-wordwrap"
+	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 	"github.com/willf/bloom"
 )
@@ -69,12 +68,21 @@ type GcpViz struct {
 	transaction   *bolt.Tx
 	bfilter       *bloom.BloomFilter
 
+	rolePredicates map[string]bool
+	// Extra attributes for nodes, ie. audit violations
+	highlights map[string]string
+	// Replaces sensitive values in rendered graphs and exports, if enabled
+	redactor *Redactor
+	// Entries of the relations file that failed, errors are only reported once per entry
+	relationFailures map[string]int
+
 	OrgRoots []string
 
-	TotalVertexes int64
-	TotalEdges    int64
-	TotalAliases  int64
-	TotalIps      int64
+	TotalVertexes   int64
+	TotalEdges      int64
+	TotalAliases    int64
+	TotalIps        int64
+	DuplicateAssets int64
 }
 
 type TemplateResourceResource struct {
@@ -90,13 +98,14 @@ type TemplateResource struct {
 	AssetType string                   `json:"asset_type"`
 	Resource  TemplateResourceResource `json:"resource"`
 	Ancestors []string                 `json:"ancestors"`
+	Cost      *ResourceCost            `json:"cost,omitempty"`
 }
 
 type ResourceRelations struct {
-	AssetTypes  map[string][]jsonpath.FilterFunc
-	Aliases     map[string][]jsonpath.FilterFunc
-	Enrich      map[string]map[string]map[string]jsonpath.FilterFunc
-	IpAddresses map[string][]jsonpath.FilterFunc
+	AssetTypes  map[string][]RelationFunc
+	Aliases     map[string][]RelationFunc
+	Enrich      map[string]map[string]map[string]RelationFunc
+	IpAddresses map[string][]RelationFunc
 }
 
 type RawResourceRelations struct {
@@ -107,10 +116,12 @@ type RawResourceRelations struct {
 }
 
 type GraphStyle struct {
-	Global  map[string]string            `yaml:"global" json:"global"`
-	Options map[string]string            `yaml:"options" json:"options"`
-	Edges   map[string]map[string]string `yaml:"edges" json:"edges"`
-	Nodes   map[string]string            `yaml:"nodes" json:"nodes"`
+	Global   map[string]string            `yaml:"global" json:"global"`
+	Options  map[string]string            `yaml:"options" json:"options"`
+	Clusters ClusterStyle                 `yaml:"clusters" json:"clusters"`
+	Costs    CostStyle                    `yaml:"costs" json:"costs"`
+	Edges    map[string]map[string]string `yaml:"edges" json:"edges"`
+	Nodes    map[string]string            `yaml:"nodes" json:"nodes"`
 }
 
 type NodeStyle struct {
@@ -119,6 +130,7 @@ type NodeStyle struct {
 	TailLabel string `json:"tailLabel"`
 	Link      string `json:"link"`
 	Resource  *TemplateResourceResource
+	Cost      *ResourceCost
 }
 
 type IpAddressLink struct {
@@ -146,6 +158,8 @@ var templateFuncMap = template.FuncMap{
 	"DaysLeft":       DaysLeft,
 	"NotLast":        NotLast,
 	"Replace":        Replace,
+	"Cost":           Cost,
+	"CostBucket":     CostBucket,
 }
 
 func NotLast(x int, a interface{}) bool {
@@ -245,11 +259,20 @@ func (v *GcpViz) Create(dbFile string) error {
 }
 
 func (v *GcpViz) Load(dbFile string) error {
+	return v.load(dbFile, true)
+}
+
+// LoadForUpdate loads an existing database so that it can be modified and saved again.
+func (v *GcpViz) LoadForUpdate(dbFile string) error {
+	return v.load(dbFile, false)
+}
+
+func (v *GcpViz) load(dbFile string, readOnly bool) error {
 	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
 		return err
 	}
 
-	db, err := bolt.Open(dbFile, 0600, &bolt.Options{ReadOnly: true})
+	db, err := bolt.Open(dbFile, 0600, &bolt.Options{ReadOnly: readOnly})
 	if err != nil {
 		return err
 	}
@@ -305,6 +328,9 @@ func (v *GcpViz) Load(dbFile string) error {
 		if err != nil {
 			break
 		}
+		if predicate := fmt.Sprint(cquad.NativeOf(q.Predicate)); IsRolePredicate(predicate) {
+			v.addRolePredicate(predicate)
+		}
 	}
 	if err != io.EOF {
 		return err
@@ -406,53 +432,62 @@ func (v *GcpViz) getAsset(node string) (*TemplateResource, error) {
 	return &templateResource, nil
 }
 
-func (v *GcpViz) renderNode(out io.Writer, node string, id int64) (bool, error) {
+func (v *GcpViz) renderNode(node string, id int64) (*GraphNode, error) {
 	templateResource, err := v.getAsset(node)
 	if err != nil {
-		return false, errors.Wrapf(err, fmt.Sprintf("resource %s not found", node))
+		return nil, errors.Wrapf(err, fmt.Sprintf("resource %s not found", node))
 	}
 
 	if _, found := Labels[templateResource.AssetType]; !found {
-		return false, fmt.Errorf("label template not found for resource type %s", templateResource.AssetType)
+		return nil, fmt.Errorf("label template not found for resource type %s", templateResource.AssetType)
 	}
 	if Labels[templateResource.AssetType] != nil {
+		rendered := v.redactor.RedactResource(templateResource)
 		var label bytes.Buffer
-		Labels[templateResource.AssetType].Execute(&label, templateResource)
+		Labels[templateResource.AssetType].Execute(&label, rendered)
 
 		var link string = ""
 		if _, found := Links[templateResource.AssetType]; found {
 			var linkBuf bytes.Buffer
-			Links[templateResource.AssetType].Execute(&linkBuf, templateResource)
+			Links[templateResource.AssetType].Execute(&linkBuf, rendered)
 			link = linkBuf.String()
 		}
 
 		if _, found := Nodes[templateResource.AssetType]; !found {
-			return false, fmt.Errorf("node style template not found for resource type %s", templateResource.AssetType)
+			return nil, fmt.Errorf("node style template not found for resource type %s", templateResource.AssetType)
 		}
 
 		var nodeOut bytes.Buffer
-		nodeStyle := NodeStyle{Resource: &templateResource.Resource, Label: v.EscapeLabel(strings.Trim(label.String(), "\n")), Link: v.EscapeLabel(strings.Trim(link, "\n"))}
+		nodeStyle := NodeStyle{Resource: &rendered.Resource, Cost: templateResource.Cost, Label: v.EscapeLabel(strings.Trim(label.String(), "\n")), Link: v.EscapeLabel(strings.Trim(link, "\n"))}
 		err = Nodes[templateResource.AssetType].Execute(&nodeOut, nodeStyle)
 		if err != nil {
-			return false, errors.Wrapf(err, fmt.Sprintf("error rending resource %s node", node))
+			return nil, errors.Wrapf(err, fmt.Sprintf("error rending resource %s node", node))
 		}
 
 		if strings.TrimSpace(nodeOut.String()) != "" {
-			fmt.Fprintf(out, "  N_%d [%s];\n", id, strings.Trim(nodeOut.String(), "\n"))
-			return true, nil
-		}
-	}
-	return false, nil
+			return &GraphNode{
+				Id:         id,
+				Name:       node,
+				AssetType:  templateResource.AssetType,
+				Label:      strings.Trim(label.String(), "\n"),
+				Link:       strings.Trim(link, "\n"),
+				Attributes: strings.Trim(nodeOut.String(), "\n") + costAttributes(templateResource.Cost) + v.highlights[node],
+				Resource:   templateResource,
+			}, nil
+		}
+	}
+	return nil, nil
 }
 
-func (v *GcpViz) renderBothNodes(parent string, node string, parentId int64, id int64, out io.Writer) error {
+func (v *GcpViz) renderBothNodes(parent string, node string, parentId int64, id int64, g *Graph) error {
 	if parentId != -1 {
 		pRaw := make([]byte, 8)
 		binary.BigEndian.PutUint64(pRaw, uint64(parentId))
 		if !v.bfilter.Test(pRaw) {
-			rendered, err := v.renderNode(out, parent, parentId)
+			rendered, err := v.renderNode(parent, parentId)
 			if err == nil {
-				if rendered {
+				if rendered != nil {
+					g.Nodes = append(g.Nodes, rendered)
 					v.bfilter.Add(pRaw)
 				}
 			} else {
@@ -464,9 +499,10 @@ func (v *GcpViz) renderBothNodes(parent string, node string, parentId int64, id
 	nRaw := make([]byte, 8)
 	binary.BigEndian.PutUint64(nRaw, uint64(id))
 	if !v.bfilter.Test(nRaw) {
-		rendered, err := v.renderNode(out, node, id)
+		rendered, err := v.renderNode(node, id)
 		if err == nil {
-			if rendered {
+			if rendered != nil {
+				g.Nodes = append(g.Nodes, rendered)
 				v.bfilter.Add(nRaw)
 			}
 		} else {
@@ -476,20 +512,29 @@ func (v *GcpViz) renderBothNodes(parent string, node string, parentId int64, id
 	return nil
 }
 
-func (v *GcpViz) renderEdge(parent string, node string, parentId int64, id int64, out io.Writer) error {
-	templateResourceParent, err := v.getAsset(parent)
+func (v *GcpViz) renderEdge(parent string, node string, parentId int64, id int64) (*GraphEdge, error) {
+	return v.renderLabeledEdge(parent, node, parentId, id, "")
+}
+
+// renderLabeledEdge renders an edge, the label is available to the edge style template
+// as .Label (ie. the roles of a principal on a resource). Edge styles can be set for all
+// target asset types with the "*" key.
+func (v *GcpViz) renderLabeledEdge(parent string, node string, parentId int64, id int64, label string) (*GraphEdge, error) {
+	templateResourceParent, err := v.getRenderedAsset(parent)
 	if err != nil {
-		return errors.Wrapf(err, fmt.Sprintf("parent resource %s not found", parent))
+		return nil, errors.Wrapf(err, fmt.Sprintf("parent resource %s not found", parent))
 	}
-	templateResourceTarget, err := v.getAsset(node)
+	templateResourceTarget, err := v.getRenderedAsset(node)
 	if err != nil {
-		return errors.Wrapf(err, fmt.Sprintf("target resource %s not found", node))
+		return nil, errors.Wrapf(err, fmt.Sprintf("target resource %s not found", node))
 	}
 
 	var edgeStyle *template.Template = nil
 	if parentStyle, found := Edges[templateResourceParent.AssetType]; found {
 		if targetStyle, found := parentStyle[templateResourceTarget.AssetType]; found {
 			edgeStyle = targetStyle
+		} else if targetStyle, found := parentStyle["*"]; found {
+			edgeStyle = targetStyle
 		} else {
 			fmt.Fprintf(os.Stderr, "Missing style %s -> %s (from %s TO %s)\n", templateResourceParent.AssetType, templateResourceTarget.AssetType, parent, node)
 		}
@@ -497,69 +542,87 @@ func (v *GcpViz) renderEdge(parent string, node string, parentId int64, id int64
 		fmt.Fprintf(os.Stderr, "Missing style %s -> %s (FROM %s to %s)\n", templateResourceParent.AssetType, templateResourceTarget.AssetType, parent, node)
 	}
 
-	if edgeStyle != nil {
-		var headLabel bytes.Buffer
-		if _, found := HeadLabels[templateResourceParent.AssetType]; found {
-			HeadLabels[templateResourceParent.AssetType].Execute(&headLabel, templateResourceParent)
-		}
-		var tailLabel bytes.Buffer
-		if _, found := TailLabels[templateResourceParent.AssetType]; found {
-			TailLabels[templateResourceParent.AssetType].Execute(&tailLabel, templateResourceParent)
-		}
-
-		var edgeOut bytes.Buffer
-		nodeStyle := NodeStyle{TailLabel: v.EscapeLabel(strings.Trim(tailLabel.String(), "\n")), HeadLabel: v.EscapeLabel(strings.Trim(headLabel.String(), "\n"))}
-		edgeStyle.Execute(&edgeOut, nodeStyle)
+	if edgeStyle == nil {
+		return nil, nil
+	}
 
-		edge := strings.Trim(edgeOut.String(), "\n")
-		if edge != "" {
-			fmt.Fprintf(out, "  N_%d -> N_%d [%s];\n", parentId, id, edge)
-		} else {
-			fmt.Fprintf(out, "  N_%d -> N_%d;\n", parentId, id)
-		}
+	var headLabel bytes.Buffer
+	if _, found := HeadLabels[templateResourceParent.AssetType]; found {
+		HeadLabels[templateResourceParent.AssetType].Execute(&headLabel, templateResourceParent)
 	}
-	return nil
+	var tailLabel bytes.Buffer
+	if _, found := TailLabels[templateResourceParent.AssetType]; found {
+		TailLabels[templateResourceParent.AssetType].Execute(&tailLabel, templateResourceParent)
+	}
+
+	var edgeOut bytes.Buffer
+	nodeStyle := NodeStyle{Label: v.EscapeLabel(label), TailLabel: v.EscapeLabel(strings.Trim(tailLabel.String(), "\n")), HeadLabel: v.EscapeLabel(strings.Trim(headLabel.String(), "\n"))}
+	edgeStyle.Execute(&edgeOut, nodeStyle)
+
+	return &GraphEdge{From: parentId, To: id, Attributes: strings.Trim(edgeOut.String(), "\n")}, nil
 }
 
+// GenerateNodes runs the Gizmo query and writes the resulting graph in DOT format.
 func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQuery string, parameters map[string]interface{}, out io.Writer) error {
 	defer wg.Done()
 
-	stats, err := v.QS.Stats(ctx, true)
+	g, err := v.GenerateGraph(ctx, gizmoQuery, parameters)
 	if err != nil {
 		return err
 	}
-	v.bfilter = bloom.New(uint(20*stats.Quads.Size), 5)
+	return g.WriteDot(out)
+}
 
-	fmt.Fprintf(out, "digraph GCP {\n")
+// newGraph creates an empty graph with the global styles and options applied.
+func (v *GcpViz) newGraph(parameters map[string]interface{}) (*Graph, error) {
+	g := &Graph{
+		Global:  make(map[string]string, len(Style.Global)),
+		Options: make(map[string]string, len(Style.Options)),
+		Nodes:   make([]*GraphNode, 0),
+		Edges:   make([]*GraphEdge, 0),
+	}
 	for k, v := range Style.Global {
 		var style bytes.Buffer
 		styleTemplate, err := template.New("style").Parse(v)
 		if err != nil {
-			return fmt.Errorf("error parsing style template: %v", err)
+			return nil, fmt.Errorf("error parsing style template: %v", err)
 		}
 		styleTemplate.Execute(&style, parameters)
 
-		fmt.Fprintf(out, "  %s [%s];\n", k, style.String())
+		g.Global[k] = style.String()
 	}
 	for k, v := range Style.Options {
-		fmt.Fprintf(out, "  %s=%s;\n", k, v)
+		g.Options[k] = v
 	}
+	return g, nil
+}
 
-	queryTemplate, err := template.New("query").Parse(gizmoQuery)
+// GenerateGraph runs the Gizmo query and builds the styled nodes and edges of the graph
+// without serializing it, so it can be rendered in any of the supported output formats.
+func (v *GcpViz) GenerateGraph(ctx context.Context, gizmoQuery string, parameters map[string]interface{}) (*Graph, error) {
+	stats, err := v.QS.Stats(ctx, true)
 	if err != nil {
-		return fmt.Errorf("error parsing query template: %v", err)
+		return nil, err
+	}
+	v.bfilter = bloom.New(uint(20*stats.Quads.Size), 5)
+
+	g, err := v.newGraph(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	gizmoQ, err := v.queryFromTemplate(gizmoQuery, parameters)
+	if err != nil {
+		return nil, err
 	}
-	var gizmoQ bytes.Buffer
-	parameters["Organizations"] = v.OrgRoots
-	queryTemplate.Execute(&gizmoQ, parameters)
 
 	session := gizmo.NewSession(v.QS)
-	it, err := session.Execute(ctx, gizmoQ.String(), query.Options{
+	it, err := session.Execute(ctx, gizmoQ, query.Options{
 		Collation: query.Raw,
 		Limit:     -1,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer it.Close()
 	for it.Next(ctx) {
@@ -567,9 +630,9 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 		switch result.(type) {
 		case (*gizmo.Result):
 		case string:
-			log.Fatalf("Invalid result from query, expected nodes, got string: %v", result.(string))
+			return nil, fmt.Errorf("invalid result from query, expected nodes, got string: %v", result.(string))
 		default:
-			log.Fatalf("Invalid result from query, expected nodes, got: %v", result)
+			return nil, fmt.Errorf("invalid result from query, expected nodes, got: %v", result)
 		}
 		data := result.(*gizmo.Result)
 
@@ -585,7 +648,7 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 			} else {
 				node = val[gizmo.TopResultTag].(string)
 				qval, err := cquad.AsValue(node)
-				if !err {
+				if !err || v.QS.ValueOf(qval) == nil {
 					continue
 				}
 				id = reflect.ValueOf(v.QS.ValueOf(qval).Key()).Int()
@@ -602,7 +665,7 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 			if _, found := val["parent"]; found {
 				parent = val["parent"].(string)
 				qval, err := cquad.AsValue(parent)
-				if !err {
+				if !err || v.QS.ValueOf(qval) == nil {
 					continue
 				}
 				parentId = reflect.ValueOf(v.QS.ValueOf(qval).Key()).Int()
@@ -612,7 +675,7 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 					for key := range data.Tags {
 						keys = append(keys, key)
 					}
-					return errors.New(fmt.Sprintf("Node %s missing parent tag (tags: %s)", node, strings.Join(keys, ",")))
+					return nil, errors.New(fmt.Sprintf("Node %s missing parent tag (tags: %s)", node, strings.Join(keys, ",")))
 				}
 			}
 		} else {
@@ -620,23 +683,27 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 			parentId = reflect.ValueOf(data.Tags["parent"]).Int()
 		}
 
-		err := v.renderBothNodes(parent, node, parentId, id, out)
+		err := v.renderBothNodes(parent, node, parentId, id, g)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error rendering node (%s -> %s): %v\n", parent, node, err)
 		}
 	}
 	if err := it.Err(); err != nil {
-		return err
+		return nil, err
 	}
 
-	// Second pass, render edges
+	// Second pass, render edges (resources using the node and principals with roles on it)
+	predicates := []interface{}{"uses"}
+	for _, predicate := range v.RolePredicates() {
+		predicates = append(predicates, predicate)
+	}
 	session = gizmo.NewSession(v.QS)
-	it, err = session.Execute(ctx, gizmoQ.String(), query.Options{
+	it, err = session.Execute(ctx, gizmoQ, query.Options{
 		Collation: query.Raw,
 		Limit:     -1,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer it.Close()
 	for it.Next(ctx) {
@@ -653,7 +720,7 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 			} else {
 				node = val[gizmo.TopResultTag].(string)
 				qval, err := cquad.AsValue(node)
-				if !err {
+				if !err || v.QS.ValueOf(qval) == nil {
 					continue
 				}
 				id = reflect.ValueOf(v.QS.ValueOf(qval).Key()).Int()
@@ -667,10 +734,15 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 		if !err {
 			continue
 		}
-		p := cayley.StartPath(v.QS, qval).In("uses")
+		p := cayley.StartPath(v.QS, qval).In(predicates...)
 		var hadEdge bool = false
+		targets := make(map[int64]bool, 0)
 		p.Iterate(nil).EachValue(v.QS, func(val cquad.Value) {
 			targetId := reflect.ValueOf(v.QS.ValueOf(val).Key()).Int()
+			if targets[targetId] {
+				return
+			}
+			targets[targetId] = true
 
 			tRaw := make([]byte, 8)
 			binary.BigEndian.PutUint64(tRaw, uint64(targetId))
@@ -680,8 +752,13 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 
 			if v.bfilter.Test(sRaw) && v.bfilter.Test(tRaw) {
 				target := cquad.NativeOf(val).(string)
-				err := v.renderEdge(target, node, targetId, id, out) // Ignore errors, because some resources might be missing
-				if err == nil {
+				var label string
+				if len(v.rolePredicates) > 0 {
+					label = strings.Join(v.principalRoles(target, node), "\n")
+				}
+				edge, err := v.renderLabeledEdge(target, node, targetId, id, label) // Ignore errors, because some resources might be missing
+				if err == nil && edge != nil {
+					g.Edges = append(g.Edges, edge)
 					hadEdge = true
 				}
 			}
@@ -692,11 +769,68 @@ func (v *GcpViz) GenerateNodes(wg *sync.WaitGroup, ctx context.Context, gizmoQue
 		}
 	}
 	if err := it.Err(); err != nil {
-		return err
+		return nil, err
 	}
 
-	fmt.Fprintf(out, "}\n")
-	return nil
+	v.clusterGraph(g)
+	v.redactGraph(g)
+	return g, nil
+}
+
+// RunQuery runs the Gizmo query and returns the results as JSON-compatible values, as
+// emitted by the query. A limit of -1 returns all results.
+func (v *GcpViz) RunQuery(ctx context.Context, gizmoQuery string, parameters map[string]interface{}, limit int) ([]interface{}, error) {
+	gizmoQ, err := v.queryFromTemplate(gizmoQuery, parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	session := gizmo.NewSession(v.QS)
+	it, err := session.Execute(ctx, gizmoQ, query.Options{
+		Collation: query.JSON,
+		Limit:     limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	results := make([]interface{}, 0)
+	for it.Next(ctx) {
+		if result := it.Result(); result != nil {
+			results = append(results, result)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// queryFromTemplate validates the parameters against the header of the query and
+// executes the query template. Parameters missing from the template are errors.
+func (v *GcpViz) queryFromTemplate(gizmoQuery string, parameters map[string]interface{}) (string, error) {
+	metadata, err := ParseQueryMetadata("", gizmoQuery)
+	if err != nil {
+		return "", err
+	}
+	parameters, err = metadata.Validate(parameters)
+	if err != nil {
+		return "", err
+	}
+	queryTemplate, err := template.New("query").Option("missingkey=error").Parse(gizmoQuery)
+	if err != nil {
+		return "", fmt.Errorf("error parsing query template: %v", err)
+	}
+	var gizmoQ bytes.Buffer
+	parameters["Organizations"] = v.OrgRoots
+	err = queryTemplate.Execute(&gizmoQ, parameters)
+	if err != nil {
+		if strings.Contains(err.Error(), "map has no entry for key") {
+			return "", &QueryParameterError{Message: err.Error()}
+		}
+		return "", fmt.Errorf("error executing query template: %v", err)
+	}
+	return gizmoQ.String(), nil
 }
 
 // Private methods
@@ -710,52 +844,32 @@ func (v *GcpViz) loadRelationsMap(fileName string) error {
 	if err != nil {
 		return err
 	}
+	// Only used to point errors to the line in the file
+	var root yaml.Node
+	yaml.Unmarshal(yamlFile, &root)
 
-	v.Relations.AssetTypes = make(map[string][]jsonpath.FilterFunc, len(relations.AssetTypes))
-	for assetType, paths := range relations.AssetTypes {
-		v.Relations.AssetTypes[assetType] = make([]jsonpath.FilterFunc, len(paths))
-		for idx, path := range paths {
-			preparedPath, err := jsonpath.Prepare(path)
-			if err != nil {
-				return err
-			}
-			v.Relations.AssetTypes[assetType][idx] = preparedPath
-		}
+	v.Relations.AssetTypes, err = compileRelationList(fileName, &root, "asset_types", relations.AssetTypes)
+	if err != nil {
+		return err
 	}
-
-	v.Relations.Aliases = make(map[string][]jsonpath.FilterFunc, len(relations.Aliases))
-	for assetType, paths := range relations.Aliases {
-		v.Relations.Aliases[assetType] = make([]jsonpath.FilterFunc, len(paths))
-		for idx, path := range paths {
-			preparedPath, err := jsonpath.Prepare(path)
-			if err != nil {
-				return err
-			}
-			v.Relations.Aliases[assetType][idx] = preparedPath
-		}
+	v.Relations.Aliases, err = compileRelationList(fileName, &root, "aliases", relations.Aliases)
+	if err != nil {
+		return err
 	}
-
-	v.Relations.IpAddresses = make(map[string][]jsonpath.FilterFunc, len(relations.IpAddresses))
-	for assetType, paths := range relations.IpAddresses {
-		v.Relations.IpAddresses[assetType] = make([]jsonpath.FilterFunc, len(paths))
-		for idx, path := range paths {
-			preparedPath, err := jsonpath.Prepare(path)
-			if err != nil {
-				return err
-			}
-			v.Relations.IpAddresses[assetType][idx] = preparedPath
-		}
+	v.Relations.IpAddresses, err = compileRelationList(fileName, &root, "ip_addresses", relations.IpAddresses)
+	if err != nil {
+		return err
 	}
 
-	v.Relations.Enrich = make(map[string]map[string]map[string]jsonpath.FilterFunc, len(relations.Enrich))
+	v.Relations.Enrich = make(map[string]map[string]map[string]RelationFunc, len(relations.Enrich))
 	for assetType, fields := range relations.Enrich {
-		v.Relations.Enrich[assetType] = make(map[string]map[string]jsonpath.FilterFunc, len(fields))
+		v.Relations.Enrich[assetType] = make(map[string]map[string]RelationFunc, len(fields))
 		for fieldName, subAsset := range fields {
-			v.Relations.Enrich[assetType][fieldName] = make(map[string]jsonpath.FilterFunc, len(subAsset))
+			v.Relations.Enrich[assetType][fieldName] = make(map[string]RelationFunc, len(subAsset))
 			for subAssetType, path := range subAsset {
-				preparedPath, err := jsonpath.Prepare(path)
+				preparedPath, err := compileRelation(path, true, relationsEntry(fileName, &root, "enrich", assetType, fieldName, subAssetType))
 				if err != nil {
-					return err
+					return relationsError(fileName, &root, err, "enrich", assetType, fieldName, subAssetType)
 				}
 				v.Relations.Enrich[assetType][fieldName][subAssetType] = preparedPath
 			}
@@ -836,7 +950,12 @@ func (v *GcpViz) loadStyleMap(fileName string, override map[string]string) error
 
 		var jsnStr = string(jsn)
 		for path, newValue := range override {
-			jsnStr, err = sjson.Set(jsnStr, path, newValue)
+			// Keep numeric style values numbers, ie. clusters.collapse_threshold
+			if gjson.Get(jsnStr, path).Type == gjson.Number && gjson.Valid(newValue) {
+				jsnStr, err = sjson.SetRaw(jsnStr, path, newValue)
+			} else {
+				jsnStr, err = sjson.Set(jsnStr, path, newValue)
+			}
 			if err != nil {
 				return err
 			}
@@ -859,6 +978,15 @@ func (v *GcpViz) loadStyleMap(fileName string, override map[string]string) error
 		}
 	}
 
+	err = Style.Clusters.compile()
+	if err != nil {
+		return err
+	}
+	err = Style.Costs.compile()
+	if err != nil {
+		return err
+	}
+
 	Nodes = make(map[string]*template.Template, len(Style.Nodes))
 	for k, v := range Style.Nodes {
 		s, err := template.New(k).Funcs(templateFuncMap).Parse(v)
@@ -910,6 +1038,11 @@ func (v *GcpViz) initializeBolt() error {
 		return err
 	}
 
+	_, err = tx.CreateBucket([]byte("IamPolicies"))
+	if err != nil {
+		return err
+	}
+
 	if err := tx.Commit(); err != nil {
 		return err
 	}
@@ -945,13 +1078,6 @@ func (v *GcpViz) jsonPathResultsToString(results interface{}) ([]string, error)
  */
 
 func (v *GcpViz) EnrichAssets() error {
-	// Iterate BoltDB
-	tx, err := v.AssetDatabase.Begin(false)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
 	/* Step 1: alias generation, configured via relations file */
 	aliasAssetTypes := make([]string, 0, len(v.Relations.Aliases))
 	for ak, _ := range v.Relations.Aliases {
@@ -959,69 +1085,32 @@ func (v *GcpViz) EnrichAssets() error {
 	}
 
 	fmt.Fprintf(os.Stderr, "\nCreating reference aliases for assets...\n")
-	wrtx, err := v.AssetDatabase.Begin(true)
-	if err != nil {
-		return err
-	}
-	err = tx.Bucket([]byte("Assets")).ForEach(func(bk, bv []byte) error {
-		isAliasAsset := false
-		for _, aliasAssetType := range aliasAssetTypes {
-			// Simple optimization to avoid unmarshaling tons of JSON
-			if strings.Contains(string(bv), aliasAssetType) {
-				isAliasAsset = true
-				break
+	err := v.AssetDatabase.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Assets")).ForEach(func(bk, bv []byte) error {
+			if !containsAnyAssetType(bv, aliasAssetTypes) {
+				return nil
 			}
-		}
-		if !isAliasAsset {
-			return nil
-		}
-
-		asset, resource, err := v.parseJsonAsset(bv)
-		if err != nil {
-			return err
-		}
 
-		name := asset.GetName()
-		assetType := asset.GetAssetType()
-		_resource := resource.(map[string]interface{})
-		if aliases, ok := v.Relations.Aliases[assetType]; ok {
-			for _, jsonPath := range aliases {
-				if res, ok := _resource["resource"]; ok {
-					_data := res.(map[string]interface{})
-					if _, ok := _data["data"]; ok {
-						targets, err := jsonPath(_data)
-						if err != nil {
-							continue
-						}
+			asset, resource, err := v.parseJsonAsset(bv)
+			if err != nil {
+				return err
+			}
 
-						_targets, err := v.jsonPathResultsToString(targets)
-						for _, vertex := range _targets {
-							err = wrtx.Bucket([]byte("Aliases")).Put([]byte(vertex), []byte(name))
-							v.TotalAliases++
-						}
-					}
+			for _, alias := range v.assetAliases(asset.GetAssetType(), resource) {
+				err = tx.Bucket([]byte("Aliases")).Put([]byte(alias), []byte(asset.GetName()))
+				if err != nil {
+					return err
 				}
-
+				v.TotalAliases++
 			}
-		}
-		return nil
+			return nil
+		})
 	})
 	if err != nil {
-		wrtx.Rollback()
 		return err
-	} else {
-		if err = wrtx.Commit(); err != nil {
-			return err
-		}
 	}
 
 	fmt.Fprintf(os.Stderr, "Creating references between assets...\n")
-	tx, err = v.AssetDatabase.Begin(false)
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-
 	relationsAssetTypes := make([]string, 0, len(v.Relations.AssetTypes))
 	for rk, _ := range v.Relations.AssetTypes {
 		relationsAssetTypes = append(relationsAssetTypes, rk)
@@ -1035,132 +1124,56 @@ func (v *GcpViz) EnrichAssets() error {
 	ipAddresses := make([]IpAddressLink, 0)
 
 	/* Step 2: standard reference generation, configured via relations file */
-	err = tx.Bucket([]byte("Assets")).ForEach(func(bk, bv []byte) error {
-		isRelationsAsset := false
-		isIpAsset := false
-		for _, relationsAssetType := range relationsAssetTypes {
-			// Simple optimization to avoid unmarshaling tons of JSON
-			if strings.Contains(string(bv), relationsAssetType) {
-				isRelationsAsset = true
-				break
-			}
-		}
-		for _, ipAssetType := range ipAssetTypes {
-			// Simple optimization to avoid unmarshaling tons of JSON
-			if strings.Contains(string(bv), ipAssetType) {
-				isIpAsset = true
-				break
+	err = v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Assets")).ForEach(func(bk, bv []byte) error {
+			isRelationsAsset := containsAnyAssetType(bv, relationsAssetTypes)
+			isIpAsset := containsAnyAssetType(bv, ipAssetTypes)
+			if !isRelationsAsset && !isIpAsset {
+				return nil
 			}
-		}
 
-		if !isRelationsAsset && !isIpAsset {
-			return nil
-		}
+			asset, resource, err := v.parseJsonAsset(bv)
+			if err != nil {
+				return err
+			}
 
-		asset, resource, err := v.parseJsonAsset(bv)
-		if err != nil {
-			return err
-		}
+			assetType := asset.GetAssetType()
+			name := asset.GetName()
 
-		assetType := asset.GetAssetType()
-		name := asset.GetName()
-
-		if isIpAsset {
-			_resource := resource.(map[string]interface{})
-			if relations, ok := v.Relations.IpAddresses[assetType]; ok {
-				for _, jsonPath := range relations {
-					if res, ok := _resource["resource"]; ok {
-						_data := res.(map[string]interface{})
-						if _, ok := _data["data"]; ok {
-							targets, err := jsonPath(_data)
-							if err != nil {
-								continue
-							}
-							_targets, err := v.jsonPathResultsToString(targets)
-							for _, ipRange := range _targets {
-								if ipRange == "0.0.0.0/0" {
-									continue
-								}
-								if !strings.Contains(ipRange, "/") {
-									ipRange = ipRange + "/32"
-								}
-								_, parsedIp, err := net.ParseCIDR(ipRange)
-								if err != nil {
-									fmt.Fprintf(os.Stderr, "Warning: Failed to parse IP %v for resource %v.\n", ipRange, name)
-								}
-								ip := IpAddressLink{Ip: parsedIp, Resource: name, AssetType: assetType}
-								ipAddresses = append(ipAddresses, ip)
-								v.TotalIps++
-							}
-						}
-					}
-				}
+			if isIpAsset {
+				ips := v.assetIpAddresses(name, assetType, resource)
+				ipAddresses = append(ipAddresses, ips...)
+				v.TotalIps += int64(len(ips))
 			}
-		}
 
-		if isRelationsAsset {
-			_resource := resource.(map[string]interface{})
-			if relations, ok := v.Relations.AssetTypes[assetType]; ok {
-				for _, jsonPath := range relations {
-					if res, ok := _resource["resource"]; ok {
-						_data := res.(map[string]interface{})
-						if _, ok := _data["data"]; ok {
-							targets, err := jsonPath(_data)
-							if err != nil {
-								continue
-							}
-							_targets, err := v.jsonPathResultsToString(targets)
-							for _, vertex := range _targets {
-								if strings.HasPrefix(vertex, "https://www.googleapis.com/compute/v1/") {
-									vertex = strings.Replace(vertex, "https://www.googleapis.com/compute/v1/", "//compute.googleapis.com/", 1)
-								}
-								if !strings.HasPrefix(vertex, "//") && strings.Contains(vertex, ".googleapis.com/") {
-									vertex = fmt.Sprintf("//%s", vertex)
-								}
-								rotx, err := v.AssetDatabase.Begin(false)
-								if err != nil {
-									return err
-								}
-								defer rotx.Rollback()
-
-								target := rotx.Bucket([]byte("Assets")).Get([]byte(vertex))
-								if target == nil {
-									alias := rotx.Bucket([]byte("Aliases")).Get([]byte(vertex))
-									if alias != nil {
-										vertex = string(alias)
-									} else {
-										if !strings.HasPrefix(vertex, "//") && !strings.Contains(vertex, ".googleapis.com/") {
-											p := strings.SplitN(assetType, "/", 2)
-											vertex = fmt.Sprintf("//%s/%s", p[0], vertex)
-										}
-									}
-								}
-
-								v.QW.AddQuad(cayley.Quad(name, "uses", vertex, assetType))
-								v.TotalEdges++
-							}
-						}
-					}
+			if isRelationsAsset {
+				for _, vertex := range v.assetReferences(tx, assetType, resource) {
+					v.QW.AddQuad(cayley.Quad(name, "uses", vertex, assetType))
+					v.TotalEdges++
 				}
 			}
-		}
-
-		return nil
+			return nil
+		})
 	})
+	if err != nil {
+		return err
+	}
 
 	/* Step 3: Link via IP addresses */
 	fmt.Fprintf(os.Stderr, "Processing resource IP addresses...\n")
-	for ik, ip := range ipAddresses {
-		for sik, sip := range ipAddresses {
-			if ik != sik {
-				if ip.AssetType != sip.AssetType && sip.Ip.Contains(ip.Ip.IP) {
-					v.QW.AddQuad(cayley.Quad(ip.Resource, "uses", sip.Resource, ip.AssetType))
-					v.TotalEdges++
-				}
-			}
-		}
+	for _, q := range linkIpAddresses(ipAddresses) {
+		v.QW.AddQuad(q)
+		v.TotalEdges++
 	}
-	/* Step 4: Enrich existing asset types by incorporating linked assets into new fields */
+
+	/* Step 4: Link principals to resources via IAM policies */
+	fmt.Fprintf(os.Stderr, "Processing IAM policies...\n")
+	err = v.linkIamPolicies()
+	if err != nil {
+		return err
+	}
+
+	/* Step 5: Enrich existing asset types by incorporating linked assets into new fields */
 	enrichAssetTypes := make([]string, 0, len(v.Relations.Enrich))
 	for ek, _ := range v.Relations.Enrich {
 		enrichAssetTypes = append(enrichAssetTypes, ek)
@@ -1168,95 +1181,235 @@ func (v *GcpViz) EnrichAssets() error {
 	enrichedAssets := make(map[string]map[string][]interface{}, 0)
 
 	fmt.Fprintf(os.Stderr, "Integrating subassets as part of main assets...\n")
-	err = tx.Bucket([]byte("Assets")).ForEach(func(bk, bv []byte) error {
-		isEnrichAsset := false
-		for _, enrichAssetType := range enrichAssetTypes {
-			// Simple optimization to avoid unmarshaling tons of JSON
-			if strings.Contains(string(bv), enrichAssetType) {
-				isEnrichAsset = true
-				break
+	err = v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Assets")).ForEach(func(bk, bv []byte) error {
+			if !containsAnyAssetType(bv, enrichAssetTypes) {
+				return nil
+			}
+			asset, _, err := v.parseJsonAsset(bv)
+			if err != nil {
+				return err
+			}
+
+			if newFields, found := v.enrichAsset(asset.GetName(), asset.GetAssetType()); found {
+				enrichedAssets[asset.GetName()] = newFields
 			}
-		}
-		if !isEnrichAsset {
 			return nil
-		}
-		asset, _, err := v.parseJsonAsset(bv)
-		if err != nil {
-			return err
-		}
+		})
+	})
+	if err != nil {
+		return err
+	}
 
-		assetType := asset.GetAssetType()
-		name := asset.GetName()
-		qval, qerr := cquad.AsValue(name)
-		if !qerr {
-			return err
+	err = v.writeEnrichedAssets(enrichedAssets)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "\nTotal vertexes: %d, total edges: %d, total aliases: %d, total IPs: %d\n", v.TotalVertexes, v.TotalEdges, v.TotalAliases, v.TotalIps)
+	return nil
+}
+
+// Simple optimization to avoid unmarshaling tons of JSON
+func containsAnyAssetType(asset []byte, assetTypes []string) bool {
+	for _, assetType := range assetTypes {
+		if strings.Contains(string(asset), assetType) {
+			return true
 		}
+	}
+	return false
+}
 
-		var subAssets []interface{}
-		subAssets = append(subAssets, nil)
-		for _, subAssetTypes := range v.Relations.Enrich[assetType] {
-			for subAssetType, _ := range subAssetTypes {
-				subAssets = append(subAssets, subAssetType)
+func (v *GcpViz) resourceJsonPaths(paths []RelationFunc, resource interface{}) []string {
+	var results []string
+	_resource := resource.(map[string]interface{})
+	for _, jsonPath := range paths {
+		if res, ok := _resource["resource"]; ok {
+			_data := res.(map[string]interface{})
+			if _, ok := _data["data"]; ok {
+				targets, err := jsonPath(_data)
+				if err != nil {
+					v.relationFailed(err, _resource)
+					continue
+				}
+				_targets, _ := v.jsonPathResultsToString(targets)
+				results = append(results, _targets...)
 			}
 		}
-		newFields := make(map[string][]interface{}, 0)
+	}
+	return results
+}
 
-		p := cayley.StartPath(v.QS, qval).LabelContext(subAssets...).In("uses")
-		p.Iterate(nil).EachValue(v.QS, func(val cquad.Value) {
-			target := cquad.NativeOf(val).(string)
-			targetAsset, err := v.getAsset(target)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: could not fetch sub-asset %v\n", target)
+// relationFailed reports a CEL expression in the relations file that could not be evaluated
+// for a resource. JSONPaths that don't match are expected and ignored.
+func (v *GcpViz) relationFailed(err error, resource map[string]interface{}) {
+	relationErr, ok := err.(*RelationError)
+	if !ok {
+		return
+	}
+	if v.relationFailures == nil {
+		v.relationFailures = make(map[string]int)
+	}
+	if v.relationFailures[relationErr.Entry] == 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %s could not be evaluated for %v: %v (further errors of this entry are not shown)\n", relationErr.Entry, resource["name"], relationErr.Err)
+	}
+	v.relationFailures[relationErr.Entry]++
+}
+
+// assetAliases returns the alternative names of an asset, as configured in the relations file.
+func (v *GcpViz) assetAliases(assetType string, resource interface{}) []string {
+	if aliases, ok := v.Relations.Aliases[assetType]; ok {
+		return v.resourceJsonPaths(aliases, resource)
+	}
+	return nil
+}
+
+// assetReferences returns the vertexes an asset uses, resolving aliases through the database.
+func (v *GcpViz) assetReferences(tx *bolt.Tx, assetType string, resource interface{}) []string {
+	relations, ok := v.Relations.AssetTypes[assetType]
+	if !ok {
+		return nil
+	}
+	var vertexes []string
+	for _, vertex := range v.resourceJsonPaths(relations, resource) {
+		if strings.HasPrefix(vertex, "https://www.googleapis.com/compute/v1/") {
+			vertex = strings.Replace(vertex, "https://www.googleapis.com/compute/v1/", "//compute.googleapis.com/", 1)
+		}
+		if !strings.HasPrefix(vertex, "//") && strings.Contains(vertex, ".googleapis.com/") {
+			vertex = fmt.Sprintf("//%s", vertex)
+		}
+
+		target := tx.Bucket([]byte("Assets")).Get([]byte(vertex))
+		if target == nil {
+			alias := tx.Bucket([]byte("Aliases")).Get([]byte(vertex))
+			if alias != nil {
+				vertex = string(alias)
 			} else {
-				_data := targetAsset.Resource.Data.(map[string]interface{})
-				for field, subAssetTypes := range v.Relations.Enrich[assetType] {
-					for subAssetType, jsonPath := range subAssetTypes {
-						if subAssetType == targetAsset.AssetType {
-							targets, err := jsonPath(_data)
-							if err != nil {
-								fmt.Fprintf(os.Stderr, "Warning: JSON-Path error in enrichment: %v\n", err)
-								continue
-							}
-							if _, ok := newFields[field]; !ok {
-								newFields[field] = make([]interface{}, 0)
-							}
-							newFields[field] = append(newFields[field], targets)
-						}
-					}
+				if !strings.HasPrefix(vertex, "//") && !strings.Contains(vertex, ".googleapis.com/") {
+					p := strings.SplitN(assetType, "/", 2)
+					vertex = fmt.Sprintf("//%s/%s", p[0], vertex)
 				}
-				enrichedAssets[name] = newFields
 			}
-		})
+		}
+		vertexes = append(vertexes, vertex)
+	}
+	return vertexes
+}
 
+// assetIpAddresses returns the IP addresses and ranges of an asset, as configured in the relations file.
+func (v *GcpViz) assetIpAddresses(name string, assetType string, resource interface{}) []IpAddressLink {
+	relations, ok := v.Relations.IpAddresses[assetType]
+	if !ok {
 		return nil
-	})
+	}
+	var ipAddresses []IpAddressLink
+	for _, ipRange := range v.resourceJsonPaths(relations, resource) {
+		if ipRange == "0.0.0.0/0" {
+			continue
+		}
+		if !strings.Contains(ipRange, "/") {
+			ipRange = ipRange + "/32"
+		}
+		_, parsedIp, err := net.ParseCIDR(ipRange)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: Failed to parse IP %v for resource %v.\n", ipRange, name)
+			continue
+		}
+		ipAddresses = append(ipAddresses, IpAddressLink{Ip: parsedIp, Resource: name, AssetType: assetType})
+	}
+	return ipAddresses
+}
 
-	tx, err = v.AssetDatabase.Begin(true)
-	if err != nil {
-		return err
+// linkIpAddresses creates `uses` edges between assets of different types when the IP
+// address of one is contained in the IP range of the other.
+func linkIpAddresses(ipAddresses []IpAddressLink) []cquad.Quad {
+	var quads []cquad.Quad
+	for ik, ip := range ipAddresses {
+		for sik, sip := range ipAddresses {
+			if ik != sik {
+				if ip.AssetType != sip.AssetType && sip.Ip.Contains(ip.Ip.IP) {
+					quads = append(quads, cayley.Quad(ip.Resource, "uses", sip.Resource, ip.AssetType))
+				}
+			}
+		}
 	}
-	defer tx.Rollback()
+	return quads
+}
 
+// enrichAsset gathers the fields of the sub-assets using the asset, as configured in the
+// enrich section of the relations file.
+func (v *GcpViz) enrichAsset(name string, assetType string) (map[string][]interface{}, bool) {
+	qval, ok := cquad.AsValue(name)
+	if !ok {
+		return nil, false
+	}
+
+	var subAssets []interface{}
+	subAssets = append(subAssets, nil)
+	for _, subAssetTypes := range v.Relations.Enrich[assetType] {
+		for subAssetType, _ := range subAssetTypes {
+			subAssets = append(subAssets, subAssetType)
+		}
+	}
+	newFields := make(map[string][]interface{}, 0)
+	found := false
+
+	p := cayley.StartPath(v.QS, qval).LabelContext(subAssets...).In("uses")
+	p.Iterate(nil).EachValue(v.QS, func(val cquad.Value) {
+		target := cquad.NativeOf(val).(string)
+		targetAsset, err := v.getAsset(target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not fetch sub-asset %v\n", target)
+		} else {
+			_data := targetAsset.Resource.Data.(map[string]interface{})
+			for field, subAssetTypes := range v.Relations.Enrich[assetType] {
+				for subAssetType, jsonPath := range subAssetTypes {
+					if subAssetType == targetAsset.AssetType {
+						targets, err := jsonPath(_data)
+						if err != nil {
+							fmt.Fprintf(os.Stderr, "Warning: error in enrichment of %s: %v\n", name, err)
+							continue
+						}
+						if _, ok := newFields[field]; !ok {
+							newFields[field] = make([]interface{}, 0)
+						}
+						newFields[field] = append(newFields[field], targets)
+					}
+				}
+			}
+			found = true
+		}
+	})
+	return newFields, found
+}
+
+func (v *GcpViz) writeEnrichedAssets(enrichedAssets map[string]map[string][]interface{}) error {
+	assets := make(map[string]*TemplateResource, len(enrichedAssets))
 	for name, newFields := range enrichedAssets {
 		asset, err := v.getAsset(name)
-		if err == nil {
-			for k, v := range newFields {
-				asset.Resource.Data.(map[string]interface{})[k] = v
+		if err != nil {
+			return err
+		}
+		data := asset.Resource.Data.(map[string]interface{})
+		for k, v := range newFields {
+			if v == nil {
+				delete(data, k)
+			} else {
+				data[k] = v
 			}
-			err = v.UpdateAsset(tx, name, asset)
+		}
+		assets[name] = asset
+	}
+
+	return v.AssetDatabase.Update(func(tx *bolt.Tx) error {
+		for name, asset := range assets {
+			err := v.UpdateAsset(tx, name, asset)
 			if err != nil {
 				return err
 			}
-		} else {
-			return err
 		}
-	}
-	if err = tx.Commit(); err != nil {
-		return err
-	}
-
-	fmt.Fprintf(os.Stderr, "\nTotal vertexes: %d, total edges: %d, total aliases: %d, total IPs: %d\n", v.TotalVertexes, v.TotalEdges, v.TotalAliases, v.TotalIps)
-	return nil
+		return nil
+	})
 }
 
 func (v *GcpViz) AddAsset(tx *bolt.Tx, asset validator.Asset, resource interface{}, addResourceData bool) error {
@@ -1273,7 +1426,7 @@ func (v *GcpViz) AddAsset(tx *bolt.Tx, asset validator.Asset, resource interface
 		return err
 	}
 	if assetType == "cloudresourcemanager.googleapis.com/Organization" {
-		v.OrgRoots = append(v.OrgRoots, name)
+		v.addOrgRoot(name)
 	}
 
 	v.QW.AddQuad(cayley.Quad(parent, "child", name, assetType))
@@ -1292,6 +1445,15 @@ func (v *GcpViz) AddAsset(tx *bolt.Tx, asset validator.Asset, resource interface
 	return nil
 }
 
+func (v *GcpViz) addOrgRoot(name string) {
+	for _, root := range v.OrgRoots {
+		if root == name {
+			return
+		}
+	}
+	v.OrgRoots = append(v.OrgRoots, name)
+}
+
 func (v *GcpViz) UpdateAsset(tx *bolt.Tx, name string, resource interface{}) error {
 	jsn, err := json.Marshal(resource)
 	if err != nil {
@@ -1317,7 +1479,10 @@ func (v *GcpViz) ReadAssetsFromFile(input string, addResourceData bool) error {
 	}
 	fileSize := finfo.Size()
 
-	var reader = bufio.NewReader(file)
+	reader, err := inventoryReader(file)
+	if err != nil {
+		return err
+	}
 	const bufferSize = 5 * 1024 * 1024 // Length of one line is maximum 5 MB
 
 	scanner := bufio.NewScanner(reader)
@@ -1363,7 +1528,17 @@ func (v *GcpViz) ReadAssetsFromFile(input string, addResourceData bool) error {
 			return err
 		}
 
-		err = v.AddAsset(tx, *pbAsset, resource, addResourceData)
+		v.redactor.removeFields(pbAsset.GetAssetType(), resource)
+		replace := false
+		if isIamPolicyAsset(resource) {
+			err = v.AddIamPolicy(tx, pbAsset.GetName(), resource)
+		} else {
+			replace, err = v.replaceDuplicateAsset(tx, pbAsset.GetName(), resource)
+		}
+		if err == nil && replace {
+			err = v.AddAsset(tx, *pbAsset, resource, addResourceData)
+			v.addAssetSource(pbAsset.GetName(), pbAsset.GetAssetType(), input)
+		}
 		if err != nil {
 			return err
 		}
@@ -1388,6 +1563,9 @@ func (v *GcpViz) unmarshallAsset(from []byte, to proto.Message) (interface{}, er
 			delete(orgPolicy, "update_time")
 		}
 	}
+	if val, ok := temp["iam_policy"].(map[string]interface{}); ok {
+		delete(val, "etag")
+	}
 	err = v.protoViaJSON(temp, to)
 	if err == nil {
 		return temp, nil
@@ -0,0 +1,776 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	cquad "github.com/cayleygraph/quad"
+)
+
+const (
+	VerdictAllowed = "allowed"
+	VerdictDenied  = "denied"
+)
+
+var verdictColors = map[string]string{
+	VerdictAllowed: "#859900",
+	VerdictDenied:  "#dc322f",
+	"":             "#268bd2",
+}
+
+// maxPaths limits the number of paths enumerated between two resources.
+const maxPaths = 100
+
+// Container resources would connect almost everything, so paths never go through them.
+var pathExcludedAssetTypes = map[string]bool{
+	"cloudresourcemanager.googleapis.com/Organization": true,
+	"cloudresourcemanager.googleapis.com/Folder":       true,
+	"cloudresourcemanager.googleapis.com/Project":      true,
+	"compute.googleapis.com/Project":                   true,
+}
+
+type PathOptions struct {
+	MaxLength        int
+	EvaluateFirewall bool
+	// Protocol and port to evaluate firewall rules for (ie. tcp:443), any if empty
+	Port string
+}
+
+type pathEdge struct {
+	from string
+	to   string
+}
+
+// PathAnalysis contains the paths found between two resources and, if firewall rules
+// were evaluated, whether traffic between them is allowed.
+type PathAnalysis struct {
+	Source      string     `json:"source"`
+	Destination string     `json:"destination"`
+	Paths       [][]string `json:"paths"`
+	Verdict     string     `json:"verdict,omitempty"`
+	Reasons     []string   `json:"reasons,omitempty"`
+
+	viz   *GcpViz
+	rules []string
+}
+
+// pathEndpoint holds the network details of a resource relevant for firewall rules.
+type pathEndpoint struct {
+	name            string
+	ip              net.IP
+	network         string
+	tags            []string
+	serviceAccounts []string
+}
+
+type firewallRule struct {
+	Name                  string   `json:"-"`
+	Network               string   `json:"network"`
+	Direction             string   `json:"direction"`
+	Priority              *int     `json:"priority"`
+	Disabled              bool     `json:"disabled"`
+	SourceRanges          []string `json:"sourceRanges"`
+	DestinationRanges     []string `json:"destinationRanges"`
+	SourceTags            []string `json:"sourceTags"`
+	TargetTags            []string `json:"targetTags"`
+	SourceServiceAccounts []string `json:"sourceServiceAccounts"`
+	TargetServiceAccounts []string `json:"targetServiceAccounts"`
+	Allowed               []struct {
+		IPProtocol string   `json:"IPProtocol"`
+		Ports      []string `json:"ports"`
+	} `json:"allowed"`
+	Denied []struct {
+		IPProtocol string   `json:"IPProtocol"`
+		Ports      []string `json:"ports"`
+	} `json:"denied"`
+}
+
+type route struct {
+	Name      string   `json:"-"`
+	Network   string   `json:"network"`
+	DestRange string   `json:"destRange"`
+	Priority  int      `json:"priority"`
+	Tags      []string `json:"tags"`
+}
+
+type pathNetwork struct {
+	Peerings []struct {
+		Network string `json:"network"`
+		State   string `json:"state"`
+	} `json:"peerings"`
+}
+
+// computeAssetName converts a Compute Engine API URL into an asset name.
+func computeAssetName(url string) string {
+	if strings.HasPrefix(url, "https://www.googleapis.com/compute/v1/") {
+		return strings.Replace(url, "https://www.googleapis.com/compute/v1/", "//compute.googleapis.com/", 1)
+	}
+	if strings.HasPrefix(url, "https://compute.googleapis.com/compute/v1/") {
+		return strings.Replace(url, "https://compute.googleapis.com/compute/v1/", "//compute.googleapis.com/", 1)
+	}
+	return url
+}
+
+func parseIpOrRange(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() == nil {
+			s = s + "/128"
+		} else {
+			s = s + "/32"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+// ResolveResource returns the assets matching an asset name, alias or IP address. IP
+// addresses are resolved with the ip_addresses relations, preferring the resources with
+// exactly that address over the most specific range containing it.
+func (v *GcpViz) ResolveResource(spec string) ([]string, net.IP, error) {
+	var found []string
+	err := v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("Assets")).Get([]byte(spec)) != nil {
+			found = append(found, spec)
+		} else if alias := tx.Bucket([]byte("Aliases")).Get([]byte(spec)); alias != nil {
+			found = append(found, string(alias))
+		}
+		return nil
+	})
+	if err != nil || len(found) > 0 {
+		return found, nil, err
+	}
+
+	ip := net.ParseIP(spec)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("resource %s not found (specify an asset name, alias or IP address)", spec)
+	}
+	ipAddresses, err := v.allIpAddresses()
+	if err != nil {
+		return nil, nil, err
+	}
+	bestPrefix := -1
+	for _, link := range ipAddresses {
+		if !link.Ip.Contains(ip) {
+			continue
+		}
+		prefix, _ := link.Ip.Mask.Size()
+		if prefix > bestPrefix {
+			bestPrefix = prefix
+			found = found[:0]
+		}
+		if prefix == bestPrefix {
+			found = append(found, link.Resource)
+		}
+	}
+	if len(found) == 0 {
+		return nil, nil, fmt.Errorf("no resource found with IP address %s", spec)
+	}
+	sort.Strings(found)
+	return found, ip, nil
+}
+
+func (v *GcpViz) assetTypeOf(tx *bolt.Tx, name string) string {
+	var asset struct {
+		AssetType string `json:"asset_type"`
+	}
+	if bv := tx.Bucket([]byte("Assets")).Get([]byte(name)); bv != nil {
+		json.Unmarshal(bv, &asset)
+	}
+	return asset.AssetType
+}
+
+// usesAdjacency returns the resources linked by `uses` edges in either direction,
+// leaving out the container resources.
+func (v *GcpViz) usesAdjacency(ctx context.Context) (map[string][]string, map[pathEdge]bool, error) {
+	edges, err := v.usesEdges(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	excluded := make(map[string]bool, 0)
+	err = v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		for edge := range edges {
+			for _, name := range edge {
+				if _, checked := excluded[name]; !checked {
+					excluded[name] = pathExcludedAssetTypes[v.assetTypeOf(tx, name)]
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	adjacency := make(map[string][]string, 0)
+	directed := make(map[pathEdge]bool, len(edges))
+	for edge := range edges {
+		if edge[0] == edge[1] || excluded[edge[0]] || excluded[edge[1]] {
+			continue
+		}
+		if !directed[pathEdge{edge[1], edge[0]}] {
+			adjacency[edge[0]] = append(adjacency[edge[0]], edge[1])
+			adjacency[edge[1]] = append(adjacency[edge[1]], edge[0])
+		}
+		directed[pathEdge{edge[0], edge[1]}] = true
+	}
+	for k := range adjacency {
+		sort.Strings(adjacency[k])
+	}
+	return adjacency, directed, nil
+}
+
+// adjacencyDistances returns the number of edges from each resource to the destination, for
+// the resources at most maxLength edges away.
+func adjacencyDistances(adjacency map[string][]string, destination string, maxLength int) map[string]int {
+	distances := map[string]int{destination: 0}
+	queue := []string{destination}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if distances[node] == maxLength {
+			continue
+		}
+		for _, next := range adjacency[node] {
+			if _, found := distances[next]; !found {
+				distances[next] = distances[node] + 1
+				queue = append(queue, next)
+			}
+		}
+	}
+	return distances
+}
+
+// shortestPaths returns the simple paths from source to destination with at most maxLength
+// edges, shortest first. Paths are searched by increasing length, only through the resources
+// that can still reach the destination within the length, until maxPaths paths are found.
+// It returns true if there are more paths.
+func shortestPaths(ctx context.Context, adjacency map[string][]string, source string, destination string, maxLength int) ([][]string, bool, error) {
+	paths := make([][]string, 0)
+	distances := adjacencyDistances(adjacency, destination, maxLength)
+	shortest, reachable := distances[source]
+	truncated := false
+	for length := shortest; reachable && length <= maxLength && !truncated; length++ {
+		visited := map[string]bool{source: true}
+		path := []string{source}
+		var walk func(node string)
+		walk = func(node string) {
+			if node == destination {
+				if len(path)-1 == length {
+					if len(paths) == maxPaths {
+						truncated = true
+						return
+					}
+					paths = append(paths, append([]string{}, path...))
+				}
+				return
+			}
+			remaining := length - len(path)
+			for _, next := range adjacency[node] {
+				if truncated || ctx.Err() != nil {
+					return
+				}
+				if distance, found := distances[next]; !found || distance > remaining || visited[next] {
+					continue
+				}
+				visited[next] = true
+				path = append(path, next)
+				walk(next)
+				path = path[:len(path)-1]
+				visited[next] = false
+			}
+		}
+		walk(source)
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+	}
+	return paths, truncated, nil
+}
+
+// FindPaths finds the simple paths between two resources over `uses` edges, shortest first.
+func (v *GcpViz) FindPaths(ctx context.Context, source string, destination string, opts PathOptions) (*PathAnalysis, error) {
+	sources, sourceIp, err := v.ResolveResource(source)
+	if err != nil {
+		return nil, err
+	}
+	destinations, destinationIp, err := v.ResolveResource(destination)
+	if err != nil {
+		return nil, err
+	}
+	adjacency, _, err := v.usesAdjacency(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	analysis := &PathAnalysis{Source: sources[0], Destination: destinations[0], Paths: make([][]string, 0), viz: v}
+	if len(sources) > 1 || len(destinations) > 1 {
+		fmt.Fprintf(os.Stderr, "Warning: multiple resources match, using %s -> %s\n", analysis.Source, analysis.Destination)
+	}
+
+	fmt.Fprintf(os.Stderr, "Finding paths from %s to %s...\n", analysis.Source, analysis.Destination)
+	paths, truncated, err := shortestPaths(ctx, adjacency, analysis.Source, analysis.Destination, opts.MaxLength)
+	if err != nil {
+		return nil, err
+	}
+	analysis.Paths = paths
+	if truncated {
+		fmt.Fprintf(os.Stderr, "Warning: more than %d paths, showing the %d shortest.\n", maxPaths, maxPaths)
+	}
+	fmt.Fprintf(os.Stderr, "Found %d paths.\n", len(analysis.Paths))
+
+	if opts.EvaluateFirewall {
+		err = analysis.evaluateFirewall(sourceIp, destinationIp, opts.Port)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "Traffic is %s:\n  %s\n", analysis.Verdict, strings.Join(analysis.Reasons, "\n  "))
+	}
+	return analysis, nil
+}
+
+func (v *GcpViz) endpoint(tx *bolt.Tx, name string, ip net.IP) (*pathEndpoint, error) {
+	ep := &pathEndpoint{name: name, ip: ip}
+	bv := tx.Bucket([]byte("Assets")).Get([]byte(name))
+	if bv == nil {
+		return nil, fmt.Errorf("resource %s not found in database", name)
+	}
+	var asset struct {
+		AssetType string `json:"asset_type"`
+		Resource  struct {
+			Data struct {
+				Network           string `json:"network"`
+				IPAddress         string `json:"IPAddress"`
+				NetworkInterfaces []struct {
+					Network       string `json:"network"`
+					NetworkIP     string `json:"networkIP"`
+					AccessConfigs []struct {
+						NatIP string `json:"natIP"`
+					} `json:"accessConfigs"`
+				} `json:"networkInterfaces"`
+				Tags struct {
+					Items []string `json:"items"`
+				} `json:"tags"`
+				ServiceAccounts []struct {
+					Email string `json:"email"`
+				} `json:"serviceAccounts"`
+			} `json:"data"`
+		} `json:"resource"`
+	}
+	if err := json.Unmarshal(bv, &asset); err != nil {
+		return nil, fmt.Errorf("error parsing asset %s: %v", name, err)
+	}
+	data := asset.Resource.Data
+	ep.tags = data.Tags.Items
+	for _, sa := range data.ServiceAccounts {
+		ep.serviceAccounts = append(ep.serviceAccounts, sa.Email)
+	}
+	for _, nic := range data.NetworkInterfaces {
+		nicIp := net.ParseIP(nic.NetworkIP)
+		if ep.ip == nil || ep.ip.Equal(nicIp) {
+			ep.ip = nicIp
+			ep.network = computeAssetName(nic.Network)
+			break
+		}
+		for _, ac := range nic.AccessConfigs {
+			if ep.ip.Equal(net.ParseIP(ac.NatIP)) {
+				ep.network = computeAssetName(nic.Network)
+			}
+		}
+	}
+	if ep.network == "" && data.Network != "" {
+		ep.network = computeAssetName(data.Network)
+	}
+	if ep.ip == nil && data.IPAddress != "" {
+		ep.ip = net.ParseIP(data.IPAddress)
+	}
+	if asset.AssetType == "compute.googleapis.com/Network" {
+		ep.network = name
+	}
+	return ep, nil
+}
+
+func intersects(a []string, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func rangesContain(ranges []string, ip net.IP) bool {
+	for _, r := range ranges {
+		if ipNet, err := parseIpOrRange(r); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPort checks a rule's protocol and port list against a protocol:port, or any
+// traffic if port is empty. Without a port, deny rules only match if they deny everything.
+func matchesPort(protocol string, ports []string, port string, deny bool) bool {
+	if port == "" {
+		return !deny || ((protocol == "all" || protocol == "") && len(ports) == 0)
+	}
+	wantProtocol, wantPort := port, ""
+	if idx := strings.Index(port, ":"); idx > -1 {
+		wantProtocol, wantPort = port[:idx], port[idx+1:]
+	}
+	if protocol != "all" && !strings.EqualFold(protocol, wantProtocol) {
+		return false
+	}
+	if len(ports) == 0 || wantPort == "" {
+		return true
+	}
+	want, err := strconv.Atoi(wantPort)
+	if err != nil {
+		return false
+	}
+	for _, p := range ports {
+		bounds := strings.SplitN(p, "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		high := low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				continue
+			}
+		}
+		if want >= low && want <= high {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *firewallRule) priority() int {
+	if r.Priority == nil {
+		return 1000
+	}
+	return *r.Priority
+}
+
+func (r *firewallRule) matchesTraffic(port string) (bool, bool) {
+	for _, d := range r.Denied {
+		if matchesPort(d.IPProtocol, d.Ports, port, true) {
+			return true, false
+		}
+	}
+	for _, a := range r.Allowed {
+		if matchesPort(a.IPProtocol, a.Ports, port, false) {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+func (r *firewallRule) appliesTo(ep *pathEndpoint) bool {
+	if len(r.TargetTags) > 0 {
+		return intersects(r.TargetTags, ep.tags)
+	}
+	if len(r.TargetServiceAccounts) > 0 {
+		return intersects(r.TargetServiceAccounts, ep.serviceAccounts)
+	}
+	return true
+}
+
+// evaluateRules applies the firewall rules in priority order, deny rules win over allow
+// rules of the same priority. Returns the verdict and the deciding rule.
+func evaluateRules(rules []*firewallRule, matches func(r *firewallRule) bool, port string, defaultAllow bool) (bool, *firewallRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].priority() != rules[j].priority() {
+			return rules[i].priority() < rules[j].priority()
+		}
+		return len(rules[i].Denied) > 0 && len(rules[j].Denied) == 0
+	})
+	for _, r := range rules {
+		if r.Disabled || !matches(r) {
+			continue
+		}
+		if matched, allow := r.matchesTraffic(port); matched {
+			return allow, r
+		}
+	}
+	return defaultAllow, nil
+}
+
+func (a *PathAnalysis) evaluateFirewall(sourceIp net.IP, destinationIp net.IP, port string) error {
+	v := a.viz
+	return v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		src, err := v.endpoint(tx, a.Source, sourceIp)
+		if err != nil {
+			return err
+		}
+		dst, err := v.endpoint(tx, a.Destination, destinationIp)
+		if err != nil {
+			return err
+		}
+		if src.ip == nil || dst.ip == nil {
+			a.Verdict = VerdictDenied
+			a.Reasons = append(a.Reasons, "could not determine IP addresses of both resources, specify them as IP addresses")
+			return nil
+		}
+
+		var rules []*firewallRule
+		var routes []*route
+		networks := make(map[string]*pathNetwork, 0)
+		subnetworks := make(map[string][]string, 0)
+		err = tx.Bucket([]byte("Assets")).ForEach(func(k, bv []byte) error {
+			if !containsAnyAssetType(bv, []string{"compute.googleapis.com/Firewall", "compute.googleapis.com/Route", "compute.googleapis.com/Network", "compute.googleapis.com/Subnetwork"}) {
+				return nil
+			}
+			var asset struct {
+				AssetType string `json:"asset_type"`
+				Resource  struct {
+					Data json.RawMessage `json:"data"`
+				} `json:"resource"`
+			}
+			if err := json.Unmarshal(bv, &asset); err != nil {
+				return nil
+			}
+			switch asset.AssetType {
+			case "compute.googleapis.com/Firewall":
+				r := &firewallRule{Name: string(k)}
+				if json.Unmarshal(asset.Resource.Data, r) == nil {
+					r.Network = computeAssetName(r.Network)
+					rules = append(rules, r)
+				}
+			case "compute.googleapis.com/Route":
+				r := &route{Name: string(k), Priority: 1000}
+				if json.Unmarshal(asset.Resource.Data, r) == nil {
+					r.Network = computeAssetName(r.Network)
+					routes = append(routes, r)
+				}
+			case "compute.googleapis.com/Network":
+				n := &pathNetwork{}
+				if json.Unmarshal(asset.Resource.Data, n) == nil {
+					networks[string(k)] = n
+				}
+			case "compute.googleapis.com/Subnetwork":
+				var s struct {
+					Network     string `json:"network"`
+					IpCidrRange string `json:"ipCidrRange"`
+				}
+				if json.Unmarshal(asset.Resource.Data, &s) == nil {
+					network := computeAssetName(s.Network)
+					subnetworks[network] = append(subnetworks[network], s.IpCidrRange)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Routing: subnet routes of the network or of an active peering, then custom routes
+		sameNetwork := src.network != "" && src.network == dst.network
+		routed := rangesContain(subnetworks[src.network], dst.ip)
+		if routed {
+			a.Reasons = append(a.Reasons, fmt.Sprintf("route: subnet route in %s", src.network))
+		} else if n, found := networks[src.network]; found {
+			for _, peering := range n.Peerings {
+				peer := computeAssetName(peering.Network)
+				if peering.State == "ACTIVE" && rangesContain(subnetworks[peer], dst.ip) {
+					routed = true
+					a.Reasons = append(a.Reasons, fmt.Sprintf("route: peering subnet route to %s", peer))
+					break
+				}
+			}
+		}
+		if !routed {
+			var best *route
+			bestPrefix := -1
+			for _, r := range routes {
+				ipNet, err := parseIpOrRange(r.DestRange)
+				if err != nil || r.Network != src.network || !ipNet.Contains(dst.ip) {
+					continue
+				}
+				if len(r.Tags) > 0 && !intersects(r.Tags, src.tags) {
+					continue
+				}
+				prefix, _ := ipNet.Mask.Size()
+				if prefix > bestPrefix || (prefix == bestPrefix && r.Priority < best.Priority) {
+					best, bestPrefix = r, prefix
+				}
+			}
+			if best != nil {
+				routed = true
+				a.rules = append(a.rules, best.Name)
+				a.Reasons = append(a.Reasons, fmt.Sprintf("route: %s (%s)", best.Name, best.DestRange))
+			}
+		}
+		if !routed {
+			a.Verdict = VerdictDenied
+			a.Reasons = append(a.Reasons, fmt.Sprintf("route: no route from %s to %s", src.network, dst.ip))
+			return nil
+		}
+
+		describe := func(direction string, allowed bool, rule *firewallRule) {
+			verdict := "denied"
+			if allowed {
+				verdict = "allowed"
+			}
+			if rule == nil {
+				a.Reasons = append(a.Reasons, fmt.Sprintf("%s: %s by implied rule", direction, verdict))
+			} else {
+				a.rules = append(a.rules, rule.Name)
+				a.Reasons = append(a.Reasons, fmt.Sprintf("%s: %s by %s (priority %d)", direction, verdict, rule.Name, rule.priority()))
+			}
+		}
+
+		var networkRules []*firewallRule
+		for _, r := range rules {
+			if r.Network == src.network && r.Direction == "EGRESS" {
+				networkRules = append(networkRules, r)
+			}
+		}
+		egressAllowed, egressRule := evaluateRules(networkRules, func(r *firewallRule) bool {
+			return r.appliesTo(src) && (len(r.DestinationRanges) == 0 || rangesContain(r.DestinationRanges, dst.ip))
+		}, port, true)
+		describe("egress", egressAllowed, egressRule)
+
+		networkRules = networkRules[:0]
+		for _, r := range rules {
+			if r.Network == dst.network && (r.Direction == "INGRESS" || r.Direction == "") {
+				networkRules = append(networkRules, r)
+			}
+		}
+		ingressAllowed, ingressRule := evaluateRules(networkRules, func(r *firewallRule) bool {
+			if !r.appliesTo(dst) {
+				return false
+			}
+			if rangesContain(r.SourceRanges, src.ip) {
+				return true
+			}
+			// Source tags and service accounts only apply within the same network
+			return sameNetwork && (intersects(r.SourceTags, src.tags) || intersects(r.SourceServiceAccounts, src.serviceAccounts))
+		}, port, false)
+		describe("ingress", ingressAllowed, ingressRule)
+
+		if egressAllowed && ingressAllowed {
+			a.Verdict = VerdictAllowed
+		} else {
+			a.Verdict = VerdictDenied
+		}
+		return nil
+	})
+}
+
+// WriteReport writes the paths and the verdict as JSON, redacted if redaction is enabled.
+func (a *PathAnalysis) WriteReport(out io.Writer) error {
+	return writeRedactedReport(out, a, a.viz.redactor)
+}
+
+// Graph renders the resources on the paths, with the edges colored by the verdict. The
+// routes and firewall rules that decided the verdict are included.
+func (a *PathAnalysis) Graph(ctx context.Context, parameters map[string]interface{}) (*Graph, error) {
+	v := a.viz
+	g, err := v.newGraph(parameters)
+	if err != nil {
+		return nil, err
+	}
+	_, directed, err := v.usesAdjacency(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	color := verdictColors[a.Verdict]
+	ids := make(map[string]int64, 0)
+	addNode := func(name string, highlight bool) {
+		if _, found := ids[name]; found {
+			return
+		}
+		id := int64(len(ids) + 1)
+		node, err := v.renderNode(name, id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to render node %s: %v\n", name, err)
+			return
+		}
+		if node == nil {
+			return
+		}
+		if highlight {
+			node.Attributes += highlightAttributes(color)
+		}
+		ids[name] = id
+		g.Nodes = append(g.Nodes, node)
+	}
+	rendered := make(map[pathEdge]bool, 0)
+	addEdge := func(from string, to string) {
+		if rendered[pathEdge{from, to}] {
+			return
+		}
+		fromId, fromFound := ids[from]
+		toId, toFound := ids[to]
+		if !fromFound || !toFound {
+			return
+		}
+		edge, err := v.renderEdge(from, to, fromId, toId)
+		if err != nil || edge == nil {
+			edge = &GraphEdge{From: fromId, To: toId}
+		}
+		if edge.Attributes != "" {
+			edge.Attributes += ","
+		}
+		edge.Attributes += fmt.Sprintf(`color="%s",penwidth=2`, color)
+		g.Edges = append(g.Edges, edge)
+		rendered[pathEdge{from, to}] = true
+	}
+
+	addNode(a.Source, true)
+	addNode(a.Destination, true)
+	for _, path := range a.Paths {
+		for _, name := range path {
+			addNode(name, false)
+		}
+	}
+	for _, path := range a.Paths {
+		for i := 1; i < len(path); i++ {
+			if directed[pathEdge{path[i-1], path[i]}] {
+				addEdge(path[i-1], path[i])
+			} else {
+				addEdge(path[i], path[i-1])
+			}
+		}
+	}
+	for _, rule := range a.rules {
+		addNode(rule, true)
+		for _, q := range v.quadsOf(cquad.Subject, rule, "uses") {
+			target := fmt.Sprint(cquad.NativeOf(q.Object))
+			if _, found := ids[target]; found {
+				addEdge(rule, target)
+			}
+		}
+	}
+	v.redactGraph(g)
+	return g, nil
+}
@@ -0,0 +1,91 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testAdjacency links each resource to the others in both directions.
+func testAdjacency(edges ...[2]string) map[string][]string {
+	adjacency := make(map[string][]string, 0)
+	for _, edge := range edges {
+		adjacency[edge[0]] = append(adjacency[edge[0]], edge[1])
+		adjacency[edge[1]] = append(adjacency[edge[1]], edge[0])
+	}
+	return adjacency
+}
+
+func TestShortestPaths(t *testing.T) {
+	adjacency := testAdjacency([2]string{"a", "b"}, [2]string{"b", "c"}, [2]string{"a", "d"}, [2]string{"d", "e"}, [2]string{"e", "c"}, [2]string{"x", "y"})
+	paths, truncated, err := shortestPaths(context.Background(), adjacency, "a", "c", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]string{{"a", "b", "c"}, {"a", "d", "e", "c"}}; !reflect.DeepEqual(expected, paths) || truncated {
+		t.Errorf("expected %v, got %v (truncated %v)", expected, paths, truncated)
+	}
+
+	paths, _, err = shortestPaths(context.Background(), adjacency, "a", "c", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 {
+		t.Errorf("expected only the path with 2 edges, got %v", paths)
+	}
+	paths, _, err = shortestPaths(context.Background(), adjacency, "a", "y", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 0 {
+		t.Errorf("expected no paths, got %v", paths)
+	}
+}
+
+func TestShortestPathsThroughSharedNetwork(t *testing.T) {
+	// Thousands of instances in the same network and subnetwork have millions of paths
+	var edges [][2]string
+	for i := 0; i < 3000; i++ {
+		instance := fmt.Sprintf("instance%d", i)
+		edges = append(edges, [2]string{instance, "network"}, [2]string{instance, "subnetwork"})
+	}
+	edges = append(edges, [2]string{"database", "network"})
+
+	start := time.Now()
+	paths, truncated, err := shortestPaths(context.Background(), testAdjacency(edges...), "instance0", "database", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("finding paths took %s", elapsed)
+	}
+	if len(paths) != maxPaths || !truncated {
+		t.Errorf("expected %d paths and more to be available, got %d", maxPaths, len(paths))
+	}
+	if !reflect.DeepEqual([]string{"instance0", "network", "database"}, paths[0]) {
+		t.Errorf("expected the shortest path first, got %v", paths[0])
+	}
+	for i := 1; i < len(paths); i++ {
+		if len(paths[i]) < len(paths[i-1]) {
+			t.Errorf("expected paths ordered by length, got %v after %v", paths[i], paths[i-1])
+		}
+	}
+}
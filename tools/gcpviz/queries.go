@@ -0,0 +1,245 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	QueryParameterString = "string"
+	QueryParameterInt    = "int"
+	QueryParameterBool   = "bool"
+)
+
+var QueryParameterTypes = []string{QueryParameterString, QueryParameterInt, QueryParameterBool}
+
+// builtinQueryParameters are set by gcpviz for every query.
+var builtinQueryParameters = map[string]bool{"Organizations": true, "Title": true}
+
+// QueryParameter is a parameter of a query, declared in its header with a JSDoc style tag:
+//
+//	@param {string} project - required parameter
+//	@param {string} [resource=""] - optional parameter with a default value
+type QueryParameter struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+	Default     string `json:"default,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// QueryMetadata is the header of a query file, with its @description and @param tags.
+type QueryMetadata struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Parameters  []*QueryParameter `json:"parameters"`
+}
+
+// QueryParameterError is returned when the parameters do not match the query header.
+type QueryParameterError struct {
+	Query   string
+	Message string
+}
+
+func (e *QueryParameterError) Error() string {
+	if e.Query == "" {
+		return fmt.Sprintf("invalid query parameters: %s", e.Message)
+	}
+	return fmt.Sprintf("invalid parameters for query %s: %s", e.Query, e.Message)
+}
+
+var queryParamRegexp = regexp.MustCompile(`^@param\s+\{(\w+)\}\s+(?:\[(\w+)(?:=([^\]]*))?\]|(\w+))\s*(?:-\s*)?(.*)$`)
+
+// ParseQueryMetadata reads the @description and @param tags from the comments of a query.
+// Tags continue on the following comment lines until an empty line or another tag.
+func ParseQueryMetadata(name string, gizmoQuery string) (*QueryMetadata, error) {
+	metadata := &QueryMetadata{Name: name, Parameters: make([]*QueryParameter, 0)}
+	location := func(line int) string {
+		if name == "" {
+			return fmt.Sprintf("query line %d", line)
+		}
+		return fmt.Sprintf("%s:%d", name, line)
+	}
+	var description *string
+	for i, line := range strings.Split(gizmoQuery, "\n") {
+		text := strings.TrimSpace(line)
+		isComment := false
+		for _, prefix := range []string{"/**", "/*", "//", "*"} {
+			if strings.HasPrefix(text, prefix) && !strings.HasPrefix(text, "*/") {
+				text = strings.TrimSpace(strings.TrimPrefix(text, prefix))
+				isComment = true
+				break
+			}
+		}
+		text = strings.TrimSpace(strings.TrimSuffix(text, "*/"))
+		if !isComment || text == "" {
+			description = nil
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(text, "@description"):
+			metadata.Description = strings.TrimSpace(strings.TrimPrefix(text, "@description"))
+			description = &metadata.Description
+		case strings.HasPrefix(text, "@param"):
+			match := queryParamRegexp.FindStringSubmatch(text)
+			if match == nil {
+				return nil, fmt.Errorf("%s: invalid @param, expected @param {type} name - description or @param {type} [name=default] - description", location(i+1))
+			}
+			param := &QueryParameter{Type: match[1], Name: match[4], Required: true, Description: match[5]}
+			if match[2] != "" {
+				param.Name = match[2]
+				param.Required = false
+				param.Default = strings.Trim(match[3], `"'`)
+			}
+			valid := false
+			for _, t := range QueryParameterTypes {
+				if param.Type == t {
+					valid = true
+				}
+			}
+			if !valid {
+				return nil, fmt.Errorf("%s: invalid type %s for parameter %s (supported: %s)", location(i+1), param.Type, param.Name, strings.Join(QueryParameterTypes, ", "))
+			}
+			if !param.Required {
+				if _, err := convertQueryParameter(param, param.Default); err != nil {
+					return nil, fmt.Errorf("%s: invalid default for parameter %s: %v", location(i+1), param.Name, err)
+				}
+			}
+			metadata.Parameters = append(metadata.Parameters, param)
+			description = &param.Description
+		case strings.HasPrefix(text, "@"):
+			description = nil
+		default:
+			if description != nil {
+				*description = strings.TrimSpace(*description + " " + text)
+			}
+		}
+	}
+	return metadata, nil
+}
+
+func convertQueryParameter(param *QueryParameter, value string) (interface{}, error) {
+	switch param.Type {
+	case QueryParameterInt:
+		return strconv.Atoi(value)
+	case QueryParameterBool:
+		if value == "" {
+			return false, nil
+		}
+		return strconv.ParseBool(value)
+	}
+	return value, nil
+}
+
+// Validate checks the parameters against the header of the query and returns the
+// parameters converted to their types, with the defaults of missing optional parameters.
+func (m *QueryMetadata) Validate(parameters map[string]interface{}) (map[string]interface{}, error) {
+	validated := make(map[string]interface{}, len(parameters)+len(m.Parameters))
+	declared := make(map[string]bool, len(m.Parameters))
+	missing := make([]string, 0)
+	for _, param := range m.Parameters {
+		declared[param.Name] = true
+		value, found := parameters[param.Name]
+		if !found {
+			if param.Required {
+				missing = append(missing, param.Name)
+				continue
+			}
+			value = param.Default
+		}
+		converted, err := convertQueryParameter(param, fmt.Sprint(value))
+		if err != nil {
+			return nil, &QueryParameterError{Query: m.Name, Message: fmt.Sprintf("parameter %s must be a %s, got %q", param.Name, param.Type, fmt.Sprint(value))}
+		}
+		validated[param.Name] = converted
+	}
+	if len(missing) > 0 {
+		return nil, &QueryParameterError{Query: m.Name, Message: fmt.Sprintf("missing required parameters: %s", strings.Join(missing, ", "))}
+	}
+
+	unknown := make([]string, 0)
+	for name, value := range parameters {
+		if declared[name] {
+			continue
+		}
+		if !builtinQueryParameters[name] {
+			unknown = append(unknown, name)
+		}
+		validated[name] = value
+	}
+	// Queries without a header accept any parameters
+	if len(unknown) > 0 && len(m.Parameters) > 0 {
+		sort.Strings(unknown)
+		return nil, &QueryParameterError{Query: m.Name, Message: fmt.Sprintf("unknown parameters: %s", strings.Join(unknown, ", "))}
+	}
+	return validated, nil
+}
+
+// ListQueries reads the headers of the query files in a directory.
+func ListQueries(queriesDir string) ([]*QueryMetadata, error) {
+	files, err := filepath.Glob(filepath.Join(queriesDir, "*.js"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	queries := make([]*QueryMetadata, 0, len(files))
+	for _, file := range files {
+		gizmoQuery, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		metadata, err := ParseQueryMetadata(strings.TrimSuffix(filepath.Base(file), ".js"), string(gizmoQuery))
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, metadata)
+	}
+	return queries, nil
+}
+
+// WriteQueryList prints the queries with their descriptions and parameters.
+func WriteQueryList(queries []*QueryMetadata, out io.Writer) {
+	for _, query := range queries {
+		fmt.Fprintf(out, "%s\n", query.Name)
+		if query.Description != "" {
+			fmt.Fprintf(out, "    %s\n", query.Description)
+		}
+		for _, param := range query.Parameters {
+			var usage string
+			if param.Required {
+				usage = "required"
+			} else {
+				usage = fmt.Sprintf("optional, default %q", param.Default)
+			}
+			fmt.Fprintf(out, "    -query-parameter %s=<%s> (%s)", param.Name, param.Type, usage)
+			if param.Description != "" {
+				fmt.Fprintf(out, ": %s", param.Description)
+			}
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintln(out)
+	}
+}
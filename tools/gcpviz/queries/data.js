@@ -14,6 +14,10 @@
 #   limitations under the License.
 #
 */
+/**
+ * @description Shows the data and analytics resources (BigQuery, Bigtable, Cloud SQL,
+ *   Spanner, Cloud Storage, Pub/Sub, Dataproc and Data Fusion) of all projects.
+ */
 var containerResourceTypes = [
     "cloudresourcemanager.googleapis.com/Organization",
     "cloudresourcemanager.googleapis.com/Folder",
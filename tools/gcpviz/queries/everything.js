@@ -14,9 +14,10 @@
 #   limitations under the License.
 #
 */
-/* WARNING! You might end up with a HUGE graph! Consider specifying
- * only the asset types you want in the gcloud asset export command 
- * using --asset-types flag.
+/**
+ * @description Shows all assets in the graph. WARNING! You might end up with a HUGE
+ *   graph! Consider specifying only the asset types you want in the gcloud asset
+ *   export command using --asset-types flag.
  */
 var nodes = [];
 var follow = function (n, depth) {
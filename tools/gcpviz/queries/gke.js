@@ -14,6 +14,9 @@
 #   limitations under the License.
 #
 */
+/**
+ * @description Shows the GKE clusters and node pools of all projects.
+ */
 var containerResourceTypes = [
     "cloudresourcemanager.googleapis.com/Organization",
     "cloudresourcemanager.googleapis.com/Folder",
@@ -0,0 +1,98 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+/**
+ * @description Shows the principals (users, groups, domains and service accounts) with
+ *   roles on the resources, as ingested from an IAM policy export.
+ * @param {string} [resource=""] - show only who has access to this resource (directly
+ *   or through its ancestors)
+ */
+var containerResourceTypes = [
+    "cloudresourcemanager.googleapis.com/Organization",
+    "cloudresourcemanager.googleapis.com/Folder",
+    "cloudresourcemanager.googleapis.com/Project",
+];
+var wantedResourceTypes = [
+    "bigquery.googleapis.com/Dataset",
+    "cloudkms.googleapis.com/CryptoKey",
+    "cloudkms.googleapis.com/KeyRing",
+    "iam.googleapis.com/ServiceAccount",
+    "pubsub.googleapis.com/Subscription",
+    "pubsub.googleapis.com/Topic",
+    "secretmanager.googleapis.com/Secret",
+    "spanner.googleapis.com/Database",
+    "spanner.googleapis.com/Instance",
+    "storage.googleapis.com/Bucket",
+];
+var resourceTypes = containerResourceTypes.concat(wantedResourceTypes);
+
+var rolePredicates = function (id) {
+    return g.V(id).inPredicates().toArray().filter(function (p) {
+        return p.indexOf("hasRole:") == 0;
+    });
+};
+
+var principals = function (id) {
+    var roles = rolePredicates(id);
+    if (roles.length == 0) {
+        return [];
+    }
+    return g.V(id).tag("parent").in(roles).tagArray();
+};
+
+var nodes = [];
+{{ if .resource }}
+var resource = "{{ .resource }}";
+var ancestors = [];
+var current = resource;
+while (current) {
+    var parents = g.V(current).in("child").toArray();
+    if (parents.length > 0 && parents[0] !== "") {
+        ancestors.push({ id: current, parent: parents[0] });
+        current = parents[0];
+    } else {
+        ancestors.push({ id: current });
+        current = undefined;
+    }
+}
+nodes = ancestors;
+{{ else }}
+var follow = function (n, depth) {
+    var out = n.tag("parent").labelContext(resourceTypes, "type").out("child");
+    if (out.count() == 0) {
+        return;
+    }
+    nodes = nodes.concat(out.tagArray());
+    follow(out, depth + 1);
+};
+
+var root = g.V("{{ index .Organizations 0 }}");
+follow(root, 1);
+nodes = root.tagArray().concat(nodes);
+{{ end }}
+
+// Principals are tagged with the resource as parent, edges are labeled with the roles
+var withPrincipals = [];
+nodes.forEach(function (node) {
+    var p = principals(node.id);
+    if (p.length > 0 || containerResourceTypes.indexOf(node.type) > -1 || node.type === undefined) {
+        withPrincipals.push(node);
+    }
+    withPrincipals = withPrincipals.concat(p);
+});
+withPrincipals.forEach(function (node) {
+    g.emit(node);
+});
@@ -14,6 +14,10 @@
 #   limitations under the License.
 #
 */
+/**
+ * @description Shows the compute resources (instances, instance groups, disks and
+ *   managed instances such as GKE, Cloud SQL and Dataproc clusters) of all projects.
+ */
 var containerResourceTypes = [
     "cloudresourcemanager.googleapis.com/Organization",
     "cloudresourcemanager.googleapis.com/Folder",
@@ -14,6 +14,10 @@
 #   limitations under the License.
 #
 */
+/**
+ * @description Shows the load balancers (forwarding targets, URL maps, backend
+ *   services and their addresses and certificates) of all projects.
+ */
 var containerResourceTypes = [
     "cloudresourcemanager.googleapis.com/Organization",
     "cloudresourcemanager.googleapis.com/Folder",
@@ -14,6 +14,10 @@
 #   limitations under the License.
 #
 */
+/**
+ * @description Shows the VPC networks, subnetworks, routers, VPNs, interconnects and
+ *   Cloud DNS of all projects.
+ */
 var containerResourceTypes = [
     "cloudresourcemanager.googleapis.com/Organization",
     "cloudresourcemanager.googleapis.com/Folder",
@@ -13,9 +13,12 @@
 #   See the License for the specific language governing permissions and
 #   limitations under the License.
 #
- *
- * This is an example for rendering only one project. Pass the project as a query parameter
- * from the command line: -query-parameter "project=//cloudresourcemanager.googleapis.com/projects/12345678901234"
+*/
+/**
+ * @description Example for rendering only one project with its networks and firewall
+ *   rules.
+ * @param {string} project - the project, ie.
+ *   //cloudresourcemanager.googleapis.com/projects/12345678901234
  */
 var containerResourceTypes = [
     "cloudresourcemanager.googleapis.com/Organization",
@@ -13,8 +13,11 @@
 #   See the License for the specific language governing permissions and
 #   limitations under the License.
 #
-
 */
+/**
+ * @description Shows the security resources (firewalls, Cloud Armor and SSL policies,
+ *   KMS keys, packet mirroring and logging sinks) of all projects.
+ */
 var containerResourceTypes = [
     "cloudresourcemanager.googleapis.com/Organization",
     "cloudresourcemanager.googleapis.com/Folder",
@@ -13,9 +13,12 @@
 #   See the License for the specific language governing permissions and
 #   limitations under the License.
 #
- * This is an example for rendering one project and its shared VPC project. Pass the projects as a query parameters
- * from the command line: -query-parameter \ 
- *   "project=//cloudresourcemanager.googleapis.com/projects/12345678901234,sharedvpcproject=//cloudres..."
+*/
+/**
+ * @description Example for rendering one project and its shared VPC host project.
+ * @param {string} project - the service project, ie.
+ *   //cloudresourcemanager.googleapis.com/projects/12345678901234
+ * @param {string} [sharedvpcproject=""] - the shared VPC host project
  */
 
 var resourceTypes = [
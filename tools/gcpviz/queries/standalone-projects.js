@@ -13,8 +13,10 @@
 #   See the License for the specific language governing permissions and
 #   limitations under the License.
 #
- * This is an example for rendering "standalone" projects. It requires -resource-data flag
- * when creating the graph database.
+*/
+/**
+ * @description Example for rendering "standalone" projects. It requires -resource-data
+ *   flag when creating the graph database.
  */
 
 var resourceTypes = [
@@ -14,8 +14,14 @@
 #   limitations under the License.
 #
 */
+/**
+ * @description Shows the VPC networks of one project with their firewall rules and the
+ *   service accounts they apply to.
+ * @param {string} project - the project, ie.
+ *   //cloudresourcemanager.googleapis.com/projects/12345678901234
+ */
 var resourceTypes = [
-    "cloudresourcemanager.googleapis.com/Project"
+    "cloudresourcemanager.googleapis.com/Project",
     "compute.googleapis.com/Network",
     "compute.googleapis.com/Firewall",
     "iam.googleapis.com/ServiceAccount",
@@ -14,6 +14,9 @@
 #   limitations under the License.
 #
 */
+/**
+ * @description Shows the VPNs (gateways, tunnels and Cloud Routers) of all projects.
+ */
 
 var containerResourceTypes = [
     "cloudresourcemanager.googleapis.com/Organization",
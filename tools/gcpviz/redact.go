@@ -0,0 +1,505 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RedactProjectIds    = "project_ids"
+	RedactResourceNames = "resource_names"
+	RedactIpAddresses   = "ip_addresses"
+	RedactLabelValues   = "label_values"
+
+	RedactionHash = "hash"
+	RedactionMask = "mask"
+	RedactionNone = "none"
+)
+
+var RedactionTargets = []string{RedactProjectIds, RedactResourceNames, RedactIpAddresses, RedactLabelValues}
+
+// redactionPrefixes are the prefixes of hashed values, so the kind of a value is still
+// recognizable in a redacted graph.
+var redactionPrefixes = map[string]string{
+	RedactProjectIds:    "project",
+	RedactResourceNames: "name",
+	RedactIpAddresses:   "ip",
+	RedactLabelValues:   "label",
+}
+
+const (
+	redactionMaskText   = "***"
+	redactionMaskIp     = "x.x.x.x"
+	redactionMaskIpv6   = "x:x::x"
+	redactionHashLength = 10
+)
+
+var ipv4Regexp = regexp.MustCompile(`\b\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\b`)
+
+// ipv6Regexp matches candidates for IPv6 addresses (including IPv4-mapped ones) that
+// don't start in the middle of a word, they are checked with net.ParseIP.
+var ipv6Regexp = regexp.MustCompile(`(?:^|[^0-9A-Za-z_.:-])([0-9A-Fa-f]*:[0-9A-Fa-f:.]*[0-9A-Fa-f:])`)
+
+// RedactionConfig is the redaction file: what to replace in rendered graphs and exports,
+// and the fields to remove from assets when generating the graph.
+type RedactionConfig struct {
+	Rules        map[string]string   `yaml:"rules"`
+	RemoveFields map[string][]string `yaml:"remove_fields"`
+}
+
+// Redactor replaces the sensitive values of the assets in a graph consistently: with a
+// salted hash the same value is always replaced by the same token.
+type Redactor struct {
+	config *RedactionConfig
+	salt   []byte
+	// Values consisting of name characters are matched as whole words, other values
+	// (ie. display names with spaces) anywhere
+	words      map[string]string
+	substrings *strings.Replacer
+}
+
+// LoadRedactionConfig reads and validates a redaction file.
+func LoadRedactionConfig(fileName string) (*RedactionConfig, error) {
+	yamlFile, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var config RedactionConfig
+	if err := yaml.Unmarshal(yamlFile, &config); err != nil {
+		return nil, err
+	}
+	for target, action := range config.Rules {
+		if _, found := redactionPrefixes[target]; !found {
+			return nil, fmt.Errorf("%s: invalid redaction target %s (supported: %s)", fileName, target, strings.Join(RedactionTargets, ", "))
+		}
+		if action != RedactionHash && action != RedactionMask && action != RedactionNone {
+			return nil, fmt.Errorf("%s: invalid redaction %s for %s (supported: hash, mask, none)", fileName, action, target)
+		}
+	}
+	for assetType, fields := range config.RemoveFields {
+		for _, field := range fields {
+			if !strings.HasPrefix(field, "$.") {
+				return nil, fmt.Errorf("%s: invalid field %s for %s, fields start with $. (ie. $.resource.data.secret)", fileName, field, assetType)
+			}
+		}
+	}
+	return &config, nil
+}
+
+func (c *RedactionConfig) action(target string) string {
+	if action, found := c.Rules[target]; found {
+		return action
+	}
+	return RedactionNone
+}
+
+func (c *RedactionConfig) hashes() bool {
+	for _, action := range c.Rules {
+		if action == RedactionHash {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableRedaction redacts the graphs rendered and exported from now on. The values to
+// redact are collected from the assets, so the graph has to be loaded first. Fields are
+// removed from assets read after this call.
+func (v *GcpViz) EnableRedaction(config *RedactionConfig, salt string) error {
+	if config.hashes() && salt == "" {
+		return fmt.Errorf("a salt is required for hashing values (set -redaction-salt or GCPVIZ_REDACTION_SALT)")
+	}
+	r := &Redactor{config: config, salt: []byte(salt), words: make(map[string]string, 0)}
+	substrings := make(map[string]string, 0)
+	add := func(target string, value string) {
+		if value == "" || config.action(target) == RedactionNone {
+			return
+		}
+		if _, found := r.words[value]; found {
+			return
+		}
+		if _, found := substrings[value]; found {
+			return
+		}
+		replacement := r.replacement(target, value)
+		if strings.IndexFunc(value, func(c rune) bool { return !isNameChar(c) }) > -1 {
+			substrings[value] = replacement
+		} else {
+			r.words[value] = replacement
+		}
+	}
+
+	if v.AssetDatabase != nil {
+		err := v.AssetDatabase.View(func(tx *bolt.Tx) error {
+			assets := tx.Bucket([]byte("Assets"))
+			if assets == nil {
+				return nil
+			}
+			return assets.ForEach(func(k, bv []byte) error {
+				var asset TemplateResource
+				if err := json.Unmarshal(bv, &asset); err != nil {
+					return nil
+				}
+				data, _ := asset.Resource.Data.(map[string]interface{})
+				if asset.AssetType == "cloudresourcemanager.googleapis.com/Project" {
+					add(RedactProjectIds, GetLastPart(asset.Name))
+					if projectId, ok := data["projectId"].(string); ok {
+						add(RedactProjectIds, projectId)
+					}
+				} else {
+					add(RedactResourceNames, GetLastPart(asset.Name))
+				}
+				for _, field := range []string{"name", "displayName", "email"} {
+					if value, ok := data[field].(string); ok {
+						add(RedactResourceNames, GetLastPart(value))
+					}
+				}
+				// Principals of IAM policies keep the email or domain in id, i.e. alice@example.com
+				// of user:alice@example.com
+				if strings.HasPrefix(asset.Name, principalPrefix) {
+					for _, field := range []string{"id", "member"} {
+						if value, ok := data[field].(string); ok {
+							add(RedactResourceNames, value)
+						}
+					}
+				}
+				if labels, ok := data["labels"].(map[string]interface{}); ok {
+					for _, value := range labels {
+						if s, ok := value.(string); ok {
+							add(RedactLabelValues, s)
+						}
+					}
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Longer values first, so a value containing another is replaced as a whole
+	keys := make([]string, 0, len(substrings))
+	for value := range substrings {
+		keys = append(keys, value)
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	pairs := make([]string, 0, 2*len(keys))
+	for _, value := range keys {
+		pairs = append(pairs, value, substrings[value])
+	}
+	r.substrings = strings.NewReplacer(pairs...)
+	v.redactor = r
+	if values := len(r.words) + len(keys); values > 0 {
+		fmt.Fprintf(os.Stderr, "Redacting %d values in graphs and exports.\n", values)
+	}
+	return nil
+}
+
+// Redact replaces the sensitive values in a string, if redaction is enabled.
+func (v *GcpViz) Redact(s string) string {
+	return v.redactor.Redact(s)
+}
+
+func isNameChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_'
+}
+
+func (r *Redactor) replacement(target string, value string) string {
+	if r.config.action(target) == RedactionMask {
+		if target == RedactIpAddresses {
+			if strings.Contains(value, ":") {
+				return redactionMaskIpv6
+			}
+			return redactionMaskIp
+		}
+		return redactionMaskText
+	}
+	mac := hmac.New(sha256.New, r.salt)
+	mac.Write([]byte(value))
+	return redactionPrefixes[target] + "-" + hex.EncodeToString(mac.Sum(nil))[:redactionHashLength]
+}
+
+// Redact replaces the sensitive values in a string.
+func (r *Redactor) Redact(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+	s = r.substrings.Replace(s)
+	if r.config.action(RedactIpAddresses) != RedactionNone {
+		// IPv6 first, so IPv4-mapped addresses are replaced as a whole
+		s = r.redactIpv6(s)
+		s = ipv4Regexp.ReplaceAllStringFunc(s, func(ip string) string {
+			if net.ParseIP(ip) == nil {
+				return ip
+			}
+			return r.replacement(RedactIpAddresses, ip)
+		})
+	}
+	if len(r.words) == 0 {
+		return s
+	}
+	var out strings.Builder
+	start := -1
+	flush := func(end int) {
+		word := s[start:end]
+		if replacement, found := r.words[word]; found {
+			out.WriteString(replacement)
+		} else {
+			out.WriteString(word)
+		}
+		start = -1
+	}
+	for i, c := range s {
+		if isNameChar(c) {
+			if start == -1 {
+				start = i
+			}
+			continue
+		}
+		if start > -1 {
+			flush(i)
+		}
+		out.WriteRune(c)
+	}
+	if start > -1 {
+		flush(len(s))
+	}
+	return out.String()
+}
+
+// redactIpv6 replaces the IPv6 addresses in a string.
+func (r *Redactor) redactIpv6(s string) string {
+	matches := ipv6Regexp.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s
+	}
+	var out strings.Builder
+	last := 0
+	for _, match := range matches {
+		start, end := match[2], match[3]
+		ip := s[start:end]
+		if end < len(s) && isNameChar(rune(s[end])) || ip == "::" || net.ParseIP(ip) == nil {
+			continue
+		}
+		out.WriteString(s[last:start])
+		out.WriteString(r.replacement(RedactIpAddresses, ip))
+		last = end
+	}
+	out.WriteString(s[last:])
+	return out.String()
+}
+
+// RedactValue returns a copy of a JSON value with the sensitive values in its strings
+// replaced (map keys are kept).
+func (r *Redactor) RedactValue(value interface{}) interface{} {
+	if r == nil {
+		return value
+	}
+	switch typed := value.(type) {
+	case string:
+		return r.Redact(typed)
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(typed))
+		for k, val := range typed {
+			redacted[k] = r.RedactValue(val)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(typed))
+		for i, val := range typed {
+			redacted[i] = r.RedactValue(val)
+		}
+		return redacted
+	}
+	return value
+}
+
+// RedactResource returns a redacted copy of an asset for rendering.
+func (r *Redactor) RedactResource(resource *TemplateResource) *TemplateResource {
+	if r == nil || resource == nil {
+		return resource
+	}
+	redacted := *resource
+	redacted.Name = r.Redact(resource.Name)
+	redacted.Resource.Parent = r.Redact(resource.Resource.Parent)
+	redacted.Resource.Data = r.RedactValue(resource.Resource.Data)
+	redacted.Ancestors = make([]string, len(resource.Ancestors))
+	for i, ancestor := range resource.Ancestors {
+		redacted.Ancestors[i] = r.Redact(ancestor)
+	}
+	return &redacted
+}
+
+// removeFields blanks the configured fields of an asset, ie. secrets.
+func (r *Redactor) removeFields(assetType string, asset interface{}) {
+	if r == nil {
+		return
+	}
+	for _, field := range r.config.RemoveFields[assetType] {
+		removeJsonField(asset, strings.Split(strings.TrimPrefix(field, "$."), "."))
+	}
+}
+
+// removeJsonField replaces the value at a path (with [*] for all items of a list) with an
+// empty value of the same type.
+func removeJsonField(value interface{}, path []string) {
+	object, ok := value.(map[string]interface{})
+	if !ok || len(path) == 0 {
+		return
+	}
+	key := strings.TrimSuffix(path[0], "[*]")
+	child, found := object[key]
+	if !found {
+		return
+	}
+	if strings.HasSuffix(path[0], "[*]") {
+		items, _ := child.([]interface{})
+		for i, item := range items {
+			if len(path) == 1 {
+				items[i] = emptyJsonValue(item)
+			} else {
+				removeJsonField(item, path[1:])
+			}
+		}
+		return
+	}
+	if len(path) == 1 {
+		object[key] = emptyJsonValue(child)
+		return
+	}
+	removeJsonField(child, path[1:])
+}
+
+func emptyJsonValue(value interface{}) interface{} {
+	switch value.(type) {
+	case []interface{}:
+		return []interface{}{}
+	case map[string]interface{}:
+		return map[string]interface{}{}
+	case string:
+		return ""
+	}
+	return nil
+}
+
+// getRenderedAsset returns an asset for rendering, redacted if redaction is enabled.
+func (v *GcpViz) getRenderedAsset(node string) (*TemplateResource, error) {
+	asset, err := v.getAsset(node)
+	if err != nil {
+		return nil, err
+	}
+	return v.redactor.RedactResource(asset), nil
+}
+
+// redactNode redacts the name and asset of a rendered node, its label and attributes are
+// rendered from the redacted asset.
+func (v *GcpViz) redactNode(node *GraphNode) {
+	if v.redactor == nil {
+		return
+	}
+	node.Name = v.redactor.Redact(node.Name)
+	node.Resource = v.redactor.RedactResource(node.Resource)
+}
+
+// redactGraph redacts the nodes and clusters of a rendered graph. Nodes keep their
+// original names until the graph is complete, since clusters are built from them.
+func (v *GcpViz) redactGraph(g *Graph) {
+	if v.redactor == nil {
+		return
+	}
+	for _, node := range g.Nodes {
+		v.redactNode(node)
+	}
+	for _, cluster := range g.Clusters {
+		cluster.Name = v.redactor.Redact(cluster.Name)
+	}
+}
+
+// unredactedExportProperties are export properties without sensitive values.
+var unredactedExportProperties = map[string]bool{"assetType": true, "updateTime": true, "monthlyCost": true, "source": true}
+
+// redactExportNode redacts the name and properties of an exported node.
+func (v *GcpViz) redactExportNode(n *ExportNode) {
+	if v.redactor == nil {
+		return
+	}
+	n.Name = v.redactor.Redact(n.Name)
+	for k, val := range n.Properties {
+		switch {
+		case unredactedExportProperties[k]:
+		case k == "data":
+			n.Properties[k] = v.redactJson(val)
+		default:
+			n.Properties[k] = v.redactor.Redact(val)
+		}
+	}
+}
+
+// writeRedactedReport writes a report as JSON, with the strings redacted by each of the
+// redactors (the graphs a report was made from).
+func writeRedactedReport(out io.Writer, report interface{}, redactors ...*Redactor) error {
+	var value interface{} = report
+	for _, r := range redactors {
+		if r == nil {
+			continue
+		}
+		jsn, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		var redacted interface{}
+		if err := json.Unmarshal(jsn, &redacted); err != nil {
+			return err
+		}
+		value = r.RedactValue(redacted)
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(value)
+}
+
+// redactJson redacts the strings in a JSON document.
+func (v *GcpViz) redactJson(jsn string) string {
+	if v.redactor == nil {
+		return jsn
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(jsn), &value); err != nil {
+		return v.redactor.Redact(jsn)
+	}
+	redacted, err := json.Marshal(v.redactor.RedactValue(value))
+	if err != nil {
+		return v.redactor.Redact(jsn)
+	}
+	return string(redacted)
+}
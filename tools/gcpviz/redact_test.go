@@ -0,0 +1,151 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRedactIpAddresses(t *testing.T) {
+	r := &Redactor{
+		config:     &RedactionConfig{Rules: map[string]string{RedactIpAddresses: RedactionMask}},
+		words:      map[string]string{},
+		substrings: strings.NewReplacer(),
+	}
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"10.0.0.1", "x.x.x.x"},
+		{"range 10.0.0.0/24", "range x.x.x.x/24"},
+		{"2001:db8::1", "x:x::x"},
+		{"range 2001:db8:0:1::/64", "range x:x::x/64"},
+		{"fe80::1%eth0 and ::1", "x:x::x%eth0 and x:x::x"},
+		{"2001:0db8:0000:0000:0000:ff00:0042:8329,10.0.0.1", "x:x::x,x.x.x.x"},
+		{"::ffff:10.0.0.1", "x:x::x"},
+		{`"nextHopIp":"fd20:1:2:3::5"`, `"nextHopIp":"x:x::x"`},
+		// Not IPv6 addresses
+		{"12:30:45", "12:30:45"},
+		{"aa:bb:cc:dd:ee:ff", "aa:bb:cc:dd:ee:ff"},
+		{"std::string", "std::string"},
+		{"deadbeef::1", "deadbeef::1"},
+		{"2001:db8::1g", "2001:db8::1g"},
+		{"role:cafe::1", "role:cafe::1"},
+		{"Foo::Bar and ::", "Foo::Bar and ::"},
+	}
+	for _, test := range tests {
+		if redacted := r.Redact(test.value); redacted != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.value, test.expected, redacted)
+		}
+	}
+
+	r.config.Rules[RedactIpAddresses] = RedactionHash
+	r.salt = []byte("salt")
+	first := r.Redact("2001:db8::1")
+	if !strings.HasPrefix(first, "ip-") || first != r.Redact("2001:db8::1") || first == r.Redact("2001:db8::2") {
+		t.Errorf("expected consistent hashes of IPv6 addresses, got %s", first)
+	}
+}
+
+func TestWriteReportIsRedacted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpviz-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := newTestGraph(t, dir, testHierarchy("engineering", "2026-10-01T00:00:00Z"))
+	config := &RedactionConfig{Rules: map[string]string{
+		RedactProjectIds:    RedactionMask,
+		RedactResourceNames: RedactionMask,
+		RedactIpAddresses:   RedactionMask,
+	}}
+	if err := v.EnableRedaction(config, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	analysis := &PathAnalysis{
+		Source:      testProject,
+		Destination: testFolder,
+		Paths:       [][]string{{testProject, testFolder}},
+		Verdict:     VerdictAllowed,
+		Reasons:     []string{"route to 2001:db8::/32 in host-project", "allowed by a rule of engineering from 10.0.0.1"},
+		viz:         v,
+	}
+	var out bytes.Buffer
+	if err := analysis.WriteReport(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"1001", "456", "host-project", "engineering", "2001:db8", "10.0.0.1"} {
+		if strings.Contains(out.String(), value) {
+			t.Errorf("path report contains %s:\n%s", value, out.String())
+		}
+	}
+
+	diff := &GraphDiff{
+		Assets:   []AssetChange{{Name: testFolder, AssetType: "cloudresourcemanager.googleapis.com/Folder", Change: "modified", ChangedFields: []string{"displayName"}}},
+		Edges:    []EdgeChange{{From: testProject, To: testFolder, Change: "removed"}},
+		previous: v,
+		current:  v,
+	}
+	out.Reset()
+	if err := diff.WriteReport(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"1001", "456"} {
+		if strings.Contains(out.String(), value) {
+			t.Errorf("diff report contains %s:\n%s", value, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "displayName") {
+		t.Errorf("expected changed fields to be kept:\n%s", out.String())
+	}
+}
+
+func TestPrincipalLabelsAreRedacted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpviz-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy := `{"name": "` + testProject + `", "asset_type": "cloudresourcemanager.googleapis.com/Project", "iam_policy": {"bindings": [{"role": "roles/viewer", "members": ["user:alice@example.com", "group:devs@example.com", "deleted:user:bob@example.com"]}]}, "ancestors": ["projects/1001", "folders/456", "organizations/123"]}`
+	v := newTestGraph(t, dir, testHierarchy("engineering", "2026-10-01T00:00:00Z")+policy+"\n")
+	config := &RedactionConfig{Rules: map[string]string{RedactResourceNames: RedactionMask}}
+	if err := v.EnableRedaction(config, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, member := range []string{"user:alice@example.com", "group:devs@example.com", "deleted:user:bob@example.com"} {
+		node, err := v.renderNode(principalPrefix+member, int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node == nil {
+			t.Fatalf("principal %s was not rendered", member)
+		}
+		for _, value := range []string{"alice", "devs", "bob", "example.com"} {
+			if strings.Contains(node.Attributes, value) {
+				t.Errorf("label of %s contains %s: %s", member, value, node.Attributes)
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yalp/jsonpath"
+	"gopkg.in/yaml.v3"
+)
+
+// RelationFunc extracts values from a resource, same as a prepared JSONPath.
+type RelationFunc func(value interface{}) (interface{}, error)
+
+// Variables of CEL expressions in relations: asset_types, aliases and ip_addresses
+// expressions get the resource (with data and parent), enrich expressions the data of
+// the sub-asset.
+var (
+	relationResourceVariables = []string{"resource", "data", "parent"}
+	relationDataVariables     = []string{"data"}
+)
+
+// RelationError is a runtime error of a CEL expression in the relations file. Unlike
+// JSONPaths that don't match, it points to a broken entry, so it is reported.
+type RelationError struct {
+	// Location of the entry in the relations file, ie. relations.yaml:29: asset_types > ...
+	Entry string
+	Err   error
+}
+
+func (e *RelationError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Entry, e.Err)
+}
+
+// compileRelation prepares a relation expression: expressions starting with $ are
+// JSONPaths, others are CEL expressions. Runtime errors of CEL expressions are returned
+// as a *RelationError with the entry.
+func compileRelation(expression string, enrich bool, entry string) (RelationFunc, error) {
+	if strings.HasPrefix(strings.TrimSpace(expression), "$") {
+		path, err := jsonpath.Prepare(strings.TrimSpace(expression))
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSONPath %s: %v", expression, err)
+		}
+		return RelationFunc(path), nil
+	}
+
+	variables := relationResourceVariables
+	if enrich {
+		variables = relationDataVariables
+	}
+	program, err := CompileCel(expression, variables...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CEL expression %q (JSONPaths start with $): %v", expression, err)
+	}
+	return func(value interface{}) (interface{}, error) {
+		var activation map[string]interface{}
+		if enrich {
+			activation = map[string]interface{}{"data": value}
+		} else {
+			resource, _ := value.(map[string]interface{})
+			activation = map[string]interface{}{"resource": resource, "data": resource["data"], "parent": resource["parent"]}
+		}
+		result, err := program.Eval(activation)
+		if err != nil {
+			return nil, &RelationError{Entry: entry, Err: err}
+		}
+		if result == nil {
+			return []interface{}{}, nil
+		}
+		return result, nil
+	}, nil
+}
+
+// relationsError adds the location of an entry in the relations file to an error.
+func relationsError(fileName string, root *yaml.Node, err error, path ...interface{}) error {
+	return fmt.Errorf("%s: %v", relationsEntry(fileName, root, path...), err)
+}
+
+// relationsEntry returns the location of an entry in the relations file.
+func relationsEntry(fileName string, root *yaml.Node, path ...interface{}) string {
+	location := make([]string, 0, len(path))
+	for _, p := range path {
+		switch key := p.(type) {
+		case string:
+			location = append(location, key)
+		case int:
+			location[len(location)-1] = fmt.Sprintf("%s[%d]", location[len(location)-1], key)
+		}
+	}
+	line := 0
+	if node := yamlNodeAt(root, path...); node != nil {
+		line = node.Line
+	}
+	return fmt.Sprintf("%s:%d: %s", fileName, line, strings.Join(location, " > "))
+}
+
+// yamlNodeAt finds the node of a map key (string) or sequence index (int) path.
+func yamlNodeAt(node *yaml.Node, path ...interface{}) *yaml.Node {
+	if node != nil && node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, p := range path {
+		if node == nil {
+			return nil
+		}
+		var next *yaml.Node
+		switch key := p.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(node.Content); i += 2 {
+					if node.Content[i].Value == key {
+						next = node.Content[i+1]
+					}
+				}
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && key < len(node.Content) {
+				next = node.Content[key]
+			}
+		}
+		node = next
+	}
+	return node
+}
+
+// compileRelationList prepares the expressions of a section of the relations file.
+func compileRelationList(fileName string, root *yaml.Node, section string, raw map[string][]string) (map[string][]RelationFunc, error) {
+	relations := make(map[string][]RelationFunc, len(raw))
+	for assetType, expressions := range raw {
+		relations[assetType] = make([]RelationFunc, len(expressions))
+		for idx, expression := range expressions {
+			relation, err := compileRelation(expression, false, relationsEntry(fileName, root, section, assetType, idx))
+			if err != nil {
+				return nil, relationsError(fileName, root, err, section, assetType, idx)
+			}
+			relations[assetType][idx] = relation
+		}
+	}
+	return relations, nil
+}
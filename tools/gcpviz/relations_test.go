@@ -0,0 +1,82 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRelationErrorsAreReported(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpviz-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "relations.yaml")
+	relations := `asset_types:
+  compute.googleapis.com/Network:
+    - $.data.peerings[*].network
+    - data.peerings.map(p, p.network)
+`
+	if err := ioutil.WriteFile(fileName, []byte(relations), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v := &GcpViz{}
+	if err := v.loadRelationsMap(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	asset := map[string]interface{}{
+		"name": "//compute.googleapis.com/projects/p/global/networks/vpc",
+		"resource": map[string]interface{}{
+			"data": map[string]interface{}{
+				"peerings": []interface{}{
+					map[string]interface{}{"name": "a", "network": "projects/p/global/networks/a"},
+					map[string]interface{}{"name": "b"},
+				},
+			},
+		},
+	}
+	paths := v.Relations.AssetTypes["compute.googleapis.com/Network"]
+	_, err = paths[1](asset["resource"])
+	relationErr, ok := err.(*RelationError)
+	if !ok {
+		t.Fatalf("expected a relation error, got %v", err)
+	}
+	expected := fileName + ":4: asset_types > compute.googleapis.com/Network[1]"
+	if relationErr.Entry != expected {
+		t.Errorf("expected entry %s, got %s", expected, relationErr.Entry)
+	}
+	if !strings.Contains(relationErr.Error(), "no such key: network") {
+		t.Errorf("expected the CEL error, got %v", relationErr)
+	}
+
+	// The JSONPath still returns the network, the failed CEL expression is counted
+	targets := v.resourceJsonPaths(paths, asset)
+	if len(targets) != 1 || targets[0] != "projects/p/global/networks/a" {
+		t.Errorf("unexpected targets %v", targets)
+	}
+	v.resourceJsonPaths(paths, asset)
+	if v.relationFailures[expected] != 2 {
+		t.Errorf("expected 2 failures of %s, got %v", expected, v.relationFailures)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxQuerySize = 1024 * 1024
+
+// DefaultQueryTimeout is the time a query can run, including waiting for other queries.
+const DefaultQueryTimeout = 30 * time.Second
+
+var formatContentTypes = map[string]string{
+	FormatDot:  "text/vnd.graphviz; charset=utf-8",
+	FormatSvg:  "image/svg+xml",
+	FormatJson: "application/json",
+	FormatHtml: "text/html; charset=utf-8",
+}
+
+// Server serves Gizmo queries and rendered graphs over HTTP from a graph loaded once.
+//
+// Endpoints:
+//
+//	GET  /api/queries                 lists the query files with their descriptions and parameters
+//	GET  /api/queries/<name>?format=  renders a query file (dot, svg, json or html)
+//	POST /api/query?limit=            runs the Gizmo query in the request body, returns JSON
+//
+// Other URL parameters are passed to the queries as parameters (param=value), "title"
+// sets the graph title.
+type Server struct {
+	viz        *GcpViz
+	queriesDir string
+
+	// QueryTimeout cancels queries (and the Gizmo JavaScript running them) that take longer
+	QueryTimeout time.Duration
+
+	// Rendering keeps state in the graph engine, so requests are served one at a time
+	busy chan struct{}
+}
+
+func NewServer(viz *GcpViz, queriesDir string) *Server {
+	return &Server{viz: viz, queriesDir: queriesDir, QueryTimeout: DefaultQueryTimeout, busy: make(chan struct{}, 1)}
+}
+
+// HttpServer returns a HTTP server for the API, with timeouts so slow clients and queries
+// don't hold connections forever.
+func (s *Server) HttpServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      s.QueryTimeout + 30*time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// runQuery runs a query with the query timeout once the previous queries are done.
+func (s *Server) runQuery(ctx context.Context, run func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout)
+	defer cancel()
+	select {
+	case s.busy <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for other queries: %v", ctx.Err())
+	}
+	defer func() { <-s.busy }()
+	err := run(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("query timed out after %s: %v", s.QueryTimeout, err)
+	}
+	return err
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/api/queries", s.handleListQueries)
+	mux.HandleFunc("/api/queries/", s.handleRenderQuery)
+	mux.HandleFunc("/api/query", s.handleQuery)
+	return mux
+}
+
+func writeJsonResponse(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(value)
+}
+
+func writeJsonError(w http.ResponseWriter, status int, err error) {
+	writeJsonResponse(w, status, map[string]string{"error": err.Error()})
+}
+
+// queryParameters returns the URL parameters that are not reserved for the server.
+func (s *Server) queryParameters(r *http.Request, reserved ...string) map[string]interface{} {
+	parameters := make(map[string]interface{}, 0)
+	for k, values := range r.URL.Query() {
+		isReserved := false
+		for _, rk := range reserved {
+			if k == rk {
+				isReserved = true
+			}
+		}
+		if !isReserved && len(values) > 0 {
+			parameters[k] = values[len(values)-1]
+		}
+	}
+	return parameters
+}
+
+func (s *Server) queryFiles() ([]string, error) {
+	files, err := ioutil.ReadDir(s.queriesDir)
+	if err != nil {
+		return nil, err
+	}
+	queries := make([]string, 0, len(files))
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".js") {
+			queries = append(queries, strings.TrimSuffix(f.Name(), ".js"))
+		}
+	}
+	sort.Strings(queries)
+	return queries, nil
+}
+
+func (s *Server) handleListQueries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	queries, err := s.queryFiles()
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	metadata, err := ListQueries(s.queriesDir)
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, map[string]interface{}{"queries": queries, "metadata": metadata})
+}
+
+func (s *Server) handleRenderQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/queries/"), ".js")
+	queries, err := s.queryFiles()
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// Only the files in the queries directory can be rendered
+	i := sort.SearchStrings(queries, name)
+	if i == len(queries) || queries[i] != name {
+		writeJsonError(w, http.StatusNotFound, fmt.Errorf("query %s not found", name))
+		return
+	}
+	gizmoQuery, err := ioutil.ReadFile(filepath.Join(s.queriesDir, name+".js"))
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FormatSvg
+	}
+	contentType, ok := formatContentTypes[format]
+	if !ok {
+		writeJsonError(w, http.StatusBadRequest, fmt.Errorf("unsupported output format %s (supported: %s)", format, strings.Join(OutputFormats, ", ")))
+		return
+	}
+	parameters := s.queryParameters(r, "format", "title")
+	parameters["Title"] = s.viz.EscapeLabel(r.URL.Query().Get("title"))
+
+	var out bytes.Buffer
+	err = s.runQuery(r.Context(), func(ctx context.Context) error {
+		graph, err := s.viz.GenerateGraph(ctx, string(gizmoQuery), parameters)
+		if err != nil {
+			return err
+		}
+		return RenderGraph(graph, format, &out)
+	})
+	if err != nil {
+		if _, ok := err.(*QueryParameterError); ok {
+			writeJsonError(w, http.StatusBadRequest, err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Failed to render query %s: %v\n", name, err)
+		writeJsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(out.Bytes())
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed, send the query in a POST body", r.Method))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxQuerySize))
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		writeJsonError(w, http.StatusBadRequest, fmt.Errorf("empty query"))
+		return
+	}
+	limit := -1
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			writeJsonError(w, http.StatusBadRequest, fmt.Errorf("invalid limit: %s", l))
+			return
+		}
+	}
+	parameters := s.queryParameters(r, "limit")
+
+	var results []interface{}
+	err = s.runQuery(r.Context(), func(ctx context.Context) error {
+		results, err = s.viz.RunQuery(ctx, string(body), parameters, limit)
+		return err
+	})
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJsonResponse(w, http.StatusOK, map[string]interface{}{"result": s.viz.redactor.RedactValue(results)})
+}
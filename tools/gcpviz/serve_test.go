@@ -0,0 +1,61 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerQueryTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpviz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v := newTestGraph(t, dir, testHierarchy("prod", "2026-10-01T00:00:00Z"))
+	defer v.AssetDatabase.Close()
+
+	server := NewServer(v, "queries")
+	server.QueryTimeout = 200 * time.Millisecond
+	handler := server.Handler()
+	query := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/query", strings.NewReader(body)))
+		return w
+	}
+
+	start := time.Now()
+	w := query("while (true) {}")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "timed out") {
+		t.Errorf("expected the query to time out, got %d %s", w.Code, w.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("query was cancelled after %s", elapsed)
+	}
+
+	// The server still answers queries after a timeout
+	w = query(`g.V("` + testFolder + `").Out("child").All()`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), testProject) {
+		t.Errorf("expected the project, got %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,142 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/cayleygraph/cayley"
+)
+
+// SourcePredicate links a vertex to the export it was read from, ie.
+// g.V().has("source", "org-a.json") returns the vertexes of one export.
+const SourcePredicate = "source"
+
+// ExpandInventoryFiles returns the files of the inputs, directories are replaced with the
+// files in them (hidden files are skipped) in lexical order.
+func ExpandInventoryFiles(inputs []string) ([]string, error) {
+	files := make([]string, 0, len(inputs))
+	for _, input := range inputs {
+		finfo, err := os.Stat(input)
+		if err != nil {
+			return nil, err
+		}
+		if !finfo.IsDir() {
+			files = append(files, input)
+			continue
+		}
+		dirFiles := make([]string, 0)
+		err = filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path != input && strings.HasPrefix(info.Name(), ".") {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode().IsRegular() {
+				dirFiles = append(dirFiles, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(dirFiles) == 0 {
+			return nil, fmt.Errorf("no files in directory %s", input)
+		}
+		sort.Strings(dirFiles)
+		files = append(files, dirFiles...)
+	}
+	return files, nil
+}
+
+// ReadAssetsFromFiles reads and merges multiple exports (files, gzipped files or
+// directories of them). Assets in several exports are deduplicated by name, the asset with
+// the latest update time is kept (or the one read last, if the times are equal).
+func (v *GcpViz) ReadAssetsFromFiles(inputs []string, addResourceData bool) error {
+	files, err := ExpandInventoryFiles(inputs)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if len(files) > 1 {
+			fmt.Fprintf(os.Stderr, "Reading export %s...\n", file)
+		}
+		if err := v.ReadAssetsFromFile(file, addResourceData); err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	if v.DuplicateAssets > 0 {
+		fmt.Fprintf(os.Stderr, "Merged %d assets found in multiple exports.\n", v.DuplicateAssets)
+	}
+	return nil
+}
+
+// inventoryReader returns a reader for an export, decompressing it if it is gzipped.
+func inventoryReader(file *os.File) (io.Reader, error) {
+	reader := bufio.NewReader(file)
+	magic, err := reader.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(reader)
+	}
+	return reader, nil
+}
+
+// replaceDuplicateAsset checks an asset against an asset with the same name read from an
+// earlier export. It returns false if the earlier asset is newer, otherwise the quads of
+// the earlier asset are removed so it can be replaced.
+func (v *GcpViz) replaceDuplicateAsset(tx *bolt.Tx, name string, resource interface{}) (bool, error) {
+	existing := tx.Bucket([]byte("Assets")).Get([]byte(name))
+	if existing == nil {
+		return true, nil
+	}
+	v.DuplicateAssets++
+
+	var current map[string]interface{}
+	if err := json.Unmarshal(existing, &current); err == nil {
+		if asset, ok := resource.(map[string]interface{}); ok {
+			currentTime := parseFeedTime(feedString(current, "update_time"))
+			updateTime := parseFeedTime(feedString(asset, "update_time"))
+			if currentTime.After(updateTime) {
+				return false, nil
+			}
+		}
+	}
+	if _, err := v.removeAssetQuads(name); err != nil {
+		return false, err
+	}
+	v.TotalVertexes--
+	v.TotalEdges--
+	return true, nil
+}
+
+// addAssetSource records the export an asset was read from.
+func (v *GcpViz) addAssetSource(name string, assetType string, source string) {
+	v.QW.AddQuad(cayley.Quad(name, SourcePredicate, source, assetType))
+}
@@ -0,0 +1,51 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	cquad "github.com/cayleygraph/quad"
+)
+
+func TestReadAssetsFromFilesMergesDuplicateParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpviz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The later export has a newer version of the folder, but not its project
+	v := newTestGraph(t, dir, testHierarchy("prod", "2026-10-01T00:00:00Z"), testFolderAsset("production", "2026-10-02T00:00:00Z")+"\n")
+	defer v.AssetDatabase.Close()
+
+	if v.DuplicateAssets != 1 {
+		t.Errorf("expected 1 duplicate asset, got %d", v.DuplicateAssets)
+	}
+	assertParent(t, v, testFolder, testOrganization)
+	assertParent(t, v, testProject, testFolder)
+	if data := v.quadsOf(cquad.Subject, testFolder, "data"); len(data) != 1 || !strings.Contains(fmt.Sprint(cquad.NativeOf(data[0].Object)), "production") {
+		t.Errorf("expected the data of the newer folder, got %v", data)
+	}
+	if sources := v.quadsOf(cquad.Subject, testFolder, SourcePredicate); len(sources) != 1 || !strings.HasSuffix(fmt.Sprint(cquad.NativeOf(sources[0].Object)), "export1.json") {
+		t.Errorf("expected the folder to be read from the later export, got %v", sources)
+	}
+}
@@ -0,0 +1,296 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type svgStyle struct {
+	attrs    map[string]string
+	defaults map[string]string
+}
+
+func (s svgStyle) get(key string, fallback string) string {
+	if v, ok := s.attrs[key]; ok && DotString(v) != "" {
+		return DotString(v)
+	}
+	if v, ok := s.defaults[key]; ok && DotString(v) != "" {
+		return DotString(v)
+	}
+	return fallback
+}
+
+func (s svgStyle) float(key string, fallback float64) float64 {
+	if f, err := strconv.ParseFloat(s.get(key, ""), 64); err == nil {
+		return f
+	}
+	return fallback
+}
+
+func (s svgStyle) has(style string) bool {
+	for _, st := range strings.Split(s.get("style", ""), ",") {
+		if strings.TrimSpace(st) == style {
+			return true
+		}
+	}
+	return false
+}
+
+func (s svgStyle) dashArray() string {
+	if s.has("dashed") {
+		return ` stroke-dasharray="5,3"`
+	}
+	if s.has("dotted") {
+		return ` stroke-dasharray="1,3"`
+	}
+	return ""
+}
+
+func svgEscape(s string) string {
+	return html.EscapeString(s)
+}
+
+func svgColor(color string) string {
+	if color == "" {
+		return "none"
+	}
+	// Graphviz color lists (ie. "red:blue") are not supported, use the first color
+	return svgEscape(strings.SplitN(color, ":", 2)[0])
+}
+
+// WriteSvg lays out the graph and writes it as a SVG image, without needing Graphviz.
+func (g *Graph) WriteSvg(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	g.writeSvg(w, true)
+	// The buffered writer keeps the first write error, Flush returns it
+	return w.Flush()
+}
+
+func (g *Graph) writeSvg(w io.Writer, standalone bool) {
+	graphStyle := svgStyle{attrs: ParseDotAttributes(g.Global["graph"])}
+	nodeDefaults := ParseDotAttributes(g.Global["node"])
+	edgeDefaults := ParseDotAttributes(g.Global["edge"])
+
+	title := g.Title()
+	titleSize := graphStyle.float("fontsize", 14.0)
+	topMargin := 0.0
+	if title != "" {
+		topMargin = float64(len(strings.Split(title, "\n")))*titleSize*1.3 + layoutMargin/2
+	}
+	layout := LayoutGraph(g, topMargin)
+
+	if standalone {
+		fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\" standalone=\"no\"?>\n")
+	}
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" xmlns:xlink=\"http://www.w3.org/1999/xlink\" width=\"%.0fpt\" height=\"%.0fpt\" viewBox=\"0 0 %.2f %.2f\">\n", layout.Width, layout.Height, layout.Width, layout.Height)
+	fmt.Fprintf(w, "<g id=\"graph0\" class=\"graph\">\n")
+	if bg := graphStyle.get("bgcolor", ""); bg != "" {
+		fmt.Fprintf(w, "<rect x=\"0\" y=\"0\" width=\"%.2f\" height=\"%.2f\" fill=\"%s\"/>\n", layout.Width, layout.Height, svgColor(bg))
+	}
+	if title != "" {
+		x, anchor := layout.Width/2, "middle"
+		if graphStyle.get("labeljust", "") == "l" {
+			x, anchor = layoutMargin, "start"
+		} else if graphStyle.get("labeljust", "") == "r" {
+			x, anchor = layout.Width-layoutMargin, "end"
+		}
+		writeSvgText(w, strings.Split(title, "\n"), x, layoutMargin/2+titleSize, titleSize, anchor, graphStyle.get("fontname", "sans-serif"), graphStyle.get("fontcolor", "black"))
+	}
+
+	markers := make(map[string]string, 0)
+	fmt.Fprintf(w, "<defs>\n")
+	for _, edge := range layout.Edges {
+		style := svgStyle{attrs: ParseDotAttributes(edge.Edge.Attributes), defaults: edgeDefaults}
+		color := style.get("color", "black")
+		if _, found := markers[color]; !found {
+			markers[color] = fmt.Sprintf("arrow%d", len(markers))
+			fmt.Fprintf(w, "<marker id=\"%s\" viewBox=\"0 0 10 10\" refX=\"10\" refY=\"5\" markerWidth=\"8\" markerHeight=\"8\" orient=\"auto-start-reverse\"><path d=\"M 0 0 L 10 5 L 0 10 z\" fill=\"%s\"/></marker>\n", markers[color], svgColor(color))
+		}
+	}
+	fmt.Fprintf(w, "</defs>\n")
+
+	for _, cluster := range layout.Clusters {
+		writeSvgCluster(w, cluster, svgStyle{attrs: ParseDotAttributes(cluster.Cluster.Attributes), defaults: graphStyle.attrs})
+	}
+	for _, edge := range layout.Edges {
+		writeSvgEdge(w, edge, svgStyle{attrs: ParseDotAttributes(edge.Edge.Attributes), defaults: edgeDefaults}, markers)
+	}
+	for _, node := range layout.Nodes {
+		writeSvgNode(w, node, svgStyle{attrs: ParseDotAttributes(node.Node.Attributes), defaults: nodeDefaults})
+	}
+	fmt.Fprintf(w, "</g>\n</svg>\n")
+}
+
+func writeSvgText(w io.Writer, lines []string, x float64, y float64, fontSize float64, anchor string, fontName string, color string) {
+	fmt.Fprintf(w, "<text text-anchor=\"%s\" font-family=\"%s\" font-size=\"%.1f\" fill=\"%s\">", anchor, svgEscape(fontName), fontSize, svgColor(color))
+	for i, line := range lines {
+		fmt.Fprintf(w, "<tspan x=\"%.2f\" y=\"%.2f\">%s</tspan>", x, y+float64(i)*fontSize*1.2, svgEscape(line))
+	}
+	fmt.Fprintf(w, "</text>\n")
+}
+
+func writeSvgCluster(w io.Writer, c *LayoutCluster, style svgStyle) {
+	fill := "none"
+	if style.has("filled") {
+		fill = style.get("fillcolor", style.get("color", "lightgrey"))
+	}
+	rx := 0.0
+	if style.has("rounded") {
+		rx = 8.0
+	}
+	label := c.Cluster.Label
+	if l, ok := style.attrs["label"]; ok {
+		label = PlainLabel(l, false)
+	}
+	fmt.Fprintf(w, "<g id=\"cluster_%d\" class=\"cluster\" data-name=\"%s\">\n", c.Cluster.Id, svgEscape(c.Cluster.Name))
+	fmt.Fprintf(w, "<title>%s</title>\n", svgEscape(label))
+	fmt.Fprintf(w, "<rect x=\"%.2f\" y=\"%.2f\" width=\"%.2f\" height=\"%.2f\" rx=\"%.1f\" fill=\"%s\" stroke=\"%s\" stroke-width=\"%.1f\"%s/>\n",
+		c.X, c.Y, c.Width, c.Height, rx, svgColor(fill), svgColor(style.get("pencolor", style.get("color", "black"))), style.float("penwidth", 1.0), style.dashArray())
+	fontSize := style.float("fontsize", 12.0)
+	if fontSize > layoutClusterLabel {
+		fontSize = layoutClusterLabel
+	}
+	writeSvgText(w, []string{label}, c.X+layoutClusterMargin/2, c.Y+fontSize+4, fontSize, "start", style.get("fontname", "sans-serif"), style.get("fontcolor", "black"))
+	fmt.Fprintf(w, "</g>\n")
+}
+
+func writeSvgNode(w io.Writer, n *LayoutNode, style svgStyle) {
+	if style.has("invis") {
+		return
+	}
+	shape := style.get("shape", "ellipse")
+	color := style.get("color", "black")
+	fill := "none"
+	if style.has("filled") {
+		fill = style.get("fillcolor", style.get("color", "lightgrey"))
+	}
+	stroke := fmt.Sprintf("fill=\"%s\" stroke=\"%s\" stroke-width=\"%.1f\"%s", svgColor(fill), svgColor(color), style.float("penwidth", 1.0), style.dashArray())
+	x, y := n.X-n.Width/2, n.Y-n.Height/2
+
+	fmt.Fprintf(w, "<g id=\"%s\" class=\"node\" data-name=\"%s\" data-type=\"%s\">\n", nodeId(n.Node.Id), svgEscape(n.Node.Name), svgEscape(n.Node.AssetType))
+	fmt.Fprintf(w, "<title>%s</title>\n", svgEscape(style.get("tooltip", n.Node.Name)))
+	url := style.get("URL", style.get("href", ""))
+	if url != "" {
+		fmt.Fprintf(w, "<a xlink:href=\"%s\" target=\"_blank\">\n", svgEscape(url))
+	}
+	switch shape {
+	case "plaintext", "plain", "none":
+	case "ellipse", "oval", "circle", "doublecircle", "point", "egg":
+		fmt.Fprintf(w, "<ellipse cx=\"%.2f\" cy=\"%.2f\" rx=\"%.2f\" ry=\"%.2f\" %s/>\n", n.X, n.Y, n.Width/2, n.Height/2, stroke)
+	case "note":
+		fold := math.Min(10, n.Height/3)
+		fmt.Fprintf(w, "<path d=\"M %.2f %.2f L %.2f %.2f L %.2f %.2f L %.2f %.2f L %.2f %.2f Z M %.2f %.2f L %.2f %.2f L %.2f %.2f\" %s/>\n",
+			x, y, x+n.Width-fold, y, x+n.Width, y+fold, x+n.Width, y+n.Height, x, y+n.Height,
+			x+n.Width-fold, y, x+n.Width-fold, y+fold, x+n.Width, y+fold, stroke)
+	case "folder", "tab":
+		tab := math.Min(8, n.Height/4)
+		fmt.Fprintf(w, "<path d=\"M %.2f %.2f L %.2f %.2f L %.2f %.2f L %.2f %.2f L %.2f %.2f L %.2f %.2f L %.2f %.2f Z\" %s/>\n",
+			x, y, x+n.Width/3, y, x+n.Width/3+tab, y+tab, x+n.Width, y+tab, x+n.Width, y+n.Height, x, y+n.Height, x, y, stroke)
+	case "cylinder":
+		capHeight := math.Min(8, n.Height/4)
+		fmt.Fprintf(w, "<path d=\"M %.2f %.2f A %.2f %.2f 0 0 0 %.2f %.2f L %.2f %.2f A %.2f %.2f 0 0 1 %.2f %.2f Z M %.2f %.2f A %.2f %.2f 0 0 0 %.2f %.2f\" %s/>\n",
+			x, y+capHeight, n.Width/2, capHeight, x+n.Width, y+capHeight, x+n.Width, y+n.Height-capHeight, n.Width/2, capHeight, x, y+n.Height-capHeight,
+			x, y+capHeight, n.Width/2, capHeight, x+n.Width, y+capHeight, stroke)
+	default:
+		rx := 0.0
+		if shape == "Mrecord" || style.has("rounded") {
+			rx = 6.0
+		}
+		fmt.Fprintf(w, "<rect x=\"%.2f\" y=\"%.2f\" width=\"%.2f\" height=\"%.2f\" rx=\"%.1f\" %s/>\n", x, y, n.Width, n.Height, rx, stroke)
+	}
+	textTop := n.Y - float64(len(n.Lines))*n.FontSize*1.2/2 + n.FontSize
+	writeSvgText(w, n.Lines, n.X, textTop, n.FontSize, "middle", style.get("fontname", "sans-serif"), style.get("fontcolor", "black"))
+	if url != "" {
+		fmt.Fprintf(w, "</a>\n")
+	}
+	fmt.Fprintf(w, "</g>\n")
+}
+
+// clipToBox returns the point where the line from the center of the node towards
+// (tx, ty) crosses the bounding box of the node.
+func clipToBox(n *LayoutNode, tx float64, ty float64) (float64, float64) {
+	dx, dy := tx-n.X, ty-n.Y
+	if dx == 0 && dy == 0 {
+		return n.X, n.Y
+	}
+	scale := math.Inf(1)
+	if dx != 0 {
+		scale = math.Min(scale, (n.Width/2)/math.Abs(dx))
+	}
+	if dy != 0 {
+		scale = math.Min(scale, (n.Height/2)/math.Abs(dy))
+	}
+	return n.X + dx*scale, n.Y + dy*scale
+}
+
+func writeSvgEdge(w io.Writer, e *LayoutEdge, style svgStyle, markers map[string]string) {
+	if style.has("invis") {
+		return
+	}
+	color := style.get("color", "black")
+	fmt.Fprintf(w, "<g id=\"%s_%s\" class=\"edge\" data-from=\"%s\" data-to=\"%s\">\n", nodeId(e.Edge.From), nodeId(e.Edge.To), nodeId(e.Edge.From), nodeId(e.Edge.To))
+
+	var path string
+	var midX, midY float64
+	if e.From == e.To {
+		x, y := e.From.X+e.From.Width/2, e.From.Y
+		path = fmt.Sprintf("M %.2f %.2f C %.2f %.2f %.2f %.2f %.2f %.2f", x, y-5, x+30, y-25, x+30, y+25, x, y+5)
+		midX, midY = x+25, y
+	} else {
+		x1, y1 := clipToBox(e.From, e.To.X, e.To.Y)
+		x2, y2 := clipToBox(e.To, e.From.X, e.From.Y)
+		path = fmt.Sprintf("M %.2f %.2f L %.2f %.2f", x1, y1, x2, y2)
+		midX, midY = (x1+x2)/2, (y1+y2)/2
+	}
+
+	dir := style.get("dir", "forward")
+	markerEnd, markerStart := "", ""
+	if (dir == "forward" || dir == "both") && style.get("arrowhead", "normal") != "none" {
+		markerEnd = fmt.Sprintf(" marker-end=\"url(#%s)\"", markers[color])
+	}
+	if (dir == "back" || dir == "both") && style.get("arrowtail", "normal") != "none" {
+		markerStart = fmt.Sprintf(" marker-start=\"url(#%s)\"", markers[color])
+	}
+	fmt.Fprintf(w, "<path d=\"%s\" fill=\"none\" stroke=\"%s\" stroke-width=\"%.1f\"%s%s%s/>\n", path, svgColor(color), style.float("penwidth", 1.0), style.dashArray(), markerEnd, markerStart)
+
+	fontSize := style.float("fontsize", 10.0)
+	if label, ok := style.attrs["label"]; ok {
+		if text := PlainLabel(label, false); text != "" {
+			writeSvgText(w, strings.Split(text, "\n"), midX, midY, fontSize, "middle", style.get("fontname", "sans-serif"), style.get("fontcolor", "black"))
+		}
+	}
+	if label, ok := style.attrs["taillabel"]; ok {
+		if text := PlainLabel(label, false); text != "" && e.From != e.To {
+			x, y := clipToBox(e.From, e.To.X, e.To.Y)
+			writeSvgText(w, strings.Split(text, "\n"), x, y+fontSize, fontSize, "middle", style.get("fontname", "sans-serif"), style.get("fontcolor", "black"))
+		}
+	}
+	if label, ok := style.attrs["headlabel"]; ok {
+		if text := PlainLabel(label, false); text != "" && e.From != e.To {
+			x, y := clipToBox(e.To, e.From.X, e.From.Y)
+			writeSvgText(w, strings.Split(text, "\n"), x, y-fontSize/2, fontSize, "middle", style.get("fontname", "sans-serif"), style.get("fontcolor", "black"))
+		}
+	}
+	fmt.Fprintf(w, "</g>\n")
+}
@@ -0,0 +1,507 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+	"github.com/cayleygraph/cayley"
+	"github.com/cayleygraph/cayley/graph"
+	cquad "github.com/cayleygraph/quad"
+	"github.com/pkg/errors"
+)
+
+// feedChange is the latest state of an asset from Cloud Asset Inventory feed messages.
+type feedChange struct {
+	name      string
+	deleted   bool
+	asset     map[string]interface{}
+	startTime time.Time
+}
+
+// camelToSnake converts the proto3 JSON field names used in feed messages (ie. assetType)
+// into the field names used in exports (ie. asset_type).
+func camelToSnake(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// normalizeFeedAsset rewrites an asset from a feed message in the same format as the
+// assets in a Cloud Asset Inventory export. The resource data itself is left as-is.
+func normalizeFeedAsset(asset map[string]interface{}) map[string]interface{} {
+	normalized := make(map[string]interface{}, len(asset))
+	for k, val := range asset {
+		if k == "resource" {
+			if resource, ok := val.(map[string]interface{}); ok {
+				normalizedResource := make(map[string]interface{}, len(resource))
+				for rk, rv := range resource {
+					if rk == "data" {
+						normalizedResource[rk] = rv
+					} else {
+						normalizedResource[camelToSnake(rk)] = rv
+					}
+				}
+				val = normalizedResource
+			}
+		}
+		normalized[camelToSnake(k)] = val
+	}
+	return normalized
+}
+
+func feedString(m map[string]interface{}, keys ...string) string {
+	for _, k := range keys {
+		if val, ok := m[k].(string); ok {
+			return val
+		}
+	}
+	return ""
+}
+
+func feedMap(m map[string]interface{}, keys ...string) map[string]interface{} {
+	for _, k := range keys {
+		if val, ok := m[k].(map[string]interface{}); ok {
+			return val
+		}
+	}
+	return nil
+}
+
+func parseFeedTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// readFeedMessages reads TemporalAsset messages (one JSON document per line) and keeps
+// the latest change for every asset, since messages can be delivered out of order.
+func readFeedMessages(input io.Reader) (map[string]*feedChange, error) {
+	const bufferSize = 5 * 1024 * 1024 // Length of one line is maximum 5 MB
+	scanner := bufio.NewScanner(input)
+	buf := make([]byte, bufferSize)
+	scanner.Buffer(buf, bufferSize)
+
+	changes := make(map[string]*feedChange, 0)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var message map[string]interface{}
+		err := json.Unmarshal(scanner.Bytes(), &message)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing feed message on line %d", line)
+		}
+
+		asset := feedMap(message, "asset")
+		priorAsset := feedMap(message, "priorAsset", "prior_asset")
+		deleted, _ := message["deleted"].(bool)
+		window := feedMap(message, "window")
+
+		change := &feedChange{deleted: deleted}
+		if asset != nil {
+			change.asset = normalizeFeedAsset(asset)
+			change.name = feedString(change.asset, "name")
+		}
+		if change.name == "" && priorAsset != nil {
+			change.name = feedString(priorAsset, "name")
+		}
+		if change.name == "" {
+			fmt.Fprintf(os.Stderr, "Warning: skipping feed message without asset name on line %d\n", line)
+			continue
+		}
+		if !deleted && (asset == nil || asset["resource"] == nil) {
+			fmt.Fprintf(os.Stderr, "Warning: skipping feed message without resource for %s on line %d\n", change.name, line)
+			continue
+		}
+		if window != nil {
+			change.startTime = parseFeedTime(feedString(window, "startTime", "start_time"))
+		}
+		if change.startTime.IsZero() && change.asset != nil {
+			change.startTime = parseFeedTime(feedString(change.asset, "update_time"))
+		}
+		if !change.deleted {
+			if _, ok := change.asset["update_time"]; !ok && !change.startTime.IsZero() {
+				change.asset["update_time"] = change.startTime.Format(time.RFC3339Nano)
+			}
+		}
+
+		if previous, found := changes[change.name]; found && previous.startTime.After(change.startTime) {
+			continue
+		}
+		changes[change.name] = change
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// quadsOf returns the quads where value is in direction d, optionally filtered by predicate.
+func (v *GcpViz) quadsOf(d cquad.Direction, value string, predicate string) []cquad.Quad {
+	ref := v.QS.ValueOf(cquad.String(value))
+	if ref == nil {
+		return nil
+	}
+	var quads []cquad.Quad
+	it := v.QS.QuadIterator(d, ref)
+	defer it.Close()
+	for it.Next(nil) {
+		q := v.QS.Quad(it.Result())
+		if predicate == "" || fmt.Sprint(cquad.NativeOf(q.Predicate)) == predicate {
+			quads = append(quads, q)
+		}
+	}
+	return quads
+}
+
+// removeQuad removes a quad from the graph, quads that were already removed are ignored.
+func (v *GcpViz) removeQuad(q cquad.Quad) error {
+	if err := v.QW.RemoveQuad(q); err != nil && !graph.IsQuadNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeAssetQuads removes the quads created from an asset: its own relations and data, and
+// the parent-child relation pointing to it. Relations from other assets are kept, including
+// the parent-child relations to its children, which are created by the children.
+func (v *GcpViz) removeAssetQuads(name string) ([]cquad.Quad, error) {
+	var quads []cquad.Quad
+	for _, q := range v.quadsOf(cquad.Subject, name, "") {
+		if fmt.Sprint(cquad.NativeOf(q.Predicate)) != "child" {
+			quads = append(quads, q)
+		}
+	}
+	quads = append(quads, v.quadsOf(cquad.Object, name, "child")...)
+	for _, q := range quads {
+		if err := v.removeQuad(q); err != nil {
+			return nil, err
+		}
+	}
+	return quads, nil
+}
+
+func (v *GcpViz) allIpAddresses() ([]IpAddressLink, error) {
+	ipAssetTypes := make([]string, 0, len(v.Relations.IpAddresses))
+	for ik := range v.Relations.IpAddresses {
+		ipAssetTypes = append(ipAssetTypes, ik)
+	}
+	ipAddresses := make([]IpAddressLink, 0)
+	err := v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("Assets")).ForEach(func(bk, bv []byte) error {
+			if !containsAnyAssetType(bv, ipAssetTypes) {
+				return nil
+			}
+			asset, resource, err := v.parseJsonAsset(bv)
+			if err != nil {
+				return err
+			}
+			ipAddresses = append(ipAddresses, v.assetIpAddresses(asset.GetName(), asset.GetAssetType(), resource)...)
+			return nil
+		})
+	})
+	return ipAddresses, err
+}
+
+// fallbackAlias returns the alias from a vertex synthesized for an unknown reference
+// (ie. //compute.googleapis.com/<alias>).
+func fallbackAlias(vertex string) string {
+	if !strings.HasPrefix(vertex, "//") {
+		return ""
+	}
+	parts := strings.SplitN(vertex[2:], "/", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+func quadKey(q cquad.Quad) string {
+	return fmt.Sprintf("%v\x00%v\x00%v", cquad.NativeOf(q.Subject), cquad.NativeOf(q.Predicate), cquad.NativeOf(q.Object))
+}
+
+// ApplyFeedMessages applies Cloud Asset Inventory real-time feed messages to a graph
+// loaded with LoadForUpdate: created, updated and deleted assets are changed in place,
+// including their aliases, references, IP address links and enriched fields.
+func (v *GcpViz) ApplyFeedMessages(input io.Reader, addResourceData bool) error {
+	changes, err := readFeedMessages(input)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(changes))
+	for name := range changes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ipsBefore, err := v.allIpAddresses()
+	if err != nil {
+		return err
+	}
+
+	var updated, deleted, skipped int
+	changed := make(map[string]bool, len(changes))
+	affected := make(map[string]bool, 0)
+	newAliases := make(map[string]string, 0)
+
+	fmt.Fprintf(os.Stderr, "Applying %d asset changes...\n", len(changes))
+	err = v.AssetDatabase.Update(func(tx *bolt.Tx) error {
+		assets := tx.Bucket([]byte("Assets"))
+		aliases := tx.Bucket([]byte("Aliases"))
+		for _, name := range names {
+			change := changes[name]
+			if existing := assets.Get([]byte(name)); existing != nil {
+				var current map[string]interface{}
+				if err := json.Unmarshal(existing, &current); err == nil {
+					updateTime := parseFeedTime(feedString(current, "update_time"))
+					if !updateTime.IsZero() && !change.startTime.IsZero() && updateTime.After(change.startTime) {
+						skipped++
+						continue
+					}
+					// Costs come from billing exports, not feeds
+					if cost, found := current["cost"]; found && !change.deleted {
+						change.asset["cost"] = cost
+					}
+				}
+			}
+
+			removed, err := v.removeAssetQuads(name)
+			if err != nil {
+				return err
+			}
+			var sources []cquad.Quad
+			for _, q := range removed {
+				switch fmt.Sprint(cquad.NativeOf(q.Predicate)) {
+				case "uses":
+					affected[fmt.Sprint(cquad.NativeOf(q.Object))] = true
+				case SourcePredicate:
+					sources = append(sources, q)
+				}
+			}
+			var staleAliases [][]byte
+			err = aliases.ForEach(func(k, val []byte) error {
+				if string(val) == name {
+					staleAliases = append(staleAliases, append([]byte{}, k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, alias := range staleAliases {
+				if err := aliases.Delete(alias); err != nil {
+					return err
+				}
+			}
+			changed[name] = true
+
+			if change.deleted {
+				if err := assets.Delete([]byte(name)); err != nil {
+					return err
+				}
+				// IAM policies are not part of resource feeds, they are only removed with the resource
+				for _, q := range v.quadsOf(cquad.Object, name, "") {
+					if IsRolePredicate(fmt.Sprint(cquad.NativeOf(q.Predicate))) {
+						if err := v.removeQuad(q); err != nil {
+							return err
+						}
+					}
+				}
+				// Children of a deleted asset are deleted or moved by their own feed messages
+				for _, q := range v.quadsOf(cquad.Subject, name, "child") {
+					if err := v.removeQuad(q); err != nil {
+						return err
+					}
+				}
+				for i, root := range v.OrgRoots {
+					if root == name {
+						v.OrgRoots = append(v.OrgRoots[:i], v.OrgRoots[i+1:]...)
+						break
+					}
+				}
+				deleted++
+				continue
+			}
+
+			jsn, err := json.Marshal(change.asset)
+			if err != nil {
+				return errors.Wrap(err, "marshaling to json")
+			}
+			pbAsset, resource, err := v.parseJsonAsset(jsn)
+			if err != nil {
+				return err
+			}
+			err = v.AddAsset(tx, *pbAsset, resource, addResourceData)
+			if err != nil {
+				return err
+			}
+			// Updated assets keep the export they were originally read from
+			for _, q := range sources {
+				if err := v.QW.AddQuad(q); err != nil {
+					return err
+				}
+			}
+			for _, alias := range v.assetAliases(pbAsset.GetAssetType(), resource) {
+				if err := aliases.Put([]byte(alias), []byte(name)); err != nil {
+					return err
+				}
+				newAliases[alias] = name
+				v.TotalAliases++
+			}
+			updated++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Updating references between assets...\n")
+	err = v.AssetDatabase.View(func(tx *bolt.Tx) error {
+		for name := range changed {
+			bv := tx.Bucket([]byte("Assets")).Get([]byte(name))
+			if bv == nil {
+				continue
+			}
+			asset, resource, err := v.parseJsonAsset(bv)
+			if err != nil {
+				return err
+			}
+			for _, vertex := range v.assetReferences(tx, asset.GetAssetType(), resource) {
+				if err := v.QW.AddQuad(cayley.Quad(name, "uses", vertex, asset.GetAssetType())); err != nil {
+					return err
+				}
+				affected[vertex] = true
+				v.TotalEdges++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// References made before an alias existed point to a synthesized vertex (see
+	// assetReferences), repoint them to the aliased asset
+	if len(newAliases) > 0 {
+		var repoint []cquad.Quad
+		it := v.QS.QuadsAllIterator()
+		for it.Next(nil) {
+			q := v.QS.Quad(it.Result())
+			if fmt.Sprint(cquad.NativeOf(q.Predicate)) != "uses" {
+				continue
+			}
+			if _, found := newAliases[fallbackAlias(fmt.Sprint(cquad.NativeOf(q.Object)))]; found {
+				repoint = append(repoint, q)
+			}
+		}
+		it.Close()
+		for _, q := range repoint {
+			target := newAliases[fallbackAlias(fmt.Sprint(cquad.NativeOf(q.Object)))]
+			if err := v.removeQuad(q); err != nil {
+				return err
+			}
+			if err := v.QW.AddQuad(cquad.Make(q.Subject, q.Predicate, target, q.Label)); err != nil {
+				return err
+			}
+			affected[target] = true
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Updating resource IP addresses...\n")
+	ipsAfter, err := v.allIpAddresses()
+	if err != nil {
+		return err
+	}
+	linksBefore := make(map[string]cquad.Quad, 0)
+	for _, q := range linkIpAddresses(ipsBefore) {
+		linksBefore[quadKey(q)] = q
+	}
+	linksAfter := make(map[string]cquad.Quad, 0)
+	for _, q := range linkIpAddresses(ipsAfter) {
+		linksAfter[quadKey(q)] = q
+	}
+	for key, q := range linksBefore {
+		if _, found := linksAfter[key]; !found {
+			if err := v.removeQuad(q); err != nil {
+				return err
+			}
+		}
+	}
+	for key, q := range linksAfter {
+		if _, found := linksBefore[key]; !found {
+			if err := v.QW.AddQuad(q); err != nil {
+				return err
+			}
+			v.TotalEdges++
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Updating enriched assets...\n")
+	for name := range changed {
+		affected[name] = true
+	}
+	enrichedAssets := make(map[string]map[string][]interface{}, 0)
+	for name := range affected {
+		asset, err := v.getAsset(name)
+		if err != nil {
+			continue
+		}
+		fields, ok := v.Relations.Enrich[asset.AssetType]
+		if !ok {
+			continue
+		}
+		newFields, _ := v.enrichAsset(name, asset.AssetType)
+		// Fields are reset, so stale sub-assets are removed
+		for field := range fields {
+			if _, found := newFields[field]; !found {
+				newFields[field] = nil
+			}
+		}
+		enrichedAssets[name] = newFields
+	}
+	err = v.writeEnrichedAssets(enrichedAssets)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "\nAssets updated: %d, deleted: %d, skipped as out of date: %d\n", updated, deleted, skipped)
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+#   Copyright 2022 Google LLC
+#
+#   Licensed under the Apache License, Version 2.0 (the "License");
+#   you may not use this file except in compliance with the License.
+#   You may obtain a copy of the License at
+#
+#       http://www.apache.org/licenses/LICENSE-2.0
+#
+#   Unless required by applicable law or agreed to in writing, software
+#   distributed under the License is distributed on an "AS IS" BASIS,
+#   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+#   See the License for the specific language governing permissions and
+#   limitations under the License.
+#
+*/
+package gcpviz
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cquad "github.com/cayleygraph/quad"
+)
+
+const (
+	testOrganization = "//cloudresourcemanager.googleapis.com/organizations/123"
+	testFolder       = "//cloudresourcemanager.googleapis.com/folders/456"
+	testProject      = "//cloudresourcemanager.googleapis.com/projects/1001"
+)
+
+// testHierarchy is an export with an organization, a folder and a project in the folder.
+func testHierarchy(folderName string, updateTime string) string {
+	return strings.Join([]string{
+		`{"name": "` + testOrganization + `", "asset_type": "cloudresourcemanager.googleapis.com/Organization", "resource": {"version": "v1", "discovery_name": "Organization", "parent": "", "data": {"displayName": "example.com", "name": "organizations/123"}}, "ancestors": ["organizations/123"], "update_time": "2026-10-01T00:00:00Z"}`,
+		testFolderAsset(folderName, updateTime),
+		`{"name": "` + testProject + `", "asset_type": "cloudresourcemanager.googleapis.com/Project", "resource": {"version": "v1", "discovery_name": "Project", "parent": "` + testFolder + `", "data": {"name": "host-project", "projectId": "host-project", "projectNumber": "1001"}}, "ancestors": ["projects/1001", "folders/456", "organizations/123"], "update_time": "2026-10-01T00:00:00Z"}`,
+	}, "\n") + "\n"
+}
+
+func testFolderAsset(folderName string, updateTime string) string {
+	return `{"name": "` + testFolder + `", "asset_type": "cloudresourcemanager.googleapis.com/Folder", "resource": {"version": "v1", "discovery_name": "Folder", "parent": "` + testOrganization + `", "data": {"displayName": "` + folderName + `", "name": "folders/456", "parent": "organizations/123"}}, "ancestors": ["folders/456", "organizations/123"], "update_time": "` + updateTime + `"}`
+}
+
+// newTestGraph reads exports into a new graph database in dir.
+func newTestGraph(t *testing.T, dir string, exports ...string) *GcpViz {
+	v, err := NewGcpViz("relations.yaml", "labels.yaml", "style.yaml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Create(filepath.Join(dir, "graph.db")); err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for i, export := range exports {
+		file := filepath.Join(dir, fmt.Sprintf("export%d.json", i))
+		if err := ioutil.WriteFile(file, []byte(export), 0600); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+	if err := v.ReadAssetsFromFiles(files, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.EnrichAssets(); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// assertParent checks that the only parent-child relation to a vertex is from parent.
+func assertParent(t *testing.T, v *GcpViz, name string, parent string) {
+	t.Helper()
+	quads := v.quadsOf(cquad.Object, name, "child")
+	if len(quads) != 1 || fmt.Sprint(cquad.NativeOf(quads[0].Subject)) != parent {
+		t.Errorf("expected %s to be a child of %s, got %v", name, parent, quads)
+	}
+}
+
+func TestApplyFeedMessagesKeepsChildren(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpviz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := newTestGraph(t, dir, testHierarchy("prod", "2026-10-01T00:00:00Z"))
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err = NewGcpViz("relations.yaml", "labels.yaml", "style.yaml", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.LoadForUpdate(filepath.Join(dir, "graph.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer v.AssetDatabase.Close()
+	feed := `{"asset": {"name": "` + testFolder + `", "assetType": "cloudresourcemanager.googleapis.com/Folder", "resource": {"version": "v1", "discoveryName": "Folder", "parent": "` + testOrganization + `", "data": {"displayName": "production", "name": "folders/456", "parent": "organizations/123"}}, "ancestors": ["folders/456", "organizations/123"]}, "window": {"startTime": "2026-10-02T00:00:00Z"}}` + "\n"
+	if err := v.ApplyFeedMessages(strings.NewReader(feed), true); err != nil {
+		t.Fatal(err)
+	}
+
+	assertParent(t, v, testFolder, testOrganization)
+	assertParent(t, v, testProject, testFolder)
+	if data := v.quadsOf(cquad.Subject, testFolder, "data"); len(data) != 1 || !strings.Contains(fmt.Sprint(cquad.NativeOf(data[0].Object)), "production") {
+		t.Errorf("expected the updated data of the folder, got %v", data)
+	}
+}
@@ -0,0 +1,304 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Strategies for selecting a free range in a parent, set per routing domain or per request.
+const (
+	// FirstFit allocates the free range with the lowest address.
+	FirstFit = "first-fit"
+	// BestFit allocates the range in the smallest free block it fits into, keeping large
+	// blocks free for large ranges.
+	BestFit = "best-fit"
+	// LastFit allocates the free range with the highest address.
+	LastFit = "last-fit"
+	// ReservedAlignment allocates the range at the start of a free block twice its size,
+	// so the range can later be extended by one bit. Falls back to first-fit.
+	ReservedAlignment = "reserved-alignment"
+)
+
+var AllocationStrategies = []string{FirstFit, BestFit, LastFit, ReservedAlignment}
+
+// validateAllocationStrategy returns an error for unknown strategies, an empty strategy
+// selects the default.
+func validateAllocationStrategy(strategy string) error {
+	if strategy == "" {
+		return nil
+	}
+	for _, s := range AllocationStrategies {
+		if strategy == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown allocation strategy %s, supported are %s", strategy, strings.Join(AllocationStrategies, ", "))
+}
+
+// addressBlock is an inclusive range of addresses.
+type addressBlock struct {
+	first *big.Int
+	last  *big.Int
+}
+
+func (b addressBlock) size() *big.Int {
+	size := new(big.Int).Sub(b.last, b.first)
+	return size.Add(size, big.NewInt(1))
+}
+
+func networkBlock(network *net.IPNet) addressBlock {
+	ip := network.IP.To4()
+	if ip == nil {
+		ip = network.IP.To16()
+	}
+	first := new(big.Int).SetBytes(ip)
+	ones, bits := network.Mask.Size()
+	last := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	last.Add(last, first).Sub(last, big.NewInt(1))
+	return addressBlock{first: first, last: last}
+}
+
+// blockNetwork returns the network of the given prefix length starting at an address.
+func blockNetwork(first *big.Int, ones int, bits int) *net.IPNet {
+	ip := make(net.IP, bits/8)
+	b := first.Bytes()
+	copy(ip[len(ip)-len(b):], b)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(ones, bits)}
+}
+
+// freeBlocks returns the free space of a parent as the largest aligned blocks, ordered by
+// address. Existing ranges of the other IP version or outside of the parent are ignored.
+func freeBlocks(parent *net.IPNet, existingRanges []Range) ([]*net.IPNet, error) {
+	_, bits := parent.Mask.Size()
+	parentBlock := networkBlock(parent)
+	var used []addressBlock
+	for _, existing := range existingRanges {
+		_, network, err := net.ParseCIDR(existing.Cidr)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse CIDR %v", err)
+		}
+		if _, existingBits := network.Mask.Size(); existingBits != bits {
+			continue
+		}
+		block := networkBlock(network)
+		if block.last.Cmp(parentBlock.first) < 0 || block.first.Cmp(parentBlock.last) > 0 {
+			continue
+		}
+		if block.first.Cmp(parentBlock.first) < 0 {
+			block.first = parentBlock.first
+		}
+		if block.last.Cmp(parentBlock.last) > 0 {
+			block.last = parentBlock.last
+		}
+		used = append(used, block)
+	}
+	sort.Slice(used, func(i, j int) bool {
+		return used[i].first.Cmp(used[j].first) < 0
+	})
+
+	var free []*net.IPNet
+	next := new(big.Int).Set(parentBlock.first)
+	for _, block := range used {
+		if block.first.Cmp(next) > 0 {
+			free = appendAlignedBlocks(free, addressBlock{first: next, last: new(big.Int).Sub(block.first, big.NewInt(1))}, bits)
+		}
+		if block.last.Cmp(next) >= 0 {
+			next = new(big.Int).Add(block.last, big.NewInt(1))
+		}
+	}
+	if next.Cmp(parentBlock.last) <= 0 {
+		free = appendAlignedBlocks(free, addressBlock{first: next, last: parentBlock.last}, bits)
+	}
+	return free, nil
+}
+
+// appendAlignedBlocks splits a range of addresses into the largest aligned blocks.
+func appendAlignedBlocks(networks []*net.IPNet, block addressBlock, bits int) []*net.IPNet {
+	first := new(big.Int).Set(block.first)
+	for first.Cmp(block.last) <= 0 {
+		// The block is limited by the alignment of its first address and the remaining addresses
+		hostBits := int(first.TrailingZeroBits())
+		if first.Sign() == 0 {
+			hostBits = bits
+		}
+		remaining := new(big.Int).Sub(block.last, first)
+		remaining.Add(remaining, big.NewInt(1))
+		for hostBits > 0 && new(big.Int).Lsh(big.NewInt(1), uint(hostBits)).Cmp(remaining) > 0 {
+			hostBits--
+		}
+		networks = append(networks, blockNetwork(first, bits-hostBits, bits))
+		first.Add(first, new(big.Int).Lsh(big.NewInt(1), uint(hostBits)))
+	}
+	return networks
+}
+
+// findNextSubnetWithStrategy selects a free range of the given size in the parent.
+func findNextSubnetWithStrategy(strategy string, range_size int, sourceRange string, existingRanges []Range) (*net.IPNet, int, error) {
+	_, parentNet, err := net.ParseCIDR(sourceRange)
+	if err != nil {
+		return nil, -1, err
+	}
+	ones, bits := parentNet.Mask.Size()
+	if range_size < ones || range_size > bits {
+		return nil, -1, fmt.Errorf("range size /%d does not fit into %s, it needs to be between /%d and /%d", range_size, parentNet.String(), ones, bits)
+	}
+	free, err := freeBlocks(parentNet, existingRanges)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	var selected *net.IPNet
+	fromTop := false
+	switch strategy {
+	case "", FirstFit:
+		selected = firstFreeBlock(free, range_size)
+	case BestFit:
+		for _, block := range free {
+			if netMask(block.Mask) <= range_size && (selected == nil || netMask(block.Mask) > netMask(selected.Mask)) {
+				selected = block
+			}
+		}
+	case LastFit:
+		for i := len(free) - 1; i >= 0 && selected == nil; i-- {
+			if netMask(free[i].Mask) <= range_size {
+				selected = free[i]
+			}
+		}
+		fromTop = true
+	case ReservedAlignment:
+		if range_size > ones {
+			selected = firstFreeBlock(free, range_size-1)
+		}
+		if selected == nil {
+			selected = firstFreeBlock(free, range_size)
+		}
+	default:
+		return nil, -1, validateAllocationStrategy(strategy)
+	}
+	if selected == nil {
+		return nil, -1, fmt.Errorf("no_address_range_available_in_parent")
+	}
+
+	block := networkBlock(selected)
+	first := block.first
+	if fromTop {
+		first = new(big.Int).Lsh(big.NewInt(1), uint(bits-range_size))
+		first.Sub(block.last, first).Add(first, big.NewInt(1))
+	}
+	return blockNetwork(first, range_size, bits), range_size, nil
+}
+
+func firstFreeBlock(free []*net.IPNet, range_size int) *net.IPNet {
+	for _, block := range free {
+		if netMask(block.Mask) <= range_size {
+			return block
+		}
+	}
+	return nil
+}
+
+// RangeUtilization is the usage of the address space of a range by its child ranges.
+type RangeUtilization struct {
+	TotalAddresses *big.Int `json:"total_addresses"`
+	UsedAddresses  *big.Int `json:"used_addresses"`
+	FreeAddresses  *big.Int `json:"free_addresses"`
+	// Largest free block that can be allocated as a range
+	LargestFreeBlock string `json:"largest_free_block"`
+	// Number of free blocks per prefix length, i.e. 2 free blocks of /24 and 1 of /26
+	FreeBlocks []FreeBlockCount `json:"free_blocks"`
+	// 0 if the free addresses are a single block, approaching 1 the more the free
+	// addresses are fragmented into small blocks
+	Fragmentation float64 `json:"fragmentation"`
+}
+
+type FreeBlockCount struct {
+	PrefixLength int `json:"prefix_length"`
+	Count        int `json:"count"`
+}
+
+// rangeUtilization calculates the utilization of a range from its child ranges.
+func rangeUtilization(cidrRange string, existingRanges []Range) (*RangeUtilization, error) {
+	_, network, err := net.ParseCIDR(cidrRange)
+	if err != nil {
+		return nil, err
+	}
+	free, err := freeBlocks(network, existingRanges)
+	if err != nil {
+		return nil, err
+	}
+
+	utilization := &RangeUtilization{
+		TotalAddresses: networkBlock(network).size(),
+		FreeAddresses:  big.NewInt(0),
+		FreeBlocks:     []FreeBlockCount{},
+	}
+	var largest *net.IPNet
+	counts := make(map[int]int)
+	for _, block := range free {
+		utilization.FreeAddresses.Add(utilization.FreeAddresses, networkBlock(block).size())
+		counts[netMask(block.Mask)]++
+		if largest == nil || netMask(block.Mask) < netMask(largest.Mask) {
+			largest = block
+		}
+	}
+	utilization.UsedAddresses = new(big.Int).Sub(utilization.TotalAddresses, utilization.FreeAddresses)
+	for prefixLength, count := range counts {
+		utilization.FreeBlocks = append(utilization.FreeBlocks, FreeBlockCount{PrefixLength: prefixLength, Count: count})
+	}
+	sort.Slice(utilization.FreeBlocks, func(i, j int) bool {
+		return utilization.FreeBlocks[i].PrefixLength < utilization.FreeBlocks[j].PrefixLength
+	})
+	if largest != nil {
+		utilization.LargestFreeBlock = largest.String()
+		ratio, _ := new(big.Float).Quo(new(big.Float).SetInt(networkBlock(largest).size()), new(big.Float).SetInt(utilization.FreeAddresses)).Float64()
+		utilization.Fragmentation = 1 - ratio
+	}
+	return utilization, nil
+}
+
+// freeRanges lists the free ranges of the given size in the parent ordered by address, at
+// most limit ranges.
+func freeRanges(range_size int, sourceRange string, existingRanges []Range, limit int) ([]string, error) {
+	_, parentNet, err := net.ParseCIDR(sourceRange)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := parentNet.Mask.Size()
+	if range_size < ones || range_size > bits {
+		return nil, fmt.Errorf("range size /%d does not fit into %s, it needs to be between /%d and /%d", range_size, parentNet.String(), ones, bits)
+	}
+	free, err := freeBlocks(parentNet, existingRanges)
+	if err != nil {
+		return nil, err
+	}
+
+	ranges := []string{}
+	step := new(big.Int).Lsh(big.NewInt(1), uint(bits-range_size))
+	for _, block := range free {
+		if netMask(block.Mask) > range_size {
+			continue
+		}
+		addresses := networkBlock(block)
+		for first := new(big.Int).Set(addresses.first); first.Cmp(addresses.last) <= 0 && len(ranges) < limit; first.Add(first, step) {
+			ranges = append(ranges, blockNetwork(first, range_size, bits).String())
+		}
+	}
+	return ranges, nil
+}
@@ -16,27 +16,31 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
-	"os"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/apparentlymart/go-cidr/cidr"
 	"github.com/gofiber/fiber/v2"
 )
 
 type CreateRoutingDomainRequest struct {
-	Name string   `json:"name"`
-	Vpcs []string `json:"vpcs"`
+	Name                string            `json:"name"`
+	Vpcs                []string          `json:"vpcs"`
+	Allocation_strategy string            `json:"allocation_strategy"`
+	Discovery           []DiscoveryConfig `json:"discovery"`
 }
 
 type UpdateRoutingDomainRequest struct {
-	Name JSONString      `json:"name"`
-	Vpcs JSONStringArray `json:"vpcs"`
+	Name                JSONString           `json:"name"`
+	Vpcs                JSONStringArray      `json:"vpcs"`
+	Allocation_strategy JSONString           `json:"allocation_strategy"`
+	Discovery           JSONDiscoveryConfigs `json:"discovery"`
 }
 
 type RangeRequest struct {
@@ -45,11 +49,60 @@ type RangeRequest struct {
 	Range_size int    `json:"range_size"`
 	Domain     string `json:"domain"`
 	Cidr       string `json:"cidr"`
+	// Allocation strategy for this range, overrides the strategy of the routing domain
+	Allocation_strategy string            `json:"allocation_strategy"`
+	Description         string            `json:"description"`
+	Owner               string            `json:"owner"`
+	Status              string            `json:"status"`
+	Labels              map[string]string `json:"labels"`
+}
+
+type UpdateRangeRequest struct {
+	Description JSONString    `json:"description"`
+	Owner       JSONString    `json:"owner"`
+	Status      JSONString    `json:"status"`
+	Labels      JSONStringMap `json:"labels"`
 }
 
 func GetRanges(c *fiber.Ctx) error {
 	var results []*fiber.Map
-	ranges, err := GetRangesFromDB()
+	// Ranges are filtered by labels given as key:value, i.e. ?label=env:prod&label=team:network
+	var labelFilters [][]string
+	for _, label := range c.Context().QueryArgs().PeekMulti("label") {
+		filter := strings.SplitN(string(label), ":", 2)
+		if len(filter) != 2 || filter[0] == "" {
+			return c.Status(400).JSON(&fiber.Map{
+				"success": false,
+				"message": fmt.Sprintf("Label filter %s needs to be key:value", string(label)),
+			})
+		}
+		labelFilters = append(labelFilters, filter)
+	}
+	// Ranges can also be looked up by ?name=, ?cidr= and ?domain=
+	name := c.Query("name")
+	cidr := c.Query("cidr")
+	if cidr != "" {
+		normalized, err := normalizeCidr(cidr)
+		if err != nil {
+			return c.Status(400).JSON(&fiber.Map{
+				"success": false,
+				"message": fmt.Sprintf("%v", err),
+			})
+		}
+		cidr = normalized
+	}
+	domain_id := 0
+	if c.Query("domain") != "" {
+		id, err := strconv.Atoi(c.Query("domain"))
+		if err != nil {
+			return c.Status(400).JSON(&fiber.Map{
+				"success": false,
+				"message": fmt.Sprintf("Domain needs to be an integer %v", err),
+			})
+		}
+		domain_id = id
+	}
+	ranges, err := store.GetRanges()
 	if err != nil {
 		return c.Status(503).JSON(&fiber.Map{
 			"success": false,
@@ -57,13 +110,19 @@ func GetRanges(c *fiber.Ctx) error {
 		})
 	}
 
+	ranges = visibleRanges(c, ranges)
 	for i := 0; i < len(ranges); i++ {
-		results = append(results, &fiber.Map{
-			"id":     ranges[i].Subnet_id,
-			"parent": ranges[i].Parent_id,
-			"name":   ranges[i].Name,
-			"cidr":   ranges[i].Cidr,
-		})
+		matches := (name == "" || ranges[i].Name == name) &&
+			(cidr == "" || ranges[i].Cidr == cidr) &&
+			(domain_id == 0 || ranges[i].Routing_domain_id == domain_id)
+		for _, filter := range labelFilters {
+			if value, found := ranges[i].Labels[filter[0]]; !found || value != filter[1] {
+				matches = false
+			}
+		}
+		if matches {
+			results = append(results, rangeResponse(&ranges[i]))
+		}
 	}
 	return c.Status(200).JSON(results)
 }
@@ -76,19 +135,270 @@ func GetRange(c *fiber.Ctx) error {
 			"message": fmt.Sprintf("%v", err),
 		})
 	}
-	rang, err := GetRangeFromDB(id)
+	rang, err := store.GetRange(id)
 	if err != nil {
 		return c.Status(503).JSON(&fiber.Map{
 			"success": false,
 			"message": fmt.Sprintf("%v", err),
 		})
 	}
+	if !authorizedStoredRange(c, RoleViewer, rang) {
+		return forbidden(c)
+	}
+
+	return c.Status(200).JSON(rangeResponse(rang))
+}
+
+func rangeResponse(rang *Range) *fiber.Map {
+	created_at := ""
+	if !rang.Created_at.IsZero() {
+		created_at = rang.Created_at.UTC().Format(time.RFC3339)
+	}
+	released_at := ""
+	if !rang.Released_at.IsZero() {
+		released_at = rang.Released_at.UTC().Format(time.RFC3339)
+	}
+	return &fiber.Map{
+		"id":          rang.Subnet_id,
+		"parent":      rang.Parent_id,
+		"domain":      rang.Routing_domain_id,
+		"name":        rang.Name,
+		"cidr":        rang.Cidr,
+		"description": rang.Description,
+		"owner":       rang.Owner,
+		"status":      rang.Status,
+		"created_at":  created_at,
+		"labels":      rang.Labels,
+		"released_at": released_at,
+	}
+}
+
+func UpdateRange(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+
+	// Instantiate new UpdateRangeRequest struct
+	p := new(UpdateRangeRequest)
+	//  Parse body into UpdateRangeRequest struct
+	if err := c.BodyParser(p); err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("Bad format %v", err),
+		})
+	}
+	if p.Status.Set && p.Status.Value == RangeReleased {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("Ranges are released with DELETE /ranges/%d", id),
+		})
+	}
+	if p.Status.Set && p.Status.Value != RangeReserved && p.Status.Value != RangeAllocated {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("Status needs to be %s or %s", RangeReserved, RangeAllocated),
+		})
+	}
+	if err := validateLabels(p.Labels.Value); err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	rang, err := store.GetRange(id)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	if !authorizedStoredRange(c, RoleAllocator, rang) {
+		return forbidden(c)
+	}
+	// Setting the status of a released range restores it from the quarantine
+	if p.Status.Set && !rang.Released_at.IsZero() && !authorized(c, RoleAdmin, rang.Routing_domain_id) {
+		return c.Status(403).JSON(&fiber.Map{
+			"success": false,
+			"message": "Permission denied, released ranges can only be restored by admins of the routing domain",
+		})
+	}
+	event := newAuditEvent(c, AuditUpdateRange, rang.Routing_domain_id, rang.Subnet_id, rang.Cidr)
+	err = store.UpdateRange(id, p.Description, p.Owner, p.Status, p.Labels, event)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("Unable to update range %v", err),
+		})
+	}
+	exportAuditEvents(*event)
+	return c.Status(200).JSON(&fiber.Map{})
+}
+
+// validateLabels checks that the labels can be used in label filters.
+func validateLabels(labels map[string]string) error {
+	for key := range labels {
+		if key == "" || strings.Contains(key, ":") {
+			return fmt.Errorf("invalid label key %q, keys can't be empty or contain a colon", key)
+		}
+	}
+	return nil
+}
+
+// GetRangeUtilization reports the used and free addresses of a range, including the
+// subnets found in Cloud Asset Inventory.
+func GetRangeUtilization(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	rang, err := store.GetRange(id)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	if !authorizedStoredRange(c, RoleViewer, rang) {
+		return forbidden(c)
+	}
+	subnet_ranges, err := store.GetRangesForParent(id)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	routingDomain, err := store.GetRoutingDomain(int64(rang.Routing_domain_id))
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	subnet_ranges, err = addExternalRanges(routingDomain, subnet_ranges)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	utilization, err := rangeUtilization(rang.Cidr, subnet_ranges)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+
+	return c.Status(200).JSON(&fiber.Map{
+		"id":                 rang.Subnet_id,
+		"cidr":               rang.Cidr,
+		"total_addresses":    utilization.TotalAddresses,
+		"used_addresses":     utilization.UsedAddresses,
+		"free_addresses":     utilization.FreeAddresses,
+		"largest_free_block": utilization.LargestFreeBlock,
+		"free_blocks":        utilization.FreeBlocks,
+		"fragmentation":      utilization.Fragmentation,
+	})
+}
+
+// Number of free ranges returned by GET /ranges/:id/free, unless set by ?limit=.
+const defaultFreeRanges = 100
+
+// Maximum number of free ranges returned by GET /ranges/:id/free.
+const maxFreeRanges = 1000
+
+// GetFreeRanges lists the free ranges of ?range_size= in a range ordered by address, the
+// ranges of the discovery providers and quarantined ranges aren't free.
+func GetFreeRanges(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	range_size := 0
+	limit := defaultFreeRanges
+	for param, value := range map[string]*int{"range_size": &range_size, "limit": &limit} {
+		if c.Query(param) == "" {
+			continue
+		}
+		*value, err = strconv.Atoi(c.Query(param))
+		if err != nil || *value <= 0 {
+			return c.Status(400).JSON(&fiber.Map{
+				"success": false,
+				"message": fmt.Sprintf("Parameter %s needs to be a positive number", param),
+			})
+		}
+	}
+	if range_size == 0 {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": "Parameter range_size is required",
+		})
+	}
+	if limit > maxFreeRanges {
+		limit = maxFreeRanges
+	}
+	rang, err := store.GetRange(id)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	if !authorizedStoredRange(c, RoleViewer, rang) {
+		return forbidden(c)
+	}
+	children, err := store.GetRangesForParent(id)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	// Released ranges are free once their quarantine is over, allocations finalize them
+	var subnet_ranges []Range
+	for _, child := range children {
+		if child.Released_at.IsZero() || !child.Released_at.Before(quarantineExpiry()) {
+			subnet_ranges = append(subnet_ranges, child)
+		}
+	}
+	routingDomain, err := store.GetRoutingDomain(int64(rang.Routing_domain_id))
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	subnet_ranges, err = addExternalRanges(routingDomain, subnet_ranges)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	cidrs, err := freeRanges(range_size, rang.Cidr, subnet_ranges, limit)
+	if err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
 
 	return c.Status(200).JSON(&fiber.Map{
-		"id":     rang.Subnet_id,
-		"parent": rang.Parent_id,
-		"name":   rang.Name,
-		"cidr":   rang.Cidr,
+		"id":         rang.Subnet_id,
+		"cidr":       rang.Cidr,
+		"range_size": range_size,
+		"cidrs":      cidrs,
 	})
 }
 
@@ -100,261 +410,465 @@ func DeleteRange(c *fiber.Ctx) error {
 			"message": fmt.Sprintf("%v", err),
 		})
 	}
-	err = DeleteRangeFromDb(id)
+	rang, err := store.GetRange(id)
 	if err != nil {
 		return c.Status(503).JSON(&fiber.Map{
 			"success": false,
 			"message": fmt.Sprintf("%v", err),
 		})
 	}
+	if !authorizedStoredRange(c, RoleAllocator, rang) {
+		return forbidden(c)
+	}
+
+	event, err := removeRange(id, func(action string, rang *Range) *AuditEvent {
+		return newAuditEvent(c, action, rang.Routing_domain_id, rang.Subnet_id, rang.Cidr)
+	})
+	if err != nil {
+		var requestErr *RangeRequestError
+		if errors.As(err, &requestErr) {
+			return c.Status(requestErr.Status).JSON(&fiber.Map{
+				"success": false,
+				"message": requestErr.Message,
+			})
+		}
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	if event != nil {
+		exportAuditEvents(*event)
+	}
 
 	return c.Status(200).JSON(&fiber.Map{
 		"success": true,
 	})
 }
 
-func CreateNewRange(c *fiber.Ctx) error {
-	ctx := context.Background()
-	tx, err := db.BeginTx(ctx, nil)
+// removeRange deletes a range, or releases it if there is a quarantine period, in a
+// transaction. The range is locked, so no child can be allocated in it while its children
+// are checked. The audit event is created by newEvent, it is returned, nil if the range
+// was already released.
+func removeRange(id int64, newEvent func(action string, rang *Range) *AuditEvent) (*AuditEvent, error) {
+	tx, err := store.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	rang, err := tx.GetRange(id)
+	if err != nil {
+		return nil, err
+	}
+	// Released ranges are quarantined, so their CIDR isn't reused while firewall rules or
+	// routes may still reference it
+	if quarantinePeriod > 0 && !rang.Released_at.IsZero() {
+		return nil, nil
+	}
+	children, err := tx.GetRangesForParent(id)
+	if err != nil {
+		return nil, err
+	}
+	var event *AuditEvent
+	if quarantinePeriod == 0 {
+		if len(children) > 0 {
+			return nil, rangeRequestError(400, "Range %d has child ranges that need to be deleted first", id)
+		}
+		event = newEvent(AuditDeleteRange, rang)
+		err = tx.DeleteRange(id)
+	} else {
+		for _, child := range children {
+			if child.Released_at.IsZero() {
+				return nil, rangeRequestError(400, "Range %d has child ranges that need to be released first", id)
+			}
+		}
+		event = newEvent(AuditReleaseRange, rang)
+		err = tx.ReleaseRange(id, time.Now().UTC())
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	err = tx.CreateAuditEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	committed = true
+	return event, nil
+}
+
+// Allocations are retried when they conflict with a concurrent allocation of the same
+// range, i.e. on unique constraint violations or deadlocks.
+const maxAllocationAttempts = 5
+
+// RangeRequestError is an error of a range request that is returned to the client with
+// its status code, other errors are returned with 503.
+type RangeRequestError struct {
+	Status  int
+	Message string
+}
+
+func (e *RangeRequestError) Error() string {
+	return e.Message
+}
 
+func rangeRequestError(status int, format string, a ...interface{}) error {
+	return &RangeRequestError{Status: status, Message: fmt.Sprintf(format, a...)}
+}
+
+func CreateNewRange(c *fiber.Ctx) error {
 	// Instantiate new RangeRequest struct
 	p := RangeRequest{}
 	//  Parse body into RangeRequest struct
 	if err := c.BodyParser(&p); err != nil {
 		fmt.Printf("Failed parsing body. %s Bad format %v", string(c.Body()), err)
-		tx.Rollback()
 		return c.Status(400).JSON(&fiber.Map{
 			"success": false,
 			"message": fmt.Sprintf("Bad format %v", err),
 		})
 	}
+	if err := validateAllocationStrategy(p.Allocation_strategy); err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	if p.Status != "" && p.Status != RangeReserved && p.Status != RangeAllocated {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("New ranges need to be %s or %s", RangeReserved, RangeAllocated),
+		})
+	}
+	if err := validateLabels(p.Labels); err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
 
-	var routingDomain *RoutingDomain
-	if p.Domain == "" {
-		routingDomain, err = GetDefaultRoutingDomainFromDB(tx)
-		if err != nil {
-			fmt.Printf("Error %v", err)
-			tx.Rollback()
-			return c.Status(503).JSON(&fiber.Map{
+	var id int64
+	var cidr string
+	routingDomain, err := requestRoutingDomain(p)
+	if err == nil {
+		id, cidr, err = allocateRange(c, p, routingDomain)
+	}
+
+	if err != nil {
+		var requestErr *RangeRequestError
+		if errors.As(err, &requestErr) {
+			return c.Status(requestErr.Status).JSON(&fiber.Map{
 				"success": false,
-				"message": "Couldn't retrieve default routing domain",
+				"message": requestErr.Message,
 			})
 		}
-	} else {
-		domain_id, err := strconv.ParseInt(p.Domain, 10, 64)
+		status := 503
+		if store.IsConflict(err) {
+			status = 409
+		}
+		return c.Status(status).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("Unable to create new Subnet Lease %v", err),
+		})
+	}
+
+	return c.Status(200).JSON(&fiber.Map{
+		"id":   id,
+		"cidr": cidr,
+	})
+}
+
+// allocateRange creates a range, allocations that conflict with a concurrent allocation
+// are retried.
+func allocateRange(c *fiber.Ctx, p RangeRequest, routingDomain *RoutingDomain) (int64, string, error) {
+	var external []ExternalRange
+	if p.Cidr == "" {
+		// Discovery providers can be slow, so they are queried before the parent is locked
+		var err error
+		external, err = discoverExternalRanges(context.Background(), routingDomain, false)
 		if err != nil {
-			return c.Status(400).JSON(&fiber.Map{
-				"success": false,
-				"message": fmt.Sprintf("%v", err),
-			})
+			return -1, "", rangeRequestError(503, "error %v", err)
+		}
+	}
+	var id int64
+	var cidr string
+	var err error
+	for attempt := 1; attempt <= maxAllocationAttempts; attempt++ {
+		id, cidr, err = createRange(c, p, routingDomain, external)
+		// Ranges with a given CIDR conflict with an existing range, there is nothing to retry
+		if err == nil || !store.IsConflict(err) || p.Cidr != "" {
+			break
 		}
-		routingDomain, err = GetRoutingDomainFromDB(domain_id)
+		log.Printf("Allocation of range %s conflicted with a concurrent allocation (attempt %d/%d): %v", p.Name, attempt, maxAllocationAttempts, err)
+		time.Sleep(time.Duration(attempt*attempt*50+rand.Intn(50)) * time.Millisecond)
+	}
+	return id, cidr, err
+}
+
+// requestRoutingDomain returns the routing domain of a range request, the default routing
+// domain if the request has none.
+func requestRoutingDomain(p RangeRequest) (*RoutingDomain, error) {
+	if p.Domain == "" {
+		routingDomain, err := store.GetDefaultRoutingDomain()
 		if err != nil {
 			fmt.Printf("Error %v", err)
-			tx.Rollback()
-			return c.Status(503).JSON(&fiber.Map{
-				"success": false,
-				"message": "Couldn't retrieve default routing domain",
-			})
+			return nil, rangeRequestError(503, "Couldn't retrieve default routing domain")
 		}
+		return routingDomain, nil
 	}
+	domain_id, err := strconv.ParseInt(p.Domain, 10, 64)
+	if err != nil {
+		return nil, rangeRequestError(400, "Domain needs to be an integer %v", err)
+	}
+	routingDomain, err := store.GetRoutingDomain(domain_id)
+	if err != nil {
+		fmt.Printf("Error %v", err)
+		return nil, rangeRequestError(503, "Couldn't retrieve routing domain")
+	}
+	return routingDomain, nil
+}
 
+// createRange creates a range in a transaction. Only the parent range is locked until the
+// transaction ends, so concurrent allocations from the same parent are serialized while
+// allocations from other parents of the routing domain are not.
+func createRange(c *fiber.Ctx, p RangeRequest, routingDomain *RoutingDomain, external []ExternalRange) (int64, string, error) {
+	tx, err := store.Begin(context.Background())
+	if err != nil {
+		return -1, "", err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	var id int64
+	var cidr string
 	if p.Cidr != "" {
-		return directInsert(c, tx, p, routingDomain)
+		id, cidr, err = directInsert(c, tx, p, routingDomain)
 	} else {
-		return findNewLeaseAndInsert(c, tx, p, routingDomain)
+		id, cidr, err = findNewLeaseAndInsert(c, tx, p, routingDomain, external)
+	}
+	if err != nil {
+		return -1, "", err
+	}
+	err = tx.CreateAuditEvent(newAuditEvent(c, AuditCreateRange, routingDomain.Id, int(id), cidr))
+	if err != nil {
+		return -1, "", err
 	}
+
+	err = tx.Commit()
+	if err != nil {
+		return -1, "", err
+	}
+	committed = true
+	exportAuditEvents(tx.AuditEvents()...)
+	return id, cidr, nil
 }
 
-func directInsert(c *fiber.Ctx, tx *sql.Tx, p RangeRequest, routingDomain *RoutingDomain) error {
-	var err error
-	domain_id, err := strconv.ParseInt(p.Domain, 10, 64)
+// authorizeAllocation checks if the principal of a request can allocate ranges in a parent.
+func authorizeAllocation(c *fiber.Ctx, tx StorageTx, parent *Range) error {
+	if auth == nil {
+		return nil
+	}
+	ancestors, err := tx.GetRangeAncestors(int64(parent.Subnet_id))
 	if err != nil {
-		return c.Status(400).JSON(&fiber.Map{
-			"success": false,
-			"message": fmt.Sprintf("Domain needs to be an integer %v", err),
-		})
+		return err
+	}
+	if !authorizedRange(c, RoleAllocator, parent, ancestors) {
+		return rangeRequestError(403, "Permission denied, allocating ranges in %s requires the allocator role", parent.Cidr)
+	}
+	return nil
+}
+
+// newRange returns the range to insert for a request.
+func newRange(p RangeRequest, parent_id int64, routingDomain *RoutingDomain, cidr string) *Range {
+	return &Range{
+		Parent_id:         int(parent_id),
+		Routing_domain_id: routingDomain.Id,
+		Name:              p.Name,
+		Cidr:              cidr,
+		Description:       p.Description,
+		Owner:             p.Owner,
+		Status:            p.Status,
+		Created_at:        time.Now().UTC(),
+		Labels:            p.Labels,
+	}
+}
+
+func directInsert(c *fiber.Ctx, tx StorageTx, p RangeRequest, routingDomain *RoutingDomain) (int64, string, error) {
+	requestCidr, err := normalizeCidr(p.Cidr)
+	if err != nil {
+		return -1, "", rangeRequestError(400, "Cidr needs to be an IPv4 or IPv6 range %v", err)
 	}
 
 	parent_id := int64(-1)
 	if p.Parent != "" {
+		var parent *Range
 		parent_id, err = strconv.ParseInt(p.Parent, 10, 64)
 		if err != nil {
-			rangeFromDb, err := getRangeByCidrAndRoutingDomain(tx, p.Parent, int(domain_id))
-			if err != nil {
-				return c.Status(400).JSON(&fiber.Map{
-					"success": false,
-					"message": fmt.Sprintf("Parent needs to be either a cidr range within the routing domain or the id of a valid range %v", err),
-				})
-			}
-			parent_id = int64(rangeFromDb.Subnet_id)
+			parent, err = tx.GetRangeByCidr(routingDomain.Id, normalizeParentCidr(p.Parent))
+		} else {
+			parent, err = tx.GetRange(parent_id)
+		}
+		if err != nil {
+			return -1, "", rangeRequestError(400, "Parent needs to be either a cidr range within the routing domain or the id of a valid range %v", err)
+		}
+		if !parent.Released_at.IsZero() {
+			return -1, "", rangeRequestError(400, "Parent %s has been released", parent.Cidr)
+		}
+		err = authorizeAllocation(c, tx, parent)
+		if err != nil {
+			return -1, "", err
+		}
+		parent_id = int64(parent.Subnet_id)
+		err = verifyContainedInParent(parent.Cidr, requestCidr)
+		if err != nil {
+			return -1, "", rangeRequestError(400, "%v", err)
+		}
+	} else if !authorized(c, RoleAdmin, routingDomain.Id) {
+		return -1, "", rangeRequestError(403, "Permission denied, top-level ranges can only be created by admins of the routing domain")
+	}
+	if quarantinePeriod > 0 {
+		err = tx.FinalizeReleasedRanges(parent_id, quarantineExpiry())
+		if err != nil {
+			return -1, "", err
+		}
+	}
+	if parent_id != -1 {
+		// The unique index only rejects the same CIDR, overlapping siblings are checked in
+		// the locked parent, including released siblings that are still quarantined
+		err = verifyNoOverlappingSibling(tx, parent_id, requestCidr)
+		if err != nil {
+			return -1, "", err
 		}
 	}
 
-	id, err := CreateRangeInDb(tx, parent_id,
-		int(domain_id),
-		p.Name,
-		p.Cidr)
-
+	id, err := tx.CreateRange(newRange(p, parent_id, routingDomain, requestCidr))
 	if err != nil {
-		tx.Rollback()
-		return c.Status(503).JSON(&fiber.Map{
-			"success": false,
-			"message": fmt.Sprintf("Unable to create new Subnet Lease %v", err),
-		})
+		return -1, "", err
 	}
+	return id, requestCidr, nil
+}
 
-	err = tx.Commit()
+// verifyNoOverlappingSibling returns a 409 error if a CIDR overlaps a child of the parent.
+func verifyNoOverlappingSibling(tx StorageTx, parent_id int64, cidr string) error {
+	_, network, err := net.ParseCIDR(cidr)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
-	return c.Status(200).JSON(&fiber.Map{
-		"id":   id,
-		"cidr": p.Cidr,
-	})
+	siblings, err := tx.GetRangesForParent(parent_id)
+	if err != nil {
+		return err
+	}
+	for _, sibling := range siblings {
+		_, siblingNetwork, err := net.ParseCIDR(sibling.Cidr)
+		if err != nil {
+			return err
+		}
+		if !overlapsAny(network, []*net.IPNet{siblingNetwork}) {
+			continue
+		}
+		if !sibling.Released_at.IsZero() {
+			return rangeRequestError(409, "%s overlaps range %d %s, which is quarantined until %s", cidr, sibling.Subnet_id, sibling.Cidr, sibling.Released_at.Add(quarantinePeriod).Format(time.RFC3339))
+		}
+		return rangeRequestError(409, "%s overlaps range %d %s", cidr, sibling.Subnet_id, sibling.Cidr)
+	}
+	return nil
 }
 
-func findNewLeaseAndInsert(c *fiber.Ctx, tx *sql.Tx, p RangeRequest, routingDomain *RoutingDomain) error {
+func findNewLeaseAndInsert(c *fiber.Ctx, tx StorageTx, p RangeRequest, routingDomain *RoutingDomain, external []ExternalRange) (int64, string, error) {
 	var err error
 	var parent *Range
 	if p.Parent != "" {
 		parent_id, err := strconv.ParseInt(p.Parent, 10, 64)
 		if err != nil {
-			parent, err = getRangeByCidrAndRoutingDomain(tx, p.Parent, routingDomain.Id)
+			parent, err = tx.GetRangeByCidr(routingDomain.Id, normalizeParentCidr(p.Parent))
 			if err != nil {
-				return c.Status(400).JSON(&fiber.Map{
-					"success": false,
-					"message": fmt.Sprintf("Parent needs to be either a cidr range within the routing domain or the id of a valid range %v", err),
-				})
+				return -1, "", rangeRequestError(400, "Parent needs to be either a cidr range within the routing domain or the id of a valid range %v", err)
 			}
 		} else {
-			parent, err = GetRangeFromDBWithTx(tx, parent_id)
+			parent, err = tx.GetRange(parent_id)
 			if err != nil {
-				tx.Rollback()
-				return c.Status(503).JSON(&fiber.Map{
-					"success": false,
-					"message": fmt.Sprintf("Unable to create new Subnet Lease  %v", err),
-				})
+				return -1, "", rangeRequestError(503, "Unable to create new Subnet Lease  %v", err)
 			}
 		}
 	} else {
-		return c.Status(400).JSON(&fiber.Map{
-			"success": false,
-			"message": "Please provide the ID of a parent range",
-		})
+		return -1, "", rangeRequestError(400, "Please provide the ID of a parent range")
 	}
-	range_size := p.Range_size
-	subnet_ranges, err := GetRangesForParentFromDB(tx, int64(parent.Subnet_id))
+	if !parent.Released_at.IsZero() {
+		return -1, "", rangeRequestError(400, "Parent %s has been released", parent.Cidr)
+	}
+	err = authorizeAllocation(c, tx, parent)
 	if err != nil {
-		tx.Rollback()
-		return c.Status(503).JSON(&fiber.Map{
-			"success": false,
-			"message": fmt.Sprintf("Unable to create new Subnet Lease  %v", err),
-		})
+		return -1, "", err
 	}
-	if os.Getenv("CAI_ORG_ID") != "" {
-		log.Printf("CAI for org %s enabled", os.Getenv("CAI_ORG_ID"))
-		// Integrating ranges from the VPC -- start
-		vpcs := strings.Split(routingDomain.Vpcs, ",")
-		log.Printf("Looking for subnets in vpcs %v", vpcs)
-		ranges, err := GetRangesForNetwork(fmt.Sprintf("organizations/%s", os.Getenv("CAI_ORG_ID")), vpcs)
+	range_size := p.Range_size
+	// Released ranges are skipped until their quarantine is over
+	if quarantinePeriod > 0 {
+		err = tx.FinalizeReleasedRanges(int64(parent.Subnet_id), quarantineExpiry())
 		if err != nil {
-			tx.Rollback()
-			return c.Status(503).JSON(&fiber.Map{
-				"success": false,
-				"message": fmt.Sprintf("error %v", err),
-			})
+			return -1, "", err
 		}
-		log.Printf("Found %d subnets in vpcs %v", len(ranges), vpcs)
-
-		for j := 0; j < len(ranges); j++ {
-			vpc_range := ranges[j]
-			if !ContainsRange(subnet_ranges, vpc_range.cidr) {
-				log.Printf("Adding range %s from CAI", vpc_range.cidr)
-				subnet_ranges = append(subnet_ranges, Range{
-					Cidr: vpc_range.cidr,
-				})
-			}
-
-			for k := 0; k < len(vpc_range.secondaryRanges); k++ {
-				secondaryRange := vpc_range.secondaryRanges[k]
-				if !ContainsRange(subnet_ranges, secondaryRange.cidr) {
-					log.Printf("Adding secondary range %s from CAI", vpc_range.cidr)
-					subnet_ranges = append(subnet_ranges, Range{
-						Cidr: secondaryRange.cidr,
-					})
-				}
-			}
-		}
-		// Integrating ranges from the VPC -- end
-	} else {
-		log.Printf("Not checking CAI, env variable with Org ID not set")
 	}
-
-	subnet, subnetOnes, err := findNextSubnet(int(range_size), parent.Cidr, subnet_ranges)
+	subnet_ranges, err := tx.GetRangesForParent(int64(parent.Subnet_id))
 	if err != nil {
-		tx.Rollback()
-		return c.Status(503).JSON(&fiber.Map{
-			"success": false,
-			"message": fmt.Sprintf("Unable to create new Subnet Lease %v", err),
-		})
+		return -1, "", err
 	}
-	nextSubnet, _ := cidr.NextSubnet(subnet, int(range_size))
-	log.Printf("next subnet will be starting with %s", nextSubnet.IP.String())
-
-	id, err := CreateRangeInDb(tx, int64(parent.Subnet_id), routingDomain.Id, p.Name, fmt.Sprintf("%s/%d", subnet.IP.To4().String(), subnetOnes))
+	subnet_ranges = mergeExternalRanges(subnet_ranges, external)
 
+	strategy := p.Allocation_strategy
+	if strategy == "" {
+		strategy = routingDomain.Allocation_strategy
+	}
+	subnet, subnetOnes, err := findNextSubnetWithStrategy(strategy, int(range_size), parent.Cidr, subnet_ranges)
 	if err != nil {
-		tx.Rollback()
-		return c.Status(503).JSON(&fiber.Map{
-			"success": false,
-			"message": fmt.Sprintf("Unable to create new Subnet Lease %v", err),
-		})
+		return -1, "", rangeRequestError(503, "Unable to create new Subnet Lease %v", err)
 	}
+	log.Printf("Allocated %s with strategy %s", formatSubnet(subnet, subnetOnes), strategy)
 
-	err = tx.Commit()
+	id, err := tx.CreateRange(newRange(p, int64(parent.Subnet_id), routingDomain, formatSubnet(subnet, subnetOnes)))
 	if err != nil {
-		log.Fatal(err)
+		return -1, "", err
 	}
-
-	return c.Status(200).JSON(&fiber.Map{
-		"id":   id,
-		"cidr": fmt.Sprintf("%s/%d", subnet.IP.To4().String(), subnetOnes),
-	})
+	return id, formatSubnet(subnet, subnetOnes), nil
 }
 
+// findNextSubnet selects the free range with the lowest address in the parent.
 func findNextSubnet(range_size int, sourceRange string, existingRanges []Range) (*net.IPNet, int, error) {
-	_, parentNet, err := net.ParseCIDR(sourceRange)
-	if err != nil {
-		return nil, -1, err
-	}
+	return findNextSubnetWithStrategy(FirstFit, range_size, sourceRange, existingRanges)
+}
 
-	subnet, subnetOnes, err := createNewSubnetLease(sourceRange, range_size, 0)
+// addExternalRanges adds the ranges found by the discovery providers of the routing domain
+// to the existing ranges, so they aren't allocated.
+func addExternalRanges(routingDomain *RoutingDomain, subnet_ranges []Range) ([]Range, error) {
+	external, err := discoverExternalRanges(context.Background(), routingDomain, false)
 	if err != nil {
-		return nil, -1, err
+		return nil, err
 	}
-	log.Printf("new subnet lease %s/%d", subnet.IP.String(), subnetOnes)
+	return mergeExternalRanges(subnet_ranges, external), nil
+}
 
-	var lastSubnet = false
-	for {
-		err = verifyNoOverlap(sourceRange, existingRanges, subnet)
-		if err == nil {
-			break
-		} else if !lastSubnet {
-			subnet, lastSubnet = cidr.NextSubnet(subnet, int(range_size))
-			if !parentNet.Contains(subnet.IP) {
-				return nil, -1, fmt.Errorf("no_address_range_available_in_parent")
-			}
-		} else {
-			return nil, -1, err
+// mergeExternalRanges adds discovered ranges to the existing ranges, unless they exist.
+func mergeExternalRanges(subnet_ranges []Range, external []ExternalRange) []Range {
+	for _, rang := range external {
+		if !ContainsRange(subnet_ranges, rang.Cidr) {
+			subnet_ranges = append(subnet_ranges, Range{
+				Name: rang.Name,
+				Cidr: rang.Cidr,
+			})
 		}
 	}
-
-	return subnet, subnetOnes, nil
+	return subnet_ranges
 }
 
 func GetRoutingDomain(c *fiber.Ctx) error {
@@ -365,7 +879,10 @@ func GetRoutingDomain(c *fiber.Ctx) error {
 			"message": fmt.Sprintf("%v", err),
 		})
 	}
-	domain, err := GetRoutingDomainFromDB(id)
+	if !authorized(c, RoleViewer, int(id)) {
+		return forbidden(c)
+	}
+	domain, err := store.GetRoutingDomain(id)
 	if err != nil {
 		return c.Status(503).JSON(&fiber.Map{
 			"success": false,
@@ -373,11 +890,52 @@ func GetRoutingDomain(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.Status(200).JSON(&fiber.Map{
-		"id":   domain.Id,
-		"name": domain.Name,
-		"vpcs": domain.Vpcs,
-	})
+	return c.Status(200).JSON(routingDomainResponse(domain))
+}
+
+// routingDomainResponse returns the JSON representation of a routing domain.
+func routingDomainResponse(domain *RoutingDomain) *fiber.Map {
+	discovery := domain.Discovery
+	if discovery == nil {
+		discovery = []DiscoveryConfig{}
+	}
+	return &fiber.Map{
+		"id":                  domain.Id,
+		"name":                domain.Name,
+		"vpcs":                domain.Vpcs,
+		"allocation_strategy": domain.Allocation_strategy,
+		"discovery":           discovery,
+	}
+}
+
+// GetExternalRanges lists the ranges found by the discovery providers of a routing domain,
+// ?refresh=true bypasses the cache.
+func GetExternalRanges(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	if !authorized(c, RoleViewer, int(id)) {
+		return forbidden(c)
+	}
+	domain, err := store.GetRoutingDomain(id)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	ranges, err := discoverExternalRanges(context.Background(), domain, c.Query("refresh") == "true")
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	return c.Status(200).JSON(ranges)
 }
 
 func DeleteRoutingDomain(c *fiber.Ctx) error {
@@ -388,20 +946,27 @@ func DeleteRoutingDomain(c *fiber.Ctx) error {
 			"message": fmt.Sprintf("%v", err),
 		})
 	}
-	err = DeleteRoutingDomainFromDB(id)
+	if !authorized(c, RoleAdmin, int(id)) {
+		return forbidden(c)
+	}
+	event := newAuditEvent(c, AuditDeleteDomain, int(id), 0, "")
+	err = store.DeleteRoutingDomain(id, event)
 	if err != nil {
 		return c.Status(503).JSON(&fiber.Map{
 			"success": false,
 			"message": fmt.Sprintf("%v", err),
 		})
 	}
+	exportAuditEvents(*event)
 
 	return c.Status(200).JSON(&fiber.Map{})
 }
 
 func GetRoutingDomains(c *fiber.Ctx) error {
 	var results []*fiber.Map
-	domains, err := GetRoutingDomainsFromDB()
+	// Routing domains can be looked up by ?name=
+	name := c.Query("name")
+	domains, err := store.GetRoutingDomains()
 	if err != nil {
 		return c.Status(503).JSON(&fiber.Map{
 			"success": false,
@@ -410,11 +975,10 @@ func GetRoutingDomains(c *fiber.Ctx) error {
 	}
 
 	for i := 0; i < len(domains); i++ {
-		results = append(results, &fiber.Map{
-			"id":   domains[i].Id,
-			"name": domains[i].Name,
-			"vpcs": domains[i].Vpcs,
-		})
+		if !authorized(c, RoleViewer, domains[i].Id) || (name != "" && domains[i].Name != name) {
+			continue
+		}
+		results = append(results, routingDomainResponse(&domains[i]))
 	}
 
 	return c.Status(200).JSON(results)
@@ -438,17 +1002,38 @@ func UpdateRoutingDomain(c *fiber.Ctx) error {
 			"message": fmt.Sprintf("Bad format %v", err),
 		})
 	}
-	err = UpdateRoutingDomainOnDb(id, p.Name, p.Vpcs)
+	if err := validateAllocationStrategy(p.Allocation_strategy.Value); err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	if err := validateDiscoveryConfigs(p.Discovery.Value); err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	if !authorized(c, RoleAdmin, int(id)) {
+		return forbidden(c)
+	}
+	event := newAuditEvent(c, AuditUpdateDomain, int(id), 0, "")
+	err = store.UpdateRoutingDomain(id, p.Name, p.Vpcs, p.Allocation_strategy, p.Discovery, event)
 	if err != nil {
 		return c.Status(503).JSON(&fiber.Map{
 			"success": false,
 			"message": fmt.Sprintf("Unable to update routing domain %v", err),
 		})
 	}
+	exportAuditEvents(*event)
 	return c.Status(200).JSON(&fiber.Map{})
 }
 
 func CreateRoutingDomain(c *fiber.Ctx) error {
+	// Routing domains can only be created by admins of all routing domains
+	if !authorized(c, RoleAdmin, 0) {
+		return forbidden(c)
+	}
 	// Instantiate new UpdateRoutingDomainRequest struct
 	p := new(CreateRoutingDomainRequest)
 	//  Parse body into UpdateRoutingDomainRequest struct
@@ -458,19 +1043,43 @@ func CreateRoutingDomain(c *fiber.Ctx) error {
 			"message": fmt.Sprintf("Bad format %v", err),
 		})
 	}
-	id, err := CreateRoutingDomainOnDb(p.Name, p.Vpcs)
+	if err := validateAllocationStrategy(p.Allocation_strategy); err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	if err := validateDiscoveryConfigs(p.Discovery); err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	event := newAuditEvent(c, AuditCreateDomain, 0, 0, "")
+	id, err := store.CreateRoutingDomain(p.Name, p.Vpcs, p.Allocation_strategy, p.Discovery, event)
 	if err != nil {
 		return c.Status(503).JSON(&fiber.Map{
 			"success": false,
 			"message": fmt.Sprintf("Unable to create new routing domain %v", err),
 		})
 	}
+	exportAuditEvents(*event)
 
 	return c.Status(200).JSON(&fiber.Map{
 		"id": id,
 	})
 }
 
+// normalizeParentCidr returns the canonical notation of a parent referenced by its CIDR,
+// or the parent unchanged if it isn't a CIDR range.
+func normalizeParentCidr(parent string) string {
+	normalized, err := normalizeCidr(parent)
+	if err != nil {
+		return parent
+	}
+	return normalized
+}
+
 func ContainsRange(array []Range, cidr string) bool {
 	for i := 0; i < len(array); i++ {
 		if cidr == array[i].Cidr {
@@ -509,3 +1118,33 @@ func (i *JSONStringArray) UnmarshalJSON(data []byte) error {
 	i.Value = val
 	return nil
 }
+
+type JSONStringMap struct {
+	Value map[string]string
+	Set   bool
+}
+
+func (i *JSONStringMap) UnmarshalJSON(data []byte) error {
+	i.Set = true
+	var val map[string]string
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	}
+	i.Value = val
+	return nil
+}
+
+type JSONDiscoveryConfigs struct {
+	Value []DiscoveryConfig
+	Set   bool
+}
+
+func (i *JSONDiscoveryConfigs) UnmarshalJSON(data []byte) error {
+	i.Set = true
+	var val []DiscoveryConfig
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	}
+	i.Value = val
+	return nil
+}
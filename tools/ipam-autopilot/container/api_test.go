@@ -0,0 +1,466 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestApp sets up the API with an in-memory database containing a routing domain and
+// the parent range 10.0.0.0/16, it returns the id of the parent range.
+func newTestApp(t *testing.T) (*fiber.App, int64) {
+	store = newTestStorage(t)
+	_, err := store.CreateRoutingDomain("test", []string{}, "", nil, nil)
+	assert.Nil(t, err)
+	app := newApp()
+	status, body := postRange(t, app, RangeRequest{Name: "parent", Cidr: "10.0.0.0/16"})
+	assert.Equal(t, 200, status)
+	return app, int64(body["id"].(float64))
+}
+
+func postRange(t *testing.T, app *fiber.App, request RangeRequest) (int, map[string]interface{}) {
+	jsn, err := json.Marshal(request)
+	assert.Nil(t, err)
+	req := httptest.NewRequest("POST", "/ranges", bytes.NewReader(jsn))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req, 10000)
+	if !assert.Nil(t, err) {
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	var body map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+	return resp.StatusCode, body
+}
+
+func TestCreateRangesConcurrently(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+
+	createRangesConcurrently(t, app, "", parent_id)
+}
+
+// TestCreateRangesConcurrentlyInDatabase runs the concurrent allocations against the
+// MySQL or PostgreSQL database configured like the API (see NewStorageFromEnv), as SQLite
+// serializes all transactions. It runs if IPAM_TEST_DATABASE is true and creates its own
+// routing domain, which is deleted afterwards.
+func TestCreateRangesConcurrentlyInDatabase(t *testing.T) {
+	if os.Getenv("IPAM_TEST_DATABASE") != "true" {
+		t.Skip("IPAM_TEST_DATABASE is not set")
+	}
+	s, err := NewStorageFromEnv()
+	if !assert.Nil(t, err) {
+		return
+	}
+	store = s
+	defer store.Close()
+	if !assert.Nil(t, store.Migrate()) {
+		return
+	}
+	domain_id, err := store.CreateRoutingDomain(fmt.Sprintf("test-%d", time.Now().UnixNano()), []string{}, "", nil, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	domain := fmt.Sprint(domain_id)
+	app := newApp()
+	var parents []int64
+	defer func() {
+		for _, parent_id := range parents {
+			children, err := store.GetRangesForParent(parent_id)
+			assert.Nil(t, err)
+			for _, child := range children {
+				assert.Nil(t, store.DeleteRange(int64(child.Subnet_id), nil))
+			}
+			assert.Nil(t, store.DeleteRange(parent_id, nil))
+		}
+		assert.Nil(t, store.DeleteRoutingDomain(domain_id, nil))
+	}()
+	// Allocations from different parents of a routing domain don't wait for each other
+	for _, cidr := range []string{"10.0.0.0/16", "10.1.0.0/16"} {
+		status, body := postRange(t, app, RangeRequest{Name: "parent", Domain: domain, Cidr: cidr})
+		if !assert.Equal(t, 200, status) {
+			return
+		}
+		parents = append(parents, int64(body["id"].(float64)))
+	}
+	createRangesConcurrently(t, app, domain, parents...)
+}
+
+// createRangesConcurrently allocates ranges from the parents in parallel and checks that
+// no range is allocated twice.
+func createRangesConcurrently(t *testing.T, app *fiber.App, domain string, parents ...int64) {
+	const requests = 20
+	var wg sync.WaitGroup
+	statuses := make([]int, requests)
+	cidrs := make([]string, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status, body := postRange(t, app, RangeRequest{
+				Name:       fmt.Sprintf("range-%d", i),
+				Domain:     domain,
+				Parent:     fmt.Sprint(parents[i%len(parents)]),
+				Range_size: 24,
+			})
+			statuses[i] = status
+			cidrs[i], _ = body["cidr"].(string)
+		}(i)
+	}
+	wg.Wait()
+
+	allocated := make(map[string]bool)
+	for i := 0; i < requests; i++ {
+		assert.Equal(t, 200, statuses[i])
+		assert.False(t, allocated[cidrs[i]], "%s allocated twice", cidrs[i])
+		allocated[cidrs[i]] = true
+	}
+	children := 0
+	for _, parent_id := range parents {
+		ranges, err := store.GetRangesForParent(parent_id)
+		assert.Nil(t, err)
+		children += len(ranges)
+	}
+	assert.Equal(t, requests, children)
+}
+
+// errTestConflict is a conflict with a concurrent transaction injected by conflictStorage.
+var errTestConflict = errors.New("test conflict")
+
+// conflictStorage fails the first conflicts range inserts with a conflict.
+type conflictStorage struct {
+	Storage
+	conflicts int
+}
+
+func (s *conflictStorage) Begin(ctx context.Context) (StorageTx, error) {
+	tx, err := s.Storage.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conflictStorageTx{StorageTx: tx, storage: s}, nil
+}
+
+func (s *conflictStorage) IsConflict(err error) bool {
+	return errors.Is(err, errTestConflict) || s.Storage.IsConflict(err)
+}
+
+type conflictStorageTx struct {
+	StorageTx
+	storage *conflictStorage
+}
+
+func (t *conflictStorageTx) CreateRange(r *Range) (int64, error) {
+	if t.storage.conflicts > 0 {
+		t.storage.conflicts--
+		return -1, errTestConflict
+	}
+	return t.StorageTx.CreateRange(r)
+}
+
+func TestCreateRangeRetriesConflicts(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	conflicts := &conflictStorage{Storage: store, conflicts: 2}
+	store = conflicts
+
+	status, body := postRange(t, app, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status, "%v", body)
+	assert.Equal(t, "10.0.0.0/24", body["cidr"])
+	assert.Equal(t, 0, conflicts.conflicts)
+
+	// Allocations give up after maxAllocationAttempts conflicts
+	conflicts.conflicts = maxAllocationAttempts
+	status, body = postRange(t, app, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 409, status)
+	assert.Equal(t, false, body["success"])
+	assert.Equal(t, 0, conflicts.conflicts)
+
+	// Ranges with an explicit CIDR are not retried
+	conflicts.conflicts = 1
+	status, _ = postRange(t, app, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Cidr: "10.0.5.0/24"})
+	assert.Equal(t, 409, status)
+	ranges, err := store.GetRangesForParent(parent_id)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ranges))
+}
+
+func TestCreateDuplicateRange(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+
+	status, _ := postRange(t, app, RangeRequest{Name: "first", Parent: fmt.Sprint(parent_id), Cidr: "10.0.1.0/24"})
+	assert.Equal(t, 200, status)
+	status, body := postRange(t, app, RangeRequest{Name: "second", Parent: fmt.Sprint(parent_id), Cidr: "10.0.1.0/24"})
+	assert.Equal(t, 409, status)
+	assert.Equal(t, false, body["success"])
+}
+
+func TestCreateRangeWithHostBits(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+
+	status, body := postRange(t, app, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Cidr: "10.0.1.5/24"})
+	assert.Equal(t, 400, status)
+	assert.Contains(t, body["message"], "the range is 10.0.1.0/24")
+}
+
+func TestCreateRangeWithInvalidParent(t *testing.T) {
+	app, _ := newTestApp(t)
+	defer store.Close()
+
+	status, _ := postRange(t, app, RangeRequest{Name: "child", Parent: "192.168.0.0/16", Range_size: 24})
+	assert.Equal(t, 400, status)
+	// The transaction of the failed request has been rolled back
+	status, _ = postRange(t, app, RangeRequest{Name: "child", Parent: "10.0.0.0/16", Range_size: 24})
+	assert.Equal(t, 200, status)
+}
+
+func TestGetRangeUtilization(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+
+	status, _ := postRange(t, app, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 17, Allocation_strategy: LastFit})
+	assert.Equal(t, 200, status)
+	status, body := postRange(t, app, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24, Allocation_strategy: "random-fit"})
+	assert.Equal(t, 400, status)
+	assert.Equal(t, false, body["success"])
+
+	resp, err := app.Test(httptest.NewRequest("GET", fmt.Sprintf("/ranges/%d/utilization", parent_id), nil))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	var utilization map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&utilization))
+	assert.Equal(t, float64(65536), utilization["total_addresses"])
+	assert.Equal(t, float64(32768), utilization["used_addresses"])
+	assert.Equal(t, "10.0.0.0/17", utilization["largest_free_block"])
+	assert.Equal(t, float64(0), utilization["fragmentation"])
+}
+
+func TestRangeLabels(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+
+	status, body := postRange(t, app, RangeRequest{Name: "prod", Parent: fmt.Sprint(parent_id), Range_size: 24, Labels: map[string]string{"env": "prod", "team": "network"}, Status: RangeReserved})
+	assert.Equal(t, 200, status)
+	prod_id := int64(body["id"].(float64))
+	status, _ = postRange(t, app, RangeRequest{Name: "dev", Parent: fmt.Sprint(parent_id), Range_size: 24, Labels: map[string]string{"env": "dev", "team": "network"}})
+	assert.Equal(t, 200, status)
+	status, _ = postRange(t, app, RangeRequest{Name: "invalid", Parent: fmt.Sprint(parent_id), Range_size: 24, Status: RangeReleased})
+	assert.Equal(t, 400, status)
+
+	getRanges := func(query string) []map[string]interface{} {
+		resp, err := app.Test(httptest.NewRequest("GET", "/ranges"+query, nil))
+		assert.Nil(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		var ranges []map[string]interface{}
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&ranges))
+		return ranges
+	}
+	assert.Equal(t, 3, len(getRanges("")))
+	assert.Equal(t, 2, len(getRanges("?label=team:network")))
+	ranges := getRanges("?label=team:network&label=env:prod")
+	assert.Equal(t, 1, len(ranges))
+	assert.Equal(t, "prod", ranges[0]["name"])
+	assert.Equal(t, RangeReserved, ranges[0]["status"])
+	assert.NotEqual(t, "", ranges[0]["created_at"])
+
+	req := httptest.NewRequest("PUT", fmt.Sprintf("/ranges/%d", prod_id), bytes.NewReader([]byte(`{"status":"allocated","description":"Production","labels":{"env":"staging"}}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 0, len(getRanges("?label=env:prod")))
+	ranges = getRanges("?label=env:staging")
+	assert.Equal(t, 1, len(ranges))
+	assert.Equal(t, "Production", ranges[0]["description"])
+	assert.Equal(t, RangeAllocated, ranges[0]["status"])
+}
+
+func deleteRange(t *testing.T, app *fiber.App, path string) int {
+	resp, err := app.Test(httptest.NewRequest("DELETE", path, nil))
+	assert.Nil(t, err)
+	return resp.StatusCode
+}
+
+func TestRangeQuarantine(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	quarantinePeriod = time.Hour
+	defer func() { quarantinePeriod = 0 }()
+
+	status, body := postRange(t, app, RangeRequest{Name: "first", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "10.0.0.0/24", body["cidr"])
+	first_id := int64(body["id"].(float64))
+	assert.Equal(t, 400, deleteRange(t, app, fmt.Sprintf("/ranges/%d", parent_id)))
+	assert.Equal(t, 200, deleteRange(t, app, fmt.Sprintf("/ranges/%d", first_id)))
+	assert.Equal(t, 200, deleteRange(t, app, fmt.Sprintf("/ranges/%d", first_id)))
+
+	// The quarantined range is skipped
+	status, body = postRange(t, app, RangeRequest{Name: "second", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "10.0.1.0/24", body["cidr"])
+	status, _ = postRange(t, app, RangeRequest{Name: "direct", Parent: fmt.Sprint(parent_id), Cidr: "10.0.0.0/24"})
+	assert.Equal(t, 409, status)
+	// Blocks within or containing the quarantined range, or overlapping active siblings, are rejected too
+	for _, cidr := range []string{"10.0.0.0/25", "10.0.0.128/26", "10.0.0.0/23", "10.0.1.0/25"} {
+		status, _ = postRange(t, app, RangeRequest{Name: "direct", Parent: fmt.Sprint(parent_id), Cidr: cidr})
+		assert.Equal(t, 409, status, cidr)
+	}
+	status, _ = postRange(t, app, RangeRequest{Name: "direct", Parent: fmt.Sprint(parent_id), Cidr: "10.0.2.0/25"})
+	assert.Equal(t, 200, status)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/quarantine", nil))
+	assert.Nil(t, err)
+	var quarantined []map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&quarantined))
+	assert.Equal(t, 1, len(quarantined))
+	assert.Equal(t, "10.0.0.0/24", quarantined[0]["cidr"])
+	assert.Equal(t, RangeReleased, quarantined[0]["status"])
+	assert.NotEqual(t, "", quarantined[0]["quarantined_until"])
+
+	// Only quarantined ranges can be force released
+	assert.Equal(t, 400, deleteRange(t, app, fmt.Sprintf("/quarantine/%d", parent_id)))
+	assert.Equal(t, 200, deleteRange(t, app, fmt.Sprintf("/quarantine/%d", first_id)))
+	status, body = postRange(t, app, RangeRequest{Name: "third", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "10.0.0.0/24", body["cidr"])
+
+	// A restored range is not force released
+	third_path := fmt.Sprintf("/ranges/%d", int64(body["id"].(float64)))
+	assert.Equal(t, 200, deleteRange(t, app, third_path))
+	req := httptest.NewRequest("PUT", third_path, bytes.NewReader([]byte(`{"status":"allocated"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err = app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, 400, deleteRange(t, app, fmt.Sprintf("/quarantine/%d", int64(body["id"].(float64)))))
+	_, err = store.GetRange(int64(body["id"].(float64)))
+	assert.Nil(t, err)
+}
+
+func TestReleaseRangeWithUpdate(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+
+	status, body := postRange(t, app, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	req := httptest.NewRequest("PUT", fmt.Sprintf("/ranges/%d", int64(body["id"].(float64))), bytes.NewReader([]byte(`{"status":"released"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	assert.Nil(t, err)
+	assert.Equal(t, 400, resp.StatusCode)
+	ranges, err := store.GetQuarantinedRanges()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ranges))
+}
+
+func TestDeleteRangeWithChildren(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+
+	status, body := postRange(t, app, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 400, deleteRange(t, app, fmt.Sprintf("/ranges/%d", parent_id)))
+	assert.Equal(t, 200, deleteRange(t, app, fmt.Sprintf("/ranges/%d", int64(body["id"].(float64)))))
+	assert.Equal(t, 200, deleteRange(t, app, fmt.Sprintf("/ranges/%d", parent_id)))
+	ranges, err := store.GetRanges()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ranges))
+}
+
+func TestRangeQuarantineExpiry(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	quarantinePeriod = time.Millisecond
+	defer func() { quarantinePeriod = 0 }()
+
+	status, body := postRange(t, app, RangeRequest{Name: "first", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 200, deleteRange(t, app, fmt.Sprintf("/ranges/%d", int64(body["id"].(float64)))))
+	time.Sleep(10 * time.Millisecond)
+
+	// Allocations finalize the released ranges of the parent after their quarantine
+	status, body = postRange(t, app, RangeRequest{Name: "second", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "10.0.0.0/24", body["cidr"])
+	ranges, err := store.GetQuarantinedRanges()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ranges))
+}
+
+func TestLookupRangesAndFreeRanges(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	quarantinePeriod = time.Hour
+	defer func() { quarantinePeriod = 0 }()
+
+	status, body := postRange(t, app, RangeRequest{Name: "first", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	status, body = postRange(t, app, RangeRequest{Name: "second", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, 200, deleteRange(t, app, fmt.Sprintf("/ranges/%d", int64(body["id"].(float64)))))
+
+	get := func(path string, result interface{}) int {
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		assert.Nil(t, err)
+		if resp.StatusCode == 200 {
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(result))
+		}
+		return resp.StatusCode
+	}
+	var ranges []map[string]interface{}
+	assert.Equal(t, 200, get("/ranges?name=first", &ranges))
+	if assert.Equal(t, 1, len(ranges)) {
+		assert.Equal(t, "10.0.0.0/24", ranges[0]["cidr"])
+		assert.Equal(t, float64(1), ranges[0]["domain"])
+	}
+	ranges = nil
+	assert.Equal(t, 200, get("/ranges?cidr=10.0.0.0/16&domain=1", &ranges))
+	assert.Equal(t, 1, len(ranges))
+	ranges = nil
+	assert.Equal(t, 200, get("/ranges?cidr=10.0.0.0/16&domain=2", &ranges))
+	assert.Equal(t, 0, len(ranges))
+	assert.Equal(t, 400, get("/ranges?cidr=10.0.0.0", &ranges))
+
+	var domains []map[string]interface{}
+	assert.Equal(t, 200, get("/domains?name=test", &domains))
+	assert.Equal(t, 1, len(domains))
+	domains = nil
+	assert.Equal(t, 200, get("/domains?name=unknown", &domains))
+	assert.Equal(t, 0, len(domains))
+
+	// The quarantined range isn't free
+	var free map[string]interface{}
+	assert.Equal(t, 200, get(fmt.Sprintf("/ranges/%d/free?range_size=24&limit=2", parent_id), &free))
+	assert.Equal(t, []interface{}{"10.0.2.0/24", "10.0.3.0/24"}, free["cidrs"])
+	assert.Equal(t, 200, get(fmt.Sprintf("/ranges/%d/free?range_size=17", parent_id), &free))
+	assert.Equal(t, []interface{}{"10.0.128.0/17"}, free["cidrs"])
+	assert.Equal(t, 400, get(fmt.Sprintf("/ranges/%d/free", parent_id), &free))
+	assert.Equal(t, 400, get(fmt.Sprintf("/ranges/%d/free?range_size=8", parent_id), &free))
+}
@@ -0,0 +1,271 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"google.golang.org/api/option"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// Actions of audit events.
+const (
+	AuditCreateRange    = "create_range"
+	AuditUpdateRange    = "update_range"
+	AuditReleaseRange   = "release_range"
+	AuditDeleteRange    = "delete_range"
+	AuditFinalizeRange  = "finalize_range"
+	AuditCreateDomain   = "create_domain"
+	AuditUpdateDomain   = "update_domain"
+	AuditDeleteDomain   = "delete_domain"
+	auditSystemActor    = "system"
+	auditAnonymousActor = "anonymous"
+)
+
+// AuditEvent records who changed a routing domain or range.
+type AuditEvent struct {
+	Id                int64     `json:"id"`
+	Time              time.Time `json:"time"`
+	Actor             string    `json:"actor"`
+	Action            string    `json:"action"`
+	Routing_domain_id int       `json:"routing_domain_id,omitempty"`
+	Range_id          int       `json:"range_id,omitempty"`
+	Cidr              string    `json:"cidr,omitempty"`
+	// body of the request causing the event
+	Request json.RawMessage `json:"request,omitempty"`
+}
+
+// AuditFilter selects audit events, fields that are not set match all events.
+type AuditFilter struct {
+	From              time.Time
+	To                time.Time
+	Routing_domain_id int
+	Range_id          int
+	Action            string
+	// Only events of these routing domains, unless nil
+	Routing_domain_ids []int
+	// Only events older than this event, for fetching the next page
+	Before int64
+	Limit  int
+}
+
+// Maximum number of events returned by GET /audit.
+const maxAuditEvents = 1000
+
+// newAuditEvent returns the event of a request changing a routing domain or range.
+func newAuditEvent(c *fiber.Ctx, action string, routing_domain_id int, range_id int, cidr string) *AuditEvent {
+	event := &AuditEvent{
+		Actor:             auditActor(c),
+		Action:            action,
+		Routing_domain_id: routing_domain_id,
+		Range_id:          range_id,
+		Cidr:              cidr,
+	}
+	if body := c.Body(); len(body) > 0 && json.Valid(body) {
+		event.Request = append(json.RawMessage{}, body...)
+	}
+	return event
+}
+
+// finalizeEvent returns the event of a released range deleted after its quarantine.
+func finalizeEvent(rang *Range) *AuditEvent {
+	return &AuditEvent{
+		Actor:             auditSystemActor,
+		Action:            AuditFinalizeRange,
+		Routing_domain_id: rang.Routing_domain_id,
+		Range_id:          rang.Subnet_id,
+		Cidr:              rang.Cidr,
+	}
+}
+
+// auditActor returns the principal of a request. Without AUTH_CONFIG, Cloud Run has already
+// verified the ID token, so the email is taken from the token.
+func auditActor(c *fiber.Ctx) string {
+	if principal, ok := c.Locals("principal").(*Principal); ok {
+		return principal.Name
+	}
+	if email := tokenClaims(bearerToken(c)).Email; email != "" {
+		return "google:" + email
+	}
+	return auditAnonymousActor
+}
+
+// AuditSink exports committed audit events, i.e. to a SIEM.
+type AuditSink interface {
+	Export(event *AuditEvent) error
+}
+
+// auditSinks are configured by AUDIT_LOG_FILE and AUDIT_PUBSUB_TOPIC.
+var auditSinks []AuditSink
+
+// auditSinksFromEnv creates the sinks for exporting audit events.
+func auditSinksFromEnv() ([]AuditSink, error) {
+	var sinks []AuditSink
+	if path := os.Getenv("AUDIT_LOG_FILE"); path != "" {
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open audit log file %s: %v", path, err)
+		}
+		sinks = append(sinks, &fileAuditSink{file: file})
+	}
+	if topic := os.Getenv("AUDIT_PUBSUB_TOPIC"); topic != "" {
+		sink, err := newPubsubAuditSink(context.Background(), topic, os.Getenv("PUBSUB_EMULATOR_HOST"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to create Pub/Sub client for %s: %v", topic, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// exportAuditEvents sends committed events to the sinks. The events are stored in the
+// database already, so failures are only logged.
+func exportAuditEvents(events ...AuditEvent) {
+	for i := range events {
+		for _, sink := range auditSinks {
+			err := sink.Export(&events[i])
+			if err != nil {
+				log.Printf("Unable to export audit event %d: %v", events[i].Id, err)
+			}
+		}
+	}
+}
+
+// fileAuditSink appends events as JSON lines to a file.
+type fileAuditSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func (s *fileAuditSink) Export(event *AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// pubsubAuditSink publishes events to a Pub/Sub topic (projects/<project>/topics/<topic>),
+// or to a Pub/Sub compatible endpoint like the emulator.
+type pubsubAuditSink struct {
+	topic   string
+	service *pubsub.Service
+}
+
+func newPubsubAuditSink(ctx context.Context, topic string, emulatorHost string) (*pubsubAuditSink, error) {
+	var opts []option.ClientOption
+	if emulatorHost != "" {
+		opts = append(opts, option.WithEndpoint(fmt.Sprintf("http://%s/", emulatorHost)), option.WithoutAuthentication())
+	}
+	service, err := pubsub.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &pubsubAuditSink{topic: topic, service: service}, nil
+}
+
+func (s *pubsubAuditSink) Export(event *AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.service.Projects.Topics.Publish(s.topic, &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{
+			Data:       base64.StdEncoding.EncodeToString(data),
+			Attributes: map[string]string{"action": event.Action, "actor": event.Actor},
+		}},
+	}).Do()
+	return err
+}
+
+// GetAuditEvents lists the audit events newest first, filtered by the query parameters
+// from and to (RFC 3339), domain, range and action. The next page is fetched with the
+// parameter before, the id of the last event of the page.
+func GetAuditEvents(c *fiber.Ctx) error {
+	filter := AuditFilter{Limit: maxAuditEvents}
+	var err error
+	for param, value := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if c.Query(param) == "" {
+			continue
+		}
+		*value, err = time.Parse(time.RFC3339, c.Query(param))
+		if err != nil {
+			return c.Status(400).JSON(&fiber.Map{
+				"success": false,
+				"message": fmt.Sprintf("Parameter %s needs to be a RFC 3339 time %v", param, err),
+			})
+		}
+	}
+	for param, value := range map[string]*int{"domain": &filter.Routing_domain_id, "range": &filter.Range_id, "limit": &filter.Limit} {
+		if c.Query(param) == "" {
+			continue
+		}
+		*value, err = strconv.Atoi(c.Query(param))
+		if err != nil || *value <= 0 {
+			return c.Status(400).JSON(&fiber.Map{
+				"success": false,
+				"message": fmt.Sprintf("Parameter %s needs to be a positive number", param),
+			})
+		}
+	}
+	if c.Query("before") != "" {
+		filter.Before, err = strconv.ParseInt(c.Query("before"), 10, 64)
+		if err != nil || filter.Before <= 0 {
+			return c.Status(400).JSON(&fiber.Map{
+				"success": false,
+				"message": "Parameter before needs to be a positive number",
+			})
+		}
+	}
+	filter.Action = c.Query("action")
+	if filter.Limit > maxAuditEvents {
+		filter.Limit = maxAuditEvents
+	}
+	// Events are visible to viewers of their routing domain, events without a routing
+	// domain to viewers of all routing domains. The filter is part of the query, so the
+	// limit applies to the visible events.
+	all, routing_domain_ids := authorizedDomains(c, RoleViewer)
+	if !all {
+		if len(routing_domain_ids) == 0 {
+			return c.Status(200).JSON([]AuditEvent{})
+		}
+		filter.Routing_domain_ids = routing_domain_ids
+	}
+
+	events, err := store.GetAuditEvents(filter)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	if events == nil {
+		events = []AuditEvent{}
+	}
+	return c.Status(200).JSON(events)
+}
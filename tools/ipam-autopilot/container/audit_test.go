@@ -0,0 +1,143 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditEvents(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	file, err := ioutil.TempFile("", "audit-*.jsonl")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	auditSinks = []AuditSink{&fileAuditSink{file: file}}
+	defer func() { auditSinks = nil }()
+	newTestAuth(t, []Grant{
+		{Principals: []string{"apikey:ci"}, Role: "admin"},
+		{Principals: []string{"apikey:other-team"}, Role: "viewer", Domain: 2},
+	}, "ci", "other-team")
+	defer func() { auth = nil }()
+
+	status, body := authRequest(t, app, "POST", "/ranges", "ci", RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	var created map[string]interface{}
+	assert.Nil(t, json.Unmarshal(body, &created))
+	child_id := int(created["id"].(float64))
+	status, _ = authRequest(t, app, "DELETE", fmt.Sprintf("/ranges/%d", child_id), "ci", nil)
+	assert.Equal(t, 200, status)
+	// Failed requests are not recorded
+	status, _ = authRequest(t, app, "POST", "/ranges", "ci", RangeRequest{Name: "child", Parent: "99", Range_size: 24})
+	assert.Equal(t, 503, status)
+
+	var events []AuditEvent
+	status, body = authRequest(t, app, "GET", fmt.Sprintf("/audit?range=%d", child_id), "ci", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &events))
+	// Newest first
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, AuditDeleteRange, events[0].Action)
+		assert.Equal(t, AuditCreateRange, events[1].Action)
+		assert.Equal(t, "apikey:ci", events[1].Actor)
+		assert.Equal(t, "10.0.0.0/24", events[1].Cidr)
+		assert.Equal(t, 1, events[1].Routing_domain_id)
+		var request RangeRequest
+		assert.Nil(t, json.Unmarshal(events[1].Request, &request))
+		assert.Equal(t, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24}, request)
+	}
+	// The parent range was created without authentication
+	var created_events []AuditEvent
+	status, body = authRequest(t, app, "GET", "/audit?action=create_range&domain=1", "ci", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &created_events))
+	if assert.Equal(t, 2, len(created_events)) {
+		assert.Equal(t, auditAnonymousActor, created_events[1].Actor)
+	}
+	status, _ = authRequest(t, app, "GET", "/audit?from=yesterday", "ci", nil)
+	assert.Equal(t, 400, status)
+
+	// Events are only visible to viewers of their routing domain
+	status, body = authRequest(t, app, "GET", "/audit", "other-team", nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "[]", string(body))
+
+	// Events are exported as JSON lines
+	exported, err := os.Open(file.Name())
+	assert.Nil(t, err)
+	defer exported.Close()
+	var lines []AuditEvent
+	scanner := bufio.NewScanner(exported)
+	for scanner.Scan() {
+		var event AuditEvent
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &event))
+		lines = append(lines, event)
+	}
+	if assert.Equal(t, 2, len(lines)) {
+		assert.Equal(t, events[1].Id, lines[0].Id)
+		assert.Equal(t, AuditDeleteRange, lines[1].Action)
+	}
+}
+
+func TestAuditEventsPagination(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	for i := 0; i < 4; i++ {
+		status, _ := postRange(t, app, RangeRequest{Name: fmt.Sprintf("range-%d", i), Parent: fmt.Sprint(parent_id), Range_size: 24})
+		assert.Equal(t, 200, status)
+	}
+	other_id, err := store.CreateRoutingDomain("other", []string{}, "", nil, &AuditEvent{Actor: "apikey:ci", Action: AuditCreateDomain})
+	assert.Nil(t, err)
+	newTestAuth(t, []Grant{
+		{Principals: []string{"apikey:team-a"}, Role: "viewer", Domain: 1},
+	}, "team-a")
+	defer func() { auth = nil }()
+
+	// The event of the other routing domain is the newest, the limit only applies to the
+	// visible events
+	var events []AuditEvent
+	status, body := authRequest(t, app, "GET", "/audit?limit=2", "team-a", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &events))
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "10.0.3.0/24", events[0].Cidr)
+		assert.Equal(t, "10.0.2.0/24", events[1].Cidr)
+	}
+	status, body = authRequest(t, app, "GET", fmt.Sprintf("/audit?limit=2&before=%d", events[1].Id), "team-a", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &events))
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, "10.0.1.0/24", events[0].Cidr)
+		assert.Equal(t, "10.0.0.0/24", events[1].Cidr)
+	}
+	status, body = authRequest(t, app, "GET", fmt.Sprintf("/audit?before=%d", events[1].Id), "team-a", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &events))
+	if assert.Equal(t, 1, len(events)) {
+		assert.Equal(t, "10.0.0.0/16", events[0].Cidr)
+	}
+	status, _ = authRequest(t, app, "GET", "/audit?before=first", "team-a", nil)
+	assert.Equal(t, 400, status)
+	status, body = authRequest(t, app, "GET", fmt.Sprintf("/audit?domain=%d", other_id), "team-a", nil)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "[]", string(body))
+}
@@ -0,0 +1,449 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gofiber/fiber/v2"
+	"google.golang.org/api/idtoken"
+	"gopkg.in/yaml.v3"
+)
+
+// Role of a principal on a routing domain or range, each role includes the lower ones.
+type Role int
+
+const (
+	// RoleViewer can read ranges and routing domains
+	RoleViewer Role = iota + 1
+	// RoleAllocator can additionally allocate, update and release ranges
+	RoleAllocator
+	// RoleAdmin can additionally manage routing domains, create top-level ranges and
+	// force-release quarantined ranges
+	RoleAdmin
+)
+
+var roleNames = map[string]Role{"viewer": RoleViewer, "allocator": RoleAllocator, "admin": RoleAdmin}
+
+// Principal is an authenticated caller of the API, i.e. google:alice@example.com,
+// apikey:ci or oidc:github:repo:example/infra:ref:refs/heads/main.
+type Principal struct {
+	Name string
+}
+
+// Authenticator authenticates requests with one kind of credentials.
+type Authenticator interface {
+	// Authenticate returns the principal of a request, or nil if the request has no
+	// credentials for this authenticator.
+	Authenticate(c *fiber.Ctx) (*Principal, error)
+}
+
+// AuthConfig is the YAML configuration of authentication and authorization, read from the
+// file in AUTH_CONFIG.
+type AuthConfig struct {
+	Google *struct {
+		// Audiences accepted in ID tokens, http://ipam-autopilot.com (used by the provider)
+		// by default
+		Audiences []string `yaml:"audiences"`
+	} `yaml:"google"`
+	ApiKeys []ApiKey `yaml:"api_keys"`
+	Oidc    []struct {
+		Name     string `yaml:"name"`
+		Issuer   string `yaml:"issuer"`
+		Audience string `yaml:"audience"`
+		// Claim identifying the principal, sub by default
+		Claim string `yaml:"claim"`
+	} `yaml:"oidc"`
+	Grants []Grant `yaml:"grants"`
+}
+
+// ApiKey is a static API key, only the hash of the key is configured.
+type ApiKey struct {
+	Name string `yaml:"name"`
+	// Hex encoded SHA-256 hash of the key
+	KeySha256 string `yaml:"key_sha256"`
+}
+
+// Grant gives principals a role on a routing domain, on a range and all its descendants,
+// or on everything if neither is set. Principals may contain a * wildcard, i.e.
+// google:*@example.com.
+type Grant struct {
+	Principals []string `yaml:"principals"`
+	Role       string   `yaml:"role"`
+	Domain     int      `yaml:"domain"`
+	Range      int      `yaml:"range"`
+	role       Role
+}
+
+// Auth authenticates and authorizes the requests of the API.
+type Auth struct {
+	authenticators []Authenticator
+	grants         []Grant
+}
+
+// auth is nil if AUTH_CONFIG isn't set, then the API relies on Cloud Run IAM only.
+var auth *Auth
+
+// LoadAuthConfig reads the authentication and authorization configuration.
+func LoadAuthConfig(ctx context.Context, path string) (*Auth, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config AuthConfig
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+	return NewAuth(ctx, &config)
+}
+
+// NewAuth creates the authenticators and validates the grants of a configuration.
+func NewAuth(ctx context.Context, config *AuthConfig) (*Auth, error) {
+	a := &Auth{}
+	if config.Google != nil {
+		audiences := config.Google.Audiences
+		if len(audiences) == 0 {
+			audiences = []string{"http://ipam-autopilot.com"}
+		}
+		a.authenticators = append(a.authenticators, &googleAuthenticator{audiences: audiences})
+	}
+	if len(config.ApiKeys) > 0 {
+		keys := &apiKeyAuthenticator{}
+		for _, key := range config.ApiKeys {
+			hash, err := hex.DecodeString(key.KeySha256)
+			if err != nil || len(hash) != sha256.Size || key.Name == "" {
+				return nil, fmt.Errorf("API key %s needs a name and the hex encoded SHA-256 hash of the key", key.Name)
+			}
+			keys.names = append(keys.names, key.Name)
+			keys.hashes = append(keys.hashes, hash)
+		}
+		a.authenticators = append(a.authenticators, keys)
+	}
+	for _, provider := range config.Oidc {
+		if provider.Name == "" || provider.Issuer == "" || provider.Audience == "" {
+			return nil, fmt.Errorf("OIDC provider %s needs a name, an issuer and an audience", provider.Name)
+		}
+		discovered, err := oidc.NewProvider(ctx, provider.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("unable to discover OIDC provider %s: %v", provider.Name, err)
+		}
+		claim := provider.Claim
+		if claim == "" {
+			claim = "sub"
+		}
+		a.authenticators = append(a.authenticators, &oidcAuthenticator{
+			name:     provider.Name,
+			issuer:   provider.Issuer,
+			claim:    claim,
+			verifier: discovered.Verifier(&oidc.Config{ClientID: provider.Audience}),
+		})
+	}
+	if len(a.authenticators) == 0 {
+		return nil, fmt.Errorf("no authenticators configured, configure google, api_keys or oidc")
+	}
+	for i, grant := range config.Grants {
+		role, found := roleNames[grant.Role]
+		if !found {
+			return nil, fmt.Errorf("grant %d has an unknown role %s, supported are viewer, allocator and admin", i+1, grant.Role)
+		}
+		if grant.Domain != 0 && grant.Range != 0 {
+			return nil, fmt.Errorf("grant %d can't be both for a domain and a range", i+1)
+		}
+		grant.role = role
+		a.grants = append(a.grants, grant)
+	}
+	return a, nil
+}
+
+// Authenticate is the middleware authenticating the requests, the principal is stored in
+// the locals of the request.
+func Authenticate(c *fiber.Ctx) error {
+	if auth == nil {
+		return c.Next()
+	}
+	for _, authenticator := range auth.authenticators {
+		principal, err := authenticator.Authenticate(c)
+		if err != nil {
+			return c.Status(401).JSON(&fiber.Map{
+				"success": false,
+				"message": fmt.Sprintf("Unauthenticated %v", err),
+			})
+		}
+		if principal != nil {
+			c.Locals("principal", principal)
+			return c.Next()
+		}
+	}
+	return c.Status(401).JSON(&fiber.Map{
+		"success": false,
+		"message": "Unauthenticated, no credentials provided",
+	})
+}
+
+// authorized checks if the principal of a request has a role on a routing domain, or on a
+// range given with its ancestors (no range ids for checks on the routing domain only).
+func authorized(c *fiber.Ctx, role Role, routing_domain_id int, range_ids ...int) bool {
+	if auth == nil {
+		return true
+	}
+	principal, ok := c.Locals("principal").(*Principal)
+	if !ok {
+		return false
+	}
+	for _, grant := range auth.grants {
+		if grant.role < role || !grant.matches(principal) {
+			continue
+		}
+		if grant.Domain == 0 && grant.Range == 0 {
+			return true
+		}
+		if grant.Domain != 0 && grant.Domain == routing_domain_id {
+			return true
+		}
+		for _, range_id := range range_ids {
+			if grant.Range != 0 && grant.Range == range_id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorizedDomains returns the routing domains on which the principal of a request has a
+// role, all is true if it has the role on all routing domains.
+func authorizedDomains(c *fiber.Ctx, role Role) (all bool, routing_domain_ids []int) {
+	if auth == nil {
+		return true, nil
+	}
+	principal, ok := c.Locals("principal").(*Principal)
+	if !ok {
+		return false, nil
+	}
+	routing_domain_ids = []int{}
+	for _, grant := range auth.grants {
+		if grant.role < role || !grant.matches(principal) {
+			continue
+		}
+		if grant.Domain == 0 && grant.Range == 0 {
+			return true, nil
+		}
+		if grant.Domain != 0 {
+			routing_domain_ids = append(routing_domain_ids, grant.Domain)
+		}
+	}
+	return false, routing_domain_ids
+}
+
+// authorizedRange checks if the principal of a request has a role on a range, through its
+// routing domain, the range itself or one of its ancestors.
+func authorizedRange(c *fiber.Ctx, role Role, rang *Range, ancestors []Range) bool {
+	range_ids := []int{rang.Subnet_id}
+	for _, ancestor := range ancestors {
+		range_ids = append(range_ids, ancestor.Subnet_id)
+	}
+	return authorized(c, role, rang.Routing_domain_id, range_ids...)
+}
+
+// authorizedStoredRange checks if the principal of a request has a role on a range, looking
+// up its ancestors. It must not be called within a transaction.
+func authorizedStoredRange(c *fiber.Ctx, role Role, rang *Range) bool {
+	if auth == nil {
+		return true
+	}
+	ancestors, err := store.GetRangeAncestors(int64(rang.Subnet_id))
+	if err != nil {
+		log.Printf("Unable to look up the ancestors of range %d: %v", rang.Subnet_id, err)
+		return false
+	}
+	return authorizedRange(c, role, rang, ancestors)
+}
+
+// visibleRanges returns the ranges the principal of a request is allowed to view, the
+// ancestors of the ranges are looked up in the given ranges, so they need to be complete.
+func visibleRanges(c *fiber.Ctx, ranges []Range) []Range {
+	if auth == nil {
+		return ranges
+	}
+	byId := make(map[int]Range, len(ranges))
+	for _, rang := range ranges {
+		byId[rang.Subnet_id] = rang
+	}
+	var visible []Range
+	for i := range ranges {
+		var ancestors []Range
+		for parent, found := byId[ranges[i].Parent_id]; found && len(ancestors) <= maxRangeDepth; parent, found = byId[parent.Parent_id] {
+			ancestors = append(ancestors, parent)
+		}
+		if authorizedRange(c, RoleViewer, &ranges[i], ancestors) {
+			visible = append(visible, ranges[i])
+		}
+	}
+	return visible
+}
+
+func forbidden(c *fiber.Ctx) error {
+	return c.Status(403).JSON(&fiber.Map{
+		"success": false,
+		"message": "Permission denied",
+	})
+}
+
+func (g *Grant) matches(principal *Principal) bool {
+	for _, pattern := range g.Principals {
+		if wildcard := strings.Index(pattern, "*"); wildcard >= 0 {
+			prefix, suffix := pattern[:wildcard], pattern[wildcard+1:]
+			if len(principal.Name) >= len(prefix)+len(suffix) && strings.HasPrefix(principal.Name, prefix) && strings.HasSuffix(principal.Name, suffix) {
+				return true
+			}
+		} else if pattern == principal.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func bearerToken(c *fiber.Ctx) string {
+	header := c.Get(fiber.HeaderAuthorization)
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// unverifiedClaims are the claims of a JWT read without verifying its signature.
+type unverifiedClaims struct {
+	Issuer string `json:"iss"`
+	Email  string `json:"email"`
+}
+
+// tokenClaims returns the unverified claims of a JWT, i.e. to select the authenticator
+// verifying it.
+func tokenClaims(token string) unverifiedClaims {
+	var claims unverifiedClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims
+	}
+	json.Unmarshal(payload, &claims)
+	return claims
+}
+
+// googleAuthenticator verifies Google ID tokens, as sent by the Terraform provider.
+type googleAuthenticator struct {
+	audiences []string
+}
+
+func (a *googleAuthenticator) Authenticate(c *fiber.Ctx) (*Principal, error) {
+	token := bearerToken(c)
+	if issuer := tokenClaims(token).Issuer; issuer != "https://accounts.google.com" && issuer != "accounts.google.com" {
+		return nil, nil
+	}
+	payload, err := idtoken.Validate(c.Context(), token, "")
+	if err != nil {
+		return nil, err
+	}
+	valid := false
+	for _, audience := range a.audiences {
+		if payload.Audience == audience {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("audience %s of ID token isn't accepted", payload.Audience)
+	}
+	return googlePrincipal(payload.Subject, payload.Claims), nil
+}
+
+// googlePrincipal returns the principal of a Google ID token, its email if Google verified
+// it and its subject (the unique ID of the account) otherwise, so unverified emails can't
+// match the grants of the account owning the email.
+func googlePrincipal(subject string, claims map[string]interface{}) *Principal {
+	email, _ := claims["email"].(string)
+	verified := false
+	switch value := claims["email_verified"].(type) {
+	case bool:
+		verified = value
+	case string:
+		verified = value == "true"
+	}
+	if email == "" || !verified {
+		return &Principal{Name: "google:" + subject}
+	}
+	return &Principal{Name: "google:" + email}
+}
+
+// apiKeyAuthenticator checks static API keys sent in the X-API-Key header.
+type apiKeyAuthenticator struct {
+	names  []string
+	hashes [][]byte
+}
+
+func (a *apiKeyAuthenticator) Authenticate(c *fiber.Ctx) (*Principal, error) {
+	key := c.Get("X-API-Key")
+	if key == "" {
+		return nil, nil
+	}
+	hash := sha256.Sum256([]byte(key))
+	for i := range a.hashes {
+		if subtle.ConstantTimeCompare(hash[:], a.hashes[i]) == 1 {
+			return &Principal{Name: "apikey:" + a.names[i]}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid API key")
+}
+
+// oidcAuthenticator verifies JWTs of an OIDC provider, i.e. GitHub Actions or GitLab CI.
+type oidcAuthenticator struct {
+	name     string
+	issuer   string
+	claim    string
+	verifier *oidc.IDTokenVerifier
+}
+
+func (a *oidcAuthenticator) Authenticate(c *fiber.Ctx) (*Principal, error) {
+	token := bearerToken(c)
+	if tokenClaims(token).Issuer != a.issuer {
+		return nil, nil
+	}
+	verified, err := a.verifier.Verify(c.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	err = verified.Claims(&claims)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := claims[a.claim].(string)
+	if !ok || value == "" {
+		return nil, fmt.Errorf("token has no claim %s", a.claim)
+	}
+	return &Principal{Name: fmt.Sprintf("oidc:%s:%s", a.name, value)}, nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func apiKey(name string) ApiKey {
+	hash := sha256.Sum256([]byte(name + "-secret"))
+	return ApiKey{Name: name, KeySha256: hex.EncodeToString(hash[:])}
+}
+
+// newTestAuth enables authentication with an API key "<name>-secret" for each principal.
+func newTestAuth(t *testing.T, grants []Grant, names ...string) {
+	config := &AuthConfig{Grants: grants}
+	for _, name := range names {
+		config.ApiKeys = append(config.ApiKeys, apiKey(name))
+	}
+	var err error
+	auth, err = NewAuth(context.Background(), config)
+	assert.Nil(t, err)
+}
+
+func authRequest(t *testing.T, app *fiber.App, method string, path string, name string, request interface{}) (int, []byte) {
+	var body []byte
+	if request != nil {
+		var err error
+		body, err = json.Marshal(request)
+		assert.Nil(t, err)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if name != "" {
+		req.Header.Set("X-API-Key", name+"-secret")
+	}
+	resp, err := app.Test(req, 10000)
+	if !assert.Nil(t, err) {
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	buf := new(bytes.Buffer)
+	_, err = buf.ReadFrom(resp.Body)
+	assert.Nil(t, err)
+	return resp.StatusCode, buf.Bytes()
+}
+
+func TestAuthenticationRequired(t *testing.T) {
+	app, _ := newTestApp(t)
+	defer store.Close()
+	newTestAuth(t, []Grant{{Principals: []string{"apikey:admin"}, Role: "admin"}}, "admin")
+	defer func() { auth = nil }()
+
+	status, _ := authRequest(t, app, "GET", "/ranges", "", nil)
+	assert.Equal(t, 401, status)
+	req := httptest.NewRequest("GET", "/ranges", nil)
+	req.Header.Set("X-API-Key", "wrong")
+	resp, err := app.Test(req, 10000)
+	assert.Nil(t, err)
+	assert.Equal(t, 401, resp.StatusCode)
+	status, _ = authRequest(t, app, "GET", "/ranges", "admin", nil)
+	assert.Equal(t, 200, status)
+	// The Terraform registry endpoints stay public
+	status, _ = authRequest(t, app, "GET", "/.well-known/terraform.json", "", nil)
+	assert.Equal(t, 200, status)
+}
+
+func TestAuthorization(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	status, other := postRange(t, app, RangeRequest{Name: "other", Cidr: "10.1.0.0/16"})
+	assert.Equal(t, 200, status)
+	other_id := int64(other["id"].(float64))
+
+	newTestAuth(t, []Grant{
+		{Principals: []string{"apikey:viewer"}, Role: "viewer", Domain: 1},
+		{Principals: []string{"apikey:team-*"}, Role: "allocator", Range: int(parent_id)},
+		{Principals: []string{"apikey:domain-admin"}, Role: "admin", Domain: 1},
+	}, "viewer", "team-a", "domain-admin", "stranger")
+	defer func() { auth = nil }()
+
+	child := RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24}
+	status, _ = authRequest(t, app, "POST", "/ranges", "viewer", child)
+	assert.Equal(t, 403, status)
+	status, _ = authRequest(t, app, "POST", "/ranges", "stranger", child)
+	assert.Equal(t, 403, status)
+	status, body := authRequest(t, app, "POST", "/ranges", "team-a", child)
+	assert.Equal(t, 200, status, string(body))
+	var created map[string]interface{}
+	assert.Nil(t, json.Unmarshal(body, &created))
+	child_id := int64(created["id"].(float64))
+
+	// Allocators of a range can allocate in its children but not in other ranges
+	status, _ = authRequest(t, app, "POST", "/ranges", "team-a", RangeRequest{Name: "grandchild", Parent: fmt.Sprint(child_id), Range_size: 26})
+	assert.Equal(t, 200, status)
+	status, _ = authRequest(t, app, "POST", "/ranges", "team-a", RangeRequest{Name: "child", Parent: fmt.Sprint(other_id), Range_size: 24})
+	assert.Equal(t, 403, status)
+	status, _ = authRequest(t, app, "POST", "/ranges", "team-a", RangeRequest{Name: "top", Cidr: "10.2.0.0/16"})
+	assert.Equal(t, 403, status)
+	status, _ = authRequest(t, app, "GET", fmt.Sprintf("/ranges/%d", other_id), "team-a", nil)
+	assert.Equal(t, 403, status)
+	status, _ = authRequest(t, app, "DELETE", fmt.Sprintf("/ranges/%d", other_id), "team-a", nil)
+	assert.Equal(t, 403, status)
+
+	// Listings only contain the visible ranges
+	var ranges []map[string]interface{}
+	status, body = authRequest(t, app, "GET", "/ranges", "team-a", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &ranges))
+	assert.Equal(t, 3, len(ranges))
+	status, body = authRequest(t, app, "GET", "/ranges", "stranger", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &ranges))
+	assert.Equal(t, 0, len(ranges))
+	status, body = authRequest(t, app, "GET", "/ranges", "viewer", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &ranges))
+	assert.Equal(t, 4, len(ranges))
+
+	// Routing domains are managed by admins
+	status, _ = authRequest(t, app, "PUT", "/domains/1", "team-a", map[string]string{"name": "renamed"})
+	assert.Equal(t, 403, status)
+	status, _ = authRequest(t, app, "PUT", "/domains/1", "domain-admin", map[string]string{"name": "renamed"})
+	assert.Equal(t, 200, status)
+	status, _ = authRequest(t, app, "POST", "/domains", "domain-admin", map[string]string{"name": "new"})
+	assert.Equal(t, 403, status)
+	status, _ = authRequest(t, app, "POST", "/ranges", "domain-admin", RangeRequest{Name: "top", Cidr: "10.2.0.0/16"})
+	assert.Equal(t, 200, status)
+	status, _ = authRequest(t, app, "DELETE", fmt.Sprintf("/ranges/%d", other_id), "domain-admin", nil)
+	assert.Equal(t, 200, status)
+}
+
+func TestGooglePrincipal(t *testing.T) {
+	assert.Equal(t, "google:alice@example.com", googlePrincipal("123", map[string]interface{}{"email": "alice@example.com", "email_verified": true}).Name)
+	assert.Equal(t, "google:alice@example.com", googlePrincipal("123", map[string]interface{}{"email": "alice@example.com", "email_verified": "true"}).Name)
+	assert.Equal(t, "google:123", googlePrincipal("123", map[string]interface{}{"email": "alice@example.com", "email_verified": false}).Name)
+	assert.Equal(t, "google:123", googlePrincipal("123", map[string]interface{}{"email": "alice@example.com"}).Name)
+	assert.Equal(t, "google:123", googlePrincipal("123", map[string]interface{}{}).Name)
+}
+
+func TestRestoreRangeRequiresAdmin(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	quarantinePeriod = time.Hour
+	defer func() { quarantinePeriod = 0 }()
+
+	newTestAuth(t, []Grant{
+		{Principals: []string{"apikey:team-a"}, Role: "allocator", Range: int(parent_id)},
+		{Principals: []string{"apikey:domain-admin"}, Role: "admin", Domain: 1},
+	}, "team-a", "domain-admin")
+	defer func() { auth = nil }()
+
+	status, body := authRequest(t, app, "POST", "/ranges", "team-a", RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status, string(body))
+	var created map[string]interface{}
+	assert.Nil(t, json.Unmarshal(body, &created))
+	path := fmt.Sprintf("/ranges/%d", int64(created["id"].(float64)))
+
+	// Allocators can update their ranges but not restore them from the quarantine
+	status, _ = authRequest(t, app, "PUT", path, "team-a", map[string]string{"status": RangeReserved})
+	assert.Equal(t, 200, status)
+	status, _ = authRequest(t, app, "DELETE", path, "team-a", nil)
+	assert.Equal(t, 200, status)
+	// The quarantined range is visible through the grant on its parent
+	var quarantined []map[string]interface{}
+	status, body = authRequest(t, app, "GET", "/quarantine", "team-a", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &quarantined))
+	assert.Equal(t, 1, len(quarantined))
+	status, _ = authRequest(t, app, "PUT", path, "team-a", map[string]string{"status": RangeAllocated})
+	assert.Equal(t, 403, status)
+	status, _ = authRequest(t, app, "PUT", path, "team-a", map[string]string{"description": "Released"})
+	assert.Equal(t, 200, status)
+	status, _ = authRequest(t, app, "PUT", path, "domain-admin", map[string]string{"status": RangeAllocated})
+	assert.Equal(t, 200, status)
+	rang, err := store.GetRange(int64(created["id"].(float64)))
+	assert.Nil(t, err)
+	assert.Equal(t, RangeAllocated, rang.Status)
+	assert.True(t, rang.Released_at.IsZero())
+}
+
+func TestGrantMatches(t *testing.T) {
+	grant := Grant{Principals: []string{"google:*@example.com", "apikey:ci"}}
+	assert.True(t, grant.matches(&Principal{Name: "google:alice@example.com"}))
+	assert.True(t, grant.matches(&Principal{Name: "apikey:ci"}))
+	assert.False(t, grant.matches(&Principal{Name: "google:alice@example.org"}))
+	assert.False(t, grant.matches(&Principal{Name: "apikey:ci2"}))
+}
+
+func TestNewAuthValidation(t *testing.T) {
+	_, err := NewAuth(context.Background(), &AuthConfig{})
+	assert.NotNil(t, err)
+	config := &AuthConfig{Grants: []Grant{{Principals: []string{"apikey:a"}, Role: "owner"}}}
+	config.ApiKeys = append(config.ApiKeys, apiKey("a"))
+	_, err = NewAuth(context.Background(), config)
+	assert.NotNil(t, err)
+}
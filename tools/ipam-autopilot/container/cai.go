@@ -34,6 +34,7 @@ type CaiRange struct {
 	id              string
 	network         string
 	cidr            string
+	ipv6Cidr        string // internal or external IPv6 range of dual-stack subnets
 	secondaryRanges []CaiSecondaryRange
 }
 
@@ -60,7 +61,7 @@ func GetRangesForNetwork(parent string, networks []string) ([]CaiRange, error) {
 			break
 		}
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 		if containsValue(networks, asset.Resource.Data.Fields["network"].GetStringValue()) {
 			var secondaryRanges []CaiSecondaryRange = make([]CaiSecondaryRange, 0)
@@ -85,11 +86,19 @@ func GetRangesForNetwork(parent string, networks []string) ([]CaiRange, error) {
 					cidr: ipCidrRange,
 				})
 			}
+			ipv6Cidr := asset.Resource.Data.Fields["internalIpv6Prefix"].GetStringValue()
+			if ipv6Cidr == "" {
+				ipv6Cidr = asset.Resource.Data.Fields["ipv6CidrRange"].GetStringValue()
+			}
+			if ipv6Cidr == "" {
+				ipv6Cidr = asset.Resource.Data.Fields["externalIpv6Prefix"].GetStringValue()
+			}
 			ranges = append(ranges, CaiRange{
 				id:              asset.Resource.Data.Fields["id"].GetStringValue(),
 				name:            asset.Name,
 				network:         asset.Resource.Data.Fields["network"].GetStringValue(),
 				cidr:            asset.Resource.Data.Fields["ipCidrRange"].GetStringValue(),
+				ipv6Cidr:        ipv6Cidr,
 				secondaryRanges: secondaryRanges,
 			})
 		} else {
@@ -15,11 +15,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/apparentlymart/go-cidr/cidr"
 	"github.com/jackc/pgtype"
@@ -31,358 +34,690 @@ type RoutingDomain struct {
 	Id   int    `db:"routing_domain_id"`
 	Name string `db:"name"`
 	Vpcs string `db:"vpcs"` // associated VPCs that should be tracked for subnet creation
+	// strategy for allocating ranges, empty for the default first-fit
+	Allocation_strategy string `db:"allocation_strategy"`
+	// providers of external ranges, stored as JSON
+	Discovery []DiscoveryConfig `db:"discovery"`
 }
 
 type Range struct {
-	Subnet_id         int    `db:"subnet_id"`
-	Parent_id         int    `db:"parent_id"`
-	Routing_domain_id int    `db:"routing_domain_id"`
-	Name              string `db:"name"`
-	Cidr              string `db:"cidr"`
+	Subnet_id         int               `db:"subnet_id"`
+	Parent_id         int               `db:"parent_id"`
+	Routing_domain_id int               `db:"routing_domain_id"`
+	Name              string            `db:"name"`
+	Cidr              string            `db:"cidr"`
+	Description       string            `db:"description"`
+	Owner             string            `db:"owner"`
+	Status            string            `db:"status"`
+	Created_at        time.Time         `db:"created_at"` // zero for ranges created before it was tracked
+	Labels            map[string]string `db:"labels"`     // stored as JSON
+	// time the range was released, the range is quarantined until it is finalized
+	Released_at time.Time `db:"released_at"`
 }
 
-func GetRangesFromDB() ([]Range, error) {
-	var ranges []Range
+// Status of a range.
+const (
+	// RangeReserved is a range that is held for a planned workload
+	RangeReserved = "reserved"
+	// RangeAllocated is a range in use, the default
+	RangeAllocated = "allocated"
+	// RangeReleased is a range that is no longer in use
+	RangeReleased = "released"
+)
+
+var RangeStatuses = []string{RangeReserved, RangeAllocated, RangeReleased}
+
+// sqlStorage implements Storage for MySQL, PostgreSQL and SQLite.
+type sqlStorage struct {
+	db      *sql.DB
+	dialect *dialect
+	dbName  string
+}
 
-	rows, err := db.Query("SELECT subnet_id, parent_id, routing_domain_id, name, cidr FROM subnets")
+// sqlStorageTx implements StorageTx, ranges are read with the lock clause of the dialect.
+type sqlStorageTx struct {
+	tx      *sql.Tx
+	dialect *dialect
+	events  []AuditEvent
+}
+
+// queryer is implemented by both sql.DB and sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const selectRanges = "SELECT subnet_id, parent_id, routing_domain_id, name, cidr, description, owner, status, created_at, labels, released_at FROM subnets"
+const selectRoutingDomains = "SELECT routing_domain_id, name, vpcs, allocation_strategy, discovery FROM routing_domains"
+
+func (s *sqlStorage) Begin(ctx context.Context) (StorageTx, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
-	for rows.Next() {
-		var subnet_id int
-		var routing_domain_id int
-		tmp := pgtype.Int4{}
-		var name string
-		var cidr string
-		err := rows.Scan(&subnet_id, &tmp, &routing_domain_id, &name, &cidr)
+	return &sqlStorageTx{tx: tx, dialect: s.dialect}, nil
+}
+
+func (s *sqlStorage) Migrate() error {
+	return MigrateDatabase(s.dialect.name, s.dbName, s.db)
+}
+
+func (s *sqlStorage) IsConflict(err error) bool {
+	return s.dialect.isConflict(err)
+}
+
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqlStorage) GetRanges() ([]Range, error) {
+	return queryRanges(s.db, selectRanges)
+}
+
+func (s *sqlStorage) GetRange(id int64) (*Range, error) {
+	return scanRange(s.db.QueryRow(s.dialect.rebind(selectRanges+" WHERE subnet_id = ?"), id))
+}
+
+func (s *sqlStorage) GetRangeAncestors(id int64) ([]Range, error) {
+	return getRangeAncestors(s.db, s.dialect, id)
+}
+
+func (s *sqlStorage) GetRangesForParent(parent_id int64) ([]Range, error) {
+	return queryRanges(s.db, s.dialect.rebind(selectRanges+" WHERE parent_id = ?"), parent_id)
+}
+
+func (s *sqlStorage) UpdateRange(id int64, description JSONString, owner JSONString, status JSONString, labels JSONStringMap, event *AuditEvent) error {
+	var columns []string
+	var args []interface{}
+	if description.Set {
+		columns = append(columns, "description = ?")
+		args = append(args, nullString(description.Value))
+	}
+	if owner.Set {
+		columns = append(columns, "owner = ?")
+		args = append(args, nullString(owner.Value))
+	}
+	if status.Set {
+		columns = append(columns, "status = ?")
+		args = append(args, status.Value)
+		// Ranges that are no longer released are restored from the quarantine
+		if status.Value != RangeReleased {
+			columns = append(columns, "released_at = NULL")
+		}
+	}
+	if labels.Set {
+		jsn, err := marshalLabels(labels.Value)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		parent_id := -1
-		if tmp.Status == pgtype.Present {
-			tmp.AssignTo(&parent_id)
+		columns = append(columns, "labels = ?")
+		args = append(args, jsn)
+	}
+	return s.audited(event, func(q queryer) error {
+		if len(columns) == 0 {
+			return nil
 		}
+		_, err := q.Exec(s.dialect.rebind("UPDATE subnets SET "+strings.Join(columns, ", ")+" WHERE subnet_id = ?"), append(args, id)...)
+		return err
+	})
+}
 
-		ranges = append(ranges, Range{
-			Subnet_id:         subnet_id,
-			Parent_id:         parent_id,
-			Routing_domain_id: routing_domain_id,
-			Name:              name,
-			Cidr:              cidr,
-		})
-	}
-	return ranges, nil
+func (s *sqlStorage) ReleaseRange(id int64, released_at time.Time, event *AuditEvent) error {
+	return s.audited(event, func(q queryer) error {
+		_, err := q.Exec(s.dialect.rebind("UPDATE subnets SET status = ?, released_at = ? WHERE subnet_id = ?"), RangeReleased, released_at, id)
+		return err
+	})
 }
 
-func GetRangesForParentFromDB(tx *sql.Tx, parent_id int64) ([]Range, error) {
-	var ranges []Range
-	rows, err := tx.Query("SELECT subnet_id, parent_id, routing_domain_id, name, cidr FROM subnets WHERE parent_id = ? FOR UPDATE", parent_id)
+func (s *sqlStorage) GetQuarantinedRanges() ([]Range, error) {
+	return queryRanges(s.db, selectRanges+" WHERE released_at IS NOT NULL ORDER BY released_at")
+}
+
+func (s *sqlStorage) FinalizeReleasedRanges(before time.Time) ([]AuditEvent, error) {
+	ranges, err := queryRanges(s.db, s.dialect.rebind(selectRanges+" WHERE released_at IS NOT NULL AND released_at < ? ORDER BY subnet_id DESC"), before)
 	if err != nil {
 		return nil, err
 	}
-	for rows.Next() {
-		var subnet_id int
-		var routing_domain_id int
-		tmp := pgtype.Int4{}
-		var name string
-		var cidr string
-		err := rows.Scan(&subnet_id, &tmp, &routing_domain_id, &name, &cidr)
-		if err != nil {
-			return nil, err
+	// Ranges are deleted one by one, children before their parents, a range with children
+	// that are still quarantined is finalized after them
+	var events []AuditEvent
+	for _, rang := range ranges {
+		event := finalizeEvent(&rang)
+		err = s.DeleteReleasedRange(int64(rang.Subnet_id), before, event)
+		if err == ErrRangeNotReleased {
+			// Restored since it was read
+			continue
 		}
-		parent_id := -1
-		if tmp.Status == pgtype.Present {
-			tmp.AssignTo(&parent_id)
+		if err != nil {
+			log.Printf("Unable to finalize released range %d %s: %v", rang.Subnet_id, rang.Cidr, err)
+			continue
 		}
-
-		ranges = append(ranges, Range{
-			Subnet_id:         subnet_id,
-			Parent_id:         parent_id,
-			Routing_domain_id: routing_domain_id,
-			Name:              name,
-			Cidr:              cidr,
-		})
+		events = append(events, *event)
 	}
-	return ranges, nil
+	return events, nil
 }
 
-func GetRangeFromDB(id int64) (*Range, error) {
-	var subnet_id int
-	var routing_domain_id int
-	tmp := pgtype.Int4{}
-	var name string
-	var cidr string
+func (s *sqlStorage) DeleteReleasedRange(id int64, before time.Time, event *AuditEvent) error {
+	query := "DELETE FROM subnets WHERE subnet_id = ? AND released_at IS NOT NULL"
+	args := []interface{}{id}
+	if !before.IsZero() {
+		query += " AND released_at < ?"
+		args = append(args, before)
+	}
+	return s.audited(event, func(q queryer) error {
+		result, err := q.Exec(s.dialect.rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return ErrRangeNotReleased
+		}
+		return nil
+	})
+}
 
-	err := db.QueryRow("SELECT subnet_id, parent_id, routing_domain_id, name, cidr FROM subnets WHERE subnet_id = ?", id).Scan(&subnet_id, &tmp, &routing_domain_id, &name, &cidr)
+func (s *sqlStorage) DeleteRange(id int64, event *AuditEvent) error {
+	return s.audited(event, func(q queryer) error {
+		_, err := q.Exec(s.dialect.rebind("DELETE FROM subnets WHERE subnet_id = ?"), id)
+		return err
+	})
+}
 
+func (s *sqlStorage) GetRoutingDomains() ([]RoutingDomain, error) {
+	var domains []RoutingDomain
+	rows, err := s.db.Query(selectRoutingDomains)
 	if err != nil {
 		return nil, err
 	}
-	parent_id := -1
-	if tmp.Status == pgtype.Present {
-		tmp.AssignTo(&parent_id)
+	defer rows.Close()
+	for rows.Next() {
+		domain, err := scanRoutingDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, *domain)
 	}
-
-	return &Range{
-		Subnet_id:         subnet_id,
-		Parent_id:         parent_id,
-		Routing_domain_id: routing_domain_id,
-		Name:              name,
-		Cidr:              cidr,
-	}, nil
+	return domains, rows.Err()
 }
 
-func GetRangeFromDBWithTx(tx *sql.Tx, id int64) (*Range, error) {
-	var subnet_id int
-	var routing_domain_id int
-	tmp := pgtype.Int4{}
-	var name string
-	var cidr string
+func (s *sqlStorage) GetRoutingDomain(id int64) (*RoutingDomain, error) {
+	return scanRoutingDomain(s.db.QueryRow(s.dialect.rebind(selectRoutingDomains+" WHERE routing_domain_id = ?"), id))
+}
 
-	err := tx.QueryRow("SELECT subnet_id, parent_id, routing_domain_id, name, cidr FROM subnets WHERE subnet_id = ? FOR UPDATE", id).Scan(&subnet_id, &tmp, &routing_domain_id, &name, &cidr)
+func (s *sqlStorage) GetDefaultRoutingDomain() (*RoutingDomain, error) {
+	return scanRoutingDomain(s.db.QueryRow(selectRoutingDomains + " ORDER BY routing_domain_id LIMIT 1"))
+}
 
+func (s *sqlStorage) CreateRoutingDomain(name string, vpcs []string, allocation_strategy string, discovery []DiscoveryConfig, event *AuditEvent) (int64, error) {
+	jsn, err := marshalDiscovery(discovery)
 	if err != nil {
-		return nil, err
+		return -1, err
 	}
-	parent_id := -1
-	if tmp.Status == pgtype.Present {
-		tmp.AssignTo(&parent_id)
+	var id int64
+	err = s.audited(event, func(q queryer) error {
+		var err error
+		id, err = s.dialect.insert(q, "routing_domain_id", "INSERT INTO routing_domains (name, vpcs, allocation_strategy, discovery) VALUES (?,?,?,?)", name, strings.Join(vpcs, ","), nullString(allocation_strategy), jsn)
+		if event != nil {
+			event.Routing_domain_id = int(id)
+		}
+		return err
+	})
+	if err != nil {
+		return -1, err
 	}
+	return id, nil
+}
 
-	return &Range{
-		Subnet_id:         subnet_id,
-		Parent_id:         parent_id,
-		Routing_domain_id: routing_domain_id,
-		Name:              name,
-		Cidr:              cidr,
-	}, nil
+func (s *sqlStorage) UpdateRoutingDomain(id int64, name JSONString, vpcs JSONStringArray, allocation_strategy JSONString, discovery JSONDiscoveryConfigs, event *AuditEvent) error {
+	var columns []string
+	var args []interface{}
+	if name.Set {
+		columns = append(columns, "name = ?")
+		args = append(args, name.Value)
+	}
+	if vpcs.Set {
+		columns = append(columns, "vpcs = ?")
+		args = append(args, strings.Join(vpcs.Value, ","))
+	}
+	if allocation_strategy.Set {
+		columns = append(columns, "allocation_strategy = ?")
+		args = append(args, nullString(allocation_strategy.Value))
+	}
+	if discovery.Set {
+		jsn, err := marshalDiscovery(discovery.Value)
+		if err != nil {
+			return err
+		}
+		columns = append(columns, "discovery = ?")
+		args = append(args, jsn)
+	}
+	return s.audited(event, func(q queryer) error {
+		if len(columns) == 0 {
+			return nil
+		}
+		_, err := q.Exec(s.dialect.rebind("UPDATE routing_domains SET "+strings.Join(columns, ", ")+" WHERE routing_domain_id = ?"), append(args, id)...)
+		return err
+	})
 }
 
-func getRangeByCidrAndRoutingDomain(tx *sql.Tx, request_cidr string, routing_domain_id int) (*Range, error) {
-	var subnet_id int
-	tmp := pgtype.Int4{}
-	var name string
-	var cidr string
+func (s *sqlStorage) DeleteRoutingDomain(id int64, event *AuditEvent) error {
+	return s.audited(event, func(q queryer) error {
+		_, err := q.Exec(s.dialect.rebind("DELETE FROM routing_domains WHERE routing_domain_id = ?"), id)
+		return err
+	})
+}
 
-	err := tx.QueryRow("SELECT subnet_id, parent_id, name, cidr FROM subnets WHERE cidr = ? and routing_domain_id = ? FOR UPDATE", request_cidr, routing_domain_id).Scan(&subnet_id, &tmp, &name, &cidr)
+func (s *sqlStorage) GetAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From)
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.To)
+	}
+	if filter.Routing_domain_id != 0 {
+		conditions = append(conditions, "routing_domain_id = ?")
+		args = append(args, filter.Routing_domain_id)
+	}
+	if filter.Range_id != 0 {
+		conditions = append(conditions, "subnet_id = ?")
+		args = append(args, filter.Range_id)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, filter.Action)
+	}
+	if filter.Routing_domain_ids != nil {
+		if len(filter.Routing_domain_ids) == 0 {
+			return nil, nil
+		}
+		placeholders := make([]string, len(filter.Routing_domain_ids))
+		for i, id := range filter.Routing_domain_ids {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+		conditions = append(conditions, "routing_domain_id IN ("+strings.Join(placeholders, ",")+")")
+	}
+	if filter.Before > 0 {
+		conditions = append(conditions, "event_id < ?")
+		args = append(args, filter.Before)
+	}
+	query := "SELECT event_id, created_at, actor, action, routing_domain_id, subnet_id, cidr, request FROM audit_events"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY event_id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	rows, err := s.db.Query(s.dialect.rebind(query), args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+	var events []AuditEvent
+	for rows.Next() {
+		var event AuditEvent
+		var routing_domain_id, subnet_id sql.NullInt64
+		var cidr, request sql.NullString
+		err = rows.Scan(&event.Id, &event.Time, &event.Actor, &event.Action, &routing_domain_id, &subnet_id, &cidr, &request)
+		if err != nil {
+			return nil, err
+		}
+		event.Time = event.Time.UTC()
+		event.Routing_domain_id = int(routing_domain_id.Int64)
+		event.Range_id = int(subnet_id.Int64)
+		event.Cidr = cidr.String
+		if request.Valid {
+			event.Request = json.RawMessage(request.String)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
 
-	parent_id := -1
-	if tmp.Status == pgtype.Present {
-		tmp.AssignTo(&parent_id)
+// audited runs a mutation and inserts its audit event in one transaction.
+func (s *sqlStorage) audited(event *AuditEvent, mutation func(q queryer) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = mutation(tx)
+	if err == nil && event != nil {
+		err = insertAuditEvent(tx, s.dialect, event)
 	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
 
-	return &Range{
-		Subnet_id:         subnet_id,
-		Parent_id:         parent_id,
-		Routing_domain_id: routing_domain_id,
-		Name:              name,
-		Cidr:              cidr,
-	}, nil
+func (t *sqlStorageTx) GetRange(id int64) (*Range, error) {
+	return scanRange(t.tx.QueryRow(t.dialect.rebind(t.dialect.locked(selectRanges+" WHERE subnet_id = ?")), id))
 }
 
-func GetRangeByCidrFromDB(tx *sql.Tx, routing_domain_id int, cidr_request string) (*Range, error) {
-	var subnet_id int
-	tmp := pgtype.Int4{}
-	var name string
-	var cidr string
+func (t *sqlStorageTx) GetRangeAncestors(id int64) ([]Range, error) {
+	return getRangeAncestors(t.tx, t.dialect, id)
+}
 
-	if cidr_request != "" {
-		err := tx.QueryRow("SELECT subnet_id, parent_id, name, cidr FROM subnets WHERE cidr = ? and routing_domain_id = ? FOR UPDATE", cidr_request, routing_domain_id).Scan(&subnet_id, &tmp, &name, &cidr)
+func (t *sqlStorageTx) GetRangeByCidr(routing_domain_id int, cidr string) (*Range, error) {
+	return scanRange(t.tx.QueryRow(t.dialect.rebind(t.dialect.locked(selectRanges+" WHERE cidr = ? and routing_domain_id = ?")), cidr, routing_domain_id))
+}
+
+// GetRangesForParent doesn't lock the children, the parent is locked before they are read.
+// The first statement of an allocation is the locking read of the parent, so the snapshot
+// of MySQL transactions contains the children committed while waiting for the lock.
+func (t *sqlStorageTx) GetRangesForParent(parent_id int64) ([]Range, error) {
+	return queryRanges(t.tx, t.dialect.rebind(selectRanges+" WHERE parent_id = ?"), parent_id)
+}
+
+func (t *sqlStorageTx) FinalizeReleasedRanges(parent_id int64, before time.Time) error {
+	// Ranges with children (i.e. children that are still quarantined) are skipped
+	query := selectRanges + " WHERE released_at IS NOT NULL AND released_at < ? AND subnet_id NOT IN (SELECT parent_id FROM subnets WHERE parent_id IS NOT NULL)"
+	var ranges []Range
+	var err error
+	if parent_id == -1 {
+		ranges, err = queryRanges(t.tx, t.dialect.rebind(t.dialect.locked(query+" AND parent_id IS NULL")), before)
+	} else {
+		ranges, err = queryRanges(t.tx, t.dialect.rebind(t.dialect.locked(query+" AND parent_id = ?")), before, parent_id)
+	}
+	if err != nil {
+		return err
+	}
+	for _, rang := range ranges {
+		_, err = t.tx.Exec(t.dialect.rebind("DELETE FROM subnets WHERE subnet_id = ?"), rang.Subnet_id)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	} else {
-		err := tx.QueryRow("SELECT subnet_id, parent_id, name, cidr FROM subnets WHERE routing_domain_id = ? LIMIT 1 FOR UPDATE", routing_domain_id).Scan(&subnet_id, &tmp, &name, &cidr)
+		err = t.CreateAuditEvent(finalizeEvent(&rang))
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	parent_id := -1
-	if tmp.Status == pgtype.Present {
-		tmp.AssignTo(&parent_id)
-	}
-
-	return &Range{
-		Subnet_id:         subnet_id,
-		Parent_id:         parent_id,
-		Routing_domain_id: routing_domain_id,
-		Name:              name,
-		Cidr:              cidr,
-	}, nil
+	return nil
 }
 
-func DeleteRangeFromDb(id int64) error {
-	_, err := db.Query("DELETE FROM subnets WHERE subnet_id = ?", id)
-
+func (t *sqlStorageTx) CreateAuditEvent(event *AuditEvent) error {
+	err := insertAuditEvent(t.tx, t.dialect, event)
 	if err != nil {
 		return err
 	}
+	t.events = append(t.events, *event)
 	return nil
 }
 
-func DeleteRoutingDomainFromDB(id int64) error {
-	_, err := db.Query("DELETE FROM routing_domains WHERE routing_domain_id = ?", id)
+func (t *sqlStorageTx) AuditEvents() []AuditEvent {
+	return t.events
+}
+
+func (t *sqlStorageTx) CreateRange(r *Range) (int64, error) {
+	labels, err := marshalLabels(r.Labels)
+	if err != nil {
+		return -1, err
+	}
+	status := r.Status
+	if status == "" {
+		status = RangeAllocated
+	}
+	parent_id := sql.NullInt64{Int64: int64(r.Parent_id), Valid: r.Parent_id != -1}
+	return t.dialect.insert(t.tx, "subnet_id", "INSERT INTO subnets (parent_id, routing_domain_id, name, cidr, description, owner, status, created_at, labels) VALUES (?,?,?,?,?,?,?,?,?)",
+		parent_id, r.Routing_domain_id, r.Name, r.Cidr, nullString(r.Description), nullString(r.Owner), status, sql.NullTime{Time: r.Created_at, Valid: !r.Created_at.IsZero()}, labels)
+}
+
+func (t *sqlStorageTx) DeleteRange(id int64) error {
+	_, err := t.tx.Exec(t.dialect.rebind("DELETE FROM subnets WHERE subnet_id = ?"), id)
+	return err
+}
+
+func (t *sqlStorageTx) ReleaseRange(id int64, released_at time.Time) error {
+	_, err := t.tx.Exec(t.dialect.rebind("UPDATE subnets SET status = ?, released_at = ? WHERE subnet_id = ?"), RangeReleased, released_at, id)
+	return err
+}
 
+func (t *sqlStorageTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *sqlStorageTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// insertAuditEvent inserts an audit event, its time and ID are set.
+func insertAuditEvent(q queryer, d *dialect, event *AuditEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	var request sql.NullString
+	if len(event.Request) > 0 {
+		request = sql.NullString{String: string(event.Request), Valid: true}
+	}
+	id, err := d.insert(q, "event_id", "INSERT INTO audit_events (created_at, actor, action, routing_domain_id, subnet_id, cidr, request) VALUES (?,?,?,?,?,?,?)",
+		event.Time, event.Actor, event.Action, sql.NullInt64{Int64: int64(event.Routing_domain_id), Valid: event.Routing_domain_id != 0},
+		sql.NullInt64{Int64: int64(event.Range_id), Valid: event.Range_id != 0}, nullString(event.Cidr), request)
 	if err != nil {
 		return err
 	}
+	event.Id = id
 	return nil
 }
 
-func CreateRangeInDb(tx *sql.Tx, parent_id int64, routing_domain_id int, name string, cidr string) (int64, error) {
-	if parent_id == -1 {
-		res, err := tx.Exec("INSERT INTO subnets (routing_domain_id, name, cidr) VALUES (?,?,?);", routing_domain_id, name, cidr)
-		if err != nil {
-			return -1, err
-		}
-		subnet_id, err := res.LastInsertId()
-		if err != nil {
-			return -1, err
-		}
-		return subnet_id, nil
-	} else {
-		res, err := tx.Exec("INSERT INTO subnets (parent_id, routing_domain_id, name, cidr) VALUES (?,?,?,?);", parent_id, routing_domain_id, name, cidr)
+// insert runs an INSERT and returns the ID of the new row.
+func (d *dialect) insert(q queryer, idColumn string, query string, args ...interface{}) (int64, error) {
+	if d.returning {
+		var id int64
+		err := q.QueryRow(d.rebind(query+" RETURNING "+idColumn), args...).Scan(&id)
 		if err != nil {
 			return -1, err
 		}
-		subnet_id, err := res.LastInsertId()
-		if err != nil {
-			return -1, err
-		}
-		return subnet_id, nil
+		return id, nil
 	}
-}
-
-func createNewSubnetLease(prevCidr string, range_size int, subnetIndex int) (*net.IPNet, int, error) {
-	_, network, err := net.ParseCIDR(prevCidr)
+	res, err := q.Exec(d.rebind(query), args...)
 	if err != nil {
-		return nil, -1, fmt.Errorf("unable to calculate subnet %v", err)
+		return -1, err
 	}
-	ones, size := network.Mask.Size()
-	subnet, err := cidr.Subnet(network, int(range_size)-ones, subnetIndex)
+	id, err := res.LastInsertId()
 	if err != nil {
-		return nil, -1, fmt.Errorf("unable to calculate subnet %v", err)
+		return -1, err
 	}
-	subnet.Mask = net.CIDRMask(range_size, size)
-	return subnet, range_size, nil
+	return id, nil
 }
 
-func verifyNoOverlap(parentCidr string, subnetRanges []Range, newSubnet *net.IPNet) error {
-	_, parentNetwork, err := net.ParseCIDR(parentCidr)
+// getRangeAncestors returns the parent of a range, its parent and so on, without locking them.
+func getRangeAncestors(q queryer, d *dialect, id int64) ([]Range, error) {
+	var ancestors []Range
+	rang, err := scanRange(q.QueryRow(d.rebind(selectRanges+" WHERE subnet_id = ?"), id))
 	if err != nil {
-		return fmt.Errorf("can't parse CIDR %v", err)
+		return nil, err
 	}
-	log.Printf("Checking Overlap\nparentCidr:\t%s", parentCidr)
-	var subnets []*net.IPNet
-	subnets = append(subnets, newSubnet)
-	log.Printf("newSubnet:\t%s/%d", newSubnet.IP.String(), netMask(newSubnet.Mask))
-	for i := 0; i < len(subnetRanges); i++ {
-		subnetRange := subnetRanges[i]
-		netAddr, subnetCidr, err := net.ParseCIDR(subnetRange.Cidr)
-		if err != nil {
-			return fmt.Errorf("can't parse CIDR %v", err)
+	for rang.Parent_id != -1 {
+		if len(ancestors) > maxRangeDepth {
+			return nil, fmt.Errorf("range %d has more than %d ancestors", id, maxRangeDepth)
 		}
-		if parentNetwork.Contains(netAddr) {
-			subnets = append(subnets, subnetCidr)
+		rang, err = scanRange(q.QueryRow(d.rebind(selectRanges+" WHERE subnet_id = ?"), rang.Parent_id))
+		if err != nil {
+			return nil, err
 		}
+		ancestors = append(ancestors, *rang)
 	}
-
-	return cidr.VerifyNoOverlap(subnets, parentNetwork)
+	return ancestors, nil
 }
 
-func netMask(mask net.IPMask) int {
-	ones, _ := mask.Size()
-	return ones
+// Ranges can't be nested deeper than the bits of an IPv6 address.
+const maxRangeDepth = 128
+
+func queryRanges(q queryer, query string, args ...interface{}) ([]Range, error) {
+	var ranges []Range
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rang, err := scanRange(rows)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, *rang)
+	}
+	return ranges, rows.Err()
 }
 
-func GetDefaultRoutingDomainFromDB(tx *sql.Tx) (*RoutingDomain, error) {
+func scanRange(row rowScanner) (*Range, error) {
+	var subnet_id int
 	var routing_domain_id int
+	tmp := pgtype.Int4{}
 	var name string
-	var vpcs sql.NullString
-
-	err := tx.QueryRow("SELECT routing_domain_id, name, vpcs FROM routing_domains LIMIT 1 FOR UPDATE").Scan(&routing_domain_id, &name, &vpcs)
+	var cidr string
+	var description sql.NullString
+	var owner sql.NullString
+	var status string
+	var created_at sql.NullTime
+	var labels sql.NullString
+	var released_at sql.NullTime
+
+	err := row.Scan(&subnet_id, &tmp, &routing_domain_id, &name, &cidr, &description, &owner, &status, &created_at, &labels, &released_at)
 	if err != nil {
 		return nil, err
 	}
+	parent_id := -1
+	if tmp.Status == pgtype.Present {
+		tmp.AssignTo(&parent_id)
+	}
+	rangeLabels := map[string]string{}
+	if labels.String != "" {
+		err = json.Unmarshal([]byte(labels.String), &rangeLabels)
+		if err != nil {
+			return nil, fmt.Errorf("invalid labels of range %d: %v", subnet_id, err)
+		}
+	}
 
-	return &RoutingDomain{
-		Id:   routing_domain_id,
-		Name: name,
-		Vpcs: vpcs.String,
+	return &Range{
+		Subnet_id:         subnet_id,
+		Parent_id:         parent_id,
+		Routing_domain_id: routing_domain_id,
+		Name:              name,
+		Cidr:              cidr,
+		Description:       description.String,
+		Owner:             owner.String,
+		Status:            status,
+		Created_at:        created_at.Time,
+		Labels:            rangeLabels,
+		Released_at:       released_at.Time,
 	}, nil
 }
 
-func GetRoutingDomainsFromDB() ([]RoutingDomain, error) {
-	var domains []RoutingDomain
-	rows, err := db.Query("SELECT routing_domain_id, name, vpcs FROM routing_domains")
+// marshalLabels returns the labels of a range as stored in the database.
+func marshalLabels(labels map[string]string) (sql.NullString, error) {
+	if len(labels) == 0 {
+		return sql.NullString{}, nil
+	}
+	jsn, err := json.Marshal(labels)
 	if err != nil {
-		return nil, err
+		return sql.NullString{}, err
 	}
-	for rows.Next() {
-		var routing_domain_id int
-		var name string
-		var vpcs sql.NullString
-		err := rows.Scan(&routing_domain_id, &name, &vpcs)
-		if err != nil {
-			return nil, err
-		}
-		domains = append(domains, RoutingDomain{
-			Id:   routing_domain_id,
-			Name: name,
-			Vpcs: vpcs.String,
-		})
+	return sql.NullString{String: string(jsn), Valid: true}, nil
+}
+
+// marshalDiscovery returns the discovery providers of a routing domain as stored in the
+// database.
+func marshalDiscovery(discovery []DiscoveryConfig) (sql.NullString, error) {
+	if len(discovery) == 0 {
+		return sql.NullString{}, nil
+	}
+	jsn, err := json.Marshal(discovery)
+	if err != nil {
+		return sql.NullString{}, err
 	}
-	return domains, nil
+	return sql.NullString{String: string(jsn), Valid: true}, nil
 }
 
-func GetRoutingDomainFromDB(id int64) (*RoutingDomain, error) {
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+func scanRoutingDomain(row rowScanner) (*RoutingDomain, error) {
 	var routing_domain_id int
 	var name string
 	var vpcs sql.NullString
+	var allocation_strategy sql.NullString
+	var discovery sql.NullString
 
-	err := db.QueryRow("SELECT routing_domain_id, name, vpcs FROM routing_domains WHERE routing_domain_id = ?", id).Scan(&routing_domain_id, &name, &vpcs)
+	err := row.Scan(&routing_domain_id, &name, &vpcs, &allocation_strategy, &discovery)
 	if err != nil {
 		return nil, err
 	}
+	var discoveryConfigs []DiscoveryConfig
+	if discovery.Valid {
+		err = json.Unmarshal([]byte(discovery.String), &discoveryConfigs)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse discovery of routing domain %d: %v", routing_domain_id, err)
+		}
+	}
 
 	return &RoutingDomain{
-		Id:   routing_domain_id,
-		Name: name,
-		Vpcs: vpcs.String,
+		Id:                  routing_domain_id,
+		Name:                name,
+		Vpcs:                vpcs.String,
+		Allocation_strategy: allocation_strategy.String,
+		Discovery:           discoveryConfigs,
 	}, nil
 }
 
-func UpdateRoutingDomainOnDb(id int64, name JSONString, vpcs JSONStringArray) error {
-	if name.Set && vpcs.Set {
-		_, err := db.Query("UPDATE routing_domains SET name = ?, vpcs = ? WHERE routing_domain_id = ?", name.Value, strings.Join(vpcs.Value, ","), id)
-		if err != nil {
-			return err
-		}
-	} else if vpcs.Set {
-		_, err := db.Query("UPDATE routing_domains SET vpcs = ? WHERE routing_domain_id = ?", strings.Join(vpcs.Value, ","), id)
-		if err != nil {
-			return err
-		}
-	} else if name.Set {
-		_, err := db.Query("UPDATE routing_domains SET name = ? WHERE routing_domain_id = ?", name.Value, id)
-		if err != nil {
-			return err
-		}
+func netMask(mask net.IPMask) int {
+	ones, _ := mask.Size()
+	return ones
+}
+
+// normalizeCidr returns the canonical notation of an IPv4 or IPv6 CIDR range (i.e.
+// 2001:DB8:0::/48 becomes 2001:db8::/48), so ranges can be looked up by their CIDR.
+// Ranges with host bits set (i.e. 10.0.0.5/24) are rejected.
+func normalizeCidr(cidrRange string) (string, error) {
+	ip, network, err := net.ParseCIDR(cidrRange)
+	if err != nil {
+		return "", err
 	}
-	return nil
+	normalized := fmt.Sprintf("%s/%d", network.IP.String(), netMask(network.Mask))
+	if !ip.Equal(network.IP) {
+		return "", fmt.Errorf("%s has host bits set, the range is %s", cidrRange, normalized)
+	}
+	return normalized, nil
+}
+
+// formatSubnet returns the CIDR notation of a subnet lease.
+func formatSubnet(subnet *net.IPNet, ones int) string {
+	return fmt.Sprintf("%s/%d", subnet.IP.String(), ones)
 }
 
-func CreateRoutingDomainOnDb(name string, vpcs []string) (int64, error) {
-	res, err := db.Exec("INSERT INTO routing_domains (name, vpcs) VALUES (?,?);", name, strings.Join(vpcs, ","))
+// verifyContainedInParent checks that a range is of the same IP version as its parent and
+// contained in it.
+func verifyContainedInParent(parentCidr string, childCidr string) error {
+	_, parentNetwork, err := net.ParseCIDR(parentCidr)
 	if err != nil {
-		return -1, err
+		return fmt.Errorf("can't parse CIDR %v", err)
 	}
-	domain_id, err := res.LastInsertId()
+	_, childNetwork, err := net.ParseCIDR(childCidr)
 	if err != nil {
-		return -1, err
+		return fmt.Errorf("can't parse CIDR %v", err)
+	}
+	if (parentNetwork.IP.To4() == nil) != (childNetwork.IP.To4() == nil) {
+		return fmt.Errorf("%s and parent %s are not of the same IP version", childCidr, parentCidr)
 	}
-	return domain_id, nil
+	first, last := cidr.AddressRange(childNetwork)
+	if !parentNetwork.Contains(first) || !parentNetwork.Contains(last) {
+		return fmt.Errorf("%s is not contained in parent %s", childCidr, parentCidr)
+	}
+	return nil
 }
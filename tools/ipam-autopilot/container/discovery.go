@@ -0,0 +1,407 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Types of discovery providers.
+const (
+	// DiscoveryCai discovers the subnets of the VPCs of a routing domain in Cloud Asset Inventory
+	DiscoveryCai = "cai"
+	// DiscoveryStatic reads ranges from a YAML or CSV file
+	DiscoveryStatic = "static"
+	// DiscoveryHttp fetches ranges from an HTTP endpoint returning JSON
+	DiscoveryHttp = "http"
+)
+
+var DiscoveryTypes = []string{DiscoveryCai, DiscoveryStatic, DiscoveryHttp}
+
+// DiscoveryConfig configures a provider discovering ranges of a routing domain that are
+// managed outside of IPAM Autopilot, i.e. VPC subnets, on-prem or other clouds. Allocations
+// never overlap with discovered ranges.
+type DiscoveryConfig struct {
+	Type string `json:"type"`
+	// Organization queried by cai, CAI_ORG_ID by default
+	Organization string `json:"organization,omitempty"`
+	// Path of the file read by static, .csv files are read as CSV, others as YAML
+	Path string `json:"path,omitempty"`
+	// URL fetched by http
+	Url string `json:"url,omitempty"`
+}
+
+// ExternalRange is a range found by a discovery provider.
+type ExternalRange struct {
+	Cidr string `json:"cidr" yaml:"cidr"`
+	Name string `json:"name,omitempty" yaml:"name"`
+	// provider that found the range, i.e. static:/etc/ipam/on-prem.yaml
+	Source string `json:"source" yaml:"-"`
+}
+
+// DiscoveryProvider finds the external ranges of a routing domain.
+type DiscoveryProvider interface {
+	Discover(ctx context.Context, routingDomain *RoutingDomain) ([]ExternalRange, error)
+}
+
+// newDiscoveryProvider creates the provider of a configuration.
+func newDiscoveryProvider(config DiscoveryConfig) (DiscoveryProvider, error) {
+	switch config.Type {
+	case DiscoveryCai:
+		organization := config.Organization
+		if organization == "" {
+			organization = os.Getenv("CAI_ORG_ID")
+		}
+		if organization == "" {
+			return nil, fmt.Errorf("cai discovery needs an organization or CAI_ORG_ID")
+		}
+		return &caiDiscovery{organization: organization}, nil
+	case DiscoveryStatic:
+		if config.Path == "" {
+			return nil, fmt.Errorf("static discovery needs a path")
+		}
+		path, err := staticDiscoveryPath(config.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &staticDiscovery{path: path}, nil
+	case DiscoveryHttp:
+		if !strings.HasPrefix(config.Url, "http://") && !strings.HasPrefix(config.Url, "https://") {
+			return nil, fmt.Errorf("http discovery needs an http or https url")
+		}
+		if !discoveryUrlAllowed(config.Url) {
+			return nil, fmt.Errorf("http discovery url %s is not in DISCOVERY_HTTP_ALLOWLIST", config.Url)
+		}
+		client := &http.Client{
+			Timeout: 30 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 10 {
+					return fmt.Errorf("stopped after 10 redirects")
+				}
+				if !discoveryUrlAllowed(req.URL.String()) {
+					return fmt.Errorf("redirect to %s is not in DISCOVERY_HTTP_ALLOWLIST", req.URL)
+				}
+				return nil
+			},
+		}
+		return &httpDiscovery{url: config.Url, client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown discovery type %s, supported are %s", config.Type, strings.Join(DiscoveryTypes, ", "))
+}
+
+// discoveryStaticDir is the directory of the files read by static discovery, set by
+// DISCOVERY_STATIC_DIR. Static discovery is disabled if it is empty.
+var discoveryStaticDir string
+
+// discoveryHttpAllowlist contains the URL prefixes http discovery may fetch, set by
+// DISCOVERY_HTTP_ALLOWLIST. Http discovery is disabled if it is empty.
+var discoveryHttpAllowlist []*url.URL
+
+// discoveryRestrictionsFromEnv reads DISCOVERY_STATIC_DIR and the comma-separated URL
+// prefixes of DISCOVERY_HTTP_ALLOWLIST.
+func discoveryRestrictionsFromEnv() error {
+	discoveryStaticDir = os.Getenv("DISCOVERY_STATIC_DIR")
+	discoveryHttpAllowlist = nil
+	for _, prefix := range strings.Split(os.Getenv("DISCOVERY_HTTP_ALLOWLIST"), ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			continue
+		}
+		allowed, err := url.Parse(prefix)
+		if err != nil || (allowed.Scheme != "http" && allowed.Scheme != "https") || allowed.Host == "" {
+			return fmt.Errorf("invalid url %s in DISCOVERY_HTTP_ALLOWLIST", prefix)
+		}
+		discoveryHttpAllowlist = append(discoveryHttpAllowlist, allowed)
+	}
+	return nil
+}
+
+// staticDiscoveryPath resolves the path of a static discovery file relative to
+// discoveryStaticDir and returns an error if it is outside of the directory.
+func staticDiscoveryPath(path string) (string, error) {
+	if discoveryStaticDir == "" {
+		return "", fmt.Errorf("static discovery is disabled, DISCOVERY_STATIC_DIR is not set")
+	}
+	dir, err := filepath.Abs(discoveryStaticDir)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("static discovery path %s is not in DISCOVERY_STATIC_DIR", path)
+	}
+	return path, nil
+}
+
+// discoveryUrlAllowed reports whether a URL has the scheme and host of a URL of
+// discoveryHttpAllowlist and its path is below the path of that URL.
+func discoveryUrlAllowed(rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.User != nil {
+		return false
+	}
+	path := u.EscapedPath()
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." || strings.EqualFold(segment, "%2e%2e") {
+			return false
+		}
+	}
+	for _, allowed := range discoveryHttpAllowlist {
+		if !strings.EqualFold(u.Scheme, allowed.Scheme) || !strings.EqualFold(u.Host, allowed.Host) {
+			continue
+		}
+		prefix := strings.TrimSuffix(allowed.EscapedPath(), "/")
+		if prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// validateDiscoveryConfigs returns an error if a provider can't be created.
+func validateDiscoveryConfigs(configs []DiscoveryConfig) error {
+	for _, config := range configs {
+		if _, err := newDiscoveryProvider(config); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discoveryConfigs returns the discovery providers of a routing domain. Routing domains
+// without providers use CAI if CAI_ORG_ID is set.
+func discoveryConfigs(routingDomain *RoutingDomain) []DiscoveryConfig {
+	if len(routingDomain.Discovery) > 0 {
+		return routingDomain.Discovery
+	}
+	if os.Getenv("CAI_ORG_ID") != "" {
+		return []DiscoveryConfig{{Type: DiscoveryCai}}
+	}
+	return nil
+}
+
+// discoveryCacheTTL is the time discovered ranges are cached, set by DISCOVERY_CACHE_TTL.
+var discoveryCacheTTL = 5 * time.Minute
+
+type discoveryCacheEntry struct {
+	ranges  []ExternalRange
+	fetched time.Time
+}
+
+var discoveryCache = struct {
+	sync.Mutex
+	entries map[string]discoveryCacheEntry
+}{entries: make(map[string]discoveryCacheEntry)}
+
+// discoverExternalRanges returns the ranges of all discovery providers of a routing domain,
+// cached for discoveryCacheTTL unless refresh is set. Ranges found by several providers
+// are returned once.
+func discoverExternalRanges(ctx context.Context, routingDomain *RoutingDomain, refresh bool) ([]ExternalRange, error) {
+	ranges := []ExternalRange{}
+	found := make(map[string]bool)
+	for _, config := range discoveryConfigs(routingDomain) {
+		// CAI results depend on the VPCs of the routing domain
+		key, err := json.Marshal(struct {
+			Domain int
+			Vpcs   string
+			Config DiscoveryConfig
+		}{routingDomain.Id, routingDomain.Vpcs, config})
+		if err != nil {
+			return nil, err
+		}
+		discoveryCache.Lock()
+		entry, cached := discoveryCache.entries[string(key)]
+		discoveryCache.Unlock()
+		if refresh || !cached || time.Since(entry.fetched) >= discoveryCacheTTL {
+			provider, err := newDiscoveryProvider(config)
+			if err == nil {
+				entry.ranges, err = provider.Discover(ctx, routingDomain)
+			}
+			if err != nil {
+				// The error may contain content of the file or response, it is only logged
+				log.Printf("%s discovery for routing domain %d failed: %v", config.Type, routingDomain.Id, err)
+				return nil, fmt.Errorf("%s discovery failed, see the logs of IPAM Autopilot", config.Type)
+			}
+			entry.fetched = time.Now()
+			log.Printf("Discovered %d ranges with %s for routing domain %d", len(entry.ranges), config.Type, routingDomain.Id)
+			discoveryCache.Lock()
+			discoveryCache.entries[string(key)] = entry
+			discoveryCache.Unlock()
+		}
+		for _, rang := range entry.ranges {
+			if !found[rang.Cidr] {
+				found[rang.Cidr] = true
+				ranges = append(ranges, rang)
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// caiDiscovery finds the primary, secondary and IPv6 ranges of the subnets in the VPCs of
+// a routing domain.
+type caiDiscovery struct {
+	organization string
+}
+
+func (d *caiDiscovery) Discover(ctx context.Context, routingDomain *RoutingDomain) ([]ExternalRange, error) {
+	vpcs := strings.Split(routingDomain.Vpcs, ",")
+	subnets, err := GetRangesForNetwork(fmt.Sprintf("organizations/%s", d.organization), vpcs)
+	if err != nil {
+		return nil, err
+	}
+	source := fmt.Sprintf("%s:organizations/%s", DiscoveryCai, d.organization)
+	var ranges []ExternalRange
+	for _, subnet := range subnets {
+		ranges = append(ranges, ExternalRange{Cidr: subnet.cidr, Name: subnet.name, Source: source})
+		if subnet.ipv6Cidr != "" {
+			ranges = append(ranges, ExternalRange{Cidr: subnet.ipv6Cidr, Name: subnet.name, Source: source})
+		}
+		for _, secondaryRange := range subnet.secondaryRanges {
+			ranges = append(ranges, ExternalRange{Cidr: secondaryRange.cidr, Name: fmt.Sprintf("%s/%s", subnet.name, secondaryRange.name), Source: source})
+		}
+	}
+	return ranges, nil
+}
+
+// staticDiscovery reads ranges from a file, either as CSV with the columns cidr and name,
+// or as YAML with a list of ranges:
+//
+//	ranges:
+//	  - cidr: 192.168.0.0/16
+//	    name: on-prem
+type staticDiscovery struct {
+	path string
+}
+
+func (d *staticDiscovery) Discover(ctx context.Context, routingDomain *RoutingDomain) ([]ExternalRange, error) {
+	data, err := ioutil.ReadFile(d.path)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []ExternalRange
+	if strings.EqualFold(filepath.Ext(d.path), ".csv") {
+		ranges, err = parseCsvRanges(data)
+	} else {
+		ranges, err = parseRangeList(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", d.path, err)
+	}
+	return withSource(ranges, fmt.Sprintf("%s:%s", DiscoveryStatic, d.path))
+}
+
+// httpDiscovery fetches ranges from an endpoint returning JSON, either a list of ranges or
+// an object with the list in ranges, i.e. {"ranges": [{"cidr": "172.16.0.0/12", "name": "aws"}]}.
+type httpDiscovery struct {
+	url    string
+	client *http.Client
+}
+
+func (d *httpDiscovery) Discover(ctx context.Context, routingDomain *RoutingDomain) ([]ExternalRange, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned status %d", d.url, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	ranges, err := parseRangeList(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing response of %s: %v", d.url, err)
+	}
+	return withSource(ranges, fmt.Sprintf("%s:%s", DiscoveryHttp, d.url))
+}
+
+// parseRangeList parses a YAML or JSON list of ranges, either at the top level or in ranges.
+func parseRangeList(data []byte) ([]ExternalRange, error) {
+	var list struct {
+		Ranges []ExternalRange `yaml:"ranges"`
+	}
+	if err := yaml.Unmarshal(data, &list); err == nil {
+		return list.Ranges, nil
+	}
+	var ranges []ExternalRange
+	err := yaml.Unmarshal(data, &ranges)
+	return ranges, err
+}
+
+// parseCsvRanges parses CSV with the columns cidr and name, a header and lines starting
+// with # are skipped.
+func parseCsvRanges(data []byte) ([]ExternalRange, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var ranges []ExternalRange
+	for i, record := range records {
+		if i == 0 && strings.EqualFold(record[0], "cidr") {
+			continue
+		}
+		rang := ExternalRange{Cidr: record[0]}
+		if len(record) > 1 {
+			rang.Name = record[1]
+		}
+		ranges = append(ranges, rang)
+	}
+	return ranges, nil
+}
+
+// withSource normalizes the CIDRs of discovered ranges and sets their source.
+func withSource(ranges []ExternalRange, source string) ([]ExternalRange, error) {
+	for i := range ranges {
+		cidr, err := normalizeCidr(strings.TrimSpace(ranges[i].Cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %s: %v", ranges[i].Cidr, err)
+		}
+		ranges[i].Cidr = cidr
+		ranges[i].Source = source
+	}
+	return ranges, nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTempFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestStaticDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discovery")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	yamlPath := writeTempFile(t, dir, "on-prem.yaml", `
+ranges:
+  - cidr: 192.168.0.0/16
+    name: on-prem
+  - cidr: 2001:DB8::/48
+`)
+	ranges, err := (&staticDiscovery{path: yamlPath}).Discover(context.Background(), &RoutingDomain{})
+	assert.Nil(t, err)
+	assert.Equal(t, []ExternalRange{
+		{Cidr: "192.168.0.0/16", Name: "on-prem", Source: "static:" + yamlPath},
+		{Cidr: "2001:db8::/48", Source: "static:" + yamlPath},
+	}, ranges)
+
+	csvPath := writeTempFile(t, dir, "aws.csv", "cidr,name\n# VPCs in eu-west-1\n172.16.0.0/12, aws\n10.10.0.0/16\n")
+	ranges, err = (&staticDiscovery{path: csvPath}).Discover(context.Background(), &RoutingDomain{})
+	assert.Nil(t, err)
+	assert.Equal(t, []ExternalRange{
+		{Cidr: "172.16.0.0/12", Name: "aws", Source: "static:" + csvPath},
+		{Cidr: "10.10.0.0/16", Source: "static:" + csvPath},
+	}, ranges)
+
+	invalidPath := writeTempFile(t, dir, "invalid.csv", "10.10.0.0/33,invalid\n")
+	_, err = (&staticDiscovery{path: invalidPath}).Discover(context.Background(), &RoutingDomain{})
+	assert.NotNil(t, err)
+}
+
+func TestHttpDiscovery(t *testing.T) {
+	responses := []string{`[{"cidr": "172.16.0.0/12", "name": "aws"}]`, `{"ranges": [{"cidr": "172.16.0.0/12"}, {"cidr": "10.10.0.0/16"}]}`}
+	for _, response := range responses {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, response)
+		}))
+		ranges, err := (&httpDiscovery{url: server.URL, client: server.Client()}).Discover(context.Background(), &RoutingDomain{})
+		assert.Nil(t, err)
+		if assert.NotEqual(t, 0, len(ranges)) {
+			assert.Equal(t, "172.16.0.0/12", ranges[0].Cidr)
+			assert.Equal(t, "http:"+server.URL, ranges[0].Source)
+		}
+		server.Close()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer server.Close()
+	_, err := (&httpDiscovery{url: server.URL, client: server.Client()}).Discover(context.Background(), &RoutingDomain{})
+	assert.NotNil(t, err)
+}
+
+func TestValidateDiscoveryConfigs(t *testing.T) {
+	// Static and http discovery are disabled by default
+	assert.NotNil(t, validateDiscoveryConfigs([]DiscoveryConfig{{Type: DiscoveryStatic, Path: "ranges.yaml"}}))
+	assert.NotNil(t, validateDiscoveryConfigs([]DiscoveryConfig{{Type: DiscoveryHttp, Url: "https://cmdb.example.com/ranges"}}))
+
+	os.Setenv("DISCOVERY_STATIC_DIR", "/etc/ipam")
+	os.Setenv("DISCOVERY_HTTP_ALLOWLIST", "https://cmdb.example.com/ranges, http://10.0.0.10:8080")
+	defer func() {
+		os.Unsetenv("DISCOVERY_STATIC_DIR")
+		os.Unsetenv("DISCOVERY_HTTP_ALLOWLIST")
+		assert.Nil(t, discoveryRestrictionsFromEnv())
+	}()
+	assert.Nil(t, discoveryRestrictionsFromEnv())
+	assert.Nil(t, validateDiscoveryConfigs([]DiscoveryConfig{{Type: DiscoveryStatic, Path: "ranges.yaml"}, {Type: DiscoveryHttp, Url: "https://cmdb.example.com/ranges"}}))
+	assert.Nil(t, validateDiscoveryConfigs([]DiscoveryConfig{{Type: DiscoveryStatic, Path: "/etc/ipam/aws/ranges.csv"}}))
+	assert.Nil(t, validateDiscoveryConfigs([]DiscoveryConfig{{Type: DiscoveryHttp, Url: "https://cmdb.example.com/ranges/aws?format=json"}}))
+	assert.Nil(t, validateDiscoveryConfigs([]DiscoveryConfig{{Type: DiscoveryHttp, Url: "http://10.0.0.10:8080/any"}}))
+	assert.Nil(t, validateDiscoveryConfigs([]DiscoveryConfig{{Type: DiscoveryCai, Organization: "123"}}))
+	assert.NotNil(t, validateDiscoveryConfigs([]DiscoveryConfig{{Type: DiscoveryStatic}}))
+	for _, path := range []string{"/etc/passwd", "../passwd", "aws/../../passwd", "/etc/ipam", "/etc/ipam-other/ranges.yaml"} {
+		assert.NotNil(t, validateDiscoveryConfigs([]DiscoveryConfig{{Type: DiscoveryStatic, Path: path}}), path)
+	}
+	for _, url := range []string{
+		"file:///etc/passwd",
+		"http://cmdb.example.com/ranges",
+		"https://cmdb.example.com/rangesx",
+		"https://cmdb.example.com/ranges/../admin",
+		"https://cmdb.example.com.evil.com/ranges",
+		"https://cmdb.example.com@169.254.169.254/ranges",
+		"http://169.254.169.254/computeMetadata/v1",
+		"http://10.0.0.10:8081/any",
+	} {
+		assert.NotNil(t, validateDiscoveryConfigs([]DiscoveryConfig{{Type: DiscoveryHttp, Url: url}}), url)
+	}
+	assert.NotNil(t, validateDiscoveryConfigs([]DiscoveryConfig{{Type: "aws"}}))
+
+	os.Setenv("DISCOVERY_HTTP_ALLOWLIST", "ftp://cmdb.example.com")
+	assert.NotNil(t, discoveryRestrictionsFromEnv())
+}
+
+func TestHttpDiscoveryRedirects(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"cidr": "10.0.0.0/24"}]`)
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer server.Close()
+	allowed, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+	discoveryHttpAllowlist = []*url.URL{allowed}
+	defer func() { discoveryHttpAllowlist = nil }()
+
+	// Redirects are only followed to allowed URLs
+	provider, err := newDiscoveryProvider(DiscoveryConfig{Type: DiscoveryHttp, Url: server.URL + "/ranges"})
+	assert.Nil(t, err)
+	_, err = provider.Discover(context.Background(), &RoutingDomain{})
+	assert.NotNil(t, err)
+
+	u, err := url.Parse(target.URL)
+	assert.Nil(t, err)
+	discoveryHttpAllowlist = append(discoveryHttpAllowlist, u)
+	ranges, err := provider.Discover(context.Background(), &RoutingDomain{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(ranges))
+}
+
+func TestAllocationSkipsExternalRanges(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"ranges": [{"cidr": "10.0.0.0/24", "name": "on-prem"}, {"cidr": "10.0.1.0/24", "name": "aws"}]}`)
+	}))
+	defer server.Close()
+
+	status, _ := authRequest(t, app, "PUT", "/domains/1", "", map[string]interface{}{"discovery": []DiscoveryConfig{{Type: "http"}}})
+	assert.Equal(t, 400, status)
+	// The URL is not in the allowlist
+	status, _ = authRequest(t, app, "PUT", "/domains/1", "", map[string]interface{}{"discovery": []DiscoveryConfig{{Type: DiscoveryHttp, Url: server.URL}}})
+	assert.Equal(t, 400, status)
+	allowed, err := url.Parse(server.URL)
+	assert.Nil(t, err)
+	discoveryHttpAllowlist = []*url.URL{allowed}
+	defer func() { discoveryHttpAllowlist = nil }()
+	status, _ = authRequest(t, app, "PUT", "/domains/1", "", map[string]interface{}{"discovery": []DiscoveryConfig{{Type: DiscoveryHttp, Url: server.URL}}})
+	assert.Equal(t, 200, status)
+	var domain map[string]interface{}
+	status, body := authRequest(t, app, "GET", "/domains/1", "", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &domain))
+	assert.Equal(t, []interface{}{map[string]interface{}{"type": "http", "url": server.URL}}, domain["discovery"])
+
+	status, created := postRange(t, app, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "10.0.2.0/24", created["cidr"])
+	status, created = postRange(t, app, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 200, status)
+	assert.Equal(t, "10.0.3.0/24", created["cidr"])
+	// Discovered ranges are cached
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	var ranges []ExternalRange
+	status, body = authRequest(t, app, "GET", "/domains/1/external-ranges?refresh=true", "", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &ranges))
+	assert.Equal(t, []ExternalRange{
+		{Cidr: "10.0.0.0/24", Name: "on-prem", Source: "http:" + server.URL},
+		{Cidr: "10.0.1.0/24", Name: "aws", Source: "http:" + server.URL},
+	}, ranges)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestDiscoveryErrorsAreNotReturned(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	dir, err := ioutil.TempDir("", "discovery")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	discoveryStaticDir = dir
+	defer func() { discoveryStaticDir = "" }()
+
+	writeTempFile(t, dir, "secret.yaml", "ranges:\n  - cidr: hunter2\n")
+	status, _ := authRequest(t, app, "PUT", "/domains/1", "", map[string]interface{}{"discovery": []DiscoveryConfig{{Type: DiscoveryStatic, Path: "secret.yaml"}}})
+	assert.Equal(t, 200, status)
+
+	status, body := authRequest(t, app, "GET", "/domains/1/external-ranges?refresh=true", "", nil)
+	assert.Equal(t, 503, status)
+	assert.NotContains(t, string(body), "hunter2")
+	assert.NotContains(t, string(body), dir)
+	status, created := postRange(t, app, RangeRequest{Name: "child", Parent: fmt.Sprint(parent_id), Range_size: 24})
+	assert.Equal(t, 503, status)
+	assert.NotContains(t, fmt.Sprint(created), "hunter2")
+}
@@ -94,3 +94,207 @@ func TestRangeCreationWithExisting4(t *testing.T) {
 	assert.NotNil(t, err)
 	assert.Equal(t, err, fmt.Errorf("no_address_range_available_in_parent"))
 }
+
+func TestRangeCreationIPv6WithEmptyExisting(t *testing.T) {
+	subnet, subnet_ones, err := findNextSubnet(64, "2001:db8::/48", []Range{})
+
+	assert.Nil(t, err)
+	_, network, _ := net.ParseCIDR("2001:db8::/64")
+	assert.Equal(t, network, subnet)
+	assert.Equal(t, 64, subnet_ones)
+	assert.Equal(t, "2001:db8::/64", formatSubnet(subnet, subnet_ones))
+}
+
+func TestRangeCreationIPv6WithExisting(t *testing.T) {
+	existingRanges := []Range{
+		Range{
+			Cidr: "2001:db8::/64",
+		},
+		Range{
+			Cidr: "2001:db8:0:1::/64",
+		},
+		Range{
+			Cidr: "10.0.0.0/8",
+		},
+	}
+	subnet, subnet_ones, err := findNextSubnet(64, "2001:db8::/48", existingRanges)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8:0:2::/64", formatSubnet(subnet, subnet_ones))
+}
+
+func TestRangeCreationIPv6Exhausted(t *testing.T) {
+	existingRanges := []Range{
+		Range{
+			Cidr: "2001:db8::/63",
+		},
+	}
+	_, _, err := findNextSubnet(64, "2001:db8::/63", existingRanges)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, err, fmt.Errorf("no_address_range_available_in_parent"))
+}
+
+func TestRangeCreationWithInvalidSize(t *testing.T) {
+	_, _, err := findNextSubnet(24, "2001:db8::/48", []Range{})
+	assert.NotNil(t, err)
+
+	_, _, err = findNextSubnet(64, "10.0.0.0/8", []Range{})
+	assert.NotNil(t, err)
+}
+
+func TestNormalizeCidr(t *testing.T) {
+	normalized, err := normalizeCidr("2001:DB8:0:0::/48")
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::/48", normalized)
+
+	normalized, err = normalizeCidr("10.0.0.0/8")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.0/8", normalized)
+
+	_, err = normalizeCidr("2001:db8::")
+	assert.NotNil(t, err)
+
+	_, err = normalizeCidr("10.0.0.5/24")
+	assert.EqualError(t, err, "10.0.0.5/24 has host bits set, the range is 10.0.0.0/24")
+
+	_, err = normalizeCidr("2001:db8::1/64")
+	assert.NotNil(t, err)
+}
+
+func TestVerifyContainedInParent(t *testing.T) {
+	assert.Nil(t, verifyContainedInParent("2001:db8::/48", "2001:db8:0:5::/64"))
+	assert.NotNil(t, verifyContainedInParent("2001:db8::/48", "2001:db9::/64"))
+	assert.NotNil(t, verifyContainedInParent("10.0.0.0/8", "2001:db8::/64"))
+}
+
+func TestRangeCreationStrategies(t *testing.T) {
+	// Free are 10.0.0.128/25, 10.0.1.0/24 and 10.0.2.0/23
+	existingRanges := []Range{
+		Range{
+			Cidr: "10.0.0.0/25",
+		},
+	}
+	expected := map[string]string{
+		FirstFit:          "10.0.0.128/26",
+		BestFit:           "10.0.0.128/26",
+		LastFit:           "10.0.3.192/26",
+		ReservedAlignment: "10.0.0.128/26",
+	}
+	for strategy, cidr := range expected {
+		subnet, subnet_ones, err := findNextSubnetWithStrategy(strategy, 26, "10.0.0.0/22", existingRanges)
+		assert.Nil(t, err)
+		assert.Equal(t, cidr, formatSubnet(subnet, subnet_ones), strategy)
+	}
+
+	// Free are 10.0.0.128/25 and 10.0.1.0/24
+	existingRanges = []Range{
+		Range{
+			Cidr: "10.0.0.0/25",
+		},
+		Range{
+			Cidr: "10.0.2.0/23",
+		},
+	}
+	expected = map[string]string{
+		FirstFit:          "10.0.0.128/25",
+		BestFit:           "10.0.0.128/25",
+		LastFit:           "10.0.1.128/25",
+		ReservedAlignment: "10.0.1.0/25",
+	}
+	for strategy, cidr := range expected {
+		subnet, subnet_ones, err := findNextSubnetWithStrategy(strategy, 25, "10.0.0.0/22", existingRanges)
+		assert.Nil(t, err)
+		assert.Equal(t, cidr, formatSubnet(subnet, subnet_ones), strategy)
+	}
+}
+
+func TestRangeCreationBestFit(t *testing.T) {
+	// Free are 10.0.1.0/24 and 10.0.2.192/26, best fit fills the smaller hole
+	existingRanges := []Range{
+		Range{
+			Cidr: "10.0.0.0/24",
+		},
+		Range{
+			Cidr: "10.0.2.0/25",
+		},
+		Range{
+			Cidr: "10.0.2.128/26",
+		},
+		Range{
+			Cidr: "10.0.3.0/24",
+		},
+	}
+	subnet, subnet_ones, err := findNextSubnetWithStrategy(BestFit, 27, "10.0.0.0/22", existingRanges)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.2.192/27", formatSubnet(subnet, subnet_ones))
+
+	subnet, subnet_ones, err = findNextSubnetWithStrategy(FirstFit, 27, "10.0.0.0/22", existingRanges)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.1.0/27", formatSubnet(subnet, subnet_ones))
+}
+
+func TestRangeCreationLastFitIPv6(t *testing.T) {
+	subnet, subnet_ones, err := findNextSubnetWithStrategy(LastFit, 64, "2001:db8::/48", []Range{})
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8:0:ffff::/64", formatSubnet(subnet, subnet_ones))
+}
+
+func TestRangeCreationUnknownStrategy(t *testing.T) {
+	_, _, err := findNextSubnetWithStrategy("random-fit", 24, "10.0.0.0/8", []Range{})
+	assert.NotNil(t, err)
+}
+
+func TestRangeUtilization(t *testing.T) {
+	existingRanges := []Range{
+		Range{
+			Cidr: "10.0.0.0/24",
+		},
+		Range{
+			Cidr: "10.0.2.0/25",
+		},
+		Range{
+			Cidr: "10.0.2.128/26",
+		},
+		Range{
+			Cidr: "10.0.3.0/24",
+		},
+	}
+	utilization, err := rangeUtilization("10.0.0.0/22", existingRanges)
+	assert.Nil(t, err)
+	assert.Equal(t, "1024", utilization.TotalAddresses.String())
+	assert.Equal(t, "704", utilization.UsedAddresses.String())
+	assert.Equal(t, "320", utilization.FreeAddresses.String())
+	assert.Equal(t, "10.0.1.0/24", utilization.LargestFreeBlock)
+	assert.Equal(t, []FreeBlockCount{{PrefixLength: 24, Count: 1}, {PrefixLength: 26, Count: 1}}, utilization.FreeBlocks)
+	assert.InDelta(t, 0.2, utilization.Fragmentation, 0.0001)
+
+	utilization, err = rangeUtilization("2001:db8::/48", []Range{})
+	assert.Nil(t, err)
+	assert.Equal(t, "1208925819614629174706176", utilization.FreeAddresses.String())
+	assert.Equal(t, "2001:db8::/48", utilization.LargestFreeBlock)
+	assert.Equal(t, 0.0, utilization.Fragmentation)
+}
+
+func TestFreeRanges(t *testing.T) {
+	existingRanges := []Range{
+		Range{
+			Cidr: "10.0.0.0/24",
+		},
+		Range{
+			Cidr: "10.0.2.0/25",
+		},
+	}
+	ranges, err := freeRanges(25, "10.0.0.0/22", existingRanges, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.1.0/25", "10.0.1.128/25", "10.0.2.128/25", "10.0.3.0/25", "10.0.3.128/25"}, ranges)
+	ranges, err = freeRanges(24, "10.0.0.0/22", existingRanges, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"10.0.1.0/24"}, ranges)
+	ranges, err = freeRanges(23, "10.0.0.0/22", existingRanges, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{}, ranges)
+
+	_, err = freeRanges(21, "10.0.0.0/22", existingRanges, 10)
+	assert.NotNil(t, err)
+}
@@ -15,45 +15,97 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"time"
 
-	"github.com/go-sql-driver/mysql"
 	"github.com/gofiber/fiber/v2"
 )
 
-var db *sql.DB
+var store Storage
 
 func main() {
 	var err error
 
-	cfg := mysql.Config{
-		User:                 os.Getenv("DATABASE_USER"),
-		Passwd:               os.Getenv("DATABASE_PASSWORD"),
-		Net:                  os.Getenv("DATABASE_NET"),
-		Addr:                 os.Getenv("DATABASE_HOST"),
-		DBName:               os.Getenv("DATABASE_NAME"),
-		MultiStatements:      true,
-		AllowNativePasswords: true,
-	}
-	// Get a database handle.
-	db, err = sql.Open("mysql", cfg.FormatDSN())
-	db.SetMaxOpenConns(100)
-	db.SetMaxIdleConns(5)
+	// Get a database handle, selected by DATABASE_TYPE.
+	store, err = NewStorageFromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	defer store.Close()
 	if os.Getenv("DISABLE_DATABASE_MIGRATION") != "TRUE" {
-		err = MigrateDatabase(os.Getenv("DATABASE_NAME"), db)
+		err = store.Migrate()
 		if err != nil {
 			log.Fatal("Unable to initalize database")
 		}
 	}
 
+	quarantinePeriod, err = quarantinePeriodFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if quarantinePeriod > 0 {
+		log.Printf("Released ranges are quarantined for %s", quarantinePeriod)
+	}
+
+	if os.Getenv("AUTH_CONFIG") != "" {
+		auth, err = LoadAuthConfig(context.Background(), os.Getenv("AUTH_CONFIG"))
+		if err != nil {
+			log.Fatalf("Unable to load auth config %v", err)
+		}
+	} else {
+		log.Printf("AUTH_CONFIG not set, the API relies on Cloud Run IAM for authentication")
+	}
+
+	if os.Getenv("DISCOVERY_CACHE_TTL") != "" {
+		discoveryCacheTTL, err = time.ParseDuration(os.Getenv("DISCOVERY_CACHE_TTL"))
+		if err != nil {
+			log.Fatalf("Can't parse value of DISCOVERY_CACHE_TTL env variable %s %v", os.Getenv("DISCOVERY_CACHE_TTL"), err)
+		}
+	}
+
+	err = discoveryRestrictionsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	auditSinks, err = auditSinksFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// ipam-autopilot reconcile runs the reconciliation instead of the API
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		err = runReconcileCommand(os.Args[2:], os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if quarantinePeriod > 0 {
+		go runQuarantineFinalizer()
+	}
+	app := newApp()
+
+	var port int64
+	if os.Getenv("PORT") != "" {
+		port, err = strconv.ParseInt(os.Getenv("PORT"), 10, 64)
+		if err != nil {
+			log.Panicf("Can't parse value of PORT env variable %s %v", os.Getenv("PORT"), err)
+		}
+	} else {
+		port = 8080
+	}
+
+	app.Listen(fmt.Sprintf(":%d", port))
+}
+
+// newApp creates the fiber app with the routes of the API.
+func newApp() *fiber.App {
 	app := fiber.New()
 	// No static assets right now app.Static("/", "./public")
 	app.Get("/", func(c *fiber.Ctx) error {
@@ -63,26 +115,28 @@ func main() {
 	app.Get("/terraform/providers/v1/ipam-autopilot/ipam/versions", GetTerraformVersions)
 	app.Get("/terraform/providers/v1/ipam-autopilot/ipam/:version/download/:os/:arch", GetTerraformVersionDownload)
 
+	// The Terraform registry endpoints above are public, the API requires authentication
+	app.Use(Authenticate)
+
 	app.Post("/ranges", CreateNewRange)
 	app.Get("/ranges", GetRanges)
 	app.Get("/ranges/:id", GetRange)
+	app.Put("/ranges/:id", UpdateRange)
+	app.Get("/ranges/:id/utilization", GetRangeUtilization)
+	app.Get("/ranges/:id/free", GetFreeRanges)
 	app.Delete("/ranges/:id", DeleteRange)
 
+	app.Get("/quarantine", GetQuarantinedRanges)
+	app.Delete("/quarantine/:id", ForceReleaseRange)
+
+	app.Get("/audit", GetAuditEvents)
+
 	app.Get("/domains", GetRoutingDomains)
 	app.Get("/domains/:id", GetRoutingDomain)
+	app.Get("/domains/:id/external-ranges", GetExternalRanges)
+	app.Post("/domains/:id/reconcile", ReconcileRoutingDomain)
 	app.Put("/domains/:id", UpdateRoutingDomain)
 	app.Post("/domains", CreateRoutingDomain)
 	app.Delete("/domains/:id", DeleteRoutingDomain)
-
-	var port int64
-	if os.Getenv("PORT") != "" {
-		port, err = strconv.ParseInt(os.Getenv("PORT"), 10, 64)
-		if err != nil {
-			log.Panicf("Can't parse value of PORT env variable %s %v", os.Getenv("PORT"), err)
-		}
-	} else {
-		port = 8080
-	}
-
-	app.Listen(fmt.Sprintf(":%d", port))
+	return app
 }
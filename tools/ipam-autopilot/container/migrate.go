@@ -16,19 +16,38 @@ package main
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
 	"github.com/golang-migrate/migrate/v4/database/mysql"
+	"github.com/golang-migrate/migrate/v4/database/pgx"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 )
 
-func MigrateDatabase(dbName string, db *sql.DB) error {
+// MigrateDatabase applies the migrations of a database type from migrations/<type>.
+func MigrateDatabase(databaseType string, dbName string, db *sql.DB) error {
 	var err error
-	driver, _ := mysql.WithInstance(db, &mysql.Config{})
+	var driver database.Driver
+	switch databaseType {
+	case DatabaseMySQL:
+		driver, err = mysql.WithInstance(db, &mysql.Config{})
+	case DatabasePostgres:
+		driver, err = pgx.WithInstance(db, &pgx.Config{})
+	case DatabaseSQLite:
+		driver, err = sqlite3.WithInstance(db, &sqlite3.Config{})
+	default:
+		err = fmt.Errorf("no migrations for database type %s", databaseType)
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		return err
+	}
 	m, err := migrate.NewWithDatabaseInstance(
-		"file://migrations",
+		fmt.Sprintf("file://migrations/%s", databaseType),
 		dbName,
 		driver)
 	if err != nil {
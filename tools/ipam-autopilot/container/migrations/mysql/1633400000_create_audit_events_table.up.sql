@@ -0,0 +1,28 @@
+-- Copyright 2021 Google LLC
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+-- Audit events have no foreign keys, they are kept after routing domains and ranges are deleted
+CREATE TABLE audit_events (
+  event_id INT NOT NULL AUTO_INCREMENT,
+  created_at DATETIME NOT NULL,
+  actor VARCHAR(255) NOT NULL,
+  action VARCHAR(64) NOT NULL,
+  routing_domain_id INT,
+  subnet_id INT,
+  cidr VARCHAR(255),
+  request TEXT,
+  PRIMARY KEY(event_id)
+);
+
+CREATE INDEX audit_events_created_at ON audit_events (created_at);
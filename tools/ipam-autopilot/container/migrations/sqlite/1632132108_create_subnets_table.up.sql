@@ -0,0 +1,27 @@
+-- Copyright 2021 Google LLC
+--
+-- Licensed under the Apache License, Version 2.0 (the "License");
+-- you may not use this file except in compliance with the License.
+-- You may obtain a copy of the License at
+--
+--      http://www.apache.org/licenses/LICENSE-2.0
+--
+-- Unless required by applicable law or agreed to in writing, software
+-- distributed under the License is distributed on an "AS IS" BASIS,
+-- WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+-- See the License for the specific language governing permissions and
+-- limitations under the License.
+
+CREATE TABLE subnets (
+  subnet_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  parent_id INTEGER,
+  routing_domain_id INTEGER,
+  name VARCHAR(255) NOT NULL,
+  cidr VARCHAR(255) NOT NULL,
+  CONSTRAINT fk_parent
+    FOREIGN KEY(parent_id)
+  REFERENCES subnets(subnet_id),
+  CONSTRAINT fk_routing_domain
+    FOREIGN KEY(routing_domain_id)
+  REFERENCES routing_domains(routing_domain_id)
+);
@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// quarantinePeriod is the time released ranges are held before their CIDR can be allocated
+// again, set by RANGE_QUARANTINE_PERIOD (i.e. 168h). Ranges are deleted immediately if 0.
+var quarantinePeriod time.Duration
+
+// Interval of the background job finalizing the released ranges after their quarantine.
+const quarantineFinalizeInterval = 10 * time.Minute
+
+// quarantinePeriodFromEnv parses RANGE_QUARANTINE_PERIOD.
+func quarantinePeriodFromEnv() (time.Duration, error) {
+	if os.Getenv("RANGE_QUARANTINE_PERIOD") == "" {
+		return 0, nil
+	}
+	period, err := time.ParseDuration(os.Getenv("RANGE_QUARANTINE_PERIOD"))
+	if err != nil {
+		return 0, fmt.Errorf("can't parse value of RANGE_QUARANTINE_PERIOD env variable %s %v", os.Getenv("RANGE_QUARANTINE_PERIOD"), err)
+	}
+	if period < 0 {
+		return 0, fmt.Errorf("RANGE_QUARANTINE_PERIOD needs to be positive")
+	}
+	return period, nil
+}
+
+// quarantineExpiry returns the time before which released ranges have completed their
+// quarantine.
+func quarantineExpiry() time.Time {
+	return time.Now().UTC().Add(-quarantinePeriod)
+}
+
+// runQuarantineFinalizer periodically deletes the released ranges whose quarantine is over.
+// Allocations finalize the released children of their parent themselves, so CIDRs are
+// available again after the quarantine even if the job isn't running.
+func runQuarantineFinalizer() {
+	ticker := time.NewTicker(quarantineFinalizeInterval)
+	defer ticker.Stop()
+	for {
+		events, err := store.FinalizeReleasedRanges(quarantineExpiry())
+		if err != nil {
+			log.Printf("Unable to finalize released ranges %v", err)
+		} else if len(events) > 0 {
+			log.Printf("Finalized %d released ranges after quarantine", len(events))
+			exportAuditEvents(events...)
+		}
+		<-ticker.C
+	}
+}
+
+func GetQuarantinedRanges(c *fiber.Ctx) error {
+	var results []*fiber.Map
+	// All ranges are read, as the grants on the ancestors of the quarantined ranges are needed
+	all, err := store.GetRanges()
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	var ranges []Range
+	for _, rang := range visibleRanges(c, all) {
+		if !rang.Released_at.IsZero() {
+			ranges = append(ranges, rang)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].Released_at.Before(ranges[j].Released_at) })
+
+	for i := 0; i < len(ranges); i++ {
+		result := rangeResponse(&ranges[i])
+		(*result)["quarantined_until"] = ranges[i].Released_at.Add(quarantinePeriod).UTC().Format(time.RFC3339)
+		results = append(results, result)
+	}
+	return c.Status(200).JSON(results)
+}
+
+// ForceReleaseRange deletes a quarantined range before the end of its quarantine.
+func ForceReleaseRange(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	rang, err := store.GetRange(id)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	if !authorizedStoredRange(c, RoleAdmin, rang) {
+		return forbidden(c)
+	}
+	if rang.Released_at.IsZero() {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("Range %d is not quarantined", id),
+		})
+	}
+	event := newAuditEvent(c, AuditDeleteRange, rang.Routing_domain_id, rang.Subnet_id, rang.Cidr)
+	// The range may have been restored since it was read
+	err = store.DeleteReleasedRange(id, time.Time{}, event)
+	if err == ErrRangeNotReleased {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("Range %d is not quarantined", id),
+		})
+	}
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	exportAuditEvents(*event)
+
+	return c.Status(200).JSON(&fiber.Map{
+		"success": true,
+	})
+}
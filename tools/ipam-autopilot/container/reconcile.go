@@ -0,0 +1,420 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Audit action of ranges imported by a reconciliation.
+const AuditImportRange = "import_range"
+
+// Ranges allocated more recently than this are not reported as orphans, their subnet may
+// not have been created yet.
+const defaultReconcileMinAge = time.Hour
+
+// A reconciliation releasing more orphans than this is refused unless forced, a
+// misconfigured discovery provider would otherwise release most ranges of a routing domain.
+const defaultReconcileMaxRelease = 10
+
+// ReconcileOptions selects the changes made by a reconciliation, without any the
+// reconciliation only reports the differences.
+type ReconcileOptions struct {
+	// Import the unknown ranges as ranges of IPAM Autopilot
+	Import bool `json:"import"`
+	// Release the orphaned ranges, they are quarantined or deleted like deleted ranges
+	Release bool `json:"release"`
+	// Minimum age of orphaned ranges, i.e. 24h, 1h by default
+	Min_age string `json:"min_age,omitempty"`
+	// Maximum number of orphans that are released, 10 by default
+	Max_release int `json:"max_release,omitempty"`
+	// Release the orphans even if discovery found no ranges or there are more than
+	// Max_release orphans
+	Force bool `json:"force"`
+}
+
+// ReconcileReport are the differences between the ranges of a routing domain and the
+// ranges found by its discovery providers.
+type ReconcileReport struct {
+	Routing_domain_id int `json:"routing_domain_id"`
+	// Discovered ranges that are not ranges of IPAM Autopilot
+	Unknown []ExternalRange `json:"unknown"`
+	// Ranges without children that don't overlap with discovered ranges, i.e. of deleted
+	// subnets
+	Orphans []ReconciledRange `json:"orphans"`
+	// Ranges without children overlapping discovered ranges with a different CIDR, i.e. a
+	// subnet that is smaller than its range
+	Drift    []DriftedRange    `json:"drift"`
+	Imported []ReconciledRange `json:"imported"`
+	Released []ReconciledRange `json:"released"`
+	// Unknown ranges that could not be imported
+	Skipped []ReconciledRange `json:"skipped"`
+}
+
+type ReconciledRange struct {
+	Id     int    `json:"id,omitempty"`
+	Name   string `json:"name"`
+	Cidr   string `json:"cidr"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// DriftedRange is a range of IPAM Autopilot and the overlapping discovered range.
+type DriftedRange struct {
+	Id         int           `json:"id"`
+	Name       string        `json:"name"`
+	Cidr       string        `json:"cidr"`
+	Discovered ExternalRange `json:"discovered"`
+}
+
+// reconcileRoutingDomain compares the ranges of a routing domain with the discovered ranges,
+// and imports or releases ranges if selected by the options. Changes are audited as actor.
+func reconcileRoutingDomain(ctx context.Context, routingDomain *RoutingDomain, options ReconcileOptions, actor string) (*ReconcileReport, error) {
+	minAge := defaultReconcileMinAge
+	if options.Min_age != "" {
+		var err error
+		minAge, err = time.ParseDuration(options.Min_age)
+		if err != nil {
+			return nil, rangeRequestError(400, "min_age needs to be a duration %v", err)
+		}
+	}
+	maxRelease := defaultReconcileMaxRelease
+	if options.Max_release < 0 {
+		return nil, rangeRequestError(400, "max_release can't be negative")
+	} else if options.Max_release > 0 {
+		maxRelease = options.Max_release
+	}
+	if len(discoveryConfigs(routingDomain)) == 0 {
+		return nil, rangeRequestError(400, "Routing domain %d has no discovery providers to reconcile with", routingDomain.Id)
+	}
+	discovered, err := discoverExternalRanges(ctx, routingDomain, true)
+	if err != nil {
+		return nil, err
+	}
+	all, err := store.GetRanges()
+	if err != nil {
+		return nil, err
+	}
+	var ranges []Range
+	known := make(map[string]bool)
+	hasChildren := make(map[int]bool)
+	released := make(map[int]bool)
+	for _, rang := range all {
+		if rang.Routing_domain_id != routingDomain.Id {
+			continue
+		}
+		ranges = append(ranges, rang)
+		known[rang.Cidr] = true
+		hasChildren[rang.Parent_id] = true
+	}
+	request, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{
+		Routing_domain_id: routingDomain.Id,
+		Unknown:           []ExternalRange{},
+		Orphans:           []ReconciledRange{},
+		Drift:             []DriftedRange{},
+		Imported:          []ReconciledRange{},
+		Released:          []ReconciledRange{},
+		Skipped:           []ReconciledRange{},
+	}
+	var discoveredNetworks []*net.IPNet
+	for _, rang := range discovered {
+		_, network, err := net.ParseCIDR(rang.Cidr)
+		if err != nil {
+			return nil, err
+		}
+		discoveredNetworks = append(discoveredNetworks, network)
+	}
+
+	// Top-level ranges and ranges with children are address space of IPAM Autopilot, only
+	// leaves are expected to match discovered ranges. Discovered ranges overlapping a leaf
+	// with a different CIDR are drift, they are neither unknown nor imported.
+	drifted := make(map[string]bool)
+	var orphans []Range
+	for _, rang := range ranges {
+		if rang.Parent_id == -1 || hasChildren[rang.Subnet_id] || !rang.Released_at.IsZero() {
+			continue
+		}
+		_, network, err := net.ParseCIDR(rang.Cidr)
+		if err != nil {
+			return nil, err
+		}
+		for i, external := range discovered {
+			if external.Cidr != rang.Cidr && overlapsAny(network, discoveredNetworks[i:i+1]) {
+				report.Drift = append(report.Drift, DriftedRange{Id: rang.Subnet_id, Name: rang.Name, Cidr: rang.Cidr, Discovered: external})
+				drifted[external.Cidr] = true
+			}
+		}
+		if rang.Status == RangeReserved || time.Since(rang.Created_at) < minAge || overlapsAny(network, discoveredNetworks) {
+			continue
+		}
+		orphans = append(orphans, rang)
+		report.Orphans = append(report.Orphans, ReconciledRange{Id: rang.Subnet_id, Name: rang.Name, Cidr: rang.Cidr})
+	}
+
+	if options.Release && len(orphans) > 0 && !options.Force {
+		if len(discovered) == 0 {
+			return nil, rangeRequestError(409, "Discovery found no ranges for routing domain %d, refusing to release %d orphans without force", routingDomain.Id, len(orphans))
+		}
+		if len(orphans) > maxRelease {
+			return nil, rangeRequestError(409, "Refusing to release %d orphans of routing domain %d without force, more than max_release %d", len(orphans), routingDomain.Id, maxRelease)
+		}
+	}
+
+	// Orphans are released first, so their addresses can be imported. They are released in
+	// a transaction locking the range like DELETE /ranges/:id, a range that got a child
+	// since the ranges were read is not released.
+	for _, rang := range orphans {
+		if !options.Release {
+			break
+		}
+		event, err := removeRange(int64(rang.Subnet_id), func(action string, locked *Range) *AuditEvent {
+			return &AuditEvent{Actor: actor, Action: action, Routing_domain_id: locked.Routing_domain_id, Range_id: locked.Subnet_id, Cidr: locked.Cidr, Request: request}
+		})
+		var requestErr *RangeRequestError
+		if errors.As(err, &requestErr) || errors.Is(err, sql.ErrNoRows) || (err == nil && event == nil) {
+			log.Printf("Orphan %d %s of routing domain %d changed since it was read, it is not released", rang.Subnet_id, rang.Cidr, routingDomain.Id)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to release range %d %s: %v", rang.Subnet_id, rang.Cidr, err)
+		}
+		exportAuditEvents(*event)
+		report.Released = append(report.Released, ReconciledRange{Id: rang.Subnet_id, Name: rang.Name, Cidr: rang.Cidr})
+		released[rang.Subnet_id] = true
+	}
+
+	for _, rang := range discovered {
+		if known[rang.Cidr] || drifted[rang.Cidr] {
+			continue
+		}
+		report.Unknown = append(report.Unknown, rang)
+		if !options.Import {
+			continue
+		}
+		imported, err := importRange(routingDomain, ranges, released, rang, actor, request)
+		if err != nil {
+			report.Skipped = append(report.Skipped, ReconciledRange{Name: rang.Name, Cidr: rang.Cidr, Reason: err.Error()})
+			continue
+		}
+		report.Imported = append(report.Imported, ReconciledRange{Id: imported.Subnet_id, Name: imported.Name, Cidr: imported.Cidr})
+	}
+	return report, nil
+}
+
+// importRange inserts a discovered range as child of the smallest range containing it,
+// ranges released by the reconciliation can't be parents.
+func importRange(routingDomain *RoutingDomain, ranges []Range, released map[int]bool, external ExternalRange, actor string, request []byte) (*Range, error) {
+	_, network, err := net.ParseCIDR(external.Cidr)
+	if err != nil {
+		return nil, err
+	}
+	var parent *Range
+	for i := range ranges {
+		if !ranges[i].Released_at.IsZero() || released[ranges[i].Subnet_id] || verifyContainedInParent(ranges[i].Cidr, external.Cidr) != nil {
+			continue
+		}
+		if parent == nil || netMaskOfCidr(ranges[i].Cidr) > netMaskOfCidr(parent.Cidr) {
+			parent = &ranges[i]
+		}
+	}
+	if parent == nil {
+		return nil, fmt.Errorf("no range of the routing domain contains %s", external.Cidr)
+	}
+
+	tx, err := store.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	// The parent is locked, so the children can't change until the range is inserted
+	if _, err = tx.GetRange(int64(parent.Subnet_id)); err != nil {
+		return nil, err
+	}
+	children, err := tx.GetRangesForParent(int64(parent.Subnet_id))
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		_, childNetwork, err := net.ParseCIDR(child.Cidr)
+		if err != nil {
+			return nil, err
+		}
+		if overlapsAny(network, []*net.IPNet{childNetwork}) {
+			return nil, fmt.Errorf("%s overlaps range %d %s", external.Cidr, child.Subnet_id, child.Cidr)
+		}
+	}
+	name := external.Name
+	if name == "" {
+		name = external.Cidr
+	}
+	rang := &Range{
+		Parent_id:         parent.Subnet_id,
+		Routing_domain_id: routingDomain.Id,
+		Name:              name,
+		Cidr:              external.Cidr,
+		Description:       fmt.Sprintf("Imported from %s", external.Source),
+		Status:            RangeAllocated,
+		Created_at:        time.Now().UTC(),
+		Labels:            map[string]string{"imported": "true"},
+	}
+	id, err := tx.CreateRange(rang)
+	if err != nil {
+		return nil, err
+	}
+	rang.Subnet_id = int(id)
+	err = tx.CreateAuditEvent(&AuditEvent{Actor: actor, Action: AuditImportRange, Routing_domain_id: routingDomain.Id, Range_id: rang.Subnet_id, Cidr: rang.Cidr, Request: request})
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	committed = true
+	exportAuditEvents(tx.AuditEvents()...)
+	return rang, nil
+}
+
+func overlapsAny(network *net.IPNet, others []*net.IPNet) bool {
+	for _, other := range others {
+		if other.Contains(network.IP) || network.Contains(other.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func netMaskOfCidr(cidr string) int {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return -1
+	}
+	return netMask(network.Mask)
+}
+
+// ReconcileRoutingDomain reconciles a routing domain with its discovery providers, only
+// reporting the differences unless import or release are set in the body.
+func ReconcileRoutingDomain(c *fiber.Ctx) error {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Status(400).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	options := new(ReconcileOptions)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(options); err != nil {
+			return c.Status(400).JSON(&fiber.Map{
+				"success": false,
+				"message": fmt.Sprintf("Bad format %v", err),
+			})
+		}
+	}
+	role := RoleViewer
+	if options.Import || options.Release {
+		role = RoleAdmin
+	}
+	if !authorized(c, role, int(id)) {
+		return forbidden(c)
+	}
+	domain, err := store.GetRoutingDomain(id)
+	if err != nil {
+		return c.Status(503).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	report, err := reconcileRoutingDomain(context.Background(), domain, *options, auditActor(c))
+	if err != nil {
+		status := 503
+		var requestError *RangeRequestError
+		if errors.As(err, &requestError) {
+			status = requestError.Status
+		}
+		return c.Status(status).JSON(&fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+	}
+	return c.Status(200).JSON(report)
+}
+
+// runReconcileCommand runs the reconciliation from the command line, i.e. as a scheduled
+// job: ipam-autopilot reconcile -domain 1 [-import] [-release] [-min-age 24h] [-max-release 10] [-force]
+func runReconcileCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	domain_id := flags.Int64("domain", 0, "ID of the routing domain, all routing domains with discovery providers if not set")
+	options := ReconcileOptions{}
+	flags.BoolVar(&options.Import, "import", false, "import unknown ranges")
+	flags.BoolVar(&options.Release, "release", false, "release orphaned ranges")
+	flags.StringVar(&options.Min_age, "min-age", "", "minimum age of orphaned ranges (default 1h)")
+	flags.IntVar(&options.Max_release, "max-release", 0, fmt.Sprintf("maximum number of orphans to release (default %d)", defaultReconcileMaxRelease))
+	flags.BoolVar(&options.Force, "force", false, "release orphans even if discovery found no ranges or there are more than -max-release")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var domains []RoutingDomain
+	if *domain_id != 0 {
+		domain, err := store.GetRoutingDomain(*domain_id)
+		if err != nil {
+			return err
+		}
+		domains = append(domains, *domain)
+	} else {
+		all, err := store.GetRoutingDomains()
+		if err != nil {
+			return err
+		}
+		for _, domain := range all {
+			if len(discoveryConfigs(&domain)) > 0 {
+				domains = append(domains, domain)
+			}
+		}
+	}
+	reports := []*ReconcileReport{}
+	for i := range domains {
+		report, err := reconcileRoutingDomain(context.Background(), &domains[i], options, auditSystemActor)
+		if err != nil {
+			return fmt.Errorf("unable to reconcile routing domain %d: %v", domains[i].Id, err)
+		}
+		reports = append(reports, report)
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(reports)
+}
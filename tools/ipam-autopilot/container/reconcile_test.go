@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileRoutingDomain(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	dir, err := ioutil.TempDir("", "reconcile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	discoveryStaticDir = dir
+	defer func() { discoveryStaticDir = "" }()
+
+	for _, cidr := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.3.0/24"} {
+		status, _ := postRange(t, app, RangeRequest{Name: cidr, Parent: fmt.Sprint(parent_id), Cidr: cidr})
+		assert.Equal(t, 200, status)
+	}
+	status, _ := postRange(t, app, RangeRequest{Name: "planned", Parent: fmt.Sprint(parent_id), Cidr: "10.0.2.0/24", Status: RangeReserved})
+	assert.Equal(t, 200, status)
+
+	// Without discovery providers there is nothing to reconcile with
+	status, _ = authRequest(t, app, "POST", "/domains/1/reconcile", "", nil)
+	assert.Equal(t, 400, status)
+
+	path := writeTempFile(t, dir, "subnets.csv", "cidr,name\n10.0.0.0/24,subnet-a\n10.0.3.0/25,subnet-b\n10.0.5.0/24,subnet-c\n10.0.4.0/23,subnet-d\n192.168.0.0/24,on-prem\n")
+	status, _ = authRequest(t, app, "PUT", "/domains/1", "", map[string]interface{}{"discovery": []DiscoveryConfig{{Type: DiscoveryStatic, Path: path}}})
+	assert.Equal(t, 200, status)
+
+	// Recently allocated ranges are not orphans by default
+	var report ReconcileReport
+	status, body := authRequest(t, app, "POST", "/domains/1/reconcile", "", nil)
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &report))
+	assert.Equal(t, 3, len(report.Unknown))
+	assert.Equal(t, 0, len(report.Orphans))
+	// The subnet is smaller than its range
+	if assert.Equal(t, 1, len(report.Drift)) {
+		assert.Equal(t, "10.0.3.0/24", report.Drift[0].Cidr)
+		assert.Equal(t, "10.0.3.0/25", report.Drift[0].Discovered.Cidr)
+		assert.Equal(t, "subnet-b", report.Drift[0].Discovered.Name)
+	}
+
+	status, body = authRequest(t, app, "POST", "/domains/1/reconcile", "", ReconcileOptions{Min_age: "0s"})
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &report))
+	if assert.Equal(t, 1, len(report.Orphans)) {
+		assert.Equal(t, "10.0.1.0/24", report.Orphans[0].Cidr)
+	}
+	assert.Equal(t, 0, len(report.Imported))
+	assert.Equal(t, 0, len(report.Released))
+
+	status, body = authRequest(t, app, "POST", "/domains/1/reconcile", "", ReconcileOptions{Import: true, Release: true, Min_age: "0s"})
+	assert.Equal(t, 200, status, string(body))
+	assert.Nil(t, json.Unmarshal(body, &report))
+	if assert.Equal(t, 1, len(report.Imported)) {
+		assert.Equal(t, "10.0.5.0/24", report.Imported[0].Cidr)
+		assert.Equal(t, "subnet-c", report.Imported[0].Name)
+	}
+	assert.Equal(t, 1, len(report.Drift))
+	// 10.0.4.0/23 overlaps the imported 10.0.5.0/24, 192.168.0.0/24 is outside of the ranges
+	assert.Equal(t, 2, len(report.Skipped))
+	if assert.Equal(t, 1, len(report.Released)) {
+		assert.Equal(t, "10.0.1.0/24", report.Released[0].Cidr)
+	}
+
+	imported, err := store.GetRange(int64(report.Imported[0].Id))
+	assert.Nil(t, err)
+	assert.Equal(t, int(parent_id), imported.Parent_id)
+	assert.Equal(t, map[string]string{"imported": "true"}, imported.Labels)
+	events, err := store.GetAuditEvents(AuditFilter{Action: AuditImportRange})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	children, err := store.GetRangesForParent(parent_id)
+	assert.Nil(t, err)
+	for _, child := range children {
+		assert.NotEqual(t, "10.0.3.0/25", child.Cidr)
+	}
+
+	var buf bytes.Buffer
+	assert.Nil(t, runReconcileCommand([]string{"-domain", "1", "-import", "-min-age", "0s"}, &buf))
+	var reports []ReconcileReport
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &reports))
+	if assert.Equal(t, 1, len(reports)) {
+		// 10.0.4.0/23 contains the imported 10.0.5.0/24 now
+		assert.Equal(t, 1, len(reports[0].Unknown))
+		assert.Equal(t, 2, len(reports[0].Drift))
+		assert.Equal(t, 0, len(reports[0].Orphans))
+		assert.Equal(t, 0, len(reports[0].Imported))
+		assert.Equal(t, 1, len(reports[0].Skipped))
+	}
+}
+
+func TestReconcileReleaseSafety(t *testing.T) {
+	app, parent_id := newTestApp(t)
+	defer store.Close()
+	dir, err := ioutil.TempDir("", "reconcile")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	discoveryStaticDir = dir
+	defer func() { discoveryStaticDir = "" }()
+
+	for _, cidr := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"} {
+		status, _ := postRange(t, app, RangeRequest{Name: cidr, Parent: fmt.Sprint(parent_id), Cidr: cidr})
+		assert.Equal(t, 200, status)
+	}
+	path := writeTempFile(t, dir, "subnets.csv", "cidr,name\n")
+	status, _ := authRequest(t, app, "PUT", "/domains/1", "", map[string]interface{}{"discovery": []DiscoveryConfig{{Type: DiscoveryStatic, Path: path}}})
+	assert.Equal(t, 200, status)
+
+	// An empty discovery result is more likely a broken provider than deleted subnets
+	status, body := authRequest(t, app, "POST", "/domains/1/reconcile", "", ReconcileOptions{Release: true, Min_age: "0s"})
+	assert.Equal(t, 409, status, string(body))
+	var report ReconcileReport
+	status, body = authRequest(t, app, "POST", "/domains/1/reconcile", "", ReconcileOptions{Min_age: "0s"})
+	assert.Equal(t, 200, status)
+	assert.Nil(t, json.Unmarshal(body, &report))
+	assert.Equal(t, 3, len(report.Orphans))
+
+	writeTempFile(t, dir, "subnets.csv", "cidr,name\n192.168.0.0/24,on-prem\n")
+	status, _ = authRequest(t, app, "POST", "/domains/1/reconcile", "", ReconcileOptions{Release: true, Min_age: "0s", Max_release: 2})
+	assert.Equal(t, 409, status)
+	status, _ = authRequest(t, app, "POST", "/domains/1/reconcile", "", ReconcileOptions{Release: true, Min_age: "0s", Max_release: -1})
+	assert.Equal(t, 400, status)
+	var buf bytes.Buffer
+	assert.NotNil(t, runReconcileCommand([]string{"-domain", "1", "-release", "-min-age", "0s", "-max-release", "2"}, &buf))
+	children, err := store.GetRangesForParent(parent_id)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(children))
+
+	status, body = authRequest(t, app, "POST", "/domains/1/reconcile", "", ReconcileOptions{Release: true, Min_age: "0s", Max_release: 2, Force: true})
+	assert.Equal(t, 200, status, string(body))
+	assert.Nil(t, json.Unmarshal(body, &report))
+	assert.Equal(t, 3, len(report.Released))
+}
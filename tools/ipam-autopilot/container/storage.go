@@ -0,0 +1,270 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Storage persists the routing domains and ranges of IPAM Autopilot. Mutations record their
+// audit event, unless it is nil, in the same transaction.
+type Storage interface {
+	// Begin starts a transaction for allocating ranges, the ranges read by id or CIDR
+	// within the transaction are locked until it is committed or rolled back.
+	Begin(ctx context.Context) (StorageTx, error)
+
+	GetRanges() ([]Range, error)
+	GetRange(id int64) (*Range, error)
+	// GetRangeAncestors returns the parent of a range, its parent and so on.
+	GetRangeAncestors(id int64) ([]Range, error)
+	GetRangesForParent(parent_id int64) ([]Range, error)
+	// UpdateRange updates the metadata of a range, fields that are not set are unchanged.
+	UpdateRange(id int64, description JSONString, owner JSONString, status JSONString, labels JSONStringMap, event *AuditEvent) error
+	DeleteRange(id int64, event *AuditEvent) error
+	// ReleaseRange marks a range as released, it is quarantined until it is finalized.
+	ReleaseRange(id int64, released_at time.Time, event *AuditEvent) error
+	// DeleteReleasedRange deletes a range only if it is released, before the given time
+	// unless it is zero, and returns ErrRangeNotReleased otherwise, i.e. if the range was
+	// restored concurrently.
+	DeleteReleasedRange(id int64, before time.Time, event *AuditEvent) error
+	GetQuarantinedRanges() ([]Range, error)
+	// FinalizeReleasedRanges deletes the ranges released before the given time and returns
+	// the finalize_range audit events of the deleted ranges.
+	FinalizeReleasedRanges(before time.Time) ([]AuditEvent, error)
+
+	GetRoutingDomains() ([]RoutingDomain, error)
+	GetRoutingDomain(id int64) (*RoutingDomain, error)
+	// GetDefaultRoutingDomain returns the routing domain with the lowest id.
+	GetDefaultRoutingDomain() (*RoutingDomain, error)
+	// CreateRoutingDomain sets the routing domain of the audit event to the new domain.
+	CreateRoutingDomain(name string, vpcs []string, allocation_strategy string, discovery []DiscoveryConfig, event *AuditEvent) (int64, error)
+	UpdateRoutingDomain(id int64, name JSONString, vpcs JSONStringArray, allocation_strategy JSONString, discovery JSONDiscoveryConfigs, event *AuditEvent) error
+	DeleteRoutingDomain(id int64, event *AuditEvent) error
+
+	// GetAuditEvents returns the audit events matching a filter, newest first.
+	GetAuditEvents(filter AuditFilter) ([]AuditEvent, error)
+
+	// IsConflict reports whether an error is caused by a concurrent transaction, i.e. a
+	// violated unique constraint, a deadlock or a lock timeout.
+	IsConflict(err error) bool
+
+	// Migrate creates or updates the database schema.
+	Migrate() error
+	Close() error
+}
+
+// StorageTx is a transaction of a Storage.
+type StorageTx interface {
+	GetRange(id int64) (*Range, error)
+	// GetRangeAncestors returns the ancestors of a range without locking them.
+	GetRangeAncestors(id int64) ([]Range, error)
+	GetRangeByCidr(routing_domain_id int, cidr string) (*Range, error)
+	GetRangesForParent(parent_id int64) ([]Range, error)
+	// CreateRange inserts a range, without a parent if its Parent_id is -1.
+	CreateRange(r *Range) (int64, error)
+	DeleteRange(id int64) error
+	// ReleaseRange marks a range as released, it is quarantined until it is finalized.
+	ReleaseRange(id int64, released_at time.Time) error
+	// FinalizeReleasedRanges deletes the children of a range (top-level ranges for -1)
+	// released before the given time, so their CIDRs can be allocated again. Each deleted
+	// range is recorded as a finalize_range event.
+	FinalizeReleasedRanges(parent_id int64, before time.Time) error
+	CreateAuditEvent(event *AuditEvent) error
+	// AuditEvents returns the events created in the transaction, for exporting them after
+	// it is committed.
+	AuditEvents() []AuditEvent
+
+	Commit() error
+	Rollback() error
+}
+
+// ErrRangeNotReleased is returned by DeleteReleasedRange if the range is not released.
+var ErrRangeNotReleased = errors.New("range is not released")
+
+// Supported values of DATABASE_TYPE.
+const (
+	DatabaseMySQL    = "mysql"
+	DatabasePostgres = "postgres"
+	DatabaseSQLite   = "sqlite"
+)
+
+// NewStorageFromEnv opens the database selected by DATABASE_TYPE (mysql by default).
+// MySQL and PostgreSQL use DATABASE_HOST, DATABASE_NAME, DATABASE_USER and
+// DATABASE_PASSWORD, SQLite uses DATABASE_NAME as the path of the database file.
+func NewStorageFromEnv() (Storage, error) {
+	databaseType := os.Getenv("DATABASE_TYPE")
+	if databaseType == "" {
+		databaseType = DatabaseMySQL
+	}
+	switch databaseType {
+	case DatabaseMySQL:
+		cfg := mysql.Config{
+			User:                 os.Getenv("DATABASE_USER"),
+			Passwd:               os.Getenv("DATABASE_PASSWORD"),
+			Net:                  os.Getenv("DATABASE_NET"),
+			Addr:                 os.Getenv("DATABASE_HOST"),
+			DBName:               os.Getenv("DATABASE_NAME"),
+			MultiStatements:      true,
+			AllowNativePasswords: true,
+			ParseTime:            true,
+		}
+		return NewMySQLStorage(cfg.FormatDSN(), os.Getenv("DATABASE_NAME"))
+	case DatabasePostgres:
+		return NewPostgresStorage(postgresDSN(), os.Getenv("DATABASE_NAME"))
+	case DatabaseSQLite:
+		path := os.Getenv("DATABASE_NAME")
+		if path == "" {
+			path = "ipam.db"
+		}
+		return NewSQLiteStorage(path)
+	}
+	return nil, fmt.Errorf("unsupported DATABASE_TYPE %s, supported are %s, %s and %s", databaseType, DatabaseMySQL, DatabasePostgres, DatabaseSQLite)
+}
+
+// postgresDSN builds the connection string for PostgreSQL, DATABASE_HOST is either
+// host:port or the directory of the Unix socket (i.e. /cloudsql/<connection name>).
+func postgresDSN() string {
+	params := map[string]string{
+		"host":     os.Getenv("DATABASE_HOST"),
+		"dbname":   os.Getenv("DATABASE_NAME"),
+		"user":     os.Getenv("DATABASE_USER"),
+		"password": os.Getenv("DATABASE_PASSWORD"),
+		"sslmode":  os.Getenv("DATABASE_SSLMODE"),
+	}
+	if host, port, err := net.SplitHostPort(params["host"]); err == nil {
+		params["host"] = host
+		params["port"] = port
+	}
+	if params["sslmode"] == "" {
+		params["sslmode"] = "disable"
+	}
+	var dsn []string
+	for _, key := range []string{"host", "port", "dbname", "user", "password", "sslmode"} {
+		if params[key] != "" {
+			dsn = append(dsn, fmt.Sprintf("%s='%s'", key, strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(params[key])))
+		}
+	}
+	return strings.Join(dsn, " ")
+}
+
+// NewMySQLStorage opens a MySQL database.
+func NewMySQLStorage(dsn string, dbName string) (Storage, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(100)
+	db.SetMaxIdleConns(5)
+	return &sqlStorage{db: db, dialect: mysqlDialect, dbName: dbName}, nil
+}
+
+// NewPostgresStorage opens a PostgreSQL database.
+func NewPostgresStorage(dsn string, dbName string) (Storage, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(100)
+	db.SetMaxIdleConns(5)
+	return &sqlStorage{db: db, dialect: postgresDialect, dbName: dbName}, nil
+}
+
+// NewSQLiteStorage opens an embedded SQLite database, :memory: opens an in-memory database.
+// SQLite only supports a single writer, so all operations share one connection.
+func NewSQLiteStorage(path string) (Storage, error) {
+	db, err := sql.Open("sqlite3", fmt.Sprintf("%s?_foreign_keys=on&_busy_timeout=5000", path))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return &sqlStorage{db: db, dialect: sqliteDialect, dbName: path}, nil
+}
+
+// dialect contains the differences between the SQL databases.
+type dialect struct {
+	name string
+	// PostgreSQL uses $1, $2... as placeholders instead of ?
+	numberedPlaceholders bool
+	// Clause for locking the rows of a SELECT until the end of the transaction
+	lockClause string
+	// PostgreSQL returns the ID of inserted rows with RETURNING, others with LastInsertId
+	returning bool
+}
+
+var (
+	mysqlDialect    = &dialect{name: DatabaseMySQL, lockClause: " FOR UPDATE"}
+	postgresDialect = &dialect{name: DatabasePostgres, numberedPlaceholders: true, lockClause: " FOR UPDATE", returning: true}
+	// SQLite has no row locks, transactions are serialized by the single connection
+	sqliteDialect = &dialect{name: DatabaseSQLite}
+)
+
+// rebind replaces the ? placeholders of a query with the placeholders of the dialect.
+func (d *dialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+	var rebound strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&rebound, "$%d", n)
+		} else {
+			rebound.WriteRune(c)
+		}
+	}
+	return rebound.String()
+}
+
+// locked appends the lock clause to a SELECT query.
+func (d *dialect) locked(query string) string {
+	return query + d.lockClause
+}
+
+// isConflict reports whether an error of the database is caused by a concurrent transaction.
+func (d *dialect) isConflict(err error) bool {
+	switch d.name {
+	case DatabaseMySQL:
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) {
+			// ER_DUP_ENTRY, ER_LOCK_DEADLOCK and ER_LOCK_WAIT_TIMEOUT
+			return mysqlErr.Number == 1062 || mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+		}
+	case DatabasePostgres:
+		var pgErr interface{ SQLState() string }
+		if errors.As(err, &pgErr) {
+			// unique_violation, serialization_failure and deadlock_detected
+			state := pgErr.SQLState()
+			return state == "23505" || state == "40001" || state == "40P01"
+		}
+	case DatabaseSQLite:
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) {
+			return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+		}
+	}
+	return false
+}
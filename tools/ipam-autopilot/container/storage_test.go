@@ -0,0 +1,223 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestStorage(t *testing.T) Storage {
+	s, err := NewSQLiteStorage(":memory:")
+	assert.Nil(t, err)
+	assert.Nil(t, s.Migrate())
+	return s
+}
+
+func TestSQLiteStorageRoutingDomains(t *testing.T) {
+	s := newTestStorage(t)
+	defer s.Close()
+
+	id, err := s.CreateRoutingDomain("test", []string{"vpc1", "vpc2"}, BestFit, nil, nil)
+	assert.Nil(t, err)
+
+	domain, err := s.GetRoutingDomain(id)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", domain.Name)
+	assert.Equal(t, "vpc1,vpc2", domain.Vpcs)
+	assert.Equal(t, BestFit, domain.Allocation_strategy)
+
+	err = s.UpdateRoutingDomain(id, JSONString{Value: "renamed", Set: true}, JSONStringArray{}, JSONString{Value: "", Set: true}, JSONDiscoveryConfigs{}, nil)
+	assert.Nil(t, err)
+	domains, err := s.GetRoutingDomains()
+	assert.Nil(t, err)
+	assert.Equal(t, []RoutingDomain{{Id: int(id), Name: "renamed", Vpcs: "vpc1,vpc2"}}, domains)
+
+	assert.Nil(t, s.DeleteRoutingDomain(id, nil))
+	_, err = s.GetRoutingDomain(id)
+	assert.NotNil(t, err)
+}
+
+func TestSQLiteStorageRanges(t *testing.T) {
+	s := newTestStorage(t)
+	defer s.Close()
+
+	domain_id, err := s.CreateRoutingDomain("test", []string{}, "", nil, nil)
+	assert.Nil(t, err)
+
+	domain, err := s.GetDefaultRoutingDomain()
+	assert.Nil(t, err)
+	assert.Equal(t, int(domain_id), domain.Id)
+	tx, err := s.Begin(context.Background())
+	assert.Nil(t, err)
+	parent_id, err := tx.CreateRange(&Range{Parent_id: -1, Routing_domain_id: domain.Id, Name: "parent", Cidr: "10.0.0.0/8"})
+	assert.Nil(t, err)
+	created_at := time.Date(2021, 9, 20, 10, 0, 0, 0, time.UTC)
+	child_id, err := tx.CreateRange(&Range{Parent_id: int(parent_id), Routing_domain_id: domain.Id, Name: "child", Cidr: "10.0.0.0/24", Status: RangeReserved, Created_at: created_at, Labels: map[string]string{"env": "prod"}})
+	assert.Nil(t, err)
+	parent, err := tx.GetRangeByCidr(domain.Id, "10.0.0.0/8")
+	assert.Nil(t, err)
+	assert.Equal(t, int(parent_id), parent.Subnet_id)
+	assert.Equal(t, -1, parent.Parent_id)
+	children, err := tx.GetRangesForParent(parent_id)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(children))
+	assert.Equal(t, Range{Subnet_id: int(child_id), Parent_id: int(parent_id), Routing_domain_id: domain.Id, Name: "child", Cidr: "10.0.0.0/24", Status: RangeReserved, Created_at: created_at, Labels: map[string]string{"env": "prod"}}, children[0])
+	assert.Nil(t, tx.Commit())
+
+	ranges, err := s.GetRanges()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ranges))
+
+	err = s.UpdateRange(child_id, JSONString{Value: "test range", Set: true}, JSONString{}, JSONString{Value: RangeAllocated, Set: true}, JSONStringMap{Value: map[string]string{"env": "dev"}, Set: true}, nil)
+	assert.Nil(t, err)
+	child, err := s.GetRange(child_id)
+	assert.Nil(t, err)
+	assert.Equal(t, "test range", child.Description)
+	assert.Equal(t, RangeAllocated, child.Status)
+	assert.Equal(t, map[string]string{"env": "dev"}, child.Labels)
+	parent, err = s.GetRange(parent_id)
+	assert.Nil(t, err)
+	assert.Equal(t, RangeAllocated, parent.Status)
+	assert.True(t, parent.Created_at.IsZero())
+
+	assert.Nil(t, s.DeleteRange(child_id, nil))
+	_, err = s.GetRange(child_id)
+	assert.NotNil(t, err)
+}
+
+func TestSQLiteStorageFinalizeReleasedRanges(t *testing.T) {
+	s := newTestStorage(t)
+	defer s.Close()
+
+	domain_id, err := s.CreateRoutingDomain("test", []string{}, "", nil, nil)
+	assert.Nil(t, err)
+	tx, err := s.Begin(context.Background())
+	assert.Nil(t, err)
+	parent_id, err := tx.CreateRange(&Range{Parent_id: -1, Routing_domain_id: int(domain_id), Name: "parent", Cidr: "10.0.0.0/8"})
+	assert.Nil(t, err)
+	child_id, err := tx.CreateRange(&Range{Parent_id: int(parent_id), Routing_domain_id: int(domain_id), Name: "child", Cidr: "10.0.0.0/24"})
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Commit())
+
+	released_at := time.Now().UTC()
+	assert.Nil(t, s.ReleaseRange(parent_id, released_at.Add(-time.Minute), nil))
+	assert.Nil(t, s.ReleaseRange(child_id, released_at, nil))
+	quarantined, err := s.GetQuarantinedRanges()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(quarantined))
+	assert.Equal(t, RangeReleased, quarantined[0].Status)
+
+	// The parent is finalized after its child
+	finalized, err := s.FinalizeReleasedRanges(released_at)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(finalized))
+	finalized, err = s.FinalizeReleasedRanges(released_at.Add(time.Second))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(finalized))
+	ranges, err := s.GetRanges()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ranges))
+	events, err := s.GetAuditEvents(AuditFilter{Action: AuditFinalizeRange})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(events))
+}
+
+func TestSQLiteStorageDeleteReleasedRange(t *testing.T) {
+	s := newTestStorage(t)
+	defer s.Close()
+
+	domain_id, err := s.CreateRoutingDomain("test", []string{}, "", nil, nil)
+	assert.Nil(t, err)
+	tx, err := s.Begin(context.Background())
+	assert.Nil(t, err)
+	id, err := tx.CreateRange(&Range{Parent_id: -1, Routing_domain_id: int(domain_id), Name: "range", Cidr: "10.0.0.0/8"})
+	assert.Nil(t, err)
+	assert.Nil(t, tx.Commit())
+
+	released_at := time.Now().UTC()
+	assert.Nil(t, s.ReleaseRange(id, released_at, nil))
+	assert.Equal(t, ErrRangeNotReleased, s.DeleteReleasedRange(id, released_at.Add(-time.Second), nil))
+
+	// A range restored after it was read for finalizing is kept
+	err = s.UpdateRange(id, JSONString{}, JSONString{}, JSONString{Value: RangeAllocated, Set: true}, JSONStringMap{}, nil)
+	assert.Nil(t, err)
+	event := &AuditEvent{Actor: auditSystemActor, Action: AuditFinalizeRange, Range_id: int(id)}
+	assert.Equal(t, ErrRangeNotReleased, s.DeleteReleasedRange(id, released_at.Add(time.Second), event))
+	assert.Equal(t, ErrRangeNotReleased, s.DeleteReleasedRange(id, time.Time{}, nil))
+	_, err = s.GetRange(id)
+	assert.Nil(t, err)
+	events, err := s.GetAuditEvents(AuditFilter{Action: AuditFinalizeRange})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(events))
+
+	assert.Nil(t, s.ReleaseRange(id, released_at, nil))
+	assert.Nil(t, s.DeleteReleasedRange(id, time.Time{}, nil))
+	_, err = s.GetRange(id)
+	assert.NotNil(t, err)
+}
+
+func TestSQLiteStorageAuditEvents(t *testing.T) {
+	s := newTestStorage(t)
+	defer s.Close()
+
+	event := &AuditEvent{Actor: "apikey:ci", Action: AuditCreateDomain, Request: []byte(`{"name":"test"}`)}
+	domain_id, err := s.CreateRoutingDomain("test", []string{}, "", nil, event)
+	assert.Nil(t, err)
+	assert.Equal(t, int(domain_id), event.Routing_domain_id)
+	assert.NotEqual(t, int64(0), event.Id)
+
+	tx, err := s.Begin(context.Background())
+	assert.Nil(t, err)
+	range_id, err := tx.CreateRange(&Range{Parent_id: -1, Routing_domain_id: int(domain_id), Name: "parent", Cidr: "10.0.0.0/8"})
+	assert.Nil(t, err)
+	assert.Nil(t, tx.CreateAuditEvent(&AuditEvent{Actor: "apikey:ci", Action: AuditCreateRange, Routing_domain_id: int(domain_id), Range_id: int(range_id), Cidr: "10.0.0.0/8"}))
+	assert.Equal(t, 1, len(tx.AuditEvents()))
+	assert.Nil(t, tx.Commit())
+
+	// Events are rolled back with their mutation, the routing domain still has a range
+	err = s.DeleteRoutingDomain(domain_id, &AuditEvent{Actor: "apikey:admin", Action: AuditDeleteDomain, Routing_domain_id: int(domain_id)})
+	assert.NotNil(t, err)
+
+	events, err := s.GetAuditEvents(AuditFilter{Routing_domain_id: int(domain_id)})
+	assert.Nil(t, err)
+	if assert.Equal(t, 2, len(events)) {
+		assert.Equal(t, AuditCreateRange, events[0].Action)
+		assert.Equal(t, "10.0.0.0/8", events[0].Cidr)
+		assert.Equal(t, "apikey:ci", events[1].Actor)
+		assert.Equal(t, AuditCreateDomain, events[1].Action)
+		assert.JSONEq(t, `{"name":"test"}`, string(events[1].Request))
+	}
+	events, err = s.GetAuditEvents(AuditFilter{Routing_domain_ids: []int{int(domain_id)}, Before: events[0].Id})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	events, err = s.GetAuditEvents(AuditFilter{Routing_domain_ids: []int{int(domain_id) + 1}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(events))
+	events, err = s.GetAuditEvents(AuditFilter{Range_id: int(range_id), Action: AuditCreateRange})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	events, err = s.GetAuditEvents(AuditFilter{From: time.Now().UTC().Add(time.Minute)})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(events))
+}
+
+func TestDialectRebind(t *testing.T) {
+	assert.Equal(t, "SELECT * FROM subnets WHERE cidr = ? and routing_domain_id = ?", mysqlDialect.rebind("SELECT * FROM subnets WHERE cidr = ? and routing_domain_id = ?"))
+	assert.Equal(t, "SELECT * FROM subnets WHERE cidr = $1 and routing_domain_id = $2", postgresDialect.rebind("SELECT * FROM subnets WHERE cidr = ? and routing_domain_id = ?"))
+}
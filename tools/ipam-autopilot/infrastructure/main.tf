@@ -131,6 +131,14 @@ resource "google_cloud_run_service" "default" {
           name  = "DISABLE_DATABASE_MIGRATION"
           value = var.disable_database_migration
         }
+        env {
+          name  = "RANGE_QUARANTINE_PERIOD"
+          value = var.range_quarantine_period
+        }
+        env {
+          name  = "DISCOVERY_HTTP_ALLOWLIST"
+          value = var.discovery_http_allowlist
+        }
         env {
           name = "DATABASE_PASSWORD"
           value_from {
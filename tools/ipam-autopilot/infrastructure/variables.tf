@@ -40,4 +40,12 @@ variable "provider_version" {
 
 variable "disable_database_migration" {
   default = "FALSE"
-}
\ No newline at end of file
+}
+
+variable "range_quarantine_period" {
+  default = "0"
+}
+
+variable "discovery_http_allowlist" {
+  default = ""
+}
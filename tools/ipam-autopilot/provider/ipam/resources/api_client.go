@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/professional-services/terraform-provider-ipam-autopilot/ipam/config"
+)
+
+// getFromApi queries a read endpoint of IPAM Autopilot and unmarshals the response into
+// result.
+func getFromApi(config config.Config, path string, query url.Values, result interface{}) error {
+	url := fmt.Sprintf("%s%s", config.Url, path)
+	if len(query) > 0 {
+		url = fmt.Sprintf("%s?%s", url, query.Encode())
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed creating request: %v", err)
+	}
+	accessToken, err := getIdentityToken()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve access token: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed querying %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("failed querying %s status_code=%d, status=%s,body=%s", path, resp.StatusCode, resp.Status, string(body))
+	}
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		return fmt.Errorf("unable to unmarshal response body: %v", err)
+	}
+	return nil
+}
+
+// lookupRange returns the range with the given name and/or CIDR, released ranges are
+// ignored. The lookup fails unless exactly one range matches.
+func lookupRange(config config.Config, name string, cidr string, domain string) (map[string]interface{}, error) {
+	query := url.Values{}
+	if name != "" {
+		query.Set("name", name)
+	}
+	if cidr != "" {
+		query.Set("cidr", cidr)
+	}
+	if domain != "" {
+		query.Set("domain", domain)
+	}
+	var response []map[string]interface{}
+	err := getFromApi(config, "/ranges", query, &response)
+	if err != nil {
+		return nil, err
+	}
+	var ranges []map[string]interface{}
+	for _, rang := range response {
+		if released_at, ok := rang["released_at"].(string); ok && released_at != "" {
+			continue
+		}
+		ranges = append(ranges, rang)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no range found for name=%q cidr=%q domain=%q", name, cidr, domain)
+	}
+	if len(ranges) > 1 {
+		return nil, fmt.Errorf("%d ranges found for name=%q cidr=%q domain=%q, set domain to select one", len(ranges), name, cidr, domain)
+	}
+	return ranges[0], nil
+}
+
+// rangeIdOfParent returns the id of a parent given by id or by CIDR.
+func rangeIdOfParent(config config.Config, parent string, domain string) (string, error) {
+	if _, err := strconv.ParseInt(parent, 10, 64); err == nil {
+		return parent, nil
+	}
+	rang, err := lookupRange(config, "", parent, domain)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d", int(rang["id"].(float64))), nil
+}
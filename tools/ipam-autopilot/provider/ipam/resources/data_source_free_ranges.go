@@ -0,0 +1,77 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/GoogleCloudPlatform/professional-services/terraform-provider-ipam-autopilot/ipam/config"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func DataSourceFreeRanges() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceFreeRangesRead,
+
+		Schema: map[string]*schema.Schema{
+			"parent": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"domain": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			"range_size": {
+				Type:     schema.TypeInt,
+				Required: true,
+			},
+			"limit": {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  100,
+			},
+			"cidrs": {
+				Type: schema.TypeList,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataSourceFreeRangesRead(d *schema.ResourceData, meta interface{}) error {
+	config := meta.(config.Config)
+	range_size := d.Get("range_size").(int)
+	parent_id, err := rangeIdOfParent(config, d.Get("parent").(string), d.Get("domain").(string))
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("range_size", fmt.Sprintf("%d", range_size))
+	query.Set("limit", fmt.Sprintf("%d", d.Get("limit").(int)))
+	response := map[string]interface{}{}
+	err = getFromApi(config, fmt.Sprintf("/ranges/%s/free", parent_id), query, &response)
+	if err != nil {
+		return err
+	}
+	d.SetId(fmt.Sprintf("%s/%d", parent_id, range_size))
+	d.Set("cidrs", response["cidrs"])
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"fmt"
+
+	"github.com/GoogleCloudPlatform/professional-services/terraform-provider-ipam-autopilot/ipam/config"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func DataSourceIpRange() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceIpRangeRead,
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				AtLeastOneOf: []string{"name", "cidr"},
+			},
+			"cidr": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				AtLeastOneOf: []string{"name", "cidr"},
+			},
+			"domain": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+			"parent": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"status": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"description": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"labels": {
+				Type: schema.TypeMap,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Computed: true,
+			},
+		},
+	}
+}
+
+func dataSourceIpRangeRead(d *schema.ResourceData, meta interface{}) error {
+	config := meta.(config.Config)
+	response, err := lookupRange(config, d.Get("name").(string), d.Get("cidr").(string), d.Get("domain").(string))
+	if err != nil {
+		return err
+	}
+
+	d.SetId(fmt.Sprintf("%d", int(response["id"].(float64))))
+	d.Set("name", response["name"].(string))
+	d.Set("cidr", response["cidr"].(string))
+	d.Set("domain", fmt.Sprintf("%d", int(response["domain"].(float64))))
+	// Top level ranges have no parent
+	if parent, ok := response["parent"].(float64); ok && parent > 0 {
+		d.Set("parent", fmt.Sprintf("%d", int(parent)))
+	} else {
+		d.Set("parent", "")
+	}
+	if status, ok := response["status"].(string); ok {
+		d.Set("status", status)
+	}
+	if description, ok := response["description"].(string); ok {
+		d.Set("description", description)
+	}
+	if labels, ok := response["labels"].(map[string]interface{}); ok {
+		d.Set("labels", labels)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/professional-services/terraform-provider-ipam-autopilot/ipam/config"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func DataSourceRoutingDomain() *schema.Resource {
+	return &schema.Resource{
+		Read: dataSourceRoutingDomainRead,
+
+		Schema: map[string]*schema.Schema{
+			"name": {
+				Type:     schema.TypeString,
+				Required: true,
+			},
+			"vpcs": {
+				Type: schema.TypeList,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Computed: true,
+			},
+			"allocation_strategy": {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			"discovery": {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"type": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"organization": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"path": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"url": {
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func dataSourceRoutingDomainRead(d *schema.ResourceData, meta interface{}) error {
+	config := meta.(config.Config)
+	name := d.Get("name").(string)
+
+	var domains []map[string]interface{}
+	err := getFromApi(config, "/domains", url.Values{"name": []string{name}}, &domains)
+	if err != nil {
+		return err
+	}
+	if len(domains) != 1 {
+		return fmt.Errorf("%d routing domains found for name=%q", len(domains), name)
+	}
+	response := domains[0]
+	d.SetId(fmt.Sprintf("%d", int(response["id"].(float64))))
+	if vpcs, ok := response["vpcs"].(string); ok && vpcs != "" {
+		d.Set("vpcs", strings.Split(vpcs, ","))
+	} else {
+		d.Set("vpcs", []string{})
+	}
+	if allocation_strategy, ok := response["allocation_strategy"].(string); ok {
+		d.Set("allocation_strategy", allocation_strategy)
+	}
+	d.Set("discovery", discoveryFromResponse(response))
+	return nil
+}
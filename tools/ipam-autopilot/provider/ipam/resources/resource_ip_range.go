@@ -20,8 +20,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/GoogleCloudPlatform/professional-services/terraform-provider-ipam-autopilot/ipam/config"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
@@ -33,7 +35,7 @@ func ResourceIpRange() *schema.Resource {
 	return &schema.Resource{
 		Create: resourceCreate,
 		Read:   resourceRead,
-		//Update: resourceUpdate,
+		Update: resourceUpdate,
 		Delete: resourceDelete,
 
 		Schema: map[string]*schema.Schema{
@@ -58,14 +60,55 @@ func ResourceIpRange() *schema.Resource {
 				ForceNew: true,
 			},
 			"cidr": {
+				Type:             schema.TypeString,
+				Optional:         true,
+				Computed:         true,
+				ForceNew:         true,
+				DiffSuppressFunc: suppressEquivalentCidr,
+			},
+			"allocation_strategy": {
 				Type:     schema.TypeString,
 				Optional: true,
-				Computed: true,
 				ForceNew: true,
 			},
+			"description": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: false,
+			},
+			"labels": {
+				Type: schema.TypeMap,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Optional: true,
+				ForceNew: false,
+			},
 		},
 	}
 }
+
+// suppressEquivalentCidr ignores differences in the notation of a CIDR range (i.e.
+// 2001:DB8:0::/48 and 2001:db8::/48), which would otherwise replace the range.
+func suppressEquivalentCidr(k, old, new string, d *schema.ResourceData) bool {
+	if old == "" || new == "" {
+		return false
+	}
+	return canonicalCidr(old) == canonicalCidr(new)
+}
+
+// canonicalCidr returns the notation of a CIDR range the API returns, or the value
+// unchanged if it isn't a CIDR range. Host bits are kept, so a range with host bits set
+// still differs from its network.
+func canonicalCidr(cidr string) string {
+	ip, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		return cidr
+	}
+	ones, _ := network.Mask.Size()
+	return fmt.Sprintf("%s/%d", ip.String(), ones)
+}
+
 func resourceCreate(d *schema.ResourceData, meta interface{}) error {
 	config := meta.(config.Config)
 	range_size := d.Get("range_size").(int)
@@ -73,26 +116,35 @@ func resourceCreate(d *schema.ResourceData, meta interface{}) error {
 	name := d.Get("name").(string)
 	domain := d.Get("domain").(string)
 	cidr := d.Get("cidr").(string)
+	allocation_strategy := d.Get("allocation_strategy").(string)
+	description := d.Get("description").(string)
+	labels := d.Get("labels").(map[string]interface{})
 	url := fmt.Sprintf("%s/ranges", config.Url)
 	var postBody []byte
 	var err error
 	if parent == "" {
 		postBody, err = json.Marshal(map[string]interface{}{
-			"range_size": range_size,
-			"name":       name,
-			"domain":     domain,
-			"cidr":       cidr,
+			"range_size":          range_size,
+			"name":                name,
+			"domain":              domain,
+			"cidr":                cidr,
+			"allocation_strategy": allocation_strategy,
+			"description":         description,
+			"labels":              labels,
 		})
 		if err != nil {
 			return fmt.Errorf("failed marshalling json: %v", err)
 		}
 	} else {
 		postBody, err = json.Marshal(map[string]interface{}{
-			"range_size": range_size,
-			"name":       name,
-			"domain":     domain,
-			"parent":     parent,
-			"cidr":       cidr,
+			"range_size":          range_size,
+			"name":                name,
+			"domain":              domain,
+			"parent":              parent,
+			"cidr":                cidr,
+			"allocation_strategy": allocation_strategy,
+			"description":         description,
+			"labels":              labels,
 		})
 		if err != nil {
 			return fmt.Errorf("failed marshalling json: %v", err)
@@ -168,8 +220,19 @@ func resourceRead(d *schema.ResourceData, meta interface{}) error {
 		if err != nil {
 			return fmt.Errorf("unable to unmarshal response body: %v", err)
 		}
+		// Released ranges are quarantined until their CIDR can be reused
+		if released_at, ok := response["released_at"].(string); ok && released_at != "" {
+			d.SetId("")
+			return nil
+		}
 		d.SetId(fmt.Sprintf("%d", int(response["id"].(float64))))
 		d.Set("cidr", response["cidr"].(string))
+		if description, ok := response["description"].(string); ok {
+			d.Set("description", description)
+		}
+		if labels, ok := response["labels"].(map[string]interface{}); ok {
+			d.Set("labels", labels)
+		}
 		return nil
 	} else {
 		body, err := ioutil.ReadAll(resp.Body)
@@ -181,6 +244,48 @@ func resourceRead(d *schema.ResourceData, meta interface{}) error {
 	}
 }
 
+func resourceUpdate(d *schema.ResourceData, meta interface{}) error {
+	config := meta.(config.Config)
+	url := fmt.Sprintf("%s/ranges/%s", config.Url, d.Id())
+	update := map[string]interface{}{}
+	if d.HasChange("description") {
+		update["description"] = d.Get("description").(string)
+	}
+	if d.HasChange("labels") {
+		update["labels"] = d.Get("labels").(map[string]interface{})
+	}
+	postBody, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("failed marshalling json: %v", err)
+	}
+	accessToken, err := getIdentityToken()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve access token: %v", err)
+	}
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(postBody))
+	if err != nil {
+		return fmt.Errorf("failed creating request: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	req.Header.Set("Content-Type", "application/json")
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed updating range: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 200 {
+		return resourceRead(d, meta)
+	} else {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed updating range status_code=%d, status=%s", resp.StatusCode, resp.Status)
+		}
+
+		return fmt.Errorf("failed updating range status_code=%d, status=%s,body=%s", resp.StatusCode, resp.Status, string(body))
+	}
+}
+
 func resourceDelete(d *schema.ResourceData, meta interface{}) error {
 	config := meta.(config.Config)
 
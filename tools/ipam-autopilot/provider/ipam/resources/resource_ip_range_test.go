@@ -0,0 +1,38 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resources
+
+import "testing"
+
+func TestSuppressEquivalentCidr(t *testing.T) {
+	tests := []struct {
+		old      string
+		new      string
+		suppress bool
+	}{
+		{"2001:db8::/48", "2001:DB8:0:0::/48", true},
+		{"10.0.0.0/24", "10.0.0.0/24", true},
+		{"10.0.0.0/24", "10.0.1.0/24", false},
+		{"10.0.0.0/24", "10.0.0.0/25", false},
+		{"10.0.0.0/24", "10.0.0.5/24", false},
+		{"", "10.0.0.0/24", false},
+		{"10.0.0.0/24", "", false},
+	}
+	for _, test := range tests {
+		if suppress := suppressEquivalentCidr("cidr", test.old, test.new, nil); suppress != test.suppress {
+			t.Errorf("%s -> %s: expected %v, got %v", test.old, test.new, test.suppress, suppress)
+		}
+	}
+}
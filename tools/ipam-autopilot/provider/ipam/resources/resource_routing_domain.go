@@ -48,20 +48,73 @@ func ResourceRoutingDomain() *schema.Resource {
 				ForceNew: false,
 				Optional: true,
 			},
+			"allocation_strategy": {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: false,
+			},
+			"discovery": {
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: false,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"type": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"organization": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"path": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"url": {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+					},
+				},
+			},
 		},
 	}
 }
 
+// discoveryFromResponse returns the discovery providers of a routing domain response in
+// the format of the discovery blocks.
+func discoveryFromResponse(response map[string]interface{}) []map[string]interface{} {
+	discovery := []map[string]interface{}{}
+	configs, _ := response["discovery"].([]interface{})
+	for _, config := range configs {
+		values, ok := config.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		block := map[string]interface{}{}
+		for _, key := range []string{"type", "organization", "path", "url"} {
+			block[key], _ = values[key].(string)
+		}
+		discovery = append(discovery, block)
+	}
+	return discovery
+}
+
 func routingDomainCreate(d *schema.ResourceData, meta interface{}) error {
 	config := meta.(config.Config)
 	vpcs := d.Get("vpcs").([]interface{})
 	name := d.Get("name").(string)
+	allocation_strategy := d.Get("allocation_strategy").(string)
+	discovery := d.Get("discovery").([]interface{})
 	url := fmt.Sprintf("%s/domains", config.Url)
 	var postBody []byte
 	var err error
 	postBody, err = json.Marshal(map[string]interface{}{
-		"name": name,
-		"vpcs": vpcs,
+		"name":                name,
+		"vpcs":                vpcs,
+		"allocation_strategy": allocation_strategy,
+		"discovery":           discovery,
 	})
 	if err != nil {
 		return fmt.Errorf("failed marshalling json: %v", err)
@@ -97,6 +150,8 @@ func routingDomainCreate(d *schema.ResourceData, meta interface{}) error {
 		d.SetId(fmt.Sprintf("%d", int(response["id"].(float64))))
 		d.Set("name", name)
 		d.Set("vpcs", vpcs)
+		d.Set("allocation_strategy", allocation_strategy)
+		d.Set("discovery", discovery)
 		return nil
 	} else {
 		body, err := ioutil.ReadAll(resp.Body)
@@ -144,6 +199,10 @@ func routingDomainRead(d *schema.ResourceData, meta interface{}) error {
 		} else {
 			d.Set("vpcs", []string{})
 		}
+		if allocation_strategy, ok := response["allocation_strategy"].(string); ok {
+			d.Set("allocation_strategy", allocation_strategy)
+		}
+		d.Set("discovery", discoveryFromResponse(response))
 
 		return nil
 	} else {
@@ -191,12 +250,16 @@ func routingDomainUpdate(d *schema.ResourceData, meta interface{}) error {
 	config := meta.(config.Config)
 	vpcs := d.Get("vpcs").([]interface{})
 	name := d.Get("name").(string)
+	allocation_strategy := d.Get("allocation_strategy").(string)
+	discovery := d.Get("discovery").([]interface{})
 	url := fmt.Sprintf("%s/domains/%s", config.Url, d.Id())
 	var postBody []byte
 	var err error
 	postBody, err = json.Marshal(map[string]interface{}{
-		"name": name,
-		"vpcs": vpcs,
+		"name":                name,
+		"vpcs":                vpcs,
+		"allocation_strategy": allocation_strategy,
+		"discovery":           discovery,
 	})
 	if err != nil {
 		return fmt.Errorf("failed marshalling json: %v", err)
@@ -232,6 +295,8 @@ func routingDomainUpdate(d *schema.ResourceData, meta interface{}) error {
 		//d.SetId(fmt.Sprintf("%d", int(response["id"].(float64))))
 		d.Set("name", name)
 		d.Set("vpcs", vpcs)
+		d.Set("allocation_strategy", allocation_strategy)
+		d.Set("discovery", discovery)
 		return nil
 	} else {
 		body, err := ioutil.ReadAll(resp.Body)